@@ -2,41 +2,164 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/jackc/pgx/v5"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal/event"
 	"secure.adoublef.com/service"
+	"secure.adoublef.com/service/chat"
+	account "secure.adoublef.com/service/user"
 	"secure.adoublef.com/store"
-	"secure.adoublef.com/store/user"
+	"secure.adoublef.com/store/migrate"
 )
 
 var connString, srvAddr string
 
+// "postgres" or "sqlite", when "sqlite" the database is the file named by DB_DSN
+var driver = os.Getenv("DB_DRIVER")
+
+// comma separated connection strings of Postgres read replicas
+var replicas = os.Getenv("DB_REPLICAS")
+
+// "true" pins a request to the primary once it has written
+var readYourWrites = os.Getenv("DB_READ_YOUR_WRITES")
+
+// JSON keyring used to encrypt emails, see crypt.File
+var keyFile = os.Getenv("DB_KEY_FILE")
+
+// "true" links each audit event to the one before it by its hash
+var auditChain = os.Getenv("DB_AUDIT_CHAIN")
+
+// comma separated ids of the users allowed to query the audit log
+// and read the debug endpoints
+var adminIDs = os.Getenv("ADMIN_IDS")
+
+// URL that account events are posted to as JSON
+var eventWebhookURL = os.Getenv("EVENT_WEBHOOK_URL")
+
+// Postgres channel that account events are published to with NOTIFY
+var eventNotifyChannel = os.Getenv("EVENT_NOTIFY_CHANNEL")
+
+// "up" applies pending migrations before serving. "status", "dry-run"
+// and "down" will report, preview or revert the last migration then exit
+var migration = flag.String("migrate", "up", `one of "up", "status", "dry-run" or "down"`)
+
+// how long a deleted account can be restored, defaults to 30 days
+var gracePeriod = os.Getenv("ACCOUNT_GRACE_PERIOD")
+
 func init() {
 	connString = os.ExpandEnv("host=${POSTGRES_HOSTNAME} port=${DB_PORT} user=${POSTGRES_USER} password=${POSTGRES_PASSWORD} dbname=${POSTGRES_DB} sslmode=${SSL_MODE}")
+	if dsn := os.Getenv("DB_DSN"); dsn != "" {
+		connString = dsn
+	}
 	srvAddr = os.ExpandEnv("${SERVER_HOSTNAME}:${SERVER_PORT}")
 }
 
+// shutdownTimeout is how long requests and chat connections
+// have to finish once the program is interrupted
+const shutdownTimeout = time.Second * 15
+
 func dev() error {
+	// the services stop once interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// setup store
-	ctx := context.Background()
 
-	c, err := pgx.Connect(ctx, connString)
+	pc, err := poolConfig()
+	if err != nil {
+		return err
+	}
+
+	sc := store.Config{Driver: driver, DSN: connString, Pool: pc, KeyFile: keyFile}
+	if replicas != "" {
+		sc.Replicas = strings.Split(replicas, ",")
+	}
+
+	if readYourWrites != "" {
+		if sc.ReadYourWrites, err = strconv.ParseBool(readYourWrites); err != nil {
+			return err
+		}
+	}
+
+	if auditChain != "" {
+		if sc.AuditChain, err = strconv.ParseBool(auditChain); err != nil {
+			return err
+		}
+	}
+
+	store, err := store.New(ctx, sc)
+	if err != nil {
+		return err
+	}
+	// ctx is done by the time the store is closed
+	defer store.Close(context.Background())
+
+	var done bool
+	if err := store.Migrate(ctx, func(m *migrate.Migrator) error {
+		done, err = runMigration(ctx, m)
+		return err
+	}); err != nil || done {
+		return err
+	}
+
+	var opts []service.Option
+	if gracePeriod != "" {
+		d, err := time.ParseDuration(gracePeriod)
+		if err != nil {
+			return err
+		}
+
+		opts = append(opts, service.WithUserOptions(account.WithGracePeriod(d)))
+	}
+
+	copts, err := chatOptions()
 	if err != nil {
-		panic(err)
+		return err
 	}
+	opts = append(opts, service.WithChatOptions(copts...))
 
-	// will panic if error,
-	// but it be useful to check the tables exist
-	// and exit if any errors arise
-	user.Migration(c)
+	if adminIDs != "" {
+		for _, s := range strings.Split(adminIDs, ",") {
+			id, err := suid.ParseString(strings.TrimSpace(s))
+			if err != nil {
+				return fmt.Errorf("parsing admin id %q: %w", s, err)
+			}
 
-	store := store.New(ctx, c)
+			opts = append(opts, service.WithAdmins(id))
+		}
+	}
+
+	// publish account events from the outbox
+	bus := event.NewBus()
+	sinks := []event.Sink{bus}
+	if eventWebhookURL != "" {
+		sinks = append(sinks, event.NewWebhook(eventWebhookURL, &http.Client{Timeout: time.Second * 10}))
+	}
+
+	if eventNotifyChannel != "" {
+		ns, err := store.NotifySink(eventNotifyChannel)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, ns)
+	}
 
-	// connect to server
-	handler := service.New(context.Background(), store)
+	// connect to server, account events are delivered to webhooks
+	handler := service.New(ctx, store, append(opts, service.WithBus(bus))...)
+
+	// the webhook service has subscribed to the bus
+	go event.NewDispatcher(store.Outbox(), sinks).Run(ctx)
 
 	srv := http.Server{
 		Addr:     srvAddr,
@@ -44,12 +167,142 @@ func dev() error {
 		ErrorLog: log.Default(),
 	}
 
+	// chat starts closing its connections as soon as ctx is done,
+	// the server then waits for requests and the connections to finish
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		srv.ErrorLog.Printf("shutting down")
+
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		err := srv.Shutdown(sctx)
+		if herr := handler.Shutdown(sctx); err == nil {
+			err = herr
+		}
+		shutdown <- err
+	}()
+
 	srv.ErrorLog.Printf("now listening on %s", srv.Addr)
 
-	return srv.ListenAndServe()
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-shutdown
+}
+
+// runMigration reports done when the program should exit after migrating
+func runMigration(ctx context.Context, m *migrate.Migrator) (done bool, err error) {
+	switch *migration {
+	case "up":
+		return false, m.Up(ctx)
+	case "dry-run":
+		m.DryRun = true
+		return true, m.Up(ctx)
+	case "down":
+		return true, m.Down(ctx, 1)
+	case "status":
+		ss, err := m.Status(ctx)
+		for _, s := range ss {
+			fmt.Println(s)
+		}
+		return true, err
+	default:
+		return true, fmt.Errorf("unknown migration command %q", *migration)
+	}
+}
+
+// poolConfig reads the optional pool settings from the environment
+func poolConfig() (c store.PoolConfig, err error) {
+	var n int
+	if n, err = envInt("DB_MIN_CONNS"); err != nil {
+		return
+	}
+	c.MinConns = int32(n)
+
+	if n, err = envInt("DB_MAX_CONNS"); err != nil {
+		return
+	}
+	c.MaxConns = int32(n)
+
+	if c.StatementCacheCapacity, err = envInt("DB_STATEMENT_CACHE_CAPACITY"); err != nil {
+		return
+	}
+
+	if c.MaxConnLifetime, err = envDuration("DB_MAX_CONN_LIFETIME"); err != nil {
+		return
+	}
+
+	if c.MaxConnIdleTime, err = envDuration("DB_MAX_CONN_IDLE_TIME"); err != nil {
+		return
+	}
+
+	c.HealthCheckPeriod, err = envDuration("DB_HEALTH_CHECK_PERIOD")
+	return
+}
+
+// chatOptions reads the optional chat settings from the environment
+func chatOptions() ([]chat.Option, error) {
+	var opts []chat.Option
+
+	ping, err := envDuration("CHAT_PING_INTERVAL")
+	if err != nil {
+		return nil, err
+	}
+	if ping > 0 {
+		opts = append(opts, chat.WithPingInterval(ping))
+	}
+
+	pong, err := envDuration("CHAT_PONG_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	if pong > 0 {
+		opts = append(opts, chat.WithPongTimeout(pong))
+	}
+
+	n, err := envInt("CHAT_SEND_BUFFER")
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		opts = append(opts, chat.WithSendBuffer(n))
+	}
+
+	// comma separated origins browsers can connect from
+	if v := os.Getenv("CHAT_ORIGINS"); v != "" {
+		opts = append(opts, chat.WithOrigins(strings.Split(v, ",")...))
+	}
+
+	// "drop" or "coalesce", what happens to a connection that falls behind
+	switch p := os.Getenv("CHAT_SLOW_POLICY"); p {
+	case "", "drop":
+	case "coalesce":
+		opts = append(opts, chat.WithSlowPolicy(chat.CoalesceSlow))
+	default:
+		return nil, fmt.Errorf("unknown chat slow policy %q", p)
+	}
+	return opts, nil
+}
+
+func envInt(key string) (int, error) {
+	if v := os.Getenv(key); v != "" {
+		return strconv.Atoi(v)
+	}
+	return 0, nil
+}
+
+func envDuration(key string) (time.Duration, error) {
+	if v := os.Getenv(key); v != "" {
+		return time.ParseDuration(v)
+	}
+	return 0, nil
 }
 
 func main() {
+	flag.Parse()
+
 	if err := dev(); err != nil {
 		log.Fatalln(err)
 	}
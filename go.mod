@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/hyphengolang/prelude v0.1.0
 	github.com/jackc/pgx/v5 v5.0.3
+	github.com/mattn/go-sqlite3 v1.14.16
 )
 
 require (
@@ -13,6 +14,7 @@ require (
 	github.com/gobwas/pool v0.2.1 // indirect
 	github.com/goccy/go-json v0.9.11 // indirect
 	github.com/google/uuid v1.3.0 // indirect
+	github.com/jackc/puddle/v2 v2.0.0 // indirect
 	github.com/lestrrat-go/blackmagic v1.0.1 // indirect
 	github.com/lestrrat-go/httpcc v1.0.1 // indirect
 	github.com/lestrrat-go/httprc v1.0.4 // indirect
@@ -26,7 +28,7 @@ require (
 
 require (
 	github.com/go-chi/chi/v5 v5.0.7
-	github.com/gobwas/ws v1.1.0 // indirect
+	github.com/gobwas/ws v1.1.0
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20200714003250-2b9c44734f2b // indirect
 	github.com/lestrrat-go/jwx/v2 v2.0.6
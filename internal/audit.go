@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyphengolang/prelude/types/suid"
+)
+
+// Actions recorded by the audit log
+const (
+	ActionSignIn         = "auth.sign_in"
+	ActionSignOut        = "auth.sign_out"
+	ActionRefreshToken   = "auth.refresh_token"
+	ActionCreateAccount  = "account.create"
+	ActionUpdateAccount  = "account.update"
+	ActionDeleteAccount  = "account.delete"
+	ActionRestoreAccount = "account.restore"
+	// Moderation of chat, the target is the user or message acted upon
+	ActionChatRole          = "chat.role"
+	ActionChatMute          = "chat.mute"
+	ActionChatUnmute        = "chat.unmute"
+	ActionChatKick          = "chat.kick"
+	ActionChatBan           = "chat.ban"
+	ActionChatUnban         = "chat.unban"
+	ActionChatDeleteMessage = "chat.delete_message"
+)
+
+// Outcomes of an audited action
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// AuditEvent records a security-relevant action. Events are append-only,
+// when chained each holds the hash of the event before it.
+type AuditEvent struct {
+	ID suid.UUID `json:"id"`
+	// Position of the event in the log, set when appended
+	Seq int64 `json:"seq"`
+	// ID of the user that made the request, empty if anonymous
+	Actor  string `json:"actor,omitempty"`
+	Action string `json:"action"`
+	// ID of the record acted upon
+	Target    string `json:"target,omitempty"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"userAgent"`
+	Outcome   string `json:"outcome"`
+	// Set when appended, truncated to the microsecond
+	CreatedAt time.Time `json:"createdAt"`
+	PrevHash  []byte    `json:"prevHash,omitempty"`
+	Hash      []byte    `json:"hash,omitempty"`
+}
+
+// ChainHash returns the hash of the event linked to the hash of the
+// event before it. Every field except `Seq` and `Hash` is covered.
+func (e *AuditEvent) ChainHash(prev []byte) []byte {
+	h := sha256.New()
+
+	write := func(b []byte) {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+
+	write(prev)
+	write(e.ID.UUID[:])
+	for _, s := range []string{e.Actor, e.Action, e.Target, e.IP, e.UserAgent, e.Outcome} {
+		write([]byte(s))
+	}
+
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], uint64(e.CreatedAt.UnixMicro()))
+	write(t[:])
+
+	return h.Sum(nil)
+}
+
+// ErrAuditChainBroken is returned when an event does not follow the hash
+// of the event before it or its hash does not match its contents
+var ErrAuditChainBroken = errors.New(`audit chain is broken`)
+
+// VerifyAuditChain checks events, ordered by `Seq` ascending, follow on
+// from the hash prev. It returns the hash of the last event so the log
+// can be verified a page at a time. Events written before the chain
+// was enabled have no hash and are skipped until the first that does.
+func VerifyAuditChain(prev []byte, es []AuditEvent) ([]byte, error) {
+	for i := range es {
+		e := &es[i]
+		if e.Hash == nil && prev == nil {
+			continue
+		}
+
+		if !bytes.Equal(e.PrevHash, prev) || !bytes.Equal(e.Hash, e.ChainHash(prev)) {
+			return prev, fmt.Errorf("%w: at seq %d", ErrAuditChainBroken, e.Seq)
+		}
+		prev = e.Hash
+	}
+	return prev, nil
+}
+
+// AuditQuery filters and paginates audit events by `Seq`
+type AuditQuery struct {
+	// Filters, ignored if empty
+	Actor   string
+	Action  string
+	Target  string
+	Outcome string
+	// Inclusive lower bound, ignored if zero
+	CreatedFrom time.Time
+	// Exclusive upper bound, ignored if zero
+	CreatedTo time.Time
+
+	Desc bool
+	// Maximum number of events to return, no limit if zero
+	Limit int
+	// Select events with a `Seq` greater or less than, ignored if zero
+	After  int64
+	Before int64
+}
+
+type AuditRepo interface {
+	Context() context.Context
+	// Method has no effect as the repository shares its connections
+	Close(ctx context.Context) error
+	// Method sets the `Seq` and `CreatedAt` of the event, and its hashes
+	// if the repository chains events
+	Append(ctx context.Context, e *AuditEvent) error
+	// Method returns the events matching the query in the order requested
+	SelectMany(ctx context.Context, q AuditQuery) ([]AuditEvent, error)
+}
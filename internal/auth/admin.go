@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+
+	www "github.com/hyphengolang/prelude/http"
+	"github.com/hyphengolang/prelude/types/suid"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// ErrNotAdmin is returned for the access token of a user that is not an admin
+var ErrNotAdmin = errors.New(`not an admin`)
+
+// ClaimID returns the user id stored in the "id" claim of a token.
+// The id is used over the "email" claim as the email may change.
+func ClaimID(tk jwt.Token) (suid.UUID, error) {
+	sid, ok := tk.PrivateClaims()["id"].(string)
+	if !ok {
+		return suid.UUID{}, errors.New(`missing "id" claim`)
+	}
+
+	return suid.ParseString(sid)
+}
+
+// ParseAdmin returns the id of the user whose access token is on the
+// request, or `ErrNotAdmin` if they are not one of the admins
+func ParseAdmin(r *http.Request, key jwk.Key, admins map[suid.UUID]bool) (suid.UUID, error) {
+	tk, err := ParseRequest(r, key, TypeAccess)
+	if err != nil {
+		return suid.UUID{}, err
+	}
+
+	uid, err := ClaimID(tk)
+	if err != nil {
+		return suid.UUID{}, err
+	}
+
+	if !admins[uid] {
+		return uid, ErrNotAdmin
+	}
+	return uid, nil
+}
+
+// RequireAdmin only lets the requests of admins through, responding
+// to others with 401 or, if they are not an admin, 403
+func RequireAdmin(key jwk.Key, admins map[suid.UUID]bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch _, err := ParseAdmin(r, key, admins); {
+			case errors.Is(err, ErrNotAdmin):
+				www.Respond(w, r, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			case err != nil:
+				www.Respond(w, r, err, http.StatusUnauthorized)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
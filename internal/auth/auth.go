@@ -14,7 +14,18 @@ import (
 	"github.com/lestrrat-go/jwx/v2/jwt"
 )
 
+// Types of token, held in the "typ" claim so that a token
+// cannot be passed where another type is expected
+const (
+	TypeID      = "id"
+	TypeAccess  = "access"
+	TypeRefresh = "refresh"
+	TypeRestore = "restore"
+)
+
 type SignOption struct {
+	// Type is set as the "typ" claim, see `TypeAccess`
+	Type       string
 	IssuedAt   time.Time
 	Issuer     string
 	Audience   []string
@@ -23,7 +34,18 @@ type SignOption struct {
 	Claims     map[string]any
 }
 
-func Parse(key jwk.Key, token []byte) (jwt.Token, error) {
+// Parse verifies the token, which must be of the type typ
+func Parse(key jwk.Key, token []byte, typ string) (jwt.Token, error) {
+	opts, err := parseOptions(key, typ)
+	if err != nil {
+		return nil, err
+	}
+
+	return jwt.Parse(token, opts...)
+}
+
+// parseOptions verify a token with the key and check its type
+func parseOptions(key jwk.Key, typ string) ([]jwt.ParseOption, error) {
 	var sep jwt.SignEncryptParseOption
 	switch key := key.(type) {
 	case jwk.RSAPublicKey:
@@ -34,9 +56,12 @@ func Parse(key jwk.Key, token []byte) (jwt.Token, error) {
 		return nil, errors.New(`unsupported encryption`)
 	}
 
-	return jwt.Parse(token, sep)
+	return []jwt.ParseOption{sep, jwt.WithClaimValue(typeClaim, typ)}, nil
 }
 
+// typeClaim holds the type of a token
+const typeClaim = "typ"
+
 /*
 ParseRequest searches a http.Request object for a JWT token.
 
@@ -56,37 +81,27 @@ If WithHeaderKey() is used, you must explicitly re-enable searching for "Authori
 
 	# searches for "Authorization" AND "x-my-token"
 	jwt.ParseRequest(req, jwt.WithHeaderKey("Authorization"), jwt.WithHeaderKey("x-my-token"))
+
+The token must be of the type typ.
 */
-func ParseRequest(r *http.Request, key jwk.Key) (jwt.Token, error) {
-	var sep jwt.SignEncryptParseOption
-	switch key := key.(type) {
-	case jwk.RSAPublicKey:
-		sep = jwt.WithKey(jwa.RS256, key)
-	case jwk.ECDSAPublicKey:
-		sep = jwt.WithKey(jwa.ES256, key)
-	default:
-		return nil, errors.New(`unsupported encryption`)
+func ParseRequest(r *http.Request, key jwk.Key, typ string) (jwt.Token, error) {
+	opts, err := parseOptions(key, typ)
+	if err != nil {
+		return nil, err
 	}
-	return jwt.ParseRequest(r, sep)
+
+	return jwt.ParseRequest(r, opts...)
 }
 
-func ParseCookie(r *http.Request, key jwk.Key, cookieName string) (jwt.Token, error) {
+// ParseCookie verifies the token held by the cookie,
+// which must be of the type typ
+func ParseCookie(r *http.Request, key jwk.Key, cookieName, typ string) (jwt.Token, error) {
 	c, err := r.Cookie(cookieName)
 	if err != nil {
 		return nil, err
 	}
 
-	var sep jwt.SignEncryptParseOption
-	switch key := key.(type) {
-	case jwk.RSAPublicKey:
-		sep = jwt.WithKey(jwa.RS256, key)
-	case jwk.ECDSAPublicKey:
-		sep = jwt.WithKey(jwa.ES256, key)
-	default:
-		return nil, errors.New(`unsupported encryption`)
-	}
-
-	return jwt.Parse([]byte(c.Value), sep)
+	return Parse(key, []byte(c.Value), typ)
 }
 
 func Sign(key jwk.Key, o *SignOption) ([]byte, error) {
@@ -125,6 +140,12 @@ func Sign(key jwk.Key, o *SignOption) ([]byte, error) {
 		}
 	}
 
+	if o.Type != "" {
+		if err := t.Set(typeClaim, o.Type); err != nil {
+			return nil, err
+		}
+	}
+
 	return jwt.Sign(t, sep)
 }
 
@@ -28,6 +28,7 @@ func TestToken(t *testing.T) {
 		}
 
 		o := SignOption{
+			Type:       TypeID,
 			Issuer:     "api.adoublef.com",
 			Subject:    u.ID.ShortUUID().String(),
 			Audience:   []string{"http://www.adoublef.com", "https://www.adoublef.com"},
@@ -38,7 +39,10 @@ func TestToken(t *testing.T) {
 		signed, err := Sign(private, &o)
 		is.NoErr(err) // sign id token
 
-		_, err = Parse(public, signed)
+		_, err = Parse(public, signed, TypeID)
 		is.NoErr(err) // parse token
+
+		_, err = Parse(public, signed, TypeAccess)
+		is.True(err != nil) // not an access token
 	})
 }
@@ -0,0 +1,479 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hyphengolang/prelude/types/suid"
+)
+
+// ChatVersion is the version of the chat protocol, carried by every envelope
+const ChatVersion = 1
+
+// Types of the envelopes sent over a chat connection
+const (
+	// A message to the members of a room, sent by a client and broadcast
+	// by the server with its id, sender and time set. A direct message
+	// is sent to a user instead, and delivered to both users
+	ChatMessage = "message"
+	// Join or leave a room. The server broadcasts them to the members
+	// of the room, including the client that joined or left
+	ChatJoin  = "join"
+	ChatLeave = "leave"
+	// The client is typing in a room, or has stopped. The server stops
+	// it for the client if it is not sent again within a few seconds
+	ChatTyping = "typing"
+	// Sent by the server when a user comes online in a room or goes
+	// offline, whichever of their connections joined or left
+	ChatPresence = "presence"
+	// Keeps the user online, a client sends it when it has nothing else
+	// to send within the heartbeat timeout of the server
+	ChatHeartbeat = "heartbeat"
+	// Sent by the server once a message is accepted, with the id the
+	// client gave the message. A message sent again with the same id is
+	// acked as the first one was and not stored or broadcast twice
+	ChatAck = "ack"
+	// The user has read the messages of a room, or the direct messages
+	// with a user, up to a seq. The server broadcasts it to the members
+	// of the room, or sends it to both users
+	ChatRead = "read"
+	// Sent by the server when an envelope is rejected, with the id the
+	// client gave the envelope
+	ChatError = "error"
+	// Re-authenticates the connection before its token expires, the
+	// server replies with when the new token expires
+	ChatAuth = "auth"
+	// Edit the text of a message, or delete it, by the id the server gave
+	// it. The server broadcasts them as it does messages. Only the sender
+	// edits a message, moderators of the room can delete it too
+	ChatEdit   = "edit"
+	ChatDelete = "delete"
+	// Sent by the server to the members of a room when a user is muted,
+	// kicked or banned from it, or the mute or ban is lifted
+	ChatModeration = "moderation"
+)
+
+// Limits of the chat protocol
+const (
+	// MaxChatFrameSize is the size of the largest frame the server reads,
+	// the connection is closed if a client sends a larger one
+	MaxChatFrameSize = 64 << 10
+	// MaxChatTextLength is the number of characters a message can have
+	MaxChatTextLength = 4096
+	// MaxChatIDLength is the length of the longest id a client can give
+	MaxChatIDLength = 64
+)
+
+// Codes of the errors sent in `ChatError` envelopes
+const (
+	ChatErrInvalidFrame   = "invalid_frame"
+	ChatErrUnsupported    = "unsupported_version"
+	ChatErrUnknownType    = "unknown_type"
+	ChatErrInvalidRoom    = "invalid_room"
+	ChatErrNotJoined      = "not_joined"
+	ChatErrInvalidPayload = "invalid_payload"
+	ChatErrTooLarge       = "too_large"
+	ChatErrUnknownUser    = "unknown_user"
+	ChatErrNotFound       = "not_found"
+	ChatErrForbidden      = "forbidden"
+	// The user is muted or banned in the room
+	ChatErrMuted  = "muted"
+	ChatErrBanned = "banned"
+	// The server failed to handle a valid envelope, it can be sent again
+	ChatErrUnavailable = "unavailable"
+)
+
+// Envelope is a frame of the chat protocol, encoded as a JSON text frame.
+//
+//	{"v":1,"type":"message","id":"1","room":"lobby","payload":{"text":"Hello"}}
+type Envelope struct {
+	V    int    `json:"v"`
+	Type string `json:"type"`
+	// ID is given by the client to match the ack or error it gets back.
+	// The server sets it to the id of the message when broadcasting it
+	ID   string `json:"id,omitempty"`
+	Room string `json:"room,omitempty"`
+	// To is the short uuid of the user a direct message is sent to
+	To string `json:"to,omitempty"`
+	// From is the short uuid of the user that sent it, set by the server
+	From string `json:"from,omitempty"`
+	// Seq is the position of a message in its room, set by the server
+	Seq int64 `json:"seq,omitempty"`
+	// TS is when the server sent it
+	TS      time.Time       `json:"ts"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// NewEnvelope returns an envelope of the current version with the payload
+// encoded as JSON
+func NewEnvelope(typ, room string, payload any) (Envelope, error) {
+	e := Envelope{V: ChatVersion, Type: typ, Room: room}
+
+	if payload != nil {
+		var err error
+		if e.Payload, err = json.Marshal(payload); err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+// Err returns the `*ChatErr` of a `ChatError` envelope, otherwise nil
+func (e Envelope) Err() error {
+	if e.Type != ChatError {
+		return nil
+	}
+
+	ce := &ChatErr{}
+	if err := json.Unmarshal(e.Payload, ce); err != nil {
+		return err
+	}
+	return ce
+}
+
+// MessagePayload is the payload of `ChatMessage`
+type MessagePayload struct {
+	Text string `json:"text"`
+	// EditedAt is set by the server on a message that has been edited
+	EditedAt *time.Time `json:"editedAt,omitempty"`
+}
+
+// JoinPayload is the optional payload of `ChatJoin`. When `Since` is
+// set the messages of the room after it are replayed before any new
+// message is sent
+type JoinPayload struct {
+	Since *int64 `json:"since,omitempty"`
+}
+
+// TypingPayload is the optional payload of `ChatTyping`, a client
+// that sends none is typing. The server always sets it
+type TypingPayload struct {
+	Typing bool `json:"typing"`
+}
+
+// EditPayload is the payload of `ChatEdit` and `ChatDelete`, which has no
+// text. The server sets the time the message was edited or deleted
+type EditPayload struct {
+	// ID the server gave the message
+	Message string     `json:"message"`
+	Text    string     `json:"text,omitempty"`
+	At      *time.Time `json:"at,omitempty"`
+}
+
+// Moderation actions in a `ChatModeration` envelope
+const (
+	ModerationMute   = "mute"
+	ModerationUnmute = "unmute"
+	ModerationKick   = "kick"
+	ModerationBan    = "ban"
+	ModerationUnban  = "unban"
+)
+
+// ModerationPayload is the payload of `ChatModeration`, the
+// envelope is from the moderator that took the action
+type ModerationPayload struct {
+	Action string `json:"action"`
+	// short uuid of the user acted upon
+	User   string `json:"user"`
+	Reason string `json:"reason,omitempty"`
+	// when a mute or ban ends, not set if it lasts until lifted
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// ReadPayload is the payload of `ChatRead`, the server
+// sets the seq to how far the user has read
+type ReadPayload struct {
+	Seq int64 `json:"seq"`
+}
+
+// Statuses of the user in a `ChatPresence` envelope
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+// PresencePayload is the payload of `ChatPresence`, the
+// user is the sender of the envelope
+type PresencePayload struct {
+	Status string `json:"status"`
+}
+
+// AckPayload is the payload of `ChatAck`
+type AckPayload struct {
+	// ID the server gave the message that was accepted
+	ID  string `json:"id"`
+	Seq int64  `json:"seq"`
+	// Set when the message had already been accepted
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// AuthPayload is the payload of `ChatAuth`, the client sends the token
+// and the server replies with when it expires
+type AuthPayload struct {
+	Token     string     `json:"token,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// ChatErr is the payload of `ChatError`
+type ChatErr struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ChatErr) Error() string { return fmt.Sprintf("chat: %s: %s", e.Code, e.Message) }
+
+func chatErr(code, format string, v ...any) *ChatErr {
+	return &ChatErr{Code: code, Message: fmt.Sprintf(format, v...)}
+}
+
+// Validate checks an envelope sent by a client, returning a `*ChatErr`
+// if it is not valid. Rooms are checked by the server.
+func (e Envelope) Validate() error {
+	if e.V != ChatVersion {
+		return chatErr(ChatErrUnsupported, "version %d is not supported, use %d", e.V, ChatVersion)
+	}
+
+	if len(e.ID) > MaxChatIDLength {
+		return chatErr(ChatErrTooLarge, "id is longer than %d bytes", MaxChatIDLength)
+	}
+
+	switch e.Type {
+	case ChatMessage:
+		if e.To != "" && e.Room != "" {
+			return chatErr(ChatErrInvalidFrame, `a message is sent to a "room" or a user, not both`)
+		}
+
+		var p MessagePayload
+		if err := json.Unmarshal(e.Payload, &p); err != nil || p.Text == "" {
+			return chatErr(ChatErrInvalidPayload, `payload must be {"text":"..."} with some text`)
+		}
+
+		if utf8.RuneCountInString(p.Text) > MaxChatTextLength {
+			return chatErr(ChatErrTooLarge, "text is longer than %d characters", MaxChatTextLength)
+		}
+	case ChatEdit, ChatDelete:
+		if e.To != "" && e.Room != "" {
+			return chatErr(ChatErrInvalidFrame, `a message is in a "room" or sent to a user, not both`)
+		}
+
+		var p EditPayload
+		if err := json.Unmarshal(e.Payload, &p); err != nil || p.Message == "" {
+			return chatErr(ChatErrInvalidPayload, `payload must be {"message":"<id>"}`)
+		}
+
+		if e.Type == ChatEdit && p.Text == "" {
+			return chatErr(ChatErrInvalidPayload, `payload must be {"message":"<id>","text":"..."} with some text`)
+		}
+
+		if utf8.RuneCountInString(p.Text) > MaxChatTextLength {
+			return chatErr(ChatErrTooLarge, "text is longer than %d characters", MaxChatTextLength)
+		}
+	case ChatAuth:
+		var p AuthPayload
+		if err := json.Unmarshal(e.Payload, &p); err != nil || p.Token == "" {
+			return chatErr(ChatErrInvalidPayload, `payload must be {"token":"..."}`)
+		}
+	case ChatJoin:
+		var p JoinPayload
+		if len(e.Payload) > 0 && (json.Unmarshal(e.Payload, &p) != nil || p.Since != nil && *p.Since < 0) {
+			return chatErr(ChatErrInvalidPayload, `payload must be {"since":<seq>}`)
+		}
+	case ChatRead:
+		if e.To != "" && e.Room != "" {
+			return chatErr(ChatErrInvalidFrame, `messages are read in a "room" or from a user, not both`)
+		}
+
+		var p ReadPayload
+		if err := json.Unmarshal(e.Payload, &p); err != nil || p.Seq < 1 {
+			return chatErr(ChatErrInvalidPayload, `payload must be {"seq":<seq>}`)
+		}
+	case ChatTyping:
+		var p TypingPayload
+		if len(e.Payload) > 0 && json.Unmarshal(e.Payload, &p) != nil {
+			return chatErr(ChatErrInvalidPayload, `payload must be {"typing":<bool>}`)
+		}
+	case ChatLeave, ChatHeartbeat:
+	default:
+		return chatErr(ChatErrUnknownType, "type %q cannot be sent by a client", e.Type)
+	}
+	return nil
+}
+
+// Message is a chat message stored in a room
+type Message struct {
+	ID   suid.UUID `json:"id"`
+	Room string    `json:"room"`
+	// Position of the message in its room, numbered from 1 without
+	// gaps in the order the messages were sent. Set when inserted
+	Seq       int64     `json:"seq"`
+	Sender    suid.UUID `json:"sender"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+	// ClientID is the id the sender gave the message, if any. The sender
+	// cannot send two messages with the same one to a room
+	ClientID string `json:"clientId,omitempty"`
+	// Set when the text was last edited
+	EditedAt *time.Time `json:"editedAt,omitempty"`
+	// Set once deleted, the message is kept without its text or edits
+	// so the seqs of the room have no gaps
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+// MessageEdit is a version of the text of a message that has since
+// been edited, written at `CreatedAt`
+type MessageEdit struct {
+	MessageID suid.UUID `json:"messageId"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Roles of the users of a room, ranked from the highest
+const (
+	RoleOwner     = "owner"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+// RoomRole is the role of a user in a room, a user without one is a member
+type RoomRole struct {
+	Room string    `json:"room"`
+	User suid.UUID `json:"user"`
+	Role string    `json:"role"`
+}
+
+// Kinds of sanction a moderator imposes on a user of a room
+const (
+	// A muted user cannot send messages, edit them or type in the room
+	SanctionMute = "mute"
+	// A banned user cannot join the room
+	SanctionBan = "ban"
+)
+
+// Sanction is a mute or ban of a user in a room, until it
+// expires or is lifted
+type Sanction struct {
+	Room string    `json:"room"`
+	User suid.UUID `json:"user"`
+	Kind string    `json:"kind"`
+	// By is the moderator that imposed it
+	By     suid.UUID `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+	// Not set if it lasts until lifted
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Set when inserted
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Active reports whether the sanction has not expired at now
+func (s Sanction) Active(now time.Time) bool {
+	return s.ExpiresAt == nil || now.Before(*s.ExpiresAt)
+}
+
+// DirectRoom returns the room that holds the direct messages between two
+// users, whichever sent them. It is not a valid name for a room that can
+// be joined, so it is only read and written by the two users.
+func DirectRoom(a, b suid.UUID) string {
+	sa, sb := a.ShortUUID().String(), b.ShortUUID().String()
+	if sb < sa {
+		sa, sb = sb, sa
+	}
+	return "@" + sa + ":" + sb
+}
+
+// ParseDirectRoom returns the users of a room returned by `DirectRoom`
+func ParseDirectRoom(room string) (a, b suid.UUID, ok bool) {
+	sa, sb, found := strings.Cut(strings.TrimPrefix(room, "@"), ":")
+	if !found || !strings.HasPrefix(room, "@") {
+		return a, b, false
+	}
+
+	var err error
+	if a, err = suid.ParseString(sa); err != nil {
+		return a, b, false
+	}
+	if b, err = suid.ParseString(sb); err != nil {
+		return a, b, false
+	}
+	return a, b, true
+}
+
+// Conversation is a room a user has read messages of,
+// such as one holding direct messages
+type Conversation struct {
+	Room string
+	User suid.UUID
+	// Seq of the last message the user has read
+	ReadSeq int64
+	// Newest message of the room
+	Last Message
+}
+
+// Unread returns the number of messages the user has not read
+func (c Conversation) Unread() int64 {
+	if n := c.Last.Seq - c.ReadSeq; n > 0 {
+		return n
+	}
+	return 0
+}
+
+// MessageQuery pages through the messages of a room by `Seq`
+type MessageQuery struct {
+	Room string
+	// Select messages with a `Seq` greater than
+	After int64
+	// Select messages with a `Seq` less than, ignored if zero
+	Before int64
+	// Return the oldest messages first rather than the newest
+	Ascending bool
+	// Maximum number of messages to return, no limit if zero
+	Limit int
+}
+
+type ChatRepo interface {
+	// Method sets the `Seq` and `CreatedAt` of the message. If the sender
+	// has already sent a message with its `ClientID` to the room, m is
+	// set to that message and `ErrAlreadyExists` is returned
+	InsertMessage(ctx context.Context, m *Message) error
+	SelectMessages(ctx context.Context, q MessageQuery) ([]Message, error)
+	// Method records that the user has read the messages of the room up
+	// to seq, or its newest message if there are fewer, unless they have
+	// already read further. It returns how far the user has read, or
+	// `ErrNotFound` if the room has no messages. The room is added to
+	// the conversations of the user
+	MarkRead(ctx context.Context, room string, uid suid.UUID, seq int64) (int64, error)
+	// Method returns the conversations of the user that have
+	// messages, the most recently active first
+	SelectConversations(ctx context.Context, uid suid.UUID) ([]Conversation, error)
+
+	SelectMessage(ctx context.Context, id suid.UUID) (Message, error)
+	// Method replaces the text of the message with that of m, adding the
+	// text it replaces to its edits, and sets m to the edited message.
+	// It returns `ErrNotFound` if the message does not exist or is deleted
+	UpdateMessage(ctx context.Context, m *Message) error
+	// Method removes the text of the message with the id of m, adding it
+	// to its edits, and sets m to its tombstone. It returns `ErrNotFound`
+	// if the message does not exist or is already deleted
+	DeleteMessage(ctx context.Context, m *Message) error
+	// Method returns the edits of the message, oldest first
+	SelectEdits(ctx context.Context, id suid.UUID) ([]MessageEdit, error)
+
+	// Method sets the role of the user in the room, `RoleMember` removes
+	// it. It returns `ErrAlreadyExists` if another user owns the room
+	SetRole(ctx context.Context, r RoomRole) error
+	// Method returns the users of the room that are not members,
+	// the owner first
+	SelectRoles(ctx context.Context, room string) ([]RoomRole, error)
+
+	// Method replaces any sanction of the same kind on the user in the
+	// room, setting the `CreatedAt` of s
+	InsertSanction(ctx context.Context, s *Sanction) error
+	// Method returns `ErrNotFound` if the user has no such sanction
+	DeleteSanction(ctx context.Context, room string, uid suid.UUID, kind string) error
+	// Method returns the sanctions of the room that have not
+	// expired, the oldest first
+	SelectSanctions(ctx context.Context, room string) ([]Sanction, error)
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/hyphengolang/prelude/types/suid"
+)
+
+// Types of the domain events written to the outbox
+const (
+	EventAccountCreated  = "account.created"
+	EventAccountUpdated  = "account.updated"
+	EventAccountDeleted  = "account.deleted"
+	EventAccountRestored = "account.restored"
+	// The account was removed for good, either by a hard delete or
+	// once the grace period of a soft delete ended
+	EventAccountPurged = "account.purged"
+)
+
+// Event is a change to an account, written to the outbox within the
+// same transaction as the change. Events are delivered at least once,
+// consumers should discard those with an `ID` they have already seen.
+type Event struct {
+	ID   suid.UUID `json:"id"`
+	Type string    `json:"type"`
+	// ID of the account, as a short uuid
+	Subject string `json:"subject"`
+	// Optional JSON object, events never hold passwords or emails
+	Data      json.RawMessage `json:"data,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// AccountData is the data of `EventAccountCreated` and `EventAccountUpdated`
+type AccountData struct {
+	Username string `json:"username"`
+	Version  int    `json:"version"`
+}
+
+// NewEvent returns an event of the user with the data encoded as JSON
+func NewEvent(typ string, id suid.UUID, data any) (Event, error) {
+	e := Event{
+		ID:        suid.NewUUID(),
+		Type:      typ,
+		Subject:   id.ShortUUID().String(),
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+
+	if data != nil {
+		var err error
+		if e.Data, err = json.Marshal(data); err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+// Outbox holds the events that are yet to be dispatched
+type Outbox interface {
+	// Method claims up to n pending events, oldest first. Claimed events
+	// are hidden from other callers until the lease ends, after which
+	// they are pending again unless acknowledged.
+	Claim(ctx context.Context, n int, lease time.Duration) ([]Event, error)
+	// Method marks the events as dispatched, so they are never claimed again
+	Ack(ctx context.Context, ids ...suid.UUID) error
+}
@@ -0,0 +1,240 @@
+// Package event dispatches the domain events written to an outbox.
+// Account changes write their event, such as "account.created", to the
+// outbox within the same transaction as the change.
+//
+// Events are claimed from the outbox in batches and published to every
+// sink, an event is only acknowledged once all sinks accept it. Events
+// that fail are claimed again once their lease ends, so a sink may see
+// the same event more than once and should use its ID to discard
+// duplicates.
+package event
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+// Sink publishes events to a consumer
+type Sink interface {
+	Publish(ctx context.Context, e internal.Event) error
+}
+
+// SinkFunc is a function that can be used as a `Sink`
+type SinkFunc func(ctx context.Context, e internal.Event) error
+
+func (f SinkFunc) Publish(ctx context.Context, e internal.Event) error { return f(ctx, e) }
+
+// Defaults of a `Dispatcher`
+const (
+	defaultInterval = time.Second
+	defaultBatch    = 100
+	defaultLease    = time.Minute
+)
+
+// Dispatcher publishes the events of an outbox to its sinks
+type Dispatcher struct {
+	o     internal.Outbox
+	sinks []Sink
+
+	interval time.Duration
+	batch    int
+	lease    time.Duration
+
+	logf func(format string, v ...any)
+}
+
+type Option func(d *Dispatcher)
+
+// WithInterval sets how long to wait once the outbox is empty
+func WithInterval(i time.Duration) Option {
+	return func(d *Dispatcher) { d.interval = i }
+}
+
+// WithBatch sets how many events are claimed at a time
+func WithBatch(n int) Option {
+	return func(d *Dispatcher) { d.batch = n }
+}
+
+// WithLease sets how long a batch has to be published before its
+// events can be claimed again
+func WithLease(l time.Duration) Option {
+	return func(d *Dispatcher) { d.lease = l }
+}
+
+func NewDispatcher(o internal.Outbox, sinks []Sink, opts ...Option) *Dispatcher {
+	d := &Dispatcher{
+		o:        o,
+		sinks:    sinks,
+		interval: defaultInterval,
+		batch:    defaultBatch,
+		lease:    defaultLease,
+		logf:     log.Printf,
+	}
+
+	for _, o := range opts {
+		o(d)
+	}
+	return d
+}
+
+// Run dispatches events until ctx is done. Full batches are followed
+// immediately by the next, otherwise it waits for the interval.
+func (d *Dispatcher) Run(ctx context.Context) {
+	t := time.NewTicker(d.interval)
+	defer t.Stop()
+
+	for {
+		n, err := d.Dispatch(ctx)
+		if err != nil {
+			d.logf("dispatching events: %v", err)
+		}
+
+		if err == nil && n == d.batch {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Dispatch publishes a single batch of events, returning how many were
+// claimed. Events are published in order, each to every sink.
+func (d *Dispatcher) Dispatch(ctx context.Context) (int, error) {
+	es, err := d.o.Claim(ctx, d.batch, d.lease)
+	if err != nil {
+		return 0, err
+	}
+
+	// the batch must be published before the lease ends
+	pctx, cancel := context.WithTimeout(ctx, d.lease)
+	defer cancel()
+
+	var acked []suid.UUID
+	for _, e := range es {
+		if err := d.publish(pctx, e); err != nil {
+			d.logf("publishing event %s (%s): %v", e.ID, e.Type, err)
+			continue
+		}
+		acked = append(acked, e.ID)
+	}
+
+	return len(es), d.o.Ack(ctx, acked...)
+}
+
+func (d *Dispatcher) publish(ctx context.Context, e internal.Event) error {
+	for _, s := range d.sinks {
+		if err := s.Publish(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler consumes the events of a `Bus`
+type Handler func(ctx context.Context, e internal.Event) error
+
+// Bus is an in-process sink that calls each of its handlers in turn.
+// Publishing fails with the first error, the event is then published
+// to every handler again.
+type Bus struct {
+	mu sync.RWMutex
+	hs []subscriber
+	n  int
+}
+
+type subscriber struct {
+	id int
+	h  Handler
+}
+
+var _ Sink = (*Bus)(nil)
+
+func NewBus() *Bus { return &Bus{} }
+
+// Subscribe calls h with every event published, until unsubscribed
+func (b *Bus) Subscribe(h Handler) (unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.n
+	b.hs, b.n = append(b.hs, subscriber{id, h}), b.n+1
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		for i, s := range b.hs {
+			if s.id == id {
+				b.hs = append(b.hs[:i:i], b.hs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (b *Bus) Publish(ctx context.Context, e internal.Event) error {
+	b.mu.RLock()
+	hs := b.hs
+	b.mu.RUnlock()
+
+	for _, s := range hs {
+		if err := s.h(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Webhook is a sink that posts each event as JSON to a single URL.
+// The ID of the event is sent as the "Idempotency-Key" header.
+type Webhook struct {
+	url string
+	c   *http.Client
+}
+
+var _ Sink = (*Webhook)(nil)
+
+func NewWebhook(url string, c *http.Client) *Webhook {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	return &Webhook{url, c}
+}
+
+func (w *Webhook) Publish(ctx context.Context, e internal.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", e.ID.String())
+
+	res, err := w.c.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/hyphengolang/prelude/types/email"
+	"github.com/hyphengolang/prelude/types/password"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+	"secure.adoublef.com/store/memory"
+)
+
+func TestDispatcher(t *testing.T) {
+	t.Parallel()
+	is, ctx := is.New(t), context.Background()
+
+	r := memory.NewUserRepo(ctx)
+	for _, name := range []string{"fizz", "buzz"} {
+		u := internal.User{
+			ID:       suid.NewUUID(),
+			Username: "i_am_" + name,
+			Email:    email.Email(name + "@mail.com"),
+			Password: password.Password("p4$$w4rD").MustHash(),
+		}
+		is.NoErr(r.Insert(ctx, &u)) // insert user
+	}
+
+	var (
+		seen []internal.Event
+		fail = true
+	)
+
+	// the first attempt to publish "buzz" fails
+	sinks := []Sink{SinkFunc(func(ctx context.Context, e internal.Event) error {
+		var d internal.AccountData
+		if err := json.Unmarshal(e.Data, &d); err != nil {
+			return err
+		}
+
+		if d.Username == "i_am_buzz" && fail {
+			fail = false
+			return errors.New(`unavailable`)
+		}
+
+		seen = append(seen, e)
+		return nil
+	})}
+
+	d := NewDispatcher(r, sinks, WithLease(time.Millisecond*10))
+	d.logf = t.Logf
+
+	n, err := d.Dispatch(ctx)
+	is.NoErr(err)          // dispatch events
+	is.Equal(n, 2)         // two events claimed
+	is.Equal(len(seen), 1) // "fizz" was published
+
+	n, err = d.Dispatch(ctx)
+	is.NoErr(err)  // dispatch again
+	is.Equal(n, 0) // "buzz" is leased
+
+	time.Sleep(time.Millisecond * 20)
+
+	n, err = d.Dispatch(ctx)
+	is.NoErr(err)          // dispatch once the lease ended
+	is.Equal(n, 1)         // "buzz" is claimed again
+	is.Equal(len(seen), 2) // "buzz" was published
+
+	time.Sleep(time.Millisecond * 20)
+
+	n, err = d.Dispatch(ctx)
+	is.NoErr(err)  // dispatch again
+	is.Equal(n, 0) // every event was acknowledged
+}
+
+func TestBus(t *testing.T) {
+	t.Parallel()
+	is, ctx := is.New(t), context.Background()
+
+	b := NewBus()
+
+	var fizz, buzz int
+	unsubscribe := b.Subscribe(func(ctx context.Context, e internal.Event) error { fizz++; return nil })
+	b.Subscribe(func(ctx context.Context, e internal.Event) error { buzz++; return nil })
+
+	is.NoErr(b.Publish(ctx, internal.Event{})) // publish to both
+	unsubscribe()
+	is.NoErr(b.Publish(ctx, internal.Event{})) // publish to "buzz"
+
+	is.Equal(fizz, 1) // "fizz" unsubscribed
+	is.Equal(buzz, 2) // "buzz" is subscribed
+
+	errFail := errors.New(`fail`)
+	b.Subscribe(func(ctx context.Context, e internal.Event) error { return errFail })
+	is.True(errors.Is(b.Publish(ctx, internal.Event{}), errFail)) // handler failed
+}
+
+func TestWebhook(t *testing.T) {
+	t.Parallel()
+	is, ctx := is.New(t), context.Background()
+
+	var (
+		got internal.Event
+		key string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key = r.Header.Get("Idempotency-Key")
+		_ = json.NewDecoder(r.Body).Decode(&got)
+	}))
+	t.Cleanup(srv.Close)
+
+	e, err := internal.NewEvent(internal.EventAccountDeleted, suid.NewUUID(), nil)
+	is.NoErr(err) // new event
+
+	is.NoErr(NewWebhook(srv.URL, srv.Client()).Publish(ctx, e)) // post event
+	is.Equal(got.ID, e.ID)                                      // event is sent
+	is.Equal(key, e.ID.String())                                // id is the idempotency key
+
+	fail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(fail.Close)
+
+	err = NewWebhook(fail.URL, fail.Client()).Publish(ctx, e)
+	is.True(err != nil) // unsuccessful status
+}
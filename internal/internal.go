@@ -2,6 +2,10 @@ package internal
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"time"
 
 	"github.com/hyphengolang/prelude/types/email"
 	"github.com/hyphengolang/prelude/types/password"
@@ -11,10 +15,116 @@ import (
 type ContextKey string
 
 type User struct {
-	ID       suid.UUID             `json:"id"`
-	Username string                `json:"username"`
-	Email    email.Email           `json:"email"`
-	Password password.PasswordHash `json:"-"`
+	ID        suid.UUID             `json:"id"`
+	Username  string                `json:"username"`
+	Email     email.Email           `json:"email"`
+	Password  password.PasswordHash `json:"-"`
+	CreatedAt time.Time             `json:"createdAt"`
+	UpdatedAt time.Time             `json:"updatedAt"`
+	// Version is incremented on every update and is used for
+	// optimistic concurrency control
+	Version int `json:"-"`
+	// DeletedAt is set once the account has been soft deleted
+	DeletedAt *time.Time `json:"-"`
+	// RevokedAt is when the account was last deleted, once it has been
+	// restored. Tokens issued before it are no longer honoured
+	RevokedAt *time.Time `json:"-"`
+}
+
+var (
+	// ErrNotFound is returned when no record matches the given key
+	ErrNotFound = errors.New(`not found`)
+	// ErrInvalidType is returned when a key is not of a supported type
+	ErrInvalidType = errors.New(`invalid type`)
+	// ErrVersionMismatch is returned when an update was made against a stale
+	// version of a record
+	ErrVersionMismatch = errors.New(`version mismatch`)
+	// ErrAlreadyExists is returned when a write conflicts with a unique
+	// value held by another record
+	ErrAlreadyExists = errors.New(`already exists`)
+	// ErrTimeout is returned when an operation did not complete before
+	// the deadline of its context
+	ErrTimeout = errors.New(`timeout`)
+	// ErrInvalidCursor is returned when a cursor cannot be parsed
+	ErrInvalidCursor = errors.New(`invalid cursor`)
+)
+
+// More info regarding soft deleting https://evilmartians.com/chronicles/soft-deletion-with-postgresql-but-with-logic-on-the-database
+type DeleteTyp int
+
+func (t DeleteTyp) String() string {
+	return [...]string{
+		"soft_delete",
+		"hard_delete",
+	}[t]
+}
+
+const (
+	SoftDelete DeleteTyp = iota
+	HardDelete
+)
+
+const (
+	// Rule to choose between a soft or hard delete, see `DeleteTyp`
+	RuleSoftDeletion = ContextKey("rule-soft-deletion")
+	// Rule to include soft deleted records when reading. Soft deleted
+	// records are hidden unless this is set to true
+	//
+	//	ctx := context.WithValue(context.Background(), RuleIncludeDeleted, true)
+	//	r.SelectMany(ctx)
+	RuleIncludeDeleted = ContextKey("rule-include-deleted")
+	// Rule to read from the primary when a store has replicas, set to true
+	// to read back a write or a record that a write depends on
+	RuleReadPrimary = ContextKey("rule-read-primary")
+)
+
+// UserQuery is used to filter and paginate users. Users are ordered
+// by (`CreatedAt`, `ID`) which is also the position held by a `Cursor`.
+type UserQuery struct {
+	// Filters
+	UsernamePrefix string
+	// Emails that are encrypted by the store can only
+	// be matched whole, the prefix is then the full email
+	EmailPrefix string
+	// Inclusive lower bound, ignored if zero
+	CreatedFrom time.Time
+	// Exclusive upper bound, ignored if zero
+	CreatedTo time.Time
+
+	Desc bool
+	// Maximum number of users to return, no limit if zero
+	Limit int
+	// Select users that come after or before the cursor in the
+	// requested order. Only one should be set.
+	After  *Cursor
+	Before *Cursor
+}
+
+// Cursor holds a keyset position of a user
+type Cursor struct {
+	CreatedAt time.Time
+	ID        suid.UUID
+}
+
+func CursorOf(u *User) *Cursor { return &Cursor{u.CreatedAt, u.ID} }
+
+// String returns an opaque representation of the cursor
+func (c Cursor) String() string {
+	b := make([]byte, 8, 8+len(c.ID.UUID))
+	binary.BigEndian.PutUint64(b, uint64(c.CreatedAt.UnixNano()))
+	return base64.RawURLEncoding.EncodeToString(append(b, c.ID.UUID[:]...))
+}
+
+func ParseCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) != 24 {
+		return nil, ErrInvalidCursor
+	}
+
+	var c Cursor
+	c.CreatedAt = time.Unix(0, int64(binary.BigEndian.Uint64(b[:8]))).UTC()
+	copy(c.ID.UUID[:], b[8:])
+	return &c, nil
 }
 
 type UserRepo interface {
@@ -25,7 +135,12 @@ type UserRepo interface {
 type RUserRepo interface {
 	Context() context.Context
 	Close(ctx context.Context) error
-	SelectMany(ctx context.Context) ([]User, error)
+	// Method returns the users matching the query in the order requested.
+	// The zero value of `UserQuery` selects every user.
+	SelectMany(ctx context.Context, q UserQuery) ([]User, error)
+	// Method returns the number of users matching the filters of the
+	// query, the cursor and limit are ignored.
+	Count(ctx context.Context, q UserQuery) (int, error)
 	// Method takes a context and a key value. If key is not of type
 	// `internal.Email` or `suid.SUID` or `string` an invalid type error will be returned.
 	Select(ctx context.Context, key any) (*User, error)
@@ -34,6 +149,12 @@ type WUserRepo interface {
 	Context() context.Context
 	Close(ctx context.Context) error
 	Insert(ctx context.Context, u *User) error
+	// Method will update the username, email and password of the user
+	// matching both `u.ID` and `u.Version`. If the stored version differs
+	// `ErrVersionMismatch` is returned.
+	//
+	// On success `u.Version` and `u.UpdatedAt` are set to the stored values.
+	Update(ctx context.Context, u *User) error
 	// Method takes a context and a key value. If key is not of type
 	// `internal.Email` or `suid.SUID` an invalid type error will be returned.
 	//
@@ -43,4 +164,9 @@ type WUserRepo interface {
 	//	ctx := context.WithValue(context.Background(), RuleSoftDeletion, HardDelete)
 	//	r.Delete(ctx, "fizz@mail.com")
 	Delete(ctx context.Context, key any) error
+	// Method will undo a soft delete of the user with the given `suid.UUID`.
+	Restore(ctx context.Context, id suid.UUID) error
+	// Method will hard delete every user that has been soft deleted for
+	// longer than the given age, returning the number of users removed.
+	Purge(ctx context.Context, age time.Duration) (int64, error)
 }
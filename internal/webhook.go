@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/hyphengolang/prelude/types/suid"
+)
+
+// States of a webhook delivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	// Every attempt failed, the delivery is no longer retried
+	DeliveryDead = "dead"
+)
+
+// Webhook is a subscription to the events of accounts
+type Webhook struct {
+	ID  suid.UUID `json:"id"`
+	URL string    `json:"url"`
+	// Types of the events delivered, every type if empty
+	Events []string `json:"events"`
+	// Key that payloads are signed with
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Wants reports whether events of the type are delivered to the webhook
+func (w *Webhook) Wants(typ string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+
+	for _, t := range w.Events {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery is an event to be posted to a webhook, there is at most
+// one delivery of an event to each webhook
+type Delivery struct {
+	ID suid.UUID `json:"id"`
+	// Position of the delivery in the log, set when inserted
+	Seq       int64     `json:"seq"`
+	WebhookID suid.UUID `json:"webhookId"`
+	EventID   suid.UUID `json:"eventId"`
+	EventType string    `json:"eventType"`
+	// The event encoded as JSON, posted as it is
+	Payload  json.RawMessage `json:"payload"`
+	Status   string          `json:"status"`
+	Attempts int             `json:"attempts"`
+	// When a pending delivery is next attempted
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	// Set by the last failed attempt
+	LastError      string    `json:"lastError,omitempty"`
+	ResponseStatus int       `json:"responseStatus,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// DeliveryQuery filters and paginates deliveries by `Seq`, newest first
+type DeliveryQuery struct {
+	WebhookID suid.UUID
+	// Ignored if empty
+	Status string
+	// Maximum number of deliveries to return, no limit if zero
+	Limit int
+	// Select deliveries with a `Seq` less than, ignored if zero
+	Before int64
+}
+
+type WebhookRepo interface {
+	// Method sets `CreatedAt` of the webhook
+	InsertWebhook(ctx context.Context, w *Webhook) error
+	SelectWebhook(ctx context.Context, id suid.UUID) (*Webhook, error)
+	// Method returns every webhook, oldest first
+	SelectWebhooks(ctx context.Context) ([]Webhook, error)
+	// Method deletes the webhook along with its deliveries
+	DeleteWebhook(ctx context.Context, id suid.UUID) error
+
+	// Method inserts a pending delivery to be attempted at once, unless
+	// the event has already been delivered to the webhook. The `Seq` and
+	// times of the delivery are set if it was inserted.
+	InsertDelivery(ctx context.Context, d *Delivery) error
+	// Method claims up to n pending deliveries that are due, oldest
+	// first. Their next attempt is put off by the lease so that they
+	// are not claimed again while being attempted.
+	ClaimDeliveries(ctx context.Context, n int, lease time.Duration) ([]Delivery, error)
+	// Method records an attempt, writing the status, attempts, next
+	// attempt, last error and response status of the delivery
+	UpdateDelivery(ctx context.Context, d *Delivery) error
+	SelectDelivery(ctx context.Context, id suid.UUID) (*Delivery, error)
+	SelectDeliveries(ctx context.Context, q DeliveryQuery) ([]Delivery, error)
+}
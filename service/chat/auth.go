@@ -0,0 +1,182 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyphengolang/prelude/types/suid"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"secure.adoublef.com/internal/auth"
+)
+
+const (
+	// protocol is selected when the client offers it, a browser has to
+	// offer it alongside the token it passes with `bearerPrefix`
+	protocol     = "chat"
+	bearerPrefix = "bearer."
+
+	// ticketTimeout is how long a ticket can be used for
+	ticketTimeout = time.Second * 30
+)
+
+var (
+	errInvalidTicket = errors.New(`invalid or expired ticket`)
+	errWrongUser     = errors.New(`token is for another user`)
+)
+
+// authenticate returns the id of the user making the request and when their
+// access token expires. The token is read from a ticket, the "Authorization"
+// header or the subprotocols offered, in that order. The cookie set by the
+// user service holds a refresh token, so it is never read.
+func (s Service) authenticate(r *http.Request) (suid.UUID, time.Time, error) {
+	if t := r.URL.Query().Get("ticket"); t != "" {
+		tk, ok := s.tickets.redeem(t)
+		if !ok {
+			return suid.UUID{}, time.Time{}, errInvalidTicket
+		}
+		return tk.uid, tk.exp, nil
+	}
+
+	tk, err := s.parseToken(r)
+	if err != nil {
+		return suid.UUID{}, time.Time{}, err
+	}
+
+	uid, err := auth.ClaimID(tk)
+	return uid, tk.Expiration(), err
+}
+
+func (s Service) parseToken(r *http.Request) (jwt.Token, error) {
+	if r.Header.Get("Authorization") != "" {
+		return auth.ParseRequest(r, s.public, auth.TypeAccess)
+	}
+
+	if token, ok := bearerProtocol(r); ok {
+		return auth.Parse(s.public, []byte(token), auth.TypeAccess)
+	}
+
+	return nil, errors.New(`missing access token`)
+}
+
+// parseUser returns the id of the user whose access token is on the request
+func (s Service) parseUser(r *http.Request) (suid.UUID, error) {
+	tk, err := s.parseToken(r)
+	if err != nil {
+		return suid.UUID{}, err
+	}
+	return auth.ClaimID(tk)
+}
+
+// bearerProtocol returns the token passed as a subprotocol, as browsers
+// cannot set the headers of the upgrade request
+//
+//	Sec-WebSocket-Protocol: chat, bearer.<token>
+func bearerProtocol(r *http.Request) (string, bool) {
+	for _, v := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, bearerPrefix) {
+				return strings.TrimPrefix(p, bearerPrefix), true
+			}
+		}
+	}
+	return "", false
+}
+
+// allowOrigin reports whether the upgrade came from the host of the service
+// or an allowed origin. Clients other than browsers send no "Origin" header.
+func (s Service) allowOrigin(r *http.Request) bool {
+	o := r.Header.Get("Origin")
+	if o == "" {
+		return true
+	}
+
+	u, err := url.Parse(o)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, r.Host) || s.origins[strings.ToLower(o)]
+}
+
+// reauthenticate returns when the token expires,
+// which must have been issued to the user uid
+func (s Service) reauthenticate(uid suid.UUID, token string) (time.Time, error) {
+	tk, err := auth.Parse(s.public, []byte(token), auth.TypeAccess)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	id, err := auth.ClaimID(tk)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if id != uid {
+		return time.Time{}, errWrongUser
+	}
+	return tk.Expiration(), nil
+}
+
+// ticket lets a client that cannot pass its access token on the upgrade
+// request connect with a single use query parameter instead
+type ticket struct {
+	uid suid.UUID
+	// expiry of the access token the ticket was issued for
+	exp time.Time
+	// the ticket cannot be redeemed after this
+	until time.Time
+}
+
+type tickets struct {
+	mu sync.Mutex
+	m  map[string]ticket
+}
+
+func newTickets() *tickets { return &tickets{m: make(map[string]ticket)} }
+
+// issue returns a new ticket for the user, removing those that have expired
+func (ts *tickets) issue(uid suid.UUID, exp time.Time) (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	t := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	until := now.Add(ticketTimeout)
+	if exp.Before(until) {
+		until = exp
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for k, v := range ts.m {
+		if now.After(v.until) {
+			delete(ts.m, k)
+		}
+	}
+
+	ts.m[t] = ticket{uid: uid, exp: exp, until: until}
+	return t, until, nil
+}
+
+// redeem returns the ticket once, if it has not expired
+func (ts *tickets) redeem(t string) (ticket, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	tk, ok := ts.m[t]
+	if !ok {
+		return ticket{}, false
+	}
+
+	delete(ts.m, t)
+	return tk, time.Now().Before(tk.until)
+}
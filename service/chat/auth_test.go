@@ -0,0 +1,166 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+	"secure.adoublef.com/internal/auth"
+	chatclient "secure.adoublef.com/service/chat/client"
+	"secure.adoublef.com/store/memory"
+)
+
+func TestAuth(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	ctx := context.Background()
+	ur := memory.NewUserRepo(ctx)
+	u := addUser(t, ur, "fizz")
+
+	s := NewService(ctx, chi.NewMux(), ur, memory.NewChatRepo(), public, WithOrigins("https://www.adoublef.com")).(Service)
+	s.logf = t.Logf
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(func() { srv.Close() })
+	tk := token(t, u, time.Minute)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/chat/"
+
+	dial := func(d ws.Dialer, url string) (net.Conn, ws.Handshake, int) {
+		conn, br, hs, err := d.Dial(context.Background(), url)
+		var se ws.StatusError
+		if errors.As(err, &se) {
+			return nil, hs, int(se)
+		}
+		is.NoErr(err) // upgrade
+		t.Cleanup(func() { conn.Close() })
+		return bufferedConn(conn, br), hs, http.StatusSwitchingProtocols
+	}
+
+	header := func(k, v string) ws.Dialer {
+		return ws.Dialer{Header: ws.HandshakeHeaderHTTP(http.Header{k: []string{v}})}
+	}
+
+	t.Run("reject connections without a token", func(t *testing.T) {
+		_, _, status := dial(ws.Dialer{}, url)
+		is.Equal(status, http.StatusUnauthorized) // no token
+
+		_, _, status = dial(header(`Authorization`, `Bearer not_a_token`), url)
+		is.Equal(status, http.StatusUnauthorized) // invalid token
+
+		buzz := &internal.User{ID: suid.NewUUID()}
+		_, _, status = dial(header(`Authorization`, `Bearer `+token(t, buzz, time.Minute)), url)
+		is.Equal(status, http.StatusUnauthorized) // unknown user
+	})
+
+	t.Run("pass the token in a header or subprotocol", func(t *testing.T) {
+		_, _, status := dial(header(`Authorization`, `Bearer `+tk), url)
+		is.Equal(status, http.StatusSwitchingProtocols) // header
+
+		_, hs, status := dial(ws.Dialer{Protocols: []string{protocol, bearerPrefix + tk}}, url)
+		is.Equal(status, http.StatusSwitchingProtocols) // subprotocol
+		is.Equal(hs.Protocol, protocol)                 // token is not selected
+
+		_, _, status = dial(header(`Cookie`, "__adf="+tk), url)
+		is.Equal(status, http.StatusUnauthorized) // cookie is not read
+
+		rt, err := auth.Sign(private, &auth.SignOption{
+			Type:       auth.TypeRefresh,
+			Expiration: time.Minute,
+			Claims:     map[string]any{"id": u.ID.ShortUUID()},
+		})
+		is.NoErr(err) // sign refresh token
+
+		_, _, status = dial(header(`Authorization`, `Bearer `+string(rt)), url)
+		is.Equal(status, http.StatusUnauthorized) // not an access token
+	})
+
+	t.Run("allow browsers from the host or an allowed origin", func(t *testing.T) {
+		dialer := func(origin string) ws.Dialer {
+			return ws.Dialer{Header: ws.HandshakeHeaderHTTP(http.Header{
+				"Authorization": []string{"Bearer " + tk},
+				"Origin":        []string{origin},
+			})}
+		}
+
+		_, _, status := dial(dialer(srv.URL), url)
+		is.Equal(status, http.StatusSwitchingProtocols) // same host
+
+		_, _, status = dial(dialer("https://www.adoublef.com"), url)
+		is.Equal(status, http.StatusSwitchingProtocols) // allowed origin
+
+		_, _, status = dial(dialer("https://evil.example.com"), url)
+		is.Equal(status, http.StatusForbidden) // other origin
+	})
+
+	t.Run("redeem a ticket once", func(t *testing.T) {
+		url := ticketURL(t, srv, "/api/v1/chat/", tk)
+
+		_, _, status := dial(ws.Dialer{}, url)
+		is.Equal(status, http.StatusSwitchingProtocols) // ticket
+
+		_, _, status = dial(ws.Dialer{}, url)
+		is.Equal(status, http.StatusUnauthorized) // already redeemed
+
+		res, err := srv.Client().Post(srv.URL+"/api/v1/chat/ticket", applicationJson, nil)
+		is.NoErr(err)                                     // request
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // ticket requires a token
+		res.Body.Close()
+	})
+
+	t.Run("close the connection when the token expires", func(t *testing.T) {
+		conn, _, _ := dial(header(`Authorization`, `Bearer `+token(t, u, time.Second*2)), url)
+
+		err := readClosed(conn)
+
+		var ce wsutil.ClosedError
+		is.True(errors.As(err, &ce))                // closed
+		is.Equal(ce.Code, ws.StatusPolicyViolation) // 1008
+		is.Equal(ce.Reason, "token expired")        // expired
+	})
+
+	t.Run("re-authenticate in-band", func(t *testing.T) {
+		conn, err := chatclient.Dial(context.Background(), url, chatclient.WithToken(token(t, u, time.Second*2)))
+		is.NoErr(err) // upgrade
+		t.Cleanup(func() { conn.Close() })
+
+		is.NoErr(conn.Auth(tk)) // re-authenticate
+
+		var p internal.AuthPayload
+		is.NoErr(json.Unmarshal(receive(t, conn, internal.ChatAuth).Payload, &p))        // read reply
+		is.True(p.ExpiresAt != nil && p.ExpiresAt.After(time.Now().Add(time.Second*30))) // new expiry
+
+		time.Sleep(time.Second * 3)
+
+		is.NoErr(conn.Send(lobby, "1", `Hello Fizz`))        // still open
+		is.Equal(receive(t, conn, internal.ChatAck).ID, "1") // not closed
+	})
+
+	t.Run("close on re-authenticating as another user", func(t *testing.T) {
+		conn, _, _ := dial(header(`Authorization`, `Bearer `+tk), url)
+
+		buzz := &internal.User{ID: suid.NewUUID()}
+		e, _ := internal.NewEnvelope(internal.ChatAuth, "", internal.AuthPayload{Token: token(t, buzz, time.Minute)})
+		p, _ := json.Marshal(e)
+		is.NoErr(wsutil.WriteClientText(conn, p)) // another user
+
+		err := readClosed(conn)
+
+		var ce wsutil.ClosedError
+		is.True(errors.As(err, &ce))                // closed
+		is.Equal(ce.Code, ws.StatusPolicyViolation) // 1008
+		is.Equal(ce.Reason, "invalid token")        // wrong user
+	})
+}
@@ -1,73 +1,724 @@
+// Package chat connects users to rooms over WebSockets.
+//
+// The upgrade requires an access token, passed with a single use ticket
+// from "POST /api/v1/chat/ticket", the "Authorization" header or, as
+// browsers cannot set headers, a "bearer.<token>" subprotocol offered
+// alongside "chat". Browsers can only connect from the host of the
+// service or an origin allowed by `WithOrigins`.
+//
+// Frames are versioned JSON envelopes, such as
+//
+//	{"v":1,"type":"message","id":"<client id>","room":"lobby","payload":{"text":"Hello"}}
+//
+// Clients send "message", "join", "leave", "typing", "heartbeat" and
+// "auth" frames. The server sets "from" and "ts" on those it broadcasts
+// and replies to each frame with an "ack" or "error" holding its client id.
+//
+// The connection is closed with 1008 (policy violation) when the token
+// expires, unless the client re-authenticates before then by sending
+//
+//	{"v":1,"type":"auth","payload":{"token":"<access token>"}}
 package chat
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/gobwas/ws"
 	www "github.com/hyphengolang/prelude/http"
-	"github.com/hyphengolang/prelude/http/websocket"
+	"github.com/hyphengolang/prelude/types/suid"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"secure.adoublef.com/internal"
+	"secure.adoublef.com/internal/auth"
 )
 
 /*
-https://github.dev/gorilla/websocket/blob/master/examples/echo/server.go
+Connect to the lobby, every connection joins it
+
+	[ ] GET /api/v1/chat/
+
+Connect to a room, created when the first connection joins it
+
+	[ ] GET /api/v1/chat/rooms/{room}
+
+Get the messages of a room, newest first, paged with "?limit=" and "?before=<seq>"
+
+	[ ] GET /api/v1/chat/rooms/{room}/messages
+
+Get the direct messages with a user, newest first. Marks them read
+
+	[ ] GET /api/v1/chat/dm/{user}/messages
+
+Get the conversations of the user with how many messages are unread,
+the most recently active first
+
+	[ ] GET /api/v1/chat/inbox
+
+Get the users online in a room
+
+	[ ] GET /api/v1/chat/rooms/{room}/presence
+
+Get a single use ticket to connect with as "?ticket="
+
+	[ ] POST /api/v1/chat/ticket
+
+Frames are JSON envelopes, see `internal.Envelope`. A message is
+broadcast to all members of its room, including the sender, which is
+also sent an ack. More rooms are joined and left with "join" and
+"leave" envelopes. A message with "to" set to the id of a user, rather
+than a room, is a direct message delivered to every connection of both
+users and no one else.
+
+Messages are stored and numbered in their room by "seq". A client that
+reconnects with "?since=<seq>", or joins with {"since":<seq>}, is sent
+up to 100 messages it missed before any new ones.
+
+The id a client gives a message must be unique to the user and room, a
+message sent again with the same id, such as after a lost ack, is acked
+with {"duplicate":true} and not stored or broadcast twice. A "read"
+envelope with {"seq":<seq>} marks the messages of a room, or with "to"
+the direct messages with a user, read up to it. It is broadcast to the
+room, or sent to both users, and the inbox counts what is unread.
+
+The sender of a message edits it with an "edit" envelope holding the id
+the server gave it, {"message":"<id>","text":"..."}, and deletes it with
+a "delete" envelope. Moderators of a room delete the messages of others
+too, see the moderation routes. Both are broadcast as the message was,
+and a deleted message is replayed as a "delete" envelope. A muted user
+cannot send, edit or type in the room, a banned user cannot join it.
+
+A user is online in a room while one of their connections in it has sent
+an envelope within the heartbeat timeout, and "presence" envelopes are
+broadcast when they come online or go offline. "typing" envelopes are
+broadcast when a user starts or stops typing, which they stop on their
+own a few seconds after the last one from the client.
+
+The server pings every connection and closes those that send nothing back
+within the pong timeout. Frames are queued to each connection up to its
+send buffer, a connection that falls further behind is closed with 1008,
+after coalescing its queue if the `SlowPolicy` is `CoalesceSlow`.
+
+Get the counters of the connections, admins only
+
+	[ ] GET /debug/chat
 */
 func (s Service) routes() {
 	s.m.Route("/api/v1/chat", func(r chi.Router) {
-		r.Get("/", s.handleChat())
+		r.Get("/", s.handleChat(lobby))
+		r.Get("/rooms/{room}", s.handleChat(""))
+		r.Get("/rooms/{room}/messages", s.handleGetMessageList())
+		r.Get("/rooms/{room}/presence", s.handleGetPresence())
+		r.Get("/dm/{user}/messages", s.handleGetDirectMessageList())
+		r.Get("/inbox", s.handleGetInbox())
+		r.Post("/ticket", s.handleTicket())
+		s.moderationRoutes(r)
 	})
+
+	s.m.With(auth.RequireAdmin(s.public, s.admins)).Get("/debug/chat", s.handleStats())
+}
+
+func (s Service) handleStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.respond(w, r, s.hub.Stats(), http.StatusOK)
+	}
+}
+
+func (s Service) handleTicket() http.HandlerFunc {
+	type response struct {
+		Ticket    string    `json:"ticket"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		tk, err := s.parseToken(r)
+		if err != nil {
+			s.respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		uid, err := auth.ClaimID(tk)
+		if err != nil {
+			s.respondStatus(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		t, until, err := s.tickets.issue(uid, tk.Expiration())
+		if err != nil {
+			s.respondStatus(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		s.respond(w, r, response{Ticket: t, ExpiresAt: until}, http.StatusOK)
+	}
+}
+
+// Message is a message stored in a room, or sent to a user
+// if it is a direct message. The ids are short uuids
+type Message struct {
+	ID        string    `json:"id"`
+	Room      string    `json:"room,omitempty"`
+	To        string    `json:"to,omitempty"`
+	Seq       int64     `json:"seq"`
+	Sender    string    `json:"sender"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+	// ClientID is the id the sender gave the message, so a client
+	// can tell which of the messages it sent were stored
+	ClientID string `json:"clientId,omitempty"`
+	// the text of a deleted message is empty
+	EditedAt  *time.Time `json:"editedAt,omitempty"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+func newMessage(m *internal.Message) Message {
+	v := Message{
+		ID:        m.ID.ShortUUID().String(),
+		Room:      m.Room,
+		Seq:       m.Seq,
+		Sender:    m.Sender.ShortUUID().String(),
+		Text:      m.Text,
+		CreatedAt: m.CreatedAt,
+		ClientID:  m.ClientID,
+		EditedAt:  m.EditedAt,
+		DeletedAt: m.DeletedAt,
+	}
+
+	if to, ok := recipient(m.Room, m.Sender); ok {
+		v.Room, v.To = "", to.ShortUUID().String()
+	}
+	return v
+}
+
+func (s Service) handleGetMessageList() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := s.parseToken(r); err != nil {
+			s.respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		room := chi.URLParam(r, "room")
+		if !roomName.MatchString(room) {
+			s.respond(w, r, errors.New(`room must be 1 to 64 letters, digits, "_" or "-"`), http.StatusBadRequest)
+			return
+		}
+
+		s.listMessages(w, r, room)
+	}
+}
+
+// handleGetDirectMessageList lists the messages between the user and the
+// one in the path, which only the two of them can read. The first page
+// marks the messages as read.
+func (s Service) handleGetDirectMessageList() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, err := s.parseUser(r)
+		if err != nil {
+			s.respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		with, err := suid.ParseString(chi.URLParam(r, "user"))
+		if err != nil {
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		if with == uid {
+			s.respond(w, r, errors.New("cannot message yourself"), http.StatusBadRequest)
+			return
+		}
+
+		room := internal.DirectRoom(uid, with)
+		ms, ok := s.listMessages(w, r, room)
+		if !ok || len(ms) == 0 || r.URL.Query().Get("before") != "" {
+			return
+		}
+
+		seq, err := s.c.MarkRead(r.Context(), room, uid, ms[0].Seq)
+		if err != nil {
+			s.logf("chat: marking direct messages read: %v", err)
+			return
+		}
+		s.hub.deliver(event(internal.ChatRead, room, uid, internal.ReadPayload{Seq: seq}), uid, with)
+	}
+}
+
+// listMessages responds with a page of the messages of the room, newest
+// first, and returns the messages if it succeeded
+func (s Service) listMessages(w http.ResponseWriter, r *http.Request, room string) ([]internal.Message, bool) {
+	type links struct {
+		Next string `json:"next,omitempty"`
+	}
+
+	type payload struct {
+		Length int       `json:"length"`
+		Data   []Message `json:"data"`
+		Links  links     `json:"links"`
+	}
+
+	q, err := parseMessageQuery(r)
+	if err != nil {
+		s.respond(w, r, err, http.StatusBadRequest)
+		return nil, false
+	}
+	q.Room = room
+
+	// read one more than the limit to know if there is another page
+	limit := q.Limit
+	q.Limit++
+
+	ms, err := s.c.SelectMessages(r.Context(), q)
+	if err != nil {
+		s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+		return nil, false
+	}
+
+	var p payload
+	if len(ms) > limit {
+		ms = ms[:limit]
+
+		v := r.URL.Query()
+		v.Set("before", strconv.FormatInt(ms[len(ms)-1].Seq, 10))
+
+		u := url.URL{Path: r.URL.Path, RawQuery: v.Encode()}
+		p.Links.Next = u.String()
+	}
+
+	p.Length, p.Data = len(ms), make([]Message, len(ms))
+	for i := range ms {
+		p.Data[i] = newMessage(&ms[i])
+	}
+
+	s.respond(w, r, p, http.StatusOK)
+	return ms, true
+}
+
+// Conversation is a room, or the direct messages with a user,
+// with the number of messages the user has not read
+type Conversation struct {
+	Room    string  `json:"room,omitempty"`
+	With    string  `json:"with,omitempty"`
+	ReadSeq int64   `json:"readSeq"`
+	Unread  int64   `json:"unread"`
+	Last    Message `json:"last"`
+}
+
+func newConversation(c *internal.Conversation) Conversation {
+	v := Conversation{
+		Room:    c.Room,
+		ReadSeq: c.ReadSeq,
+		Unread:  c.Unread(),
+		Last:    newMessage(&c.Last),
+	}
+
+	if with, ok := recipient(c.Room, c.User); ok {
+		v.Room, v.With = "", with.ShortUUID().String()
+	}
+	return v
+}
+
+func (s Service) handleGetInbox() http.HandlerFunc {
+	type payload struct {
+		Length int            `json:"length"`
+		Unread int64          `json:"unread"`
+		Data   []Conversation `json:"data"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, err := s.parseUser(r)
+		if err != nil {
+			s.respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		cs, err := s.c.SelectConversations(r.Context(), uid)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		p := payload{Length: len(cs), Data: make([]Conversation, len(cs))}
+		for i := range cs {
+			p.Data[i] = newConversation(&cs[i])
+			p.Unread += p.Data[i].Unread
+		}
+
+		s.respond(w, r, p, http.StatusOK)
+	}
+}
+
+func parseMessageQuery(r *http.Request) (internal.MessageQuery, error) {
+	q, v := internal.MessageQuery{Limit: defaultPageSize}, r.URL.Query()
+
+	var err error
+	if l := v.Get("limit"); l != "" {
+		if q.Limit, err = strconv.Atoi(l); err != nil || q.Limit < 1 || q.Limit > maxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+
+	if b := v.Get("before"); b != "" {
+		if q.Before, err = strconv.ParseInt(b, 10, 64); err != nil || q.Before < 1 {
+			return q, errors.New(`before must be a positive integer`)
+		}
+	}
+	return q, nil
+}
+
+func (s Service) handleGetPresence() http.HandlerFunc {
+	type payload struct {
+		Length int        `json:"length"`
+		Data   []Presence `json:"data"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := s.parseToken(r); err != nil {
+			s.respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		room := chi.URLParam(r, "room")
+		if !roomName.MatchString(room) {
+			s.respond(w, r, errors.New(`room must be 1 to 64 letters, digits, "_" or "-"`), http.StatusBadRequest)
+			return
+		}
+
+		ps := s.hub.Roster(room)
+		s.respond(w, r, payload{Length: len(ps), Data: ps}, http.StatusOK)
+	}
 }
 
-func (s Service) handleChat() http.HandlerFunc {
+// lobby is the room joined by connecting to "/api/v1/chat/"
+const lobby = "lobby"
+
+// roomName matches the names of rooms
+var roomName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// handleChat joins the connection to the named room, or the
+// room in the path if name is empty
+func (s Service) handleChat(name string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		conn, err := websocket.UpgradeHTTP(w, r)
+		if !s.allowOrigin(r) {
+			s.respond(w, r, fmt.Errorf("origin %q is not allowed", r.Header.Get("Origin")), http.StatusForbidden)
+			return
+		}
+
+		room := name
+		if room == "" {
+			room = chi.URLParam(r, "room")
+		}
+
+		if !roomName.MatchString(room) {
+			s.respond(w, r, errors.New(`room must be 1 to 64 letters, digits, "_" or "-"`), http.StatusBadRequest)
+			return
+		}
+
+		// the messages after since are replayed once joined
+		since := int64(-1)
+		if v := r.URL.Query().Get("since"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				s.respond(w, r, errors.New(`since must be a non-negative integer`), http.StatusBadRequest)
+				return
+			}
+			since = n
+		}
+
+		uid, exp, err := s.authenticate(r)
 		if err != nil {
-			s.respond(w, r, err, http.StatusUpgradeRequired)
+			s.respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		active, err := s.sanctions.active(r.Context(), room, uid)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		if active[internal.SanctionBan] {
+			s.respond(w, r, fmt.Errorf("banned from room %q", room), http.StatusForbidden)
 			return
 		}
 
-		defer conn.Close()
+		u, err := s.r.Select(r.Context(), uid)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
 
+		// the upgrader responds to the request if it fails
+		rwc, _, _, err := s.upgrader.Upgrade(r, w)
+		if err != nil {
+			return
+		}
+		defer rwc.Close()
+
+		q := newQueue(s.sendBuffer, s.slowPolicy, &s.hub.stats)
+		c := newClient(newConn(rwc, s.readTimeout, s.writeTimeout), u, q, originOf(r), s.logf)
+		if !s.hub.register(c) {
+			if err := c.c.close(ws.StatusGoingAway, "server is shutting down"); err == nil {
+				c.c.drain()
+			}
+			return
+		}
+		defer s.hub.unregister(c)
+
+		go c.write(s.pingInterval, s.pongTimeout)
+		defer c.close(s.hub)
+
+		// closing starts the closing handshake, that the read loop finishes
+		c.expire = time.AfterFunc(time.Until(exp), func() {
+			_ = c.c.close(ws.StatusPolicyViolation, "token expired")
+		})
+		defer c.expire.Stop()
+
+		var replay func()
+		if since >= 0 {
+			replay = s.replay(r.Context(), c, "", room, since)
+		}
+
+		c.join(s.hub, room, replay)
+		s.broadcast(c, room, s.envelope(c, internal.ChatJoin, room, "", nil))
 		for {
-			msg, _ := conn.ReadString()
-			_ = conn.WriteString(msg)
+			p, op, err := c.c.read()
+			if err == nil {
+				err = s.handleFrame(r.Context(), c, op, p)
+			}
+
+			if err != nil {
+				// the peer may have gone without a close frame
+				if code, reason, ok := closeStatus(err); ok && c.c.close(code, reason) == nil {
+					c.c.drain()
+				}
+				return
+			}
 		}
 	}
 }
 
+// Shutdown sends a close frame to every connection and waits for them to
+// be closed, those still open once ctx is done are closed without waiting.
+// Connections made after Shutdown is called are closed at once.
+func (s Service) Shutdown(ctx context.Context) error { return s.hub.Shutdown(ctx) }
+
 /* WEBSOCKET */
 
 type Service struct {
-	m chi.Router
+	ctx context.Context
+
+	m   chi.Router
+	r   internal.UserRepo
+	c   internal.ChatRepo
+	hub *Hub
+	// records moderation in the audit log when set
+	a         internal.AuditRepo
+	sanctions *sanctions
 
-	respond   func(w http.ResponseWriter, r *http.Request, data any, status int)
-	decode    func(rw http.ResponseWriter, r *http.Request, data any) (err error)
-	created   func(w http.ResponseWriter, r *http.Request, id string)
-	setCookie func(w http.ResponseWriter, cookie *http.Cookie)
+	// access tokens are verified with public
+	public   jwk.Key
+	tickets  *tickets
+	upgrader ws.HTTPUpgrader
+	// origins browsers can connect from, besides the host of the service
+	origins map[string]bool
+	// ids of the users that moderate every room and read the counters
+	admins map[suid.UUID]bool
+
+	// how long a connection can go without sending a frame
+	readTimeout time.Duration
+	// how long a user stays online without sending a frame
+	heartbeatTimeout time.Duration
+	// how long a frame can take to write
+	writeTimeout time.Duration
+	// how often connections are pinged, and how long they have to reply
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	// how many frames can be queued to a connection
+	sendBuffer int
+	slowPolicy SlowPolicy
+
+	respond func(w http.ResponseWriter, r *http.Request, data any, status int)
+	decode  func(rw http.ResponseWriter, r *http.Request, data any) (err error)
+	created func(w http.ResponseWriter, r *http.Request, id string)
 
 	log  func(v ...any)
 	logf func(format string, v ...any)
 }
 
-func NewService(ctx context.Context, m chi.Router) http.Handler {
+type Option func(s *Service)
+
+// WithHeartbeatTimeout sets how long a user stays online in a room
+// without sending a frame, clients send heartbeats more often.
+func WithHeartbeatTimeout(d time.Duration) Option {
+	return func(s *Service) { s.heartbeatTimeout = d }
+}
+
+// WithReadTimeout sets how long a connection can go without
+// sending a frame before it is closed.
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *Service) { s.readTimeout = d }
+}
+
+// WithOrigins allows browsers to connect from the origins,
+// such as "https://www.adoublef.com", besides the host of the service.
+func WithOrigins(origins ...string) Option {
+	return func(s *Service) {
+		for _, o := range origins {
+			s.origins[strings.ToLower(strings.TrimSuffix(strings.TrimSpace(o), "/"))] = true
+		}
+	}
+}
+
+// WithWriteTimeout sets how long a frame can take to write
+// before the connection is closed.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Service) { s.writeTimeout = d }
+}
+
+// WithPingInterval sets how often connections are pinged,
+// they are not pinged if it is zero.
+func WithPingInterval(d time.Duration) Option {
+	return func(s *Service) { s.pingInterval = d }
+}
+
+// WithPongTimeout sets how long a connection has to send any
+// frame back after a ping before it is closed.
+func WithPongTimeout(d time.Duration) Option {
+	return func(s *Service) { s.pongTimeout = d }
+}
+
+// WithSendBuffer sets how many frames can be queued to a connection
+// before the `SlowPolicy` applies. Fewer messages are replayed to fit.
+func WithSendBuffer(n int) Option {
+	return func(s *Service) { s.sendBuffer = n }
+}
+
+// WithSlowPolicy sets what happens to a connection that
+// falls behind, it is `DropSlow` by default.
+func WithSlowPolicy(p SlowPolicy) Option {
+	return func(s *Service) { s.slowPolicy = p }
+}
+
+// WithAudit records moderation in the audit log.
+func WithAudit(a internal.AuditRepo) Option {
+	return func(s *Service) { s.a = a }
+}
+
+// WithAdmins allows the users to moderate every room and
+// read the counters of the connections.
+func WithAdmins(ids ...suid.UUID) Option {
+	return func(s *Service) {
+		for _, id := range ids {
+			s.admins[id] = true
+		}
+	}
+}
+
+// NewService returns the chat service, its connections are
+// closed by `Shutdown` once ctx is done.
+func NewService(ctx context.Context, m chi.Router, r internal.UserRepo, c internal.ChatRepo, public jwk.Key, opts ...Option) http.Handler {
 	s := Service{
-		m:         m,
-		respond:   www.Respond,
-		decode:    www.Decode,
-		created:   www.Created,
-		setCookie: http.SetCookie,
-		log:       log.Println,
-		logf:      log.Printf,
+		ctx:              ctx,
+		m:                m,
+		r:                r,
+		c:                c,
+		sanctions:        newSanctions(c),
+		public:           public,
+		tickets:          newTickets(),
+		origins:          make(map[string]bool),
+		admins:           make(map[suid.UUID]bool),
+		upgrader:         ws.HTTPUpgrader{Protocol: func(p string) bool { return p == protocol }},
+		readTimeout:      defaultReadTimeout,
+		heartbeatTimeout: defaultHeartbeatTimeout,
+		writeTimeout:     defaultWriteTimeout,
+		pingInterval:     defaultPingInterval,
+		pongTimeout:      defaultPongTimeout,
+		sendBuffer:       defaultSendBuffer,
+		slowPolicy:       DropSlow,
+		respond:          www.Respond,
+		decode:           www.Decode,
+		created:          www.Created,
+		log:              log.Println,
+		logf:             log.Printf,
 	}
 
+	for _, o := range opts {
+		o(&s)
+	}
+
+	s.hub = NewHub(s.heartbeatTimeout)
 	s.routes()
 
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+
+			sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+
+			if err := s.Shutdown(sctx); err != nil {
+				s.logf("chat: shutting down: %v", err)
+			}
+		}()
+	}
 	return s
 }
 
+const (
+	defaultReadTimeout      = time.Minute * 5
+	defaultHeartbeatTimeout = time.Second * 30
+	defaultWriteTimeout     = time.Second * 10
+	defaultPingInterval     = time.Second * 30
+	defaultPongTimeout      = time.Second * 10
+	defaultSendBuffer       = 256
+	// how long the peer has to reply to a close frame
+	closeTimeout    = time.Second * 5
+	shutdownTimeout = time.Second * 10
+	auditTimeout    = time.Second * 5
+
+	// most messages replayed to a client, fewer if they
+	// would take up more than half of its send buffer
+	maxReplay = 100
+
+	defaultPageSize = 50
+	maxPageSize     = 200
+
+	// most characters in the reason for a mute, ban or kick
+	maxReasonLength = 512
+)
+
+func (s Service) Context() context.Context {
+	if s.ctx != nil {
+		return s.ctx
+	}
+
+	return context.Background()
+}
+
 func (s Service) ServeHTTP(w http.ResponseWriter, r *http.Request) { s.m.ServeHTTP(w, r) }
 
+// status returns the status code of a domain error,
+// otherwise the fallback is returned
+func (s Service) status(err error, fallback int) int {
+	switch {
+	case errors.Is(err, internal.ErrNotFound):
+		// the account has been deleted since the token was issued
+		return http.StatusUnauthorized
+	case errors.Is(err, internal.ErrTimeout):
+		return http.StatusGatewayTimeout
+	}
+	return fallback
+}
+
 func (s Service) respondStatus(w http.ResponseWriter, r *http.Request, status int) {
 	s.respond(w, r, http.StatusText(status), status)
 }
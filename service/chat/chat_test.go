@@ -1,67 +1,458 @@
 package chat
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/hyphengolang/prelude/http/websocket"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
 	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/hyphengolang/prelude/types/email"
+	"github.com/hyphengolang/prelude/types/password"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+	"secure.adoublef.com/internal/auth"
+	chatclient "secure.adoublef.com/service/chat/client"
+	"secure.adoublef.com/store/memory"
 )
 
 const (
 	applicationJson = "application/json"
 )
 
-var h http.Handler
+var private, public = auth.RS256()
 
-func init() {
+// token returns an access token for the user
+func token(t *testing.T, u *internal.User, exp time.Duration) string {
+	tk, err := auth.Sign(private, &auth.SignOption{
+		Type:       auth.TypeAccess,
+		Expiration: exp,
+		Claims:     map[string]any{"id": u.ID.ShortUUID()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(tk)
+}
+
+// ticketURL returns the url of path with a ticket for the token
+func ticketURL(t *testing.T, srv *httptest.Server, path, token string) string {
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/chat/ticket", nil)
+	req.Header.Set(`Authorization`, `Bearer `+token)
+
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var v struct {
+		Ticket string `json:"ticket"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + path + "?ticket=" + v.Ticket
+}
+
+// addUser adds a user with the name to the repository
+func addUser(t *testing.T, r internal.UserRepo, name string) *internal.User {
+	u := &internal.User{
+		ID:       suid.NewUUID(),
+		Username: "i_am_" + name,
+		Email:    email.Email(name + "@mail.com"),
+		Password: password.Password("p4$$w4rD").MustHash(),
+	}
+
+	if err := r.Insert(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// receive returns the next envelope of the type, skipping the others
+func receive(t *testing.T, c *chatclient.Conn, typ string) internal.Envelope {
+	for {
+		e, err := c.Receive()
+		if err != nil {
+			t.Fatalf("receiving %q: %v", typ, err)
+		}
+
+		if e.Type == typ {
+			return e
+		}
+	}
+}
+
+// receiveEach returns the next envelope of each type, in any order
+func receiveEach(t *testing.T, c *chatclient.Conn, typs ...string) map[string]internal.Envelope {
+	es := make(map[string]internal.Envelope, len(typs))
+	for len(es) < len(typs) {
+		e, err := c.Receive()
+		if err != nil {
+			t.Fatalf("receiving %q: %v", typs, err)
+		}
 
-	h = NewService(context.Background(), chi.NewMux())
+		for _, typ := range typs {
+			if _, ok := es[typ]; !ok && e.Type == typ {
+				es[typ] = e
+			}
+		}
+	}
+	return es
 }
 
 // https://quii.gitbook.io/learn-go-with-tests/build-an-application/websockets
 
 func TestService(t *testing.T) {
 	t.Parallel()
-	is, ctx := is.New(t), context.TODO()
-	_, _ = is, ctx
+	is := is.New(t)
 
-	srv := httptest.NewServer(h)
+	ctx := context.Background()
+	ur := memory.NewUserRepo(ctx)
+	fizz := addUser(t, ur, "fizz")
+
+	s := NewService(ctx, chi.NewMux(), ur, memory.NewChatRepo(), public).(Service)
+	s.logf = t.Logf
+
+	srv := httptest.NewServer(s)
 	t.Cleanup(func() { srv.Close() })
 
-	conn, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/chat/")
+	conn, err := chatclient.Dial(context.Background(), ticketURL(t, srv, "/api/v1/chat/", token(t, fizz, time.Minute)))
 	is.NoErr(err) // failed to upgrade
 
 	t.Cleanup(func() { conn.Close() })
 
+	t.Run("join the lobby", func(t *testing.T) {
+		e := receive(t, conn, internal.ChatJoin)
+		is.Equal(e.Room, lobby)                        // lobby
+		is.Equal(e.From, fizz.ID.ShortUUID().String()) // joined by fizz
+	})
+
 	t.Run("send a message", func(t *testing.T) {
-		input := `Hello Foo`
+		is.NoErr(conn.Send(lobby, "1", `Hello Foo`)) // write to server
+
+		// the ack and the broadcast are queued separately
+		es := receiveEach(t, conn, internal.ChatAck, internal.ChatMessage)
+
+		ack := es[internal.ChatAck]
+		is.Equal(ack.ID, "1") // id given by the client
+
+		var a internal.AckPayload
+		is.NoErr(json.Unmarshal(ack.Payload, &a)) // decode ack
+		is.Equal(a.Seq, int64(1))                 // first message of the lobby
+
+		e := es[internal.ChatMessage]
+		is.Equal(e.ID, a.ID)                           // id given by the server
+		is.Equal(e.Seq, a.Seq)                         // numbered in the room
+		is.Equal(e.V, internal.ChatVersion)            // versioned
+		is.Equal(e.From, fizz.ID.ShortUUID().String()) // sent by fizz
+		is.True(!e.TS.IsZero())                        // time is set
+
+		var m internal.MessagePayload
+		is.NoErr(json.Unmarshal(e.Payload, &m)) // decode message
+		is.Equal(m.Text, `Hello Foo`)           // input == output
+	})
+
+	t.Run("reply with error frames", func(t *testing.T) {
+		errCode := func(e internal.Envelope) string {
+			var ce *internal.ChatErr
+			is.True(errors.As(e.Err(), &ce)) // error frame
+			return ce.Code
+		}
+
+		is.NoErr(conn.SendEnvelope(internal.Envelope{Type: "shout", ID: "2"})) // unknown type
+		e := receive(t, conn, internal.ChatError)
+		is.Equal(e.ID, "2")                               // id given by the client
+		is.Equal(errCode(e), internal.ChatErrUnknownType) // unknown type
+
+		is.NoErr(conn.Send("bar", "3", `Hello Bar`))                                       // not joined
+		is.Equal(errCode(receive(t, conn, internal.ChatError)), internal.ChatErrNotJoined) // not joined
 
-		err = conn.WriteString(input)
-		is.NoErr(err) // write to server
+		is.NoErr(conn.Send(lobby, "4", ""))                                                     // no text
+		is.Equal(errCode(receive(t, conn, internal.ChatError)), internal.ChatErrInvalidPayload) // invalid payload
 
-		var output string
-		output, err = conn.ReadString()
-		is.NoErr(err) // reading echo
+		is.NoErr(conn.Send(lobby, "5", strings.Repeat("a", internal.MaxChatTextLength+1))) // too long
+		is.Equal(errCode(receive(t, conn, internal.ChatError)), internal.ChatErrTooLarge)  // too large
 
-		is.Equal(output, `Hello Foo`) // input == output
+		is.NoErr(conn.Join("fizz buzz"))                                                     // invalid name
+		is.Equal(errCode(receive(t, conn, internal.ChatError)), internal.ChatErrInvalidRoom) // invalid room
 	})
 
-	t.Run("send another message", func(t *testing.T) {
-		input := `Hello Bar`
+	t.Run("join, type in and leave a room", func(t *testing.T) {
+		is.NoErr(conn.Join("bar"))                                  // join
+		is.Equal(receive(t, conn, internal.ChatJoin).Room, "bar")   // joined
+		is.NoErr(conn.Typing("bar"))                                // typing
+		is.Equal(receive(t, conn, internal.ChatTyping).Room, "bar") // broadcast
+		is.NoErr(conn.Leave("bar"))                                 // leave
+		is.Equal(receive(t, conn, internal.ChatLeave).Room, "bar")  // left
+	})
+}
+
+func TestRooms(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	ctx := context.Background()
+	ur := memory.NewUserRepo(ctx)
+	u := addUser(t, ur, "fizz")
+
+	s := NewService(ctx, chi.NewMux(), ur, memory.NewChatRepo(), public).(Service)
+	s.logf = t.Logf
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(func() { srv.Close() })
+	tk := token(t, u, time.Minute)
+
+	dial := func(room string) *chatclient.Conn {
+		conn, err := chatclient.Dial(context.Background(), ticketURL(t, srv, "/api/v1/chat/rooms/"+room, tk))
+		is.NoErr(err) // upgrade
+		return conn
+	}
+
+	// joining is asynchronous to the upgrade
+	wait := func(room string, n int) {
+		for i := 0; i < 100 && s.hub.Members(room) != n; i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		is.Equal(s.hub.Members(room), n) // members of the room
+	}
+
+	text := func(e internal.Envelope) string {
+		var m internal.MessagePayload
+		is.NoErr(json.Unmarshal(e.Payload, &m)) // decode message
+		return m.Text
+	}
+
+	fizz, buzz, bar := dial("fizz"), dial("fizz"), dial("bar")
+	t.Cleanup(func() { fizz.Close(); buzz.Close(); bar.Close() })
+
+	wait("fizz", 2)
+	wait("bar", 1)
 
-		err = conn.WriteJSON(input)
-		is.NoErr(err) // write to server
+	t.Run("broadcast to every member of a room", func(t *testing.T) {
+		is.NoErr(fizz.Send("fizz", "", `Hello Fizz`)) // write to "fizz"
 
-		var output string
-		err := conn.ReadJSON(&output)
-		is.NoErr(err) // reading echo
+		for _, conn := range []*chatclient.Conn{fizz, buzz} {
+			is.Equal(text(receive(t, conn, internal.ChatMessage)), `Hello Fizz`) // every member receives it
+		}
+	})
+
+	t.Run("only members of the room receive its messages", func(t *testing.T) {
+		is.NoErr(fizz.Send("fizz", "", `Hello again`)) // write to "fizz"
+		is.NoErr(bar.Send("bar", "", `Hello Bar`))     // write to "bar"
+
+		is.Equal(text(receive(t, bar, internal.ChatMessage)), `Hello Bar`) // not the message to "fizz"
+	})
+
+	t.Run("leave the room on disconnect", func(t *testing.T) {
+		is.NoErr(buzz.Close()) // disconnect
+		wait("fizz", 1)
+
+		is.NoErr(bar.Close()) // disconnect the last member
+		wait("bar", 0)
+		is.Equal(s.hub.Rooms(), 1) // empty room is removed
+	})
 
-		is.True(output != "")   // not empty
-		is.Equal(output, input) // input == output
+	t.Run("reject invalid room names", func(t *testing.T) {
+		res, err := srv.Client().Get(srv.URL + "/api/v1/chat/rooms/fizz%20buzz")
+		is.NoErr(err)                                   // request
+		is.Equal(res.StatusCode, http.StatusBadRequest) // invalid name
+		res.Body.Close()
 	})
 }
+
+func TestLifecycle(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	ctx := context.Background()
+	ur := memory.NewUserRepo(ctx)
+	u := addUser(t, ur, "fizz")
+
+	s := NewService(ctx, chi.NewMux(), ur, memory.NewChatRepo(), public, WithReadTimeout(time.Millisecond*200)).(Service)
+	s.logf = t.Logf
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(func() { srv.Close() })
+	tk := token(t, u, time.Minute)
+
+	dial := func() net.Conn {
+		conn, br, _, err := ws.Dial(context.Background(), ticketURL(t, srv, "/api/v1/chat/", tk))
+		is.NoErr(err) // upgrade
+		t.Cleanup(func() { conn.Close() })
+		return bufferedConn(conn, br)
+	}
+
+	wait := func(n int) {
+		for i := 0; i < 100 && s.hub.Clients() != n; i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		is.Equal(s.hub.Clients(), n) // connected clients
+	}
+
+	// readClose reads frames until the close frame of the server
+	readClose := func(conn net.Conn) (ws.StatusCode, string) {
+		for {
+			h, err := ws.ReadHeader(conn)
+			is.NoErr(err) // read frame
+
+			p := make([]byte, h.Length)
+			_, err = io.ReadFull(conn, p)
+			is.NoErr(err) // read payload
+
+			if h.OpCode == ws.OpClose {
+				return ws.ParseCloseFrameData(p)
+			}
+		}
+	}
+
+	t.Run("release an abrupt disconnect", func(t *testing.T) {
+		conn := dial()
+		wait(1)
+
+		is.NoErr(conn.Close()) // no close frame
+		wait(0)
+		is.Equal(s.hub.Members(lobby), 0) // left the lobby
+	})
+
+	t.Run("reply to a close frame", func(t *testing.T) {
+		conn := dial()
+		wait(1)
+
+		is.NoErr(wsutil.WriteClientMessage(conn, ws.OpClose, ws.NewCloseFrameBody(ws.StatusNormalClosure, "bye"))) // close
+
+		code, _ := readClose(conn)
+		is.Equal(code, ws.StatusNormalClosure) // echoed
+		wait(0)
+	})
+
+	t.Run("close on invalid utf-8", func(t *testing.T) {
+		conn := dial()
+		wait(1)
+
+		is.NoErr(wsutil.WriteClientText(conn, []byte{0xff, 0xfe})) // invalid text
+
+		code, _ := readClose(conn)
+		is.Equal(code, ws.StatusInvalidFramePayloadData) // 1007
+
+		is.NoErr(wsutil.WriteClientMessage(conn, ws.OpClose, ws.NewCloseFrameBody(code, ""))) // reply
+		wait(0)
+	})
+
+	t.Run("close on binary or large frames", func(t *testing.T) {
+		conn := dial()
+		wait(1)
+
+		is.NoErr(wsutil.WriteClientBinary(conn, []byte(`{}`))) // binary
+
+		code, _ := readClose(conn)
+		is.Equal(code, ws.StatusUnsupportedData) // 1003
+
+		is.NoErr(wsutil.WriteClientMessage(conn, ws.OpClose, ws.NewCloseFrameBody(code, ""))) // reply
+		wait(0)
+
+		conn = dial()
+		wait(1)
+
+		is.NoErr(wsutil.WriteClientText(conn, make([]byte, internal.MaxChatFrameSize+1))) // too large
+
+		code, _ = readClose(conn)
+		is.Equal(code, ws.StatusMessageTooBig) // 1009
+	})
+
+	t.Run("close an idle connection", func(t *testing.T) {
+		conn := dial()
+		wait(1)
+
+		code, reason := readClose(conn)
+		is.Equal(code, ws.StatusGoingAway) // 1001
+		is.Equal(reason, "read timeout")   // idle
+
+		is.NoErr(wsutil.WriteClientMessage(conn, ws.OpClose, ws.NewCloseFrameBody(code, ""))) // reply
+		wait(0)
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	ctx := context.Background()
+	ur := memory.NewUserRepo(ctx)
+	u := addUser(t, ur, "fizz")
+
+	s := NewService(ctx, chi.NewMux(), ur, memory.NewChatRepo(), public).(Service)
+	s.logf = t.Logf
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(func() { srv.Close() })
+	tk := token(t, u, time.Minute)
+
+	dial := func() net.Conn {
+		conn, br, _, err := ws.Dial(context.Background(), ticketURL(t, srv, "/api/v1/chat/", tk))
+		is.NoErr(err) // upgrade
+		t.Cleanup(func() { conn.Close() })
+		return bufferedConn(conn, br)
+	}
+
+	fizz, buzz := dial(), dial()
+	for i := 0; i < 100 && s.hub.Clients() != 2; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	is.Equal(s.hub.Clients(), 2) // connected
+
+	// the reader of the client replies to the close frame of the server
+	for _, conn := range []net.Conn{fizz, buzz} {
+		go func(conn net.Conn) { _ = readClosed(conn) }(conn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	is.NoErr(s.Shutdown(ctx))    // every connection is closed
+	is.Equal(s.hub.Clients(), 0) // none left
+
+	conn := dial()
+	err := readClosed(conn)
+
+	var ce wsutil.ClosedError
+	is.True(errors.As(err, &ce))          // closed at once
+	is.Equal(ce.Code, ws.StatusGoingAway) // 1001
+}
+
+// readClosed reads frames until the server closes the connection, replying
+// to its close frame
+func readClosed(conn net.Conn) error {
+	for {
+		if _, _, err := wsutil.ReadServerData(conn); err != nil {
+			return err
+		}
+	}
+}
+
+// bufferedConn reads from br, which may hold frames sent by
+// the server along with its reply to the upgrade
+func bufferedConn(conn net.Conn, br *bufio.Reader) net.Conn {
+	if br == nil {
+		return conn
+	}
+	return readerConn{conn, br}
+}
+
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readerConn) Read(p []byte) (int, error) { return c.r.Read(p) }
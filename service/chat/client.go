@@ -0,0 +1,197 @@
+package chat
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"secure.adoublef.com/internal"
+)
+
+// client is a connection that has joined one or more rooms. Frames for
+// the client are queued and written by its own goroutine, so that a slow
+// connection does not hold up the others.
+type client struct {
+	c *conn
+	// u is the user that authenticated the connection
+	u    *internal.User
+	q    *queue
+	done chan struct{}
+	// where the connection came from, for the audit log
+	from origin
+
+	// rooms the client has been kicked from, which it has yet to leave
+	mu      sync.Mutex
+	evicted []string
+
+	// only used by the goroutine reading from the connection
+	rooms map[string]*room
+	// closes the connection once the token of the user expires
+	expire *time.Timer
+
+	logf func(format string, v ...any)
+}
+
+func newClient(c *conn, u *internal.User, q *queue, from origin, logf func(format string, v ...any)) *client {
+	return &client{
+		c:     c,
+		u:     u,
+		q:     q,
+		done:  make(chan struct{}),
+		from:  from,
+		rooms: make(map[string]*room),
+		logf:  logf,
+	}
+}
+
+// queue adds m to the frames to be written, the
+// client is dropped if it has fallen too far behind
+func (c *client) queue(m message) {
+	if !c.q.push(m) {
+		c.logf("chat: dropping %s, send queue is full", c.c.rwc.RemoteAddr())
+	}
+}
+
+// write sends queued frames until the client is closed, and a ping every
+// interval unless it is zero. The connection is closed if a write fails,
+// or the peer sends nothing within pongTimeout of a ping, so that reading
+// stops, unless it is closing and waiting on the reply of the peer.
+func (c *client) write(interval, pongTimeout time.Duration) {
+	var ping <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		ping = t.C
+	}
+
+	pt := time.NewTimer(pongTimeout)
+	pt.Stop()
+	defer pt.Stop()
+
+	// set while waiting for the reply to a ping
+	var pong <-chan time.Time
+	var pinged time.Time
+
+	for {
+		select {
+		case <-c.q.ready:
+			ms, full := c.q.take()
+			if full {
+				// the close handshake is finished by the reader, unless
+				// the peer is too far behind to be sent the close frame
+				if err := c.c.close(ws.StatusPolicyViolation, "send queue is full"); err != nil {
+					c.c.Close()
+				}
+				return
+			}
+
+			for _, m := range ms {
+				if err := c.c.write(m.op, m.p); err != nil {
+					c.fail(err)
+					return
+				}
+			}
+		case <-ping:
+			if pong != nil {
+				continue
+			}
+
+			pinged = time.Now()
+			if err := c.c.write(ws.OpPing, nil); err != nil {
+				c.fail(err)
+				return
+			}
+
+			pt.Reset(pongTimeout)
+			pong = pt.C
+		case <-pong:
+			pong = nil
+			if c.c.lastAlive().Before(pinged) {
+				c.q.stats.pingTimeouts.Add(1)
+				c.logf("chat: closing %s, no reply to ping", c.c.rwc.RemoteAddr())
+				c.c.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// fail closes the connection after a failed write, unless it is
+// closing and waiting on the reply of the peer
+func (c *client) fail(err error) {
+	if !errors.Is(err, errClosed) {
+		c.c.Close()
+	}
+}
+
+// join reports false if the client is already a member of the room,
+// see `Hub.join` for replay
+func (c *client) join(h *Hub, name string, replay func()) bool {
+	if _, ok := c.rooms[name]; ok {
+		return false
+	}
+
+	c.rooms[name] = h.join(name, c, replay)
+	return true
+}
+
+func (c *client) joined(name string) bool {
+	_, ok := c.rooms[name]
+	return ok
+}
+
+func (c *client) leave(h *Hub, name string) {
+	if r, ok := c.rooms[name]; ok {
+		h.leave(r, c)
+		delete(c.rooms, name)
+	}
+}
+
+// evict records that the client has been removed from the members of
+// the room by its goroutine, the client leaves it when next pruned
+func (c *client) evict(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evicted = append(c.evicted, name)
+}
+
+// prune leaves the rooms the client has been kicked from,
+// so that it can no longer send to them
+func (c *client) prune(h *Hub) {
+	c.mu.Lock()
+	names := c.evicted
+	c.evicted = nil
+	c.mu.Unlock()
+
+	for _, name := range names {
+		c.leave(h, name)
+	}
+}
+
+// broadcast sends m to every member of a room the client has
+// joined, including the client itself
+func (c *client) broadcast(name string, m message) {
+	if r, ok := c.rooms[name]; ok {
+		r.broadcast <- m
+	}
+}
+
+// typing tells a room the client has joined that it
+// has started or stopped typing
+func (c *client) typing(name string, typing bool) {
+	if r, ok := c.rooms[name]; ok {
+		r.typing <- typist{c, typing}
+	}
+}
+
+// close leaves every room and stops the writer
+func (c *client) close(h *Hub) {
+	for name := range c.rooms {
+		c.leave(h, name)
+	}
+	close(c.done)
+}
@@ -0,0 +1,256 @@
+// Package client speaks the chat protocol, so that other services and
+// tests can connect to chat.
+//
+//	c, err := client.Dial(ctx, "ws://localhost:8080/api/v1/chat/", client.WithToken(token))
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//
+//	if err := c.Send("lobby", "1", "Hello"); err != nil {
+//		return err
+//	}
+//
+//	e, err := c.Receive()
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"secure.adoublef.com/internal"
+)
+
+// Protocol is the subprotocol offered to the server
+const Protocol = "chat"
+
+const writeTimeout = time.Second * 10
+
+type Option func(d *ws.Dialer)
+
+// WithToken passes the access token in the "Authorization" header.
+// A ticket is passed in the url instead, as "?ticket=".
+func WithToken(token string) Option {
+	return WithHeader(http.Header{"Authorization": []string{"Bearer " + token}})
+}
+
+// WithHeader adds the header to the upgrade request
+func WithHeader(h http.Header) Option {
+	return func(d *ws.Dialer) { d.Header = ws.HandshakeHeaderHTTP(h) }
+}
+
+// Conn is a connection to chat. It is safe to send
+// from one goroutine while receiving from another.
+type Conn struct {
+	rwc net.Conn
+	rd  *wsutil.Reader
+
+	// held for the whole of every frame written
+	mu sync.Mutex
+}
+
+// Dial connects to the chat url, failing with a `ws.StatusError` if the
+// server responds to the upgrade with an error
+func Dial(ctx context.Context, url string, opts ...Option) (*Conn, error) {
+	d := ws.Dialer{Protocols: []string{Protocol}}
+	for _, o := range opts {
+		o(&d)
+	}
+
+	rwc, br, _, err := d.Dial(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	// the server may have sent frames along with its reply to the upgrade
+	var src io.Reader = rwc
+	if br != nil {
+		p := make([]byte, br.Buffered())
+		n, _ := br.Read(p)
+		ws.PutReader(br)
+
+		src = io.MultiReader(bytes.NewReader(p[:n]), rwc)
+	}
+
+	c := &Conn{rwc: rwc}
+	c.rd = &wsutil.Reader{
+		Source:         src,
+		State:          ws.StateClientSide,
+		CheckUTF8:      true,
+		OnIntermediate: c.handleControl,
+	}
+	return c, nil
+}
+
+// Receive returns the next envelope from the server, replying to any control
+// frames received before it. Once the server closes the connection the
+// error is a `wsutil.ClosedError` holding the status code.
+func (c *Conn) Receive() (internal.Envelope, error) {
+	var e internal.Envelope
+	for {
+		h, err := c.rd.NextFrame()
+		if err != nil {
+			return e, err
+		}
+
+		if h.OpCode.IsControl() {
+			if err := c.handleControl(h, c.rd); err != nil {
+				return e, err
+			}
+			continue
+		}
+
+		p, err := io.ReadAll(c.rd)
+		if err != nil {
+			return e, err
+		}
+
+		return e, json.Unmarshal(p, &e)
+	}
+}
+
+func (c *Conn) handleControl(h ws.Header, r io.Reader) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.rwc.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	return wsutil.ControlFrameHandler(c.rwc, ws.StateClientSide)(h, r)
+}
+
+// SendEnvelope writes the envelope, setting its version
+func (c *Conn) SendEnvelope(e internal.Envelope) error {
+	e.V = internal.ChatVersion
+	if e.TS.IsZero() {
+		e.TS = time.Now().UTC()
+	}
+
+	p, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return c.write(ws.OpText, p)
+}
+
+// Send sends a message to the room, the server acks it with the id.
+// Sending it again with the same id does not send it twice
+func (c *Conn) Send(room, id, text string) error {
+	return c.send(internal.ChatMessage, room, id, internal.MessagePayload{Text: text})
+}
+
+// SendTo sends a direct message to the user with the short id,
+// the server acks it with the id
+func (c *Conn) SendTo(user, id, text string) error {
+	return c.sendTo(internal.ChatMessage, user, id, internal.MessagePayload{Text: text})
+}
+
+// MarkRead marks the messages of the room read up to seq,
+// the server broadcasts how far the user has read
+func (c *Conn) MarkRead(room string, seq int64) error {
+	return c.send(internal.ChatRead, room, "", internal.ReadPayload{Seq: seq})
+}
+
+// MarkReadWith marks the direct messages with the user with the short id
+// read up to seq, the server sends both users how far the user has read
+func (c *Conn) MarkReadWith(user string, seq int64) error {
+	return c.sendTo(internal.ChatRead, user, "", internal.ReadPayload{Seq: seq})
+}
+
+// Edit replaces the text of a message the user sent to the room, by the id
+// the server gave it. The server broadcasts the edit and acks it with id
+func (c *Conn) Edit(room, id, message, text string) error {
+	return c.send(internal.ChatEdit, room, id, internal.EditPayload{Message: message, Text: text})
+}
+
+// Delete deletes a message of the room, by the id the server gave it. The
+// server broadcasts the deletion and acks it with id
+func (c *Conn) Delete(room, id, message string) error {
+	return c.send(internal.ChatDelete, room, id, internal.EditPayload{Message: message})
+}
+
+// EditTo replaces the text of a direct message the user
+// sent to the user with the short id
+func (c *Conn) EditTo(user, id, message, text string) error {
+	return c.sendTo(internal.ChatEdit, user, id, internal.EditPayload{Message: message, Text: text})
+}
+
+// DeleteTo deletes a direct message the user sent
+// to the user with the short id
+func (c *Conn) DeleteTo(user, id, message string) error {
+	return c.sendTo(internal.ChatDelete, user, id, internal.EditPayload{Message: message})
+}
+
+// Join joins the room, the server broadcasts the join to its members
+func (c *Conn) Join(room string) error { return c.send(internal.ChatJoin, room, "", nil) }
+
+// JoinSince joins the room, the server first sends the
+// messages of the room numbered after since
+func (c *Conn) JoinSince(room string, since int64) error {
+	return c.send(internal.ChatJoin, room, "", internal.JoinPayload{Since: &since})
+}
+
+// Leave leaves the room, the server broadcasts the leave to its members
+func (c *Conn) Leave(room string) error { return c.send(internal.ChatLeave, room, "", nil) }
+
+// Typing tells the members of the room that the user is typing,
+// it is sent again every few seconds while they keep typing
+func (c *Conn) Typing(room string) error { return c.send(internal.ChatTyping, room, "", nil) }
+
+// StopTyping tells the members of the room that the user has stopped typing
+func (c *Conn) StopTyping(room string) error {
+	return c.send(internal.ChatTyping, room, "", internal.TypingPayload{Typing: false})
+}
+
+// Heartbeat keeps the user online when there is nothing else to send
+func (c *Conn) Heartbeat() error { return c.send(internal.ChatHeartbeat, "", "", nil) }
+
+// Auth re-authenticates the connection before its token expires
+func (c *Conn) Auth(token string) error {
+	return c.send(internal.ChatAuth, "", "", internal.AuthPayload{Token: token})
+}
+
+func (c *Conn) send(typ, room, id string, payload any) error {
+	e, err := internal.NewEnvelope(typ, room, payload)
+	if err != nil {
+		return err
+	}
+
+	e.ID = id
+	return c.SendEnvelope(e)
+}
+
+func (c *Conn) sendTo(typ, user, id string, payload any) error {
+	e, err := internal.NewEnvelope(typ, "", payload)
+	if err != nil {
+		return err
+	}
+
+	e.ID, e.To = id, user
+	return c.SendEnvelope(e)
+}
+
+func (c *Conn) write(op ws.OpCode, p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.rwc.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	return wsutil.WriteClientMessage(c.rwc, op, p)
+}
+
+// Close sends a close frame with a normal closure then closes the
+// connection, without waiting for the server to reply
+func (c *Conn) Close() error {
+	_ = c.write(ws.OpClose, ws.NewCloseFrameBody(ws.StatusNormalClosure, ""))
+	return c.rwc.Close()
+}
@@ -0,0 +1,215 @@
+package chat
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"secure.adoublef.com/internal"
+)
+
+// errClosed is returned when writing to a connection that
+// has sent or replied to a close frame
+var errClosed = errors.New(`chat: connection is closing`)
+
+// conn is the server side of a WebSocket connection. Frames are written
+// both by the writer of a client and by the reader, when it replies to a
+// control frame, so every write holds the lock for the whole frame.
+type conn struct {
+	rwc net.Conn
+	rd  *wsutil.Reader
+
+	// how long to wait for the next frame from the peer
+	readTimeout time.Duration
+	// how long a frame can take to write
+	writeTimeout time.Duration
+
+	// unix nanoseconds of the last data frame from the peer, and of the
+	// last frame of any kind, such as a pong
+	active atomic.Int64
+	alive  atomic.Int64
+
+	mu sync.Mutex
+	// set once a close frame has been sent, nothing is written after it
+	closed bool
+}
+
+func newConn(rwc net.Conn, readTimeout, writeTimeout time.Duration) *conn {
+	c := &conn{rwc: rwc, readTimeout: readTimeout, writeTimeout: writeTimeout}
+	c.rd = &wsutil.Reader{
+		Source:         rwc,
+		State:          ws.StateServerSide,
+		CheckUTF8:      true,
+		MaxFrameSize:   internal.MaxChatFrameSize,
+		OnIntermediate: c.handleControl,
+	}
+	now := time.Now().UnixNano()
+	c.active.Store(now)
+	c.alive.Store(now)
+	return c
+}
+
+// read returns the next data message, replying to any control frames
+// received before it. A close frame from the peer is returned as a
+// `wsutil.ClosedError`, once it has been replied to.
+func (c *conn) read() ([]byte, ws.OpCode, error) {
+	for {
+		if err := c.extendReadDeadline(); err != nil {
+			return nil, 0, err
+		}
+
+		h, err := c.rd.NextFrame()
+		if err != nil {
+			return nil, 0, err
+		}
+		now := time.Now().UnixNano()
+		c.alive.Store(now)
+
+		if h.OpCode.IsControl() {
+			if err := c.handleControl(h, c.rd); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		c.active.Store(now)
+
+		// a message can be fragmented over several frames
+		p, err := io.ReadAll(io.LimitReader(c.rd, internal.MaxChatFrameSize+1))
+		if err == nil && len(p) > internal.MaxChatFrameSize {
+			err = wsutil.ErrFrameTooLarge
+		}
+
+		if err == nil && c.isClosed() {
+			// nothing is accepted once the close frame has been sent
+			continue
+		}
+		return p, h.OpCode, err
+	}
+}
+
+// lastActive returns when the peer last sent a data frame
+func (c *conn) lastActive() time.Time { return time.Unix(0, c.active.Load()) }
+
+// lastAlive returns when the peer last sent a frame of any kind
+func (c *conn) lastAlive() time.Time { return time.Unix(0, c.alive.Load()) }
+
+func (c *conn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
+}
+
+// extendReadDeadline gives the peer another read timeout to send a frame,
+// unless the connection is closing and waiting on the reply of the peer
+func (c *conn) extendReadDeadline() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	return c.rwc.SetReadDeadline(time.Now().Add(c.readTimeout))
+}
+
+func (c *conn) handleControl(h ws.Header, r io.Reader) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if h.OpCode == ws.OpClose {
+		// the peer replied to the close frame that was sent
+		if c.closed {
+			p, _ := io.ReadAll(io.LimitReader(r, h.Length))
+			code, reason := ws.ParseCloseFrameData(p)
+			return wsutil.ClosedError{Code: code, Reason: reason}
+		}
+		c.closed = true
+	}
+
+	if err := c.rwc.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+		return err
+	}
+	return wsutil.ControlFrameHandler(c.rwc, ws.StateServerSide)(h, r)
+}
+
+// write sends p as a single frame
+func (c *conn) write(op ws.OpCode, p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errClosed
+	}
+
+	if err := c.rwc.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+		return err
+	}
+	return wsutil.WriteServerMessage(c.rwc, op, p)
+}
+
+// close starts the closing handshake by sending a close frame with the
+// status code. The peer then has the close timeout to reply, after which
+// reading fails and the connection can be closed.
+func (c *conn) close(code ws.StatusCode, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	if err := c.rwc.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+		return err
+	}
+
+	if err := wsutil.WriteServerMessage(c.rwc, ws.OpClose, ws.NewCloseFrameBody(code, reason)); err != nil {
+		return err
+	}
+	return c.rwc.SetReadDeadline(time.Now().Add(closeTimeout))
+}
+
+// drain discards frames until the peer has replied to the close
+// frame, or the close timeout has passed
+func (c *conn) drain() {
+	for {
+		if _, _, err := c.read(); err != nil {
+			return
+		}
+	}
+}
+
+func (c *conn) Close() error { return c.rwc.Close() }
+
+// closeStatus returns the status that a connection is closed with once
+// reading has failed with err. No close frame is sent if the peer has
+// already sent one or has gone without sending one.
+func closeStatus(err error) (code ws.StatusCode, reason string, ok bool) {
+	var (
+		ce wsutil.ClosedError
+		xe closeError
+		pe ws.ProtocolError
+		ne net.Error
+	)
+
+	switch {
+	case errors.As(err, &ce):
+		return 0, "", false
+	case errors.As(err, &xe):
+		return xe.code, xe.reason, true
+	case errors.Is(err, wsutil.ErrInvalidUTF8):
+		return ws.StatusInvalidFramePayloadData, "invalid utf-8", true
+	case errors.Is(err, wsutil.ErrFrameTooLarge):
+		return ws.StatusMessageTooBig, "message too big", true
+	case errors.As(err, &pe):
+		return ws.StatusProtocolError, pe.Error(), true
+	case errors.As(err, &ne) && ne.Timeout():
+		return ws.StatusGoingAway, "read timeout", true
+	}
+	return 0, "", false
+}
@@ -0,0 +1,370 @@
+package chat
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/hyphengolang/prelude/types/suid"
+)
+
+// Hub tracks the clients that are connected and the rooms they have joined.
+//
+// Each room runs its own goroutine that owns the set of its members and
+// who is online, so a broadcast is a send on a channel and takes no locks. The hub is only
+// locked to find or create a room when a client joins, and to remove an
+// empty room when the last client leaves.
+type Hub struct {
+	mu      sync.Mutex
+	rooms   map[string]*room
+	clients map[*client]bool
+	// connections of each user, who are sent their direct messages
+	users map[suid.UUID]map[*client]bool
+	// set once the hub is shutting down, no more clients are registered
+	closing bool
+	wg      sync.WaitGroup
+
+	// how long a user stays online in a room without sending a frame
+	heartbeat time.Duration
+	stats     counters
+
+	// held while a direct message is stored and delivered, a lock is
+	// shared by several pairs of users but always the same one
+	direct [32]sync.Mutex
+}
+
+func NewHub(heartbeat time.Duration) *Hub {
+	return &Hub{
+		rooms:     make(map[string]*room),
+		clients:   make(map[*client]bool),
+		users:     make(map[suid.UUID]map[*client]bool),
+		heartbeat: heartbeat,
+	}
+}
+
+// Clients returns the number of clients that are connected
+func (h *Hub) Clients() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.clients)
+}
+
+// register tracks c until it is unregistered, reporting
+// false if the hub is shutting down
+func (h *Hub) register(c *client) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closing {
+		return false
+	}
+
+	h.clients[c] = true
+	if h.users[c.u.ID] == nil {
+		h.users[c.u.ID] = make(map[*client]bool)
+	}
+	h.users[c.u.ID][c] = true
+
+	h.wg.Add(1)
+	return true
+}
+
+func (h *Hub) unregister(c *client) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	if delete(h.users[c.u.ID], c); len(h.users[c.u.ID]) == 0 {
+		delete(h.users, c.u.ID)
+	}
+	h.mu.Unlock()
+
+	h.wg.Done()
+}
+
+// deliver queues m to every connection of the users
+func (h *Hub) deliver(m message, uids ...suid.UUID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, uid := range uids {
+		for c := range h.users[uid] {
+			c.queue(m)
+		}
+	}
+}
+
+// directLock returns the lock of the direct room
+func (h *Hub) directLock(room string) *sync.Mutex {
+	f := fnv.New32a()
+	f.Write([]byte(room))
+	return &h.direct[f.Sum32()%uint32(len(h.direct))]
+}
+
+// Shutdown sends a close frame to every client and waits for them to be
+// unregistered. Once ctx is done the remaining connections are closed.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.closing = true
+	cs := make([]*client, 0, len(h.clients))
+	for c := range h.clients {
+		cs = append(cs, c)
+	}
+	h.mu.Unlock()
+
+	for _, c := range cs {
+		_ = c.c.close(ws.StatusGoingAway, "server is shutting down")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, c := range cs {
+			c.c.Close()
+		}
+		return ctx.Err()
+	}
+}
+
+// Stats are counters of the hub, to tell how far behind clients are
+type Stats struct {
+	Clients int `json:"clients"`
+	Rooms   int `json:"rooms"`
+	// frames waiting to be written, across every client and to
+	// the client furthest behind
+	QueueDepth    int `json:"queueDepth"`
+	MaxQueueDepth int `json:"maxQueueDepth"`
+	// frames replaced by a newer one, see `CoalesceSlow`
+	Coalesced int64 `json:"coalesced"`
+	// clients closed because their queue was full, and
+	// the frames that were discarded with them
+	Dropped   int64 `json:"dropped"`
+	Discarded int64 `json:"discarded"`
+	// clients closed because they did not answer a ping
+	PingTimeouts int64 `json:"pingTimeouts"`
+}
+
+func (h *Hub) Stats() Stats {
+	h.mu.Lock()
+	st := Stats{Clients: len(h.clients), Rooms: len(h.rooms)}
+	for c := range h.clients {
+		n := c.q.len()
+		st.QueueDepth += n
+		if n > st.MaxQueueDepth {
+			st.MaxQueueDepth = n
+		}
+	}
+	h.mu.Unlock()
+
+	st.Coalesced = h.stats.coalesced.Load()
+	st.Dropped = h.stats.dropped.Load()
+	st.Discarded = h.stats.discarded.Load()
+	st.PingTimeouts = h.stats.pingTimeouts.Load()
+	return st
+}
+
+// Rooms returns the number of rooms with at least one member
+func (h *Hub) Rooms() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.rooms)
+}
+
+// Members returns the number of clients that have joined the room
+func (h *Hub) Members(name string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if r, ok := h.rooms[name]; ok {
+		return r.n
+	}
+	return 0
+}
+
+// Roster returns the users online in the room
+func (h *Hub) Roster(name string) []Presence {
+	h.mu.Lock()
+	r, ok := h.rooms[name]
+	h.mu.Unlock()
+
+	if !ok {
+		return []Presence{}
+	}
+
+	ch := make(chan []Presence, 1)
+	select {
+	case r.roster <- ch:
+		return <-ch
+	case <-r.done:
+		// the last member left after the room was found
+		return []Presence{}
+	}
+}
+
+// send queues m to the members of the room, if it has any
+func (h *Hub) send(name string, m message) {
+	h.mu.Lock()
+	r, ok := h.rooms[name]
+	h.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	select {
+	case r.broadcast <- m:
+	case <-r.done:
+	}
+}
+
+// kick queues m to the members of the room, then removes every
+// connection of the user from it. Each is left once its client
+// reads another frame, see `client.prune`.
+func (h *Hub) kick(name string, uid suid.UUID, m message) {
+	h.mu.Lock()
+	r, ok := h.rooms[name]
+	h.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	select {
+	case r.kick <- eviction{uid, m}:
+	case <-r.done:
+	}
+}
+
+// join adds c to the room, which is created if it has no members. If
+// replay is not nil it is called once c is a member, before another
+// message can be stored in the room.
+func (h *Hub) join(name string, c *client, replay func()) *room {
+	h.mu.Lock()
+	r, ok := h.rooms[name]
+	if !ok {
+		r = newRoom(name, h.heartbeat)
+		h.rooms[name] = r
+		go r.run()
+	}
+	r.n++
+	h.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.join <- c
+	if replay != nil {
+		replay()
+	}
+	return r
+}
+
+// leave removes c from the room, which is stopped once empty
+func (h *Hub) leave(r *room, c *client) {
+	r.leave <- c
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if r.n--; r.n == 0 {
+		delete(h.rooms, r.name)
+		close(r.done)
+	}
+}
+
+// message is a frame to be sent to the members of a room
+type message struct {
+	op ws.OpCode
+	p  []byte
+	// frames with the same key can be coalesced, see `CoalesceSlow`
+	key string
+}
+
+type room struct {
+	name string
+	// number of members, guarded by the lock of the hub
+	n int
+
+	// held while a message is stored and broadcast, so members get them
+	// in the order they are numbered, and while a member that has just
+	// joined is sent those it missed
+	mu sync.Mutex
+
+	join      chan *client
+	leave     chan *client
+	typing    chan typist
+	roster    chan chan []Presence
+	broadcast chan message
+	kick      chan eviction
+	done      chan struct{}
+
+	heartbeat time.Duration
+}
+
+// eviction removes the connections of a user
+// from a room, once its members are sent m
+type eviction struct {
+	uid suid.UUID
+	m   message
+}
+
+// typist is a member that has started or stopped typing
+type typist struct {
+	c      *client
+	typing bool
+}
+
+func newRoom(name string, heartbeat time.Duration) *room {
+	return &room{
+		name:      name,
+		join:      make(chan *client),
+		leave:     make(chan *client),
+		typing:    make(chan typist),
+		roster:    make(chan chan []Presence),
+		broadcast: make(chan message),
+		kick:      make(chan eviction),
+		done:      make(chan struct{}),
+		heartbeat: heartbeat,
+	}
+}
+
+// run owns the members of the room until it is empty. Messages are
+// queued to each member in turn, a member that has fallen behind
+// misses the message rather than holding up the others.
+func (r *room) run() {
+	p := newPresence(r.name, r.heartbeat)
+
+	t := time.NewTicker(sweepInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case c := <-r.join:
+			p.join(c)
+		case c := <-r.leave:
+			p.leave(c)
+		case tp := <-r.typing:
+			p.setTyping(tp.c, tp.typing)
+		case ch := <-r.roster:
+			ch <- p.roster()
+		case m := <-r.broadcast:
+			p.send(m)
+		case ev := <-r.kick:
+			p.send(ev.m)
+			p.evict(ev.uid)
+		case now := <-t.C:
+			p.sweep(now)
+		case <-r.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,716 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+/*
+Get the users of a room that have a role, the owner first
+
+	[ ] GET /api/v1/chat/rooms/{room}/roles
+
+Set the role of a user in a room with {"role":"moderator"}. The user that
+sent the first message of a room other than the lobby claims it by making
+themself its owner, who then makes others moderators. Admins set any role,
+and make the owner of a room that has none
+
+	[ ] PUT /api/v1/chat/rooms/{room}/roles/{user}
+
+Mute or ban a user of a room with {"duration":"10m","reason":"..."}, until
+lifted if there is no duration. Moderators only, as are the rest
+
+	[ ] PUT /api/v1/chat/rooms/{room}/mutes/{user}
+	[ ] PUT /api/v1/chat/rooms/{room}/bans/{user}
+
+Lift the mute or ban of a user
+
+	[ ] DELETE /api/v1/chat/rooms/{room}/mutes/{user}
+	[ ] DELETE /api/v1/chat/rooms/{room}/bans/{user}
+
+Remove every connection of a user from a room, they can join it again
+
+	[ ] POST /api/v1/chat/rooms/{room}/kicks/{user}
+
+Get the mutes and bans of a room that have not expired
+
+	[ ] GET /api/v1/chat/rooms/{room}/sanctions
+
+Get the earlier versions of a message, oldest first. Only the two users
+read those of a direct message, and only moderators those of a deleted
+message, which include the text it had
+
+	[ ] GET /api/v1/chat/messages/{id}/edits
+
+Moderators outrank members, the owner outranks moderators and admins
+outrank everyone, a user only acts on those they outrank. Members of the
+room are sent a "moderation" envelope for each action, and every action
+is recorded in the audit log.
+*/
+func (s Service) moderationRoutes(r chi.Router) {
+	r.Get("/rooms/{room}/roles", s.handleGetRoleList())
+	r.Put("/rooms/{room}/roles/{user}", s.handleSetRole())
+	r.Put("/rooms/{room}/mutes/{user}", s.handleSanction(internal.SanctionMute))
+	r.Put("/rooms/{room}/bans/{user}", s.handleSanction(internal.SanctionBan))
+	r.Delete("/rooms/{room}/mutes/{user}", s.handleLift(internal.SanctionMute))
+	r.Delete("/rooms/{room}/bans/{user}", s.handleLift(internal.SanctionBan))
+	r.Post("/rooms/{room}/kicks/{user}", s.handleKick())
+	r.Get("/rooms/{room}/sanctions", s.handleGetSanctionList())
+	r.Get("/messages/{id}/edits", s.handleGetEditList())
+}
+
+// ranks of users in a room, each can moderate those ranked below
+const (
+	rankMember = iota
+	rankModerator
+	rankOwner
+	rankAdmin
+)
+
+// rank returns the rank of the user in the room
+func (s Service) rank(ctx context.Context, room string, uid suid.UUID) (int, error) {
+	if s.admins[uid] {
+		return rankAdmin, nil
+	}
+
+	rs, err := s.c.SelectRoles(ctx, room)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, rr := range rs {
+		if rr.User != uid {
+			continue
+		}
+
+		switch rr.Role {
+		case internal.RoleOwner:
+			return rankOwner, nil
+		case internal.RoleModerator:
+			return rankModerator, nil
+		}
+	}
+	return rankMember, nil
+}
+
+// isCreator reports whether the user sent the first message of the
+// room, which created it
+func (s Service) isCreator(ctx context.Context, room string, uid suid.UUID) (bool, error) {
+	ms, err := s.c.SelectMessages(ctx, internal.MessageQuery{Room: room, Ascending: true, Limit: 1})
+	if err != nil || len(ms) == 0 {
+		return false, err
+	}
+	return ms[0].Sender == uid, nil
+}
+
+// sanctionsTTL is how long the sanctions of a room are cached, so that
+// those set through another instance of the service are seen
+const sanctionsTTL = time.Minute
+
+// sanctions caches the sanctions of each room that has been checked,
+// so that sending a message does not read them from the store
+type sanctions struct {
+	c internal.ChatRepo
+
+	// guards the rooms, it is never held while the store is read
+	mu    sync.Mutex
+	rooms map[string]*roomSanctions
+	swept time.Time
+}
+
+// roomSanctions are the sanctions of a room, read once by the first
+// user to check them while the others wait
+type roomSanctions struct {
+	// closed once the fields below are set
+	done   chan struct{}
+	ss     []internal.Sanction
+	err    error
+	readAt time.Time
+}
+
+// expired reports whether the sanctions have been read and are stale
+func (rs *roomSanctions) expired(now time.Time) bool {
+	select {
+	case <-rs.done:
+		return now.Sub(rs.readAt) > sanctionsTTL
+	default:
+		return false
+	}
+}
+
+func newSanctions(c internal.ChatRepo) *sanctions {
+	return &sanctions{c: c, rooms: make(map[string]*roomSanctions)}
+}
+
+// active returns the kinds of sanction the user has in the room
+func (s *sanctions) active(ctx context.Context, room string, uid suid.UUID) (map[string]bool, error) {
+	ss, err := s.load(ctx, room)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	kinds := make(map[string]bool)
+	for _, sn := range ss {
+		if sn.User == uid && sn.Active(now) {
+			kinds[sn.Kind] = true
+		}
+	}
+	return kinds, nil
+}
+
+// load returns the sanctions of the room, reading them from the
+// store if they are not cached or have expired
+func (s *sanctions) load(ctx context.Context, room string) ([]internal.Sanction, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	rs, ok := s.rooms[room]
+	if ok && !rs.expired(now) {
+		s.mu.Unlock()
+
+		select {
+		case <-rs.done:
+			return rs.ss, rs.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	rs = &roomSanctions{done: make(chan struct{})}
+	s.rooms[room] = rs
+	s.sweep(now)
+	s.mu.Unlock()
+
+	rs.ss, rs.err = s.c.SelectSanctions(ctx, room)
+	rs.readAt = time.Now()
+	close(rs.done)
+
+	if rs.err != nil {
+		// the next user to check reads the room again
+		s.drop(room, rs)
+	}
+	return rs.ss, rs.err
+}
+
+// sweep removes the rooms that have expired, at most once in each TTL so
+// that rooms no longer checked are not kept. The caller holds mu.
+func (s *sanctions) sweep(now time.Time) {
+	if now.Sub(s.swept) < sanctionsTTL {
+		return
+	}
+	s.swept = now
+
+	for room, rs := range s.rooms {
+		if rs.expired(now) {
+			delete(s.rooms, room)
+		}
+	}
+}
+
+// drop removes the sanctions of the room if they are still rs
+func (s *sanctions) drop(room string, rs *roomSanctions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rooms[room] == rs {
+		delete(s.rooms, room)
+	}
+}
+
+// forget drops the room from the cache once its sanctions have changed
+func (s *sanctions) forget(room string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.rooms, room)
+}
+
+// origin is where a request came from, as recorded in the audit log
+type origin struct {
+	ip, userAgent string
+}
+
+func originOf(r *http.Request) origin {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return origin{ip, r.UserAgent()}
+}
+
+// audit appends an event for a moderation action. The request may have
+// been cancelled so the service context is used, failures are only
+// logged as they should not change the outcome of the action.
+func (s Service) audit(from origin, action, outcome string, actor, target suid.UUID) {
+	if s.a == nil {
+		return
+	}
+
+	e := internal.AuditEvent{
+		ID:        suid.NewUUID(),
+		Actor:     actor.ShortUUID().String(),
+		Action:    action,
+		Target:    target.ShortUUID().String(),
+		IP:        from.ip,
+		UserAgent: from.userAgent,
+		Outcome:   outcome,
+	}
+
+	ctx, cancel := context.WithTimeout(s.Context(), auditTimeout)
+	defer cancel()
+
+	if err := s.a.Append(ctx, &e); err != nil {
+		s.logf("chat: appending audit event %q: %v", action, err)
+	}
+}
+
+// outcome returns the outcome of an action that failed with err
+func outcome(err error) string {
+	if err != nil {
+		return internal.OutcomeFailure
+	}
+	return internal.OutcomeSuccess
+}
+
+// moderation returns the frame sent to the members of a room about an
+// action taken by a moderator. Unlike other events it is never coalesced.
+func moderation(room string, by suid.UUID, p internal.ModerationPayload) message {
+	m := event(internal.ChatModeration, room, by, p)
+	m.key = ""
+	return m
+}
+
+// Role is the role of a user in a room, the user is a short uuid
+type Role struct {
+	User string `json:"user"`
+	Role string `json:"role"`
+}
+
+func (s Service) handleGetRoleList() http.HandlerFunc {
+	type payload struct {
+		Length int    `json:"length"`
+		Data   []Role `json:"data"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := s.parseUser(r); err != nil {
+			s.respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		room := chi.URLParam(r, "room")
+		if !roomName.MatchString(room) {
+			s.respond(w, r, errors.New(`room must be 1 to 64 letters, digits, "_" or "-"`), http.StatusBadRequest)
+			return
+		}
+
+		rs, err := s.c.SelectRoles(r.Context(), room)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		p := payload{Length: len(rs), Data: make([]Role, len(rs))}
+		for i, rr := range rs {
+			p.Data[i] = Role{User: rr.User.ShortUUID().String(), Role: rr.Role}
+		}
+
+		s.respond(w, r, p, http.StatusOK)
+	}
+}
+
+// handleSetRole sets the role of a user. A user can step down from their
+// role, and make themself the owner of a room that has none if they sent
+// its first message. Otherwise only the owner and admins set roles, of
+// users they outrank.
+func (s Service) handleSetRole() http.HandlerFunc {
+	type request struct {
+		Role string `json:"role"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, actor, target, ok := s.parseModeration(w, r)
+		if !ok {
+			return
+		}
+
+		var d request
+		if err := s.decode(w, r, &d); err != nil {
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		switch d.Role {
+		case internal.RoleOwner, internal.RoleModerator, internal.RoleMember:
+		default:
+			s.respond(w, r, errors.New(`role must be "owner", "moderator" or "member"`), http.StatusBadRequest)
+			return
+		}
+
+		allowed := actor == target && d.Role == internal.RoleMember
+		if !allowed && actor == target && d.Role == internal.RoleOwner && room != lobby {
+			var err error
+			if allowed, err = s.isCreator(r.Context(), room, actor); err != nil {
+				s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+				return
+			}
+		}
+
+		if !allowed {
+			var err error
+			if allowed, err = s.outranks(r.Context(), room, actor, target, rankOwner); err != nil {
+				s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+				return
+			}
+		}
+
+		if !allowed {
+			s.audit(originOf(r), internal.ActionChatRole, internal.OutcomeFailure, actor, target)
+			s.respondStatus(w, r, http.StatusForbidden)
+			return
+		}
+
+		err := s.c.SetRole(r.Context(), internal.RoomRole{Room: room, User: target, Role: d.Role})
+		s.audit(originOf(r), internal.ActionChatRole, outcome(err), actor, target)
+		switch {
+		case errors.Is(err, internal.ErrAlreadyExists):
+			s.respond(w, r, fmt.Errorf("room %q already has an owner", room), http.StatusConflict)
+			return
+		case err != nil:
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		s.respond(w, r, Role{User: target.ShortUUID().String(), Role: d.Role}, http.StatusOK)
+	}
+}
+
+// Sanction is a mute or ban of a user of a room, the ids are short uuids
+type Sanction struct {
+	User      string     `json:"user"`
+	Kind      string     `json:"kind"`
+	By        string     `json:"by"`
+	Reason    string     `json:"reason,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+func newSanction(sn *internal.Sanction) Sanction {
+	return Sanction{
+		User:      sn.User.ShortUUID().String(),
+		Kind:      sn.Kind,
+		By:        sn.By.ShortUUID().String(),
+		Reason:    sn.Reason,
+		ExpiresAt: sn.ExpiresAt,
+		CreatedAt: sn.CreatedAt,
+	}
+}
+
+// sanctionRequest is the optional body of a mute, ban or kick
+type sanctionRequest struct {
+	Duration string `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// decodeSanction decodes the body of the request, which may be empty,
+// and returns when a sanction that starts now expires
+func (s Service) decodeSanction(w http.ResponseWriter, r *http.Request) (sanctionRequest, *time.Time, error) {
+	var d sanctionRequest
+	if err := s.decode(w, r, &d); err != nil && !errors.Is(err, io.EOF) {
+		return d, nil, err
+	}
+
+	if utf8.RuneCountInString(d.Reason) > maxReasonLength {
+		return d, nil, fmt.Errorf("reason is longer than %d characters", maxReasonLength)
+	}
+
+	if d.Duration == "" {
+		return d, nil, nil
+	}
+
+	dur, err := time.ParseDuration(d.Duration)
+	if err != nil || dur <= 0 {
+		return d, nil, errors.New(`duration must be positive, such as "10m"`)
+	}
+
+	exp := time.Now().Add(dur).UTC().Truncate(time.Microsecond)
+	return d, &exp, nil
+}
+
+// handleSanction mutes or bans a user of the room, a banned
+// user is also removed from the room
+func (s Service) handleSanction(kind string) http.HandlerFunc {
+	action, act := internal.ActionChatMute, internal.ModerationMute
+	if kind == internal.SanctionBan {
+		action, act = internal.ActionChatBan, internal.ModerationBan
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, actor, target, ok := s.authorizeModeration(w, r, action)
+		if !ok {
+			return
+		}
+
+		d, exp, err := s.decodeSanction(w, r)
+		if err != nil {
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		sn := internal.Sanction{Room: room, User: target, Kind: kind, By: actor, Reason: d.Reason, ExpiresAt: exp}
+		err = s.c.InsertSanction(r.Context(), &sn)
+		s.audit(originOf(r), action, outcome(err), actor, target)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+		s.sanctions.forget(room)
+
+		m := moderation(room, actor, internal.ModerationPayload{Action: act, User: target.ShortUUID().String(), Reason: d.Reason, ExpiresAt: exp})
+		if kind == internal.SanctionBan {
+			s.hub.kick(room, target, m)
+		} else {
+			s.hub.send(room, m)
+		}
+
+		s.respond(w, r, newSanction(&sn), http.StatusOK)
+	}
+}
+
+// handleLift lifts the mute or ban of a user of the room
+func (s Service) handleLift(kind string) http.HandlerFunc {
+	action, act := internal.ActionChatUnmute, internal.ModerationUnmute
+	if kind == internal.SanctionBan {
+		action, act = internal.ActionChatUnban, internal.ModerationUnban
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, actor, target, ok := s.authorizeModeration(w, r, action)
+		if !ok {
+			return
+		}
+
+		err := s.c.DeleteSanction(r.Context(), room, target, kind)
+		s.audit(originOf(r), action, outcome(err), actor, target)
+		switch {
+		case errors.Is(err, internal.ErrNotFound):
+			s.respond(w, r, fmt.Errorf("user has no %s in room %q", kind, room), http.StatusNotFound)
+			return
+		case err != nil:
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+		s.sanctions.forget(room)
+
+		s.hub.send(room, moderation(room, actor, internal.ModerationPayload{Action: act, User: target.ShortUUID().String()}))
+		s.respondStatus(w, r, http.StatusOK)
+	}
+}
+
+// handleKick removes every connection of a user from the room
+func (s Service) handleKick() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, actor, target, ok := s.authorizeModeration(w, r, internal.ActionChatKick)
+		if !ok {
+			return
+		}
+
+		d, _, err := s.decodeSanction(w, r)
+		if err != nil {
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		s.audit(originOf(r), internal.ActionChatKick, internal.OutcomeSuccess, actor, target)
+		s.hub.kick(room, target, moderation(room, actor, internal.ModerationPayload{Action: internal.ModerationKick, User: target.ShortUUID().String(), Reason: d.Reason}))
+		s.respondStatus(w, r, http.StatusOK)
+	}
+}
+
+func (s Service) handleGetSanctionList() http.HandlerFunc {
+	type payload struct {
+		Length int        `json:"length"`
+		Data   []Sanction `json:"data"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, err := s.parseUser(r)
+		if err != nil {
+			s.respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		room := chi.URLParam(r, "room")
+		if !roomName.MatchString(room) {
+			s.respond(w, r, errors.New(`room must be 1 to 64 letters, digits, "_" or "-"`), http.StatusBadRequest)
+			return
+		}
+
+		rank, err := s.rank(r.Context(), room, uid)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		if rank < rankModerator {
+			s.respondStatus(w, r, http.StatusForbidden)
+			return
+		}
+
+		ss, err := s.c.SelectSanctions(r.Context(), room)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		p := payload{Length: len(ss), Data: make([]Sanction, len(ss))}
+		for i := range ss {
+			p.Data[i] = newSanction(&ss[i])
+		}
+
+		s.respond(w, r, p, http.StatusOK)
+	}
+}
+
+// Edit is an earlier version of a message, written at CreatedAt
+type Edit struct {
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (s Service) handleGetEditList() http.HandlerFunc {
+	type payload struct {
+		Length int    `json:"length"`
+		Data   []Edit `json:"data"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, err := s.parseUser(r)
+		if err != nil {
+			s.respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		id, err := suid.ParseString(chi.URLParam(r, "id"))
+		if err != nil {
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		m, err := s.c.SelectMessage(r.Context(), id)
+		if err != nil && !errors.Is(err, internal.ErrNotFound) {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		// a direct message is not found by anyone else
+		a, b, direct := internal.ParseDirectRoom(m.Room)
+		if err != nil || direct && uid != a && uid != b {
+			s.respond(w, r, fmt.Errorf("message %q not found", chi.URLParam(r, "id")), http.StatusNotFound)
+			return
+		}
+
+		// the text of a deleted message is only read by moderators
+		if m.DeletedAt != nil {
+			rank, err := s.rank(r.Context(), m.Room, uid)
+			if err != nil {
+				s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+				return
+			}
+
+			if rank < rankModerator {
+				s.respondStatus(w, r, http.StatusForbidden)
+				return
+			}
+		}
+
+		es, err := s.c.SelectEdits(r.Context(), id)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		p := payload{Length: len(es), Data: make([]Edit, len(es))}
+		for i, e := range es {
+			p.Data[i] = Edit{Text: e.Text, CreatedAt: e.CreatedAt}
+		}
+
+		s.respond(w, r, p, http.StatusOK)
+	}
+}
+
+// parseModeration returns the room and the user in the path, and the user
+// making the request, responding with an error if any is not valid
+func (s Service) parseModeration(w http.ResponseWriter, r *http.Request) (room string, actor, target suid.UUID, ok bool) {
+	actor, err := s.parseUser(r)
+	if err != nil {
+		s.respond(w, r, err, http.StatusUnauthorized)
+		return "", actor, target, false
+	}
+
+	room = chi.URLParam(r, "room")
+	if !roomName.MatchString(room) {
+		s.respond(w, r, errors.New(`room must be 1 to 64 letters, digits, "_" or "-"`), http.StatusBadRequest)
+		return "", actor, target, false
+	}
+
+	if target, err = suid.ParseString(chi.URLParam(r, "user")); err != nil {
+		s.respond(w, r, err, http.StatusBadRequest)
+		return "", actor, target, false
+	}
+	return room, actor, target, true
+}
+
+// authorizeModeration is `parseModeration` for a mute, ban or kick, which
+// the user making the request must be a moderator to take against a user
+// they outrank. A refusal is recorded in the audit log as the action.
+func (s Service) authorizeModeration(w http.ResponseWriter, r *http.Request, action string) (room string, actor, target suid.UUID, ok bool) {
+	if room, actor, target, ok = s.parseModeration(w, r); !ok {
+		return
+	}
+
+	if actor == target {
+		s.respond(w, r, errors.New("cannot moderate yourself"), http.StatusBadRequest)
+		return "", actor, target, false
+	}
+
+	allowed, err := s.outranks(r.Context(), room, actor, target, rankModerator)
+	if err != nil {
+		s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+		return "", actor, target, false
+	}
+
+	if !allowed {
+		s.audit(originOf(r), action, internal.OutcomeFailure, actor, target)
+		s.respondStatus(w, r, http.StatusForbidden)
+		return "", actor, target, false
+	}
+	return room, actor, target, true
+}
+
+// outranks reports whether the actor is at least of rank
+// least in the room and outranks the target
+func (s Service) outranks(ctx context.Context, room string, actor, target suid.UUID, least int) (bool, error) {
+	ra, err := s.rank(ctx, room, actor)
+	if err != nil || ra < least {
+		return false, err
+	}
+
+	rt, err := s.rank(ctx, room, target)
+	if err != nil {
+		return false, err
+	}
+	return ra > rt, nil
+}
@@ -0,0 +1,346 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gobwas/ws"
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+	chatclient "secure.adoublef.com/service/chat/client"
+	"secure.adoublef.com/store/memory"
+)
+
+func TestModeration(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	ctx := context.Background()
+	admin := &internal.User{ID: suid.NewUUID()}
+	audit := memory.NewAuditRepo(ctx, false)
+
+	ur := memory.NewUserRepo(ctx)
+	fizz := addUser(t, ur, "fizz")
+
+	s := NewService(ctx, chi.NewMux(), ur, memory.NewChatRepo(), public, WithAudit(audit), WithAdmins(admin.ID)).(Service)
+	s.logf = t.Logf
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(func() { srv.Close() })
+	buzz, bar := addUser(t, ur, "buzz"), addUser(t, ur, "bar")
+
+	dial := func(u *internal.User, path string) (*chatclient.Conn, int) {
+		conn, err := chatclient.Dial(ctx, ticketURL(t, srv, path, token(t, u, time.Minute)))
+		var se ws.StatusError
+		if errors.As(err, &se) {
+			return nil, int(se)
+		}
+		is.NoErr(err) // upgrade
+		t.Cleanup(func() { conn.Close() })
+		return conn, http.StatusSwitchingProtocols
+	}
+
+	do := func(method, path string, u *internal.User, body string, v any) int {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set(`Authorization`, `Bearer `+token(t, u, time.Minute))
+		req.Header.Set(`Content-Type`, applicationJson)
+
+		res, err := srv.Client().Do(req)
+		is.NoErr(err) // request
+		defer res.Body.Close()
+
+		if v != nil && res.StatusCode == http.StatusOK {
+			is.NoErr(json.NewDecoder(res.Body).Decode(v)) // decode
+		}
+		return res.StatusCode
+	}
+
+	ack := func(c *chatclient.Conn, id string) internal.AckPayload {
+		for {
+			if e := receive(t, c, internal.ChatAck); e.ID == id {
+				var a internal.AckPayload
+				is.NoErr(json.Unmarshal(e.Payload, &a)) // decode ack
+				return a
+			}
+		}
+	}
+
+	code := func(c *chatclient.Conn, id string) string {
+		for {
+			if e := receive(t, c, internal.ChatError); e.ID == id {
+				var ce *internal.ChatErr
+				is.True(errors.As(e.Err(), &ce)) // error frame
+				return ce.Code
+			}
+		}
+	}
+
+	moderated := func(c *chatclient.Conn, action string) internal.ModerationPayload {
+		for {
+			var p internal.ModerationPayload
+			is.NoErr(json.Unmarshal(receive(t, c, internal.ChatModeration).Payload, &p)) // decode moderation
+			if p.Action == action {
+				return p
+			}
+		}
+	}
+
+	path := func(kind string, u *internal.User) string {
+		return "/api/v1/chat/rooms/fizz/" + kind + "/" + u.ID.ShortUUID().String()
+	}
+
+	fc, _ := dial(fizz, "/api/v1/chat/rooms/fizz")
+	bc, _ := dial(buzz, "/api/v1/chat/rooms/fizz")
+	rc, _ := dial(bar, "/api/v1/chat/rooms/fizz")
+
+	t.Run("edit and delete messages", func(t *testing.T) {
+		is.NoErr(fc.Send("fizz", "m-1", "Hello")) // write to "fizz"
+		id := ack(fc, "m-1").ID
+
+		is.NoErr(fc.Edit("fizz", "e-1", id, "Hello, world")) // edit it
+		is.Equal(ack(fc, "e-1").ID, id)
+
+		var p internal.EditPayload
+		e := receive(t, rc, internal.ChatEdit)
+		is.NoErr(json.Unmarshal(e.Payload, &p)) // decode edit
+		is.Equal(p.Message, id)                 // broadcast
+		is.Equal(p.Text, "Hello, world")
+		is.Equal(e.From, fizz.ID.ShortUUID().String())
+
+		is.NoErr(rc.Edit("fizz", "e-2", id, "Goodbye")) // not the sender
+		is.Equal(code(rc, "e-2"), internal.ChatErrForbidden)
+		is.NoErr(rc.Delete("fizz", "d-0", id)) // nor a moderator
+		is.Equal(code(rc, "d-0"), internal.ChatErrForbidden)
+
+		var es struct {
+			Data []Edit `json:"data"`
+		}
+		is.Equal(do(http.MethodGet, "/api/v1/chat/messages/"+id+"/edits", bar, "", &es), http.StatusOK) // edits
+		is.Equal(len(es.Data), 1)
+		is.Equal(es.Data[0].Text, "Hello") // the version replaced
+
+		is.NoErr(fc.Delete("fizz", "d-1", id)) // delete it
+		is.Equal(ack(fc, "d-1").ID, id)
+		is.NoErr(json.Unmarshal(receive(t, rc, internal.ChatDelete).Payload, &p)) // decode delete
+		is.Equal(p.Message, id)                                                   // broadcast
+		is.True(p.At != nil)
+
+		is.NoErr(fc.Edit("fizz", "e-3", id, "Hello again")) // gone
+		is.Equal(code(fc, "e-3"), internal.ChatErrNotFound)
+		is.Equal(do(http.MethodGet, "/api/v1/chat/messages/"+id+"/edits", bar, "", nil), http.StatusForbidden) // moderators only
+
+		var ms struct {
+			Data []Message `json:"data"`
+		}
+		is.Equal(do(http.MethodGet, "/api/v1/chat/rooms/fizz/messages", bar, "", &ms), http.StatusOK) // history
+		is.Equal(ms.Data[0].Text, "")                                                                 // a tombstone
+		is.True(ms.Data[0].DeletedAt != nil)
+
+		lc, _ := dial(bar, "/api/v1/chat/")
+		is.NoErr(lc.JoinSince("fizz", 0))                    // replay
+		is.Equal(receive(t, lc, internal.ChatDelete).ID, id) // as deleted
+		is.NoErr(lc.Close())                                 // done
+	})
+
+	t.Run("give users roles in a room", func(t *testing.T) {
+		role := func(u, of *internal.User, r string) int {
+			return do(http.MethodPut, path("roles", of), u, `{"role":"`+r+`"}`, nil)
+		}
+
+		is.Equal(role(buzz, buzz, internal.RoleOwner), http.StatusForbidden) // did not create the room
+		is.Equal(role(fizz, fizz, internal.RoleOwner), http.StatusOK)        // claim the room
+		is.Equal(role(admin, buzz, internal.RoleOwner), http.StatusConflict) // already owned
+		is.Equal(role(bar, buzz, internal.RoleModerator), http.StatusForbidden)
+		is.Equal(role(fizz, buzz, internal.RoleModerator), http.StatusOK) // by the owner
+		is.Equal(role(fizz, buzz, "admin"), http.StatusBadRequest)
+
+		lobby := "/api/v1/chat/rooms/lobby/roles/" + bar.ID.ShortUUID().String()
+		is.Equal(do(http.MethodPut, lobby, bar, `{"role":"owner"}`, nil), http.StatusForbidden) // cannot claim the lobby
+
+		empty := "/api/v1/chat/rooms/empty/roles/" + bar.ID.ShortUUID().String()
+		is.Equal(do(http.MethodPut, empty, bar, `{"role":"owner"}`, nil), http.StatusForbidden) // nor a room without messages
+		is.Equal(do(http.MethodPut, empty, admin, `{"role":"owner"}`, nil), http.StatusOK)      // unless made owner by an admin
+
+		var rs struct {
+			Data []Role `json:"data"`
+		}
+		is.Equal(do(http.MethodGet, "/api/v1/chat/rooms/fizz/roles", bar, "", &rs), http.StatusOK) // roles
+		is.Equal(len(rs.Data), 2)
+		is.Equal(rs.Data[0].User, fizz.ID.ShortUUID().String()) // owner first
+		is.Equal(rs.Data[1].Role, internal.RoleModerator)
+	})
+
+	t.Run("moderators delete the messages of others", func(t *testing.T) {
+		is.NoErr(rc.Send("fizz", "m-2", "Spam")) // write to "fizz"
+		id := ack(rc, "m-2").ID
+
+		is.NoErr(bc.Delete("fizz", "d-2", id)) // by a moderator
+		is.Equal(ack(bc, "d-2").ID, id)
+		is.Equal(receive(t, rc, internal.ChatDelete).From, buzz.ID.ShortUUID().String()) // from the moderator
+
+		es, err := audit.SelectMany(ctx, internal.AuditQuery{Action: internal.ActionChatDeleteMessage})
+		is.NoErr(err) // audit
+		is.Equal(len(es), 1)
+		is.Equal(es[0].Actor, buzz.ID.ShortUUID().String())
+		is.Equal(es[0].Target, id)
+
+		var eds struct {
+			Data []Edit `json:"data"`
+		}
+		is.Equal(do(http.MethodGet, "/api/v1/chat/messages/"+id+"/edits", buzz, "", &eds), http.StatusOK) // by a moderator
+		is.Equal(len(eds.Data), 1)
+		is.Equal(eds.Data[0].Text, "Spam") // the text removed
+	})
+
+	t.Run("mute users until lifted or expired", func(t *testing.T) {
+		is.Equal(do(http.MethodPut, path("mutes", fizz), buzz, ``, nil), http.StatusForbidden) // outranked
+		is.Equal(do(http.MethodPut, path("mutes", bar), bar, ``, nil), http.StatusBadRequest)  // themself
+
+		var sn Sanction
+		is.Equal(do(http.MethodPut, path("mutes", bar), buzz, `{"reason":"spam"}`, &sn), http.StatusOK) // mute
+		is.Equal(sn.By, buzz.ID.ShortUUID().String())
+		is.True(sn.ExpiresAt == nil) // until lifted
+
+		p := moderated(rc, internal.ModerationMute) // told
+		is.Equal(p.User, bar.ID.ShortUUID().String())
+		is.Equal(p.Reason, "spam")
+
+		is.NoErr(rc.Send("fizz", "m-3", "Hello?")) // muted
+		is.Equal(code(rc, "m-3"), internal.ChatErrMuted)
+
+		is.Equal(do(http.MethodDelete, path("mutes", bar), buzz, ``, nil), http.StatusOK)       // lift
+		is.Equal(do(http.MethodDelete, path("mutes", bar), buzz, ``, nil), http.StatusNotFound) // lifted
+		moderated(rc, internal.ModerationUnmute)                                                // told
+
+		is.NoErr(rc.Send("fizz", "m-4", "Hello!")) // no longer muted
+		ack(rc, "m-4")
+
+		is.Equal(do(http.MethodPut, path("mutes", bar), buzz, `{"duration":"10ms"}`, nil), http.StatusOK) // mute briefly
+		time.Sleep(time.Millisecond * 30)
+		is.NoErr(rc.Send("fizz", "m-5", "Hello!")) // expired
+		ack(rc, "m-5")
+
+		is.Equal(do(http.MethodPut, path("mutes", bar), buzz, `{"duration":"forever"}`, nil), http.StatusBadRequest)
+	})
+
+	t.Run("kick and ban users", func(t *testing.T) {
+		is.Equal(do(http.MethodPost, path("kicks", bar), buzz, ``, nil), http.StatusOK) // kick
+		moderated(fc, internal.ModerationKick)                                          // told
+		moderated(rc, internal.ModerationKick)                                          // before removed
+
+		is.NoErr(rc.Send("fizz", "m-6", "Hello?")) // not a member
+		is.Equal(code(rc, "m-6"), internal.ChatErrNotJoined)
+		is.NoErr(rc.Join("fizz")) // can join again
+		is.NoErr(rc.Send("fizz", "m-7", "Hello!"))
+		ack(rc, "m-7")
+
+		is.Equal(do(http.MethodPut, path("bans", bar), buzz, `{"duration":"1h"}`, nil), http.StatusOK) // ban
+		is.True(moderated(rc, internal.ModerationBan).ExpiresAt != nil)                                // told
+
+		is.NoErr(rc.Join("fizz")) // banned
+		is.Equal(code(rc, ""), internal.ChatErrBanned)
+
+		_, status := dial(bar, "/api/v1/chat/rooms/fizz")
+		is.Equal(status, http.StatusForbidden) // cannot connect to it
+
+		var ss struct {
+			Data []Sanction `json:"data"`
+		}
+		is.Equal(do(http.MethodGet, "/api/v1/chat/rooms/fizz/sanctions", bar, ``, nil), http.StatusForbidden) // not a moderator
+		is.Equal(do(http.MethodGet, "/api/v1/chat/rooms/fizz/sanctions", buzz, ``, &ss), http.StatusOK)       // sanctions
+		is.Equal(len(ss.Data), 1)
+		is.Equal(ss.Data[0].Kind, internal.SanctionBan)
+
+		is.Equal(do(http.MethodDelete, path("bans", bar), admin, ``, nil), http.StatusOK) // by an admin
+		_, status = dial(bar, "/api/v1/chat/rooms/fizz")
+		is.Equal(status, http.StatusSwitchingProtocols) // can connect again
+
+		for action, outcomes := range map[string]int{internal.ActionChatBan: 1, internal.ActionChatUnban: 1, internal.ActionChatMute: 2} {
+			es, err := audit.SelectMany(ctx, internal.AuditQuery{Action: action, Target: bar.ID.ShortUUID().String()})
+			is.NoErr(err) // audit
+			is.Equal(len(es), outcomes)
+		}
+	})
+}
+
+// slowSanctions counts the reads of sanctions, those of
+// the slow room wait until release is closed
+type slowSanctions struct {
+	internal.ChatRepo
+	slow    string
+	reads   atomic.Int64
+	release chan struct{}
+}
+
+func (r *slowSanctions) SelectSanctions(ctx context.Context, room string) ([]internal.Sanction, error) {
+	r.reads.Add(1)
+	if room == r.slow {
+		<-r.release
+	}
+	return r.ChatRepo.SelectSanctions(ctx, room)
+}
+
+func TestSanctions(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	ctx := context.Background()
+	fizz, buzz := suid.NewUUID(), suid.NewUUID()
+
+	repo := &slowSanctions{ChatRepo: memory.NewChatRepo(), slow: "general", release: make(chan struct{})}
+	is.NoErr(repo.InsertSanction(ctx, &internal.Sanction{Room: "general", User: fizz, Kind: internal.SanctionMute, By: buzz}))
+	c := newSanctions(repo)
+
+	t.Run("read a room once for every user checking it", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				active, err := c.active(ctx, "general", fizz)
+				is.NoErr(err)                          // checked
+				is.True(active[internal.SanctionMute]) // muted
+				is.True(!active[internal.SanctionBan]) // not banned
+			}()
+		}
+
+		// other rooms are not held up by the read
+		active, err := c.active(ctx, "random", fizz)
+		is.NoErr(err)            // checked
+		is.Equal(len(active), 0) // no sanctions
+
+		close(repo.release)
+		wg.Wait()
+		is.Equal(repo.reads.Load(), int64(2)) // once for each room
+	})
+
+	t.Run("read a room again once it is forgotten", func(t *testing.T) {
+		is.NoErr(repo.DeleteSanction(ctx, "general", fizz, internal.SanctionMute))
+		c.forget("general")
+
+		active, err := c.active(ctx, "general", fizz)
+		is.NoErr(err)                           // checked
+		is.True(!active[internal.SanctionMute]) // lifted
+		is.Equal(repo.reads.Load(), int64(3))   // read again
+	})
+
+	t.Run("read a room again once it has expired", func(t *testing.T) {
+		c.mu.Lock()
+		c.rooms["general"].readAt = time.Now().Add(-sanctionsTTL - time.Second)
+		c.mu.Unlock()
+
+		_, err := c.active(ctx, "general", buzz)
+		is.NoErr(err)                         // checked
+		is.Equal(repo.reads.Load(), int64(4)) // read again
+	})
+}
@@ -0,0 +1,211 @@
+package chat
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+const (
+	// how long a user is typing for after they last said so
+	typingTimeout = time.Second * 5
+	// how often a room looks for users that have gone quiet
+	sweepInterval = time.Second
+)
+
+// Presence is a user that is online in a room
+type Presence struct {
+	User string `json:"user"`
+	// number of connections the user has in the room
+	Tabs   int       `json:"tabs"`
+	Since  time.Time `json:"since"`
+	Typing bool      `json:"typing"`
+}
+
+// presence is the state of a room, owned by its goroutine. A user is
+// online while one of their connections in the room has sent a data
+// frame within the heartbeat timeout, so a user with several tabs open
+// is online once and goes offline when the last of them is closed or
+// stops sending heartbeats.
+type presence struct {
+	room      string
+	heartbeat time.Duration
+
+	members map[*client]bool
+	// when each user online came online
+	online map[suid.UUID]time.Time
+	// until when each user is typing
+	typing map[suid.UUID]time.Time
+}
+
+func newPresence(room string, heartbeat time.Duration) *presence {
+	return &presence{
+		room:      room,
+		heartbeat: heartbeat,
+		members:   make(map[*client]bool),
+		online:    make(map[suid.UUID]time.Time),
+		typing:    make(map[suid.UUID]time.Time),
+	}
+}
+
+// join adds c to the members, which is first told who is online
+func (p *presence) join(c *client) {
+	for uid := range p.online {
+		if uid != c.u.ID {
+			c.queue(event(internal.ChatPresence, p.room, uid, internal.PresencePayload{Status: internal.PresenceOnline}))
+		}
+	}
+
+	for uid := range p.typing {
+		if uid != c.u.ID {
+			c.queue(event(internal.ChatTyping, p.room, uid, internal.TypingPayload{Typing: true}))
+		}
+	}
+
+	p.members[c] = true
+	p.update(c.u.ID, time.Now())
+}
+
+func (p *presence) leave(c *client) {
+	delete(p.members, c)
+	p.update(c.u.ID, time.Now())
+}
+
+// evict removes the connections of the user, which are
+// told to leave the room, and broadcasts them going offline
+func (p *presence) evict(uid suid.UUID) {
+	for c := range p.members {
+		if c.u.ID == uid {
+			delete(p.members, c)
+			c.evict(p.room)
+		}
+	}
+	p.update(uid, time.Now())
+}
+
+// setTyping broadcasts when the user of c starts or stops typing
+func (p *presence) setTyping(c *client, typing bool) {
+	now := time.Now()
+	p.update(c.u.ID, now)
+
+	_, was := p.typing[c.u.ID]
+	if typing {
+		p.typing[c.u.ID] = now.Add(typingTimeout)
+	} else {
+		delete(p.typing, c.u.ID)
+	}
+
+	if typing != was {
+		p.send(event(internal.ChatTyping, p.room, c.u.ID, internal.TypingPayload{Typing: typing}))
+	}
+}
+
+// sweep broadcasts the users that have gone quiet or come back, and
+// those that have stopped typing without saying so
+func (p *presence) sweep(now time.Time) {
+	users := make(map[suid.UUID]bool, len(p.online))
+	for c := range p.members {
+		users[c.u.ID] = true
+	}
+	for uid := range p.online {
+		users[uid] = true
+	}
+
+	for uid := range users {
+		p.update(uid, now)
+	}
+
+	for uid, until := range p.typing {
+		if now.After(until) {
+			delete(p.typing, uid)
+			p.send(event(internal.ChatTyping, p.room, uid, internal.TypingPayload{Typing: false}))
+		}
+	}
+}
+
+// update broadcasts the user going online or offline, a user
+// that goes offline is no longer typing either
+func (p *presence) update(uid suid.UUID, now time.Time) {
+	_, was := p.online[uid]
+	is := p.tabs(uid, now) > 0
+
+	switch {
+	case is && !was:
+		p.online[uid] = now
+		p.send(event(internal.ChatPresence, p.room, uid, internal.PresencePayload{Status: internal.PresenceOnline}))
+	case !is && was:
+		delete(p.online, uid)
+		delete(p.typing, uid)
+		p.send(event(internal.ChatPresence, p.room, uid, internal.PresencePayload{Status: internal.PresenceOffline}))
+	}
+}
+
+// tabs returns the number of connections of the user that have
+// sent a data frame within the heartbeat timeout, a pong is not
+// enough as browsers send them for tabs in the background
+func (p *presence) tabs(uid suid.UUID, now time.Time) int {
+	var n int
+	for c := range p.members {
+		if c.u.ID == uid && now.Sub(c.c.lastActive()) < p.heartbeat {
+			n++
+		}
+	}
+	return n
+}
+
+// roster returns the users online, those online longest first
+func (p *presence) roster() []Presence {
+	now := time.Now()
+
+	ps := make([]Presence, 0, len(p.online))
+	for uid, since := range p.online {
+		_, typing := p.typing[uid]
+		ps = append(ps, Presence{
+			User:   uid.ShortUUID().String(),
+			Tabs:   p.tabs(uid, now),
+			Since:  since.UTC(),
+			Typing: typing,
+		})
+	}
+
+	sort.Slice(ps, func(i, j int) bool {
+		if !ps[i].Since.Equal(ps[j].Since) {
+			return ps[i].Since.Before(ps[j].Since)
+		}
+		return ps[i].User < ps[j].User
+	})
+	return ps
+}
+
+// send queues m to every member
+func (p *presence) send(m message) {
+	for c := range p.members {
+		c.queue(m)
+	}
+}
+
+// event returns a frame the server sends about a user in the room, a
+// newer one of the same type replaces it in the queue of a slow client.
+// In a direct room it is sent to the other user instead.
+func event(typ, room string, uid suid.UUID, payload any) message {
+	e := internal.Envelope{
+		V:    internal.ChatVersion,
+		Type: typ,
+		Room: room,
+		From: uid.ShortUUID().String(),
+		TS:   time.Now().UTC(),
+	}
+
+	if to, ok := recipient(room, uid); ok {
+		e.Room, e.To = "", to.ShortUUID().String()
+	}
+
+	// neither can fail to encode
+	e.Payload, _ = json.Marshal(payload)
+	p, _ := json.Marshal(e)
+	return message{op: ws.OpText, p: p, key: typ + " " + room + " " + e.From}
+}
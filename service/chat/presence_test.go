@@ -0,0 +1,139 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hyphengolang/prelude/testing/is"
+	"secure.adoublef.com/internal"
+	chatclient "secure.adoublef.com/service/chat/client"
+	"secure.adoublef.com/store/memory"
+)
+
+func TestPresence(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	ctx := context.Background()
+	ur := memory.NewUserRepo(ctx)
+	fizz := addUser(t, ur, "fizz")
+
+	s := NewService(ctx, chi.NewMux(), ur, memory.NewChatRepo(), public, WithHeartbeatTimeout(time.Second*2)).(Service)
+	s.logf = t.Logf
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(func() { srv.Close() })
+
+	buzz := addUser(t, ur, "buzz")
+
+	dial := func(u *internal.User) *chatclient.Conn {
+		conn, err := chatclient.Dial(context.Background(), ticketURL(t, srv, "/api/v1/chat/rooms/fizz", token(t, u, time.Minute)))
+		is.NoErr(err) // upgrade
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	// next returns the next envelope of the type sent about the user
+	next := func(c *chatclient.Conn, typ string, u *internal.User) internal.Envelope {
+		for {
+			if e := receive(t, c, typ); e.From == u.ID.ShortUUID().String() {
+				return e
+			}
+		}
+	}
+
+	status := func(e internal.Envelope) string {
+		var p internal.PresencePayload
+		is.NoErr(json.Unmarshal(e.Payload, &p)) // decode presence
+		return p.Status
+	}
+
+	typing := func(e internal.Envelope) bool {
+		var p internal.TypingPayload
+		is.NoErr(json.Unmarshal(e.Payload, &p)) // decode typing
+		return p.Typing
+	}
+
+	roster := func() []Presence {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/chat/rooms/fizz/presence", nil)
+		req.Header.Set(`Authorization`, `Bearer `+token(t, fizz, time.Minute))
+
+		res, err := srv.Client().Do(req)
+		is.NoErr(err)                           // request
+		is.Equal(res.StatusCode, http.StatusOK) // listed
+		defer res.Body.Close()
+
+		var p struct {
+			Data []Presence `json:"data"`
+		}
+		is.NoErr(json.NewDecoder(res.Body).Decode(&p)) // decode roster
+		return p.Data
+	}
+
+	tab1 := dial(fizz)
+	is.Equal(status(next(tab1, internal.ChatPresence, fizz)), internal.PresenceOnline) // fizz is online
+
+	t.Run("count every tab of a user once", func(t *testing.T) {
+		is.NoErr(tab1.Heartbeat()) // stay online
+
+		tab2 := dial(fizz)
+		for i := 0; i < 100 && s.hub.Members("fizz") != 2; i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		ps := roster()
+		is.Equal(len(ps), 1)                               // one user
+		is.Equal(ps[0].User, fizz.ID.ShortUUID().String()) // fizz
+		is.Equal(ps[0].Tabs, 2)                            // with two tabs
+
+		is.NoErr(tab2.Close()) // close a tab
+		for i := 0; i < 100 && s.hub.Members("fizz") != 1; i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		is.Equal(roster()[0].Tabs, 1) // still online
+	})
+
+	t.Run("broadcast users coming online and typing", func(t *testing.T) {
+		is.NoErr(tab1.Heartbeat()) // stay online
+
+		conn := dial(buzz)
+		is.Equal(status(next(conn, internal.ChatPresence, fizz)), internal.PresenceOnline) // told fizz is here
+		is.Equal(status(next(tab1, internal.ChatPresence, buzz)), internal.PresenceOnline) // buzz came online
+
+		is.NoErr(conn.Typing("fizz"))                          // start typing
+		is.True(typing(next(tab1, internal.ChatTyping, buzz))) // buzz is typing
+		is.Equal(len(roster()), 2)                             // both online
+		is.True(roster()[1].Typing)                            // buzz came online last
+
+		is.NoErr(conn.StopTyping("fizz"))                       // stop typing
+		is.True(!typing(next(tab1, internal.ChatTyping, buzz))) // buzz stopped
+
+		is.NoErr(conn.Typing("fizz"))                           // start typing again
+		is.True(typing(next(tab1, internal.ChatTyping, buzz)))  // buzz is typing
+		is.NoErr(conn.Send("fizz", "", "Hello Fizz"))           // send what was typed
+		is.True(!typing(next(tab1, internal.ChatTyping, buzz))) // sending stops typing
+
+		is.NoErr(conn.Close())                                                              // last tab of buzz
+		is.Equal(status(next(tab1, internal.ChatPresence, buzz)), internal.PresenceOffline) // buzz went offline
+	})
+
+	t.Run("expire users that stop sending heartbeats", func(t *testing.T) {
+		is.Equal(status(next(tab1, internal.ChatPresence, fizz)), internal.PresenceOffline) // quiet for too long
+		is.Equal(len(roster()), 0)                                                          // nobody online
+
+		is.NoErr(tab1.Heartbeat())                                                         // back again
+		is.Equal(status(next(tab1, internal.ChatPresence, fizz)), internal.PresenceOnline) // online again
+	})
+
+	t.Run("reject a roster without a token", func(t *testing.T) {
+		res, err := srv.Client().Get(srv.URL + "/api/v1/chat/rooms/fizz/presence")
+		is.NoErr(err)                                     // request
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // no token
+		res.Body.Close()
+	})
+}
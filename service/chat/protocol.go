@@ -0,0 +1,522 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+// closeError closes the connection with the status code
+type closeError struct {
+	code   ws.StatusCode
+	reason string
+}
+
+func (e closeError) Error() string { return fmt.Sprintf("chat: closing with %d: %s", e.code, e.reason) }
+
+var errBinary = closeError{ws.StatusUnsupportedData, "binary frames are not supported"}
+
+// handleFrame acts on a frame read from the client. An envelope that is not
+// valid is answered with an error frame, an error is only returned when the
+// connection has to be closed.
+func (s Service) handleFrame(ctx context.Context, c *client, op ws.OpCode, p []byte) error {
+	if op != ws.OpText {
+		return errBinary
+	}
+
+	var e internal.Envelope
+	if err := json.Unmarshal(p, &e); err != nil {
+		s.replyErr(c, "", &internal.ChatErr{Code: internal.ChatErrInvalidFrame, Message: "frame must be a JSON envelope"})
+		return nil
+	}
+
+	if err := e.Validate(); err != nil {
+		s.replyErr(c, e.ID, err)
+		return nil
+	}
+
+	// the rooms the client has been kicked from are left first
+	c.prune(s.hub)
+
+	switch e.Type {
+	case internal.ChatHeartbeat:
+		// the frame has been seen, which is all it is for
+		return nil
+	case internal.ChatAuth:
+		return s.handleAuth(c, e)
+	case internal.ChatJoin:
+		if !roomName.MatchString(e.Room) {
+			s.replyErr(c, e.ID, &internal.ChatErr{Code: internal.ChatErrInvalidRoom, Message: `room must be 1 to 64 letters, digits, "_" or "-"`})
+			return nil
+		}
+
+		if !s.allowed(ctx, c, e, internal.SanctionBan) {
+			return nil
+		}
+
+		var replay func()
+		var p internal.JoinPayload
+		if _ = json.Unmarshal(e.Payload, &p); p.Since != nil {
+			replay = s.replay(ctx, c, e.ID, e.Room, *p.Since)
+		}
+
+		if c.join(s.hub, e.Room, replay) {
+			s.broadcast(c, e.Room, s.envelope(c, internal.ChatJoin, e.Room, "", nil))
+		}
+		return nil
+	}
+
+	if e.To != "" {
+		switch e.Type {
+		case internal.ChatMessage:
+			s.handleDirect(ctx, c, e)
+			return nil
+		case internal.ChatRead:
+			s.handleDirectRead(ctx, c, e)
+			return nil
+		case internal.ChatEdit, internal.ChatDelete:
+			s.handleDirectChange(ctx, c, e)
+			return nil
+		}
+	}
+
+	// the rest are sent to a room the client has joined
+	if !c.joined(e.Room) {
+		s.replyErr(c, e.ID, &internal.ChatErr{Code: internal.ChatErrNotJoined, Message: fmt.Sprintf("room %q has not been joined", e.Room)})
+		return nil
+	}
+
+	switch e.Type {
+	case internal.ChatMessage, internal.ChatEdit, internal.ChatTyping:
+		if !s.allowed(ctx, c, e, internal.SanctionBan, internal.SanctionMute) {
+			return nil
+		}
+	}
+
+	switch e.Type {
+	case internal.ChatLeave:
+		s.broadcast(c, e.Room, s.envelope(c, internal.ChatLeave, e.Room, "", nil))
+		c.leave(s.hub, e.Room)
+	case internal.ChatTyping:
+		p := internal.TypingPayload{Typing: true}
+		_ = json.Unmarshal(e.Payload, &p)
+		c.typing(e.Room, p.Typing)
+	case internal.ChatMessage:
+		s.handleMessage(ctx, c, e)
+	case internal.ChatRead:
+		s.handleRead(ctx, c, e)
+	case internal.ChatEdit, internal.ChatDelete:
+		s.handleChange(ctx, c, e, e.Room, &c.rooms[e.Room].mu, func(m message) { c.broadcast(e.Room, m) })
+	}
+	return nil
+}
+
+// allowed reports whether the user of c has none of the kinds of sanction
+// in the room of the envelope, replying with an error frame if they do
+func (s Service) allowed(ctx context.Context, c *client, e internal.Envelope, kinds ...string) bool {
+	active, err := s.sanctions.active(ctx, e.Room, c.u.ID)
+	if err != nil {
+		s.logf("chat: reading sanctions of %q: %v", e.Room, err)
+		s.replyErr(c, e.ID, &internal.ChatErr{Code: internal.ChatErrUnavailable, Message: "sanctions could not be checked"})
+		return false
+	}
+
+	for _, kind := range kinds {
+		switch {
+		case active[kind] && kind == internal.SanctionBan:
+			s.replyErr(c, e.ID, &internal.ChatErr{Code: internal.ChatErrBanned, Message: fmt.Sprintf("banned from room %q", e.Room)})
+			return false
+		case active[kind]:
+			s.replyErr(c, e.ID, &internal.ChatErr{Code: internal.ChatErrMuted, Message: fmt.Sprintf("muted in room %q", e.Room)})
+			return false
+		}
+	}
+	return true
+}
+
+// handleChange edits or deletes a message of the room, holding mu while it
+// is stored and sent so that members get changes in the order they are
+// made. Only the sender edits a message, moderators delete those of others
+// in rooms, which is recorded in the audit log.
+func (s Service) handleChange(ctx context.Context, c *client, e internal.Envelope, room string, mu *sync.Mutex, send func(message)) {
+	var p internal.EditPayload
+	_ = json.Unmarshal(e.Payload, &p)
+
+	notFound := &internal.ChatErr{Code: internal.ChatErrNotFound, Message: fmt.Sprintf("no message %q", p.Message)}
+	id, err := suid.ParseString(p.Message)
+	if err != nil {
+		s.replyErr(c, e.ID, notFound)
+		return
+	}
+
+	m, err := s.c.SelectMessage(ctx, id)
+	switch {
+	case errors.Is(err, internal.ErrNotFound):
+		s.replyErr(c, e.ID, notFound)
+		return
+	case err != nil:
+		s.logf("chat: reading message of %q: %v", room, err)
+		s.replyErr(c, e.ID, &internal.ChatErr{Code: internal.ChatErrUnavailable, Message: "message could not be changed"})
+		return
+	case m.Room != room || m.DeletedAt != nil:
+		s.replyErr(c, e.ID, notFound)
+		return
+	}
+
+	moderated := m.Sender != c.u.ID
+	if moderated {
+		var rank int
+		if _, direct := recipient(room, c.u.ID); e.Type == internal.ChatDelete && !direct {
+			if rank, err = s.rank(ctx, room, c.u.ID); err != nil {
+				s.logf("chat: reading roles of %q: %v", room, err)
+				s.replyErr(c, e.ID, &internal.ChatErr{Code: internal.ChatErrUnavailable, Message: "message could not be changed"})
+				return
+			}
+		}
+
+		if rank < rankModerator {
+			s.replyErr(c, e.ID, &internal.ChatErr{Code: internal.ChatErrForbidden, Message: fmt.Sprintf("cannot %s message %q", e.Type, p.Message)})
+			return
+		}
+	}
+
+	mu.Lock()
+	if e.Type == internal.ChatEdit {
+		m.Text = p.Text
+		err = s.c.UpdateMessage(ctx, &m)
+	} else {
+		err = s.c.DeleteMessage(ctx, &m)
+	}
+	if err == nil {
+		if cm, ok := s.encode(changeEnvelope(m, c.u.ID)); ok {
+			send(cm)
+		}
+	}
+	mu.Unlock()
+
+	if moderated {
+		s.audit(c.from, internal.ActionChatDeleteMessage, outcome(err), c.u.ID, m.ID)
+	}
+
+	switch {
+	case errors.Is(err, internal.ErrNotFound):
+		// deleted since it was read
+		s.replyErr(c, e.ID, notFound)
+		return
+	case err != nil:
+		s.logf("chat: changing message of %q: %v", room, err)
+		s.replyErr(c, e.ID, &internal.ChatErr{Code: internal.ChatErrUnavailable, Message: "message could not be changed"})
+		return
+	}
+
+	s.reply(c, s.envelope(c, internal.ChatAck, e.Room, e.ID, internal.AckPayload{ID: m.ID.ShortUUID().String(), Seq: m.Seq}))
+}
+
+// handleDirectChange edits or deletes a direct message
+// the user sent, both users are sent the change
+func (s Service) handleDirectChange(ctx context.Context, c *client, e internal.Envelope) {
+	with, err := suid.ParseString(e.To)
+	if err != nil || with == c.u.ID {
+		s.replyErr(c, e.ID, &internal.ChatErr{Code: internal.ChatErrUnknownUser, Message: fmt.Sprintf("no messages with user %q", e.To)})
+		return
+	}
+
+	room := internal.DirectRoom(c.u.ID, with)
+	s.handleChange(ctx, c, e, room, s.hub.directLock(room), func(m message) { s.hub.deliver(m, c.u.ID, with) })
+}
+
+// handleMessage stores the message before it is broadcast, the
+// client is sent an error if it cannot be stored so it can retry.
+// A message sent again with the same id is only acked again.
+func (s Service) handleMessage(ctx context.Context, c *client, e internal.Envelope) {
+	var p internal.MessagePayload
+	_ = json.Unmarshal(e.Payload, &p)
+
+	m := internal.Message{ID: suid.NewUUID(), Room: e.Room, Sender: c.u.ID, Text: p.Text, ClientID: e.ID}
+
+	r := c.rooms[e.Room]
+	r.mu.Lock()
+	err := s.c.InsertMessage(ctx, &m)
+	if err == nil {
+		s.broadcast(c, e.Room, messageEnvelope(m))
+	}
+	r.mu.Unlock()
+
+	dup := errors.Is(err, internal.ErrAlreadyExists)
+	if err != nil && !dup {
+		s.logf("chat: storing message to %q: %v", e.Room, err)
+		s.replyErr(c, e.ID, &internal.ChatErr{Code: internal.ChatErrUnavailable, Message: "message could not be sent"})
+		return
+	}
+
+	// the sender has read what they sent
+	if _, err := s.c.MarkRead(ctx, e.Room, c.u.ID, m.Seq); err != nil {
+		s.logf("chat: marking message read: %v", err)
+	}
+
+	// sending the message is the end of typing it
+	c.typing(e.Room, false)
+	s.reply(c, s.envelope(c, internal.ChatAck, e.Room, e.ID, internal.AckPayload{ID: m.ID.ShortUUID().String(), Seq: m.Seq, Duplicate: dup}))
+}
+
+// handleRead moves the read marker of the user in the room and
+// broadcasts how far they have read to its members
+func (s Service) handleRead(ctx context.Context, c *client, e internal.Envelope) {
+	if seq, ok := s.markRead(ctx, c, e, e.Room); ok {
+		c.broadcast(e.Room, event(internal.ChatRead, e.Room, c.u.ID, internal.ReadPayload{Seq: seq}))
+	}
+}
+
+// handleDirectRead moves the read marker of the user in the direct
+// messages with another, both users are sent how far they have read
+func (s Service) handleDirectRead(ctx context.Context, c *client, e internal.Envelope) {
+	with, err := suid.ParseString(e.To)
+	if err != nil || with == c.u.ID {
+		s.replyErr(c, e.ID, &internal.ChatErr{Code: internal.ChatErrUnknownUser, Message: fmt.Sprintf("no messages with user %q", e.To)})
+		return
+	}
+
+	room := internal.DirectRoom(c.u.ID, with)
+	if seq, ok := s.markRead(ctx, c, e, room); ok {
+		s.hub.deliver(event(internal.ChatRead, room, c.u.ID, internal.ReadPayload{Seq: seq}), c.u.ID, with)
+	}
+}
+
+// markRead stores the read marker of the envelope, replying
+// with an error frame if it cannot be
+func (s Service) markRead(ctx context.Context, c *client, e internal.Envelope, room string) (int64, bool) {
+	var p internal.ReadPayload
+	_ = json.Unmarshal(e.Payload, &p)
+
+	seq, err := s.c.MarkRead(ctx, room, c.u.ID, p.Seq)
+	switch {
+	case errors.Is(err, internal.ErrNotFound):
+		s.replyErr(c, e.ID, &internal.ChatErr{Code: internal.ChatErrInvalidPayload, Message: "there are no messages to read"})
+		return 0, false
+	case err != nil:
+		s.logf("chat: marking messages of %q read: %v", room, err)
+		s.replyErr(c, e.ID, &internal.ChatErr{Code: internal.ChatErrUnavailable, Message: "messages could not be marked read"})
+		return 0, false
+	}
+	return seq, true
+}
+
+// handleDirect stores a direct message and delivers it to every
+// connection of both users, so the other tabs of the sender have it too
+func (s Service) handleDirect(ctx context.Context, c *client, e internal.Envelope) {
+	to, err := suid.ParseString(e.To)
+	if err != nil || to == c.u.ID {
+		s.replyErr(c, e.ID, &internal.ChatErr{Code: internal.ChatErrUnknownUser, Message: fmt.Sprintf("cannot message user %q", e.To)})
+		return
+	}
+
+	if _, err := s.r.Select(ctx, to); err != nil {
+		ce := &internal.ChatErr{Code: internal.ChatErrUnavailable, Message: "message could not be sent"}
+		if errors.Is(err, internal.ErrNotFound) {
+			ce = &internal.ChatErr{Code: internal.ChatErrUnknownUser, Message: fmt.Sprintf("cannot message user %q", e.To)}
+		}
+		s.replyErr(c, e.ID, ce)
+		return
+	}
+
+	var p internal.MessagePayload
+	_ = json.Unmarshal(e.Payload, &p)
+
+	room := internal.DirectRoom(c.u.ID, to)
+	m := internal.Message{ID: suid.NewUUID(), Room: room, Sender: c.u.ID, Text: p.Text, ClientID: e.ID}
+
+	mu := s.hub.directLock(room)
+	mu.Lock()
+	err = s.c.InsertMessage(ctx, &m)
+	if err == nil {
+		if dm, ok := s.encode(messageEnvelope(m)); ok {
+			s.hub.deliver(dm, c.u.ID, to)
+		}
+	}
+	mu.Unlock()
+
+	dup := errors.Is(err, internal.ErrAlreadyExists)
+	if err != nil && !dup {
+		s.logf("chat: storing direct message: %v", err)
+		s.replyErr(c, e.ID, &internal.ChatErr{Code: internal.ChatErrUnavailable, Message: "message could not be sent"})
+		return
+	}
+
+	// the sender has read what they sent, both have the conversation in their inbox
+	if _, err := s.c.MarkRead(ctx, room, c.u.ID, m.Seq); err != nil {
+		s.logf("chat: marking direct message read: %v", err)
+	}
+	if _, err := s.c.MarkRead(ctx, room, to, 0); err != nil {
+		s.logf("chat: adding conversation to inbox: %v", err)
+	}
+
+	s.reply(c, s.envelope(c, internal.ChatAck, "", e.ID, internal.AckPayload{ID: m.ID.ShortUUID().String(), Seq: m.Seq, Duplicate: dup}))
+}
+
+// replay returns a function that sends c the messages of the room after
+// since, oldest first. At most `maxReplay` are sent, the client reads
+// the rest from the history of the room.
+func (s Service) replay(ctx context.Context, c *client, id, room string, since int64) func() {
+	return func() {
+		limit := maxReplay
+		if n := s.sendBuffer / 2; n < limit {
+			limit = n + 1
+		}
+
+		ms, err := s.c.SelectMessages(ctx, internal.MessageQuery{Room: room, After: since, Ascending: true, Limit: limit})
+		if err != nil {
+			s.logf("chat: replaying messages of %q: %v", room, err)
+			s.replyErr(c, id, &internal.ChatErr{Code: internal.ChatErrUnavailable, Message: "missed messages could not be replayed"})
+			return
+		}
+
+		for _, m := range ms {
+			s.reply(c, messageEnvelope(m))
+		}
+	}
+}
+
+// messageEnvelope returns the envelope a stored message is sent in, a
+// direct message is sent to a user rather than a room. A message that
+// has been deleted is sent as it was when deleted.
+func messageEnvelope(m internal.Message) internal.Envelope {
+	if m.DeletedAt != nil {
+		return changeEnvelope(m, m.Sender)
+	}
+
+	e := internal.Envelope{
+		V:    internal.ChatVersion,
+		Type: internal.ChatMessage,
+		ID:   m.ID.ShortUUID().String(),
+		Room: m.Room,
+		From: m.Sender.ShortUUID().String(),
+		Seq:  m.Seq,
+		TS:   m.CreatedAt,
+	}
+
+	if to, ok := recipient(m.Room, m.Sender); ok {
+		e.Room, e.To = "", to.ShortUUID().String()
+	}
+	e.Payload, _ = json.Marshal(internal.MessagePayload{Text: m.Text, EditedAt: m.EditedAt})
+	return e
+}
+
+// changeEnvelope returns the envelope a message that has been
+// edited or deleted is sent in, from the user that changed it
+func changeEnvelope(m internal.Message, by suid.UUID) internal.Envelope {
+	typ, at := internal.ChatEdit, m.EditedAt
+	if m.DeletedAt != nil {
+		typ, at = internal.ChatDelete, m.DeletedAt
+	}
+
+	e := internal.Envelope{
+		V:    internal.ChatVersion,
+		Type: typ,
+		ID:   m.ID.ShortUUID().String(),
+		Room: m.Room,
+		From: by.ShortUUID().String(),
+		Seq:  m.Seq,
+		TS:   *at,
+	}
+
+	if to, ok := recipient(m.Room, by); ok {
+		e.Room, e.To = "", to.ShortUUID().String()
+	}
+	e.Payload, _ = json.Marshal(internal.EditPayload{Message: e.ID, Text: m.Text, At: at})
+	return e
+}
+
+// handleAuth re-authenticates the connection, which is closed
+// if the token is not valid for the same user
+func (s Service) handleAuth(c *client, e internal.Envelope) error {
+	var p internal.AuthPayload
+	_ = json.Unmarshal(e.Payload, &p)
+
+	exp, err := s.reauthenticate(c.u.ID, p.Token)
+	if err != nil {
+		return closeError{ws.StatusPolicyViolation, "invalid token"}
+	}
+
+	// the connection is already closing if the timer has fired
+	c.expire.Reset(time.Until(exp))
+
+	s.reply(c, s.envelope(c, internal.ChatAuth, "", e.ID, internal.AuthPayload{ExpiresAt: &exp}))
+	return nil
+}
+
+// envelope returns an envelope sent by the server on behalf of the client,
+// the payload is encoded as JSON unless it already is
+func (s Service) envelope(c *client, typ, room, id string, payload any) internal.Envelope {
+	e := internal.Envelope{
+		V:    internal.ChatVersion,
+		Type: typ,
+		ID:   id,
+		Room: room,
+		From: c.u.ID.ShortUUID().String(),
+		TS:   time.Now().UTC(),
+	}
+
+	switch p := payload.(type) {
+	case nil:
+	case json.RawMessage:
+		e.Payload = p
+	default:
+		e.Payload, _ = json.Marshal(p)
+	}
+	return e
+}
+
+// recipient returns the other user of a direct room
+func recipient(room string, from suid.UUID) (suid.UUID, bool) {
+	a, b, ok := internal.ParseDirectRoom(room)
+	if !ok {
+		return suid.UUID{}, false
+	}
+
+	if a == from {
+		return b, true
+	}
+	return a, true
+}
+
+// reply queues the envelope to the client alone
+func (s Service) reply(c *client, e internal.Envelope) {
+	if m, ok := s.encode(e); ok {
+		c.queue(m)
+	}
+}
+
+// replyErr sends an error frame for the envelope with the id
+func (s Service) replyErr(c *client, id string, err error) {
+	var ce *internal.ChatErr
+	if !errors.As(err, &ce) {
+		ce = &internal.ChatErr{Code: internal.ChatErrInvalidFrame, Message: err.Error()}
+	}
+
+	e := internal.Envelope{V: internal.ChatVersion, Type: internal.ChatError, ID: id, TS: time.Now().UTC()}
+	e.Payload, _ = json.Marshal(ce)
+	s.reply(c, e)
+}
+
+// broadcast sends the envelope to every member of the room
+func (s Service) broadcast(c *client, room string, e internal.Envelope) {
+	if m, ok := s.encode(e); ok {
+		c.broadcast(room, m)
+	}
+}
+
+func (s Service) encode(e internal.Envelope) (message, bool) {
+	p, err := json.Marshal(e)
+	if err != nil {
+		s.logf("chat: encoding %q envelope: %v", e.Type, err)
+		return message{}, false
+	}
+	return message{op: ws.OpText, p: p}, true
+}
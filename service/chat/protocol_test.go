@@ -0,0 +1,387 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+	chatclient "secure.adoublef.com/service/chat/client"
+	"secure.adoublef.com/store/memory"
+)
+
+func TestHistory(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	ctx := context.Background()
+	ur := memory.NewUserRepo(ctx)
+	u := addUser(t, ur, "fizz")
+
+	s := NewService(ctx, chi.NewMux(), ur, memory.NewChatRepo(), public).(Service)
+	s.logf = t.Logf
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(func() { srv.Close() })
+	tk := token(t, u, time.Minute)
+
+	dial := func(path string) *chatclient.Conn {
+		conn, err := chatclient.Dial(context.Background(), ticketURL(t, srv, path, tk))
+		is.NoErr(err) // upgrade
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	seq := func(e internal.Envelope) int64 {
+		var a internal.AckPayload
+		is.NoErr(json.Unmarshal(e.Payload, &a)) // decode ack
+		return a.Seq
+	}
+
+	fizz := dial("/api/v1/chat/rooms/fizz")
+	for i := 1; i <= 5; i++ {
+		is.NoErr(fizz.Send("fizz", "", fmt.Sprintf("Hello %d", i))) // write to "fizz"
+		is.Equal(seq(receive(t, fizz, internal.ChatAck)), int64(i)) // numbered in order
+	}
+
+	get := func(path, token string) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if token != "" {
+			req.Header.Set(`Authorization`, `Bearer `+token)
+		}
+		return srv.Client().Do(req)
+	}
+
+	t.Run("page through the messages of a room", func(t *testing.T) {
+		type payload struct {
+			Length int       `json:"length"`
+			Data   []Message `json:"data"`
+			Links  struct {
+				Next string `json:"next"`
+			} `json:"links"`
+		}
+
+		var seqs []int64
+		for path := "/api/v1/chat/rooms/fizz/messages?limit=2"; path != ""; {
+			res, err := get(path, tk)
+			is.NoErr(err)                           // request
+			is.Equal(res.StatusCode, http.StatusOK) // listed
+
+			var p payload
+			is.NoErr(json.NewDecoder(res.Body).Decode(&p)) // decode page
+			res.Body.Close()
+
+			is.Equal(p.Length, len(p.Data)) // length of the page
+			for _, m := range p.Data {
+				is.Equal(m.Room, "fizz")                      // room
+				is.Equal(m.Sender, u.ID.ShortUUID().String()) // sent by the user
+				is.Equal(m.Text, fmt.Sprintf("Hello %d", m.Seq))
+				seqs = append(seqs, m.Seq)
+			}
+			path = p.Links.Next
+		}
+		is.Equal(seqs, []int64{5, 4, 3, 2, 1}) // newest first
+	})
+
+	t.Run("reject listing without a token or with a bad cursor", func(t *testing.T) {
+		res, err := get("/api/v1/chat/rooms/fizz/messages", "")
+		is.NoErr(err)                                     // request
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // no token
+		res.Body.Close()
+
+		res, err = get("/api/v1/chat/rooms/fizz/messages?before=-1", tk)
+		is.NoErr(err)                                   // request
+		is.Equal(res.StatusCode, http.StatusBadRequest) // not positive
+		res.Body.Close()
+	})
+
+	t.Run("replay missed messages on reconnect", func(t *testing.T) {
+		conn, err := chatclient.Dial(context.Background(), ticketURL(t, srv, "/api/v1/chat/rooms/fizz", tk)+"&since=3")
+		is.NoErr(err) // upgrade
+		t.Cleanup(func() { conn.Close() })
+
+		// replayed before the new message, which is sent once joined
+		is.Equal(receive(t, conn, internal.ChatMessage).Seq, int64(4)) // missed
+		is.Equal(receive(t, conn, internal.ChatMessage).Seq, int64(5)) // missed
+
+		is.NoErr(fizz.Send("fizz", "", "Hello 6"))                     // new message
+		is.Equal(receive(t, conn, internal.ChatMessage).Seq, int64(6)) // live
+	})
+
+	t.Run("replay missed messages on join", func(t *testing.T) {
+		conn := dial("/api/v1/chat/")
+		is.NoErr(conn.JoinSince("fizz", 5)) // join with a cursor
+
+		e := receive(t, conn, internal.ChatMessage)
+		is.Equal(e.Room, "fizz")  // replayed from the room
+		is.Equal(e.Seq, int64(6)) // after the cursor
+	})
+
+	t.Run("reject an invalid cursor", func(t *testing.T) {
+		res, err := get("/api/v1/chat/rooms/fizz?since=a", tk)
+		is.NoErr(err)                                   // request
+		is.Equal(res.StatusCode, http.StatusBadRequest) // not an integer
+		res.Body.Close()
+	})
+}
+
+func TestDirect(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	ctx := context.Background()
+	ur := memory.NewUserRepo(ctx)
+	fizz := addUser(t, ur, "fizz")
+
+	s := NewService(ctx, chi.NewMux(), ur, memory.NewChatRepo(), public).(Service)
+	s.logf = t.Logf
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(func() { srv.Close() })
+	buzz, bar := addUser(t, ur, "buzz"), addUser(t, ur, "bar")
+
+	dial := func(u *internal.User) *chatclient.Conn {
+		conn, err := chatclient.Dial(context.Background(), ticketURL(t, srv, "/api/v1/chat/", token(t, u, time.Minute)))
+		is.NoErr(err) // upgrade
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	get := func(path string, u *internal.User, v any) int {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if u != nil {
+			req.Header.Set(`Authorization`, `Bearer `+token(t, u, time.Minute))
+		}
+
+		res, err := srv.Client().Do(req)
+		is.NoErr(err) // request
+		defer res.Body.Close()
+
+		if res.StatusCode == http.StatusOK {
+			is.NoErr(json.NewDecoder(res.Body).Decode(v)) // decode
+		}
+		return res.StatusCode
+	}
+
+	type inbox struct {
+		Length int            `json:"length"`
+		Unread int64          `json:"unread"`
+		Data   []Conversation `json:"data"`
+	}
+
+	fizz1, fizz2 := dial(fizz), dial(fizz)
+	buzz1, buzz2 := dial(buzz), dial(buzz)
+	barc := dial(bar)
+
+	t.Run("deliver to every connection of both users", func(t *testing.T) {
+		is.NoErr(fizz1.SendTo(buzz.ID.ShortUUID().String(), "dm-1", "Hello buzz")) // write to buzz
+
+		es := receiveEach(t, fizz1, internal.ChatMessage, internal.ChatAck)
+		is.Equal(es[internal.ChatAck].ID, "dm-1") // acked
+
+		var a internal.AckPayload
+		is.NoErr(json.Unmarshal(es[internal.ChatAck].Payload, &a)) // decode ack
+		is.Equal(a.Seq, int64(1))                                  // first of the conversation
+
+		for _, c := range []*chatclient.Conn{fizz2, buzz1, buzz2} {
+			e := receive(t, c, internal.ChatMessage)
+			is.Equal(e.Room, "")                           // not a room
+			is.Equal(e.From, fizz.ID.ShortUUID().String()) // from fizz
+			is.Equal(e.To, buzz.ID.ShortUUID().String())   // to buzz
+		}
+
+		// anything sent to bar would be queued before the reply to its probe
+		is.NoErr(barc.Send("", "probe", "")) // invalid
+		for {
+			e, err := barc.Receive()
+			is.NoErr(err)                           // receive
+			is.True(e.Type != internal.ChatMessage) // not sent to bar
+			if e.Type == internal.ChatError {
+				break
+			}
+		}
+	})
+
+	t.Run("reject unknown users and the sender", func(t *testing.T) {
+		for _, to := range []string{suid.NewUUID().ShortUUID().String(), fizz.ID.ShortUUID().String(), "nobody"} {
+			is.NoErr(fizz1.SendTo(to, "dm-x", "Hello?")) // write to no one
+
+			var ce *internal.ChatErr
+			is.True(errors.As(receive(t, fizz1, internal.ChatError).Err(), &ce)) // error frame
+			is.Equal(ce.Code, internal.ChatErrUnknownUser)                       // unknown user
+		}
+	})
+
+	t.Run("count unread messages in the inbox", func(t *testing.T) {
+		var b inbox
+		is.Equal(get("/api/v1/chat/inbox", buzz, &b), http.StatusOK) // listed
+		is.Equal(b.Length, 1)
+		is.Equal(b.Unread, int64(1))
+		is.Equal(b.Data[0].With, fizz.ID.ShortUUID().String()) // with fizz
+		is.Equal(b.Data[0].Last.Text, "Hello buzz")            // last message
+
+		var f inbox
+		is.Equal(get("/api/v1/chat/inbox", fizz, &f), http.StatusOK) // listed
+		is.Equal(f.Unread, int64(0))                                 // sent by fizz
+		is.Equal(f.Data[0].With, buzz.ID.ShortUUID().String())       // with buzz
+
+		var ms struct {
+			Data []Message `json:"data"`
+		}
+		is.Equal(get("/api/v1/chat/dm/"+fizz.ID.ShortUUID().String()+"/messages", buzz, &ms), http.StatusOK) // history
+		is.Equal(len(ms.Data), 1)
+		is.Equal(ms.Data[0].To, buzz.ID.ShortUUID().String()) // to buzz
+
+		is.Equal(get("/api/v1/chat/inbox", buzz, &b), http.StatusOK) // listed
+		is.Equal(b.Unread, int64(0))                                 // read
+	})
+
+	t.Run("only the two users can read the messages", func(t *testing.T) {
+		var ms struct {
+			Data []Message `json:"data"`
+		}
+		is.Equal(get("/api/v1/chat/dm/"+fizz.ID.ShortUUID().String()+"/messages", bar, &ms), http.StatusOK) // history
+		is.Equal(len(ms.Data), 0)                                                                           // of bar and fizz
+
+		var b inbox
+		is.Equal(get("/api/v1/chat/inbox", bar, &b), http.StatusOK) // listed
+		is.Equal(b.Length, 0)                                       // nothing
+
+		is.Equal(get("/api/v1/chat/inbox", nil, nil), http.StatusUnauthorized)                                        // no token
+		is.Equal(get("/api/v1/chat/dm/"+fizz.ID.ShortUUID().String()+"/messages", nil, nil), http.StatusUnauthorized) // no token
+		is.Equal(get("/api/v1/chat/dm/"+bar.ID.ShortUUID().String()+"/messages", bar, nil), http.StatusBadRequest)    // with themself
+		is.Equal(get("/api/v1/chat/dm/0/messages", bar, nil), http.StatusBadRequest)                                  // not an id
+	})
+}
+
+func TestReceipts(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	ctx := context.Background()
+	ur := memory.NewUserRepo(ctx)
+	fizz := addUser(t, ur, "fizz")
+
+	s := NewService(ctx, chi.NewMux(), ur, memory.NewChatRepo(), public).(Service)
+	s.logf = t.Logf
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(func() { srv.Close() })
+	buzz := addUser(t, ur, "buzz")
+
+	dial := func(u *internal.User) *chatclient.Conn {
+		conn, err := chatclient.Dial(context.Background(), ticketURL(t, srv, "/api/v1/chat/rooms/fizz", token(t, u, time.Minute)))
+		is.NoErr(err) // upgrade
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	ack := func(c *chatclient.Conn, id string) internal.AckPayload {
+		for {
+			if e := receive(t, c, internal.ChatAck); e.ID == id {
+				var a internal.AckPayload
+				is.NoErr(json.Unmarshal(e.Payload, &a)) // decode ack
+				return a
+			}
+		}
+	}
+
+	read := func(c *chatclient.Conn, u *internal.User) internal.Envelope {
+		for {
+			if e := receive(t, c, internal.ChatRead); e.From == u.ID.ShortUUID().String() {
+				return e
+			}
+		}
+	}
+
+	seq := func(e internal.Envelope) int64 {
+		var p internal.ReadPayload
+		is.NoErr(json.Unmarshal(e.Payload, &p)) // decode read
+		return p.Seq
+	}
+
+	unread := func(u *internal.User) int64 {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/chat/inbox", nil)
+		req.Header.Set(`Authorization`, `Bearer `+token(t, u, time.Minute))
+
+		res, err := srv.Client().Do(req)
+		is.NoErr(err)                           // request
+		is.Equal(res.StatusCode, http.StatusOK) // listed
+		defer res.Body.Close()
+
+		var p struct {
+			Unread int64 `json:"unread"`
+		}
+		is.NoErr(json.NewDecoder(res.Body).Decode(&p)) // decode inbox
+		return p.Unread
+	}
+
+	fc, bc := dial(fizz), dial(buzz)
+
+	t.Run("store a message sent again once", func(t *testing.T) {
+		is.NoErr(fc.Send("fizz", "m-1", "Hello")) // write to "fizz"
+		first := ack(fc, "m-1")
+		is.Equal(first.Duplicate, false) // stored
+
+		is.NoErr(fc.Send("fizz", "m-1", "Hello")) // ack was lost
+		again := ack(fc, "m-1")
+		is.Equal(again.Duplicate, true) // not stored twice
+		is.Equal(again.ID, first.ID)    // the same message
+		is.Equal(again.Seq, first.Seq)
+
+		is.NoErr(fc.Send("fizz", "m-2", "World")) // write to "fizz"
+		is.Equal(ack(fc, "m-2").Seq, first.Seq+1) // no gap
+
+		// buzz is sent the message once, then the next one
+		is.Equal(receive(t, bc, internal.ChatMessage).Seq, first.Seq)
+		is.Equal(receive(t, bc, internal.ChatMessage).Seq, first.Seq+1)
+	})
+
+	t.Run("broadcast read markers and count unread messages", func(t *testing.T) {
+		is.Equal(unread(buzz), int64(0)) // buzz has read nothing in no room
+		is.Equal(unread(fizz), int64(0)) // fizz sent both
+
+		is.NoErr(bc.MarkRead("fizz", 1))        // read the first
+		is.Equal(seq(read(fc, buzz)), int64(1)) // fizz sees how far buzz read
+		is.Equal(seq(read(bc, buzz)), int64(1)) // as do the tabs of buzz
+		is.Equal(unread(buzz), int64(1))        // one left
+
+		is.NoErr(bc.MarkRead("fizz", 99))       // read past the newest
+		is.Equal(seq(read(bc, buzz)), int64(2)) // no further than the newest
+		is.Equal(unread(buzz), int64(0))        // read every one
+
+		is.NoErr(bc.MarkRead("fizz", 1)) // does not go back
+		is.Equal(seq(read(bc, buzz)), int64(2))
+	})
+
+	t.Run("send direct read markers to both users", func(t *testing.T) {
+		is.NoErr(fc.SendTo(buzz.ID.ShortUUID().String(), "dm-1", "Hello buzz")) // write to buzz
+		seq1 := ack(fc, "dm-1").Seq
+		is.Equal(unread(buzz), int64(1)) // the direct message
+
+		is.NoErr(bc.MarkReadWith(fizz.ID.ShortUUID().String(), seq1)) // read it
+		e := read(fc, buzz)
+		is.Equal(e.To, fizz.ID.ShortUUID().String()) // sent to fizz
+		is.Equal(e.Room, "")                         // not a room
+		is.Equal(seq(e), seq1)
+		is.Equal(unread(buzz), int64(0)) // read
+	})
+
+	t.Run("reject markers with nothing to read", func(t *testing.T) {
+		bar := addUser(t, ur, "bar")
+
+		is.NoErr(fc.SendEnvelope(internal.Envelope{Type: internal.ChatRead, ID: "r-1", To: bar.ID.ShortUUID().String(), Payload: json.RawMessage(`{"seq":1}`)}))
+		is.Equal(receive(t, fc, internal.ChatError).ID, "r-1") // no messages with bar
+
+		is.NoErr(fc.SendEnvelope(internal.Envelope{Type: internal.ChatRead, ID: "r-2", Room: "fizz", Payload: json.RawMessage(`{"seq":0}`)}))
+		is.Equal(receive(t, fc, internal.ChatError).ID, "r-2") // not a seq
+	})
+}
@@ -0,0 +1,119 @@
+package chat
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// SlowPolicy is what happens to a client that cannot keep up
+// with the frames queued to it
+type SlowPolicy int
+
+const (
+	// DropSlow closes the connection once its queue is full, the client
+	// can reconnect and replay the messages it missed with "since"
+	DropSlow SlowPolicy = iota
+	// CoalesceSlow replaces a queued "typing" or "presence" envelope with
+	// a newer one about the same user and room, so a client that falls
+	// behind is only sent where things stand. It is closed as with
+	// `DropSlow` if its queue fills up all the same.
+	CoalesceSlow
+)
+
+// queue is the bounded buffer of frames waiting to be written to a client.
+// It is filled by the goroutines of rooms and of the reader of the
+// client, and emptied by the writer of the client.
+type queue struct {
+	mu     sync.Mutex
+	frames []message
+	// set once a frame did not fit, nothing is queued after it
+	full bool
+
+	size   int
+	policy SlowPolicy
+	stats  *counters
+
+	// signals the writer that there are frames or the queue is full
+	ready chan struct{}
+}
+
+func newQueue(size int, policy SlowPolicy, stats *counters) *queue {
+	return &queue{
+		size:   size,
+		policy: policy,
+		stats:  stats,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// push adds m to the queue, reporting false if the queue has just
+// become full. The frame is discarded, as is every one after it.
+func (q *queue) push(m message) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.full {
+		q.stats.discarded.Add(1)
+		return true
+	}
+
+	if q.policy == CoalesceSlow && m.key != "" {
+		for i := range q.frames {
+			if q.frames[i].key == m.key {
+				q.frames[i] = m
+				q.stats.coalesced.Add(1)
+				return true
+			}
+		}
+	}
+
+	if len(q.frames) >= q.size {
+		q.stats.dropped.Add(1)
+		q.stats.discarded.Add(int64(len(q.frames)) + 1)
+
+		q.full, q.frames = true, nil
+		q.signal()
+		return false
+	}
+
+	q.frames = append(q.frames, m)
+	q.signal()
+	return true
+}
+
+func (q *queue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take empties the queue, returning the frames in the order they
+// were queued and whether the queue has become full
+func (q *queue) take() ([]message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ms := q.frames
+	q.frames = nil
+	return ms, q.full
+}
+
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.frames)
+}
+
+// counters are shared by the queues and writers of every client
+type counters struct {
+	// frames replaced by a newer one
+	coalesced atomic.Int64
+	// clients closed because their queue was full
+	dropped atomic.Int64
+	// frames discarded along with the clients that were dropped
+	discarded atomic.Int64
+	// clients closed because they did not answer a ping
+	pingTimeouts atomic.Int64
+}
@@ -0,0 +1,195 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+	chatclient "secure.adoublef.com/service/chat/client"
+	"secure.adoublef.com/store/memory"
+)
+
+func TestQueue(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	typing := func(from string) message {
+		return message{op: ws.OpText, p: []byte(from), key: "typing fizz " + from}
+	}
+
+	t.Run("drop a client that falls behind", func(t *testing.T) {
+		var st counters
+		q := newQueue(2, DropSlow, &st)
+
+		is.True(q.push(typing("a")))  // queued
+		is.True(q.push(typing("a")))  // not coalesced
+		is.True(!q.push(typing("b"))) // full
+		is.True(q.push(typing("c")))  // discarded
+
+		ms, full := q.take()
+		is.True(full)                           // writer closes the client
+		is.Equal(len(ms), 0)                    // queued frames are discarded
+		is.Equal(st.dropped.Load(), int64(1))   // one client
+		is.Equal(st.discarded.Load(), int64(4)) // every frame
+	})
+
+	t.Run("coalesce events about the same user", func(t *testing.T) {
+		var st counters
+		q := newQueue(2, CoalesceSlow, &st)
+
+		is.True(q.push(typing("a")))                            // queued
+		is.True(q.push(message{op: ws.OpText, p: []byte("m")})) // queued
+		is.True(q.push(typing("a")))                            // coalesced
+		is.Equal(q.len(), 2)                                    // two frames
+		is.True(!q.push(typing("b")))                           // full
+
+		var st2 counters
+		q = newQueue(2, CoalesceSlow, &st2)
+		is.True(q.push(message{op: ws.OpText, p: []byte("old"), key: "k"})) // queued
+		is.True(q.push(message{op: ws.OpText, p: []byte("new"), key: "k"})) // coalesced
+
+		ms, full := q.take()
+		is.True(!full)                           // not full
+		is.Equal(len(ms), 1)                     // one frame
+		is.Equal(string(ms[0].p), "new")         // the newest
+		is.Equal(st2.coalesced.Load(), int64(1)) // counted
+	})
+}
+
+func TestBackpressure(t *testing.T) {
+	t.Parallel()
+
+	// setup returns the service and the url of a room, with a new ticket
+	setup := func(t *testing.T, is *is.I, opts ...Option) (s Service, url func() string, wait func(n int)) {
+		ctx := context.Background()
+		ur := memory.NewUserRepo(ctx)
+		u := addUser(t, ur, "fizz")
+
+		s = NewService(ctx, chi.NewMux(), ur, memory.NewChatRepo(), public, opts...).(Service)
+		s.logf = t.Logf
+
+		srv := httptest.NewServer(s)
+		t.Cleanup(func() { srv.Close() })
+		tk := token(t, u, time.Minute)
+
+		url = func() string { return ticketURL(t, srv, "/api/v1/chat/rooms/fizz", tk) }
+
+		wait = func(n int) {
+			for i := 0; i < 200 && s.hub.Clients() != n; i++ {
+				time.Sleep(time.Millisecond * 10)
+			}
+			is.Equal(s.hub.Clients(), n) // connected
+		}
+		return s, url, wait
+	}
+
+	dial := func(t *testing.T, is *is.I, url string) net.Conn {
+		conn, br, _, err := ws.Dial(context.Background(), url)
+		is.NoErr(err) // upgrade
+		t.Cleanup(func() { conn.Close() })
+		return bufferedConn(conn, br)
+	}
+
+	t.Run("close connections that do not answer pings", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		s, url, wait := setup(t, is, WithPingInterval(time.Millisecond*100), WithPongTimeout(time.Millisecond*100))
+
+		_, live := dial(t, is, url()), dial(t, is, url())
+		wait(2)
+
+		// reading replies to pings
+		go func() { _ = readClosed(live) }()
+
+		time.Sleep(time.Millisecond * 500)
+		wait(1)                                        // the dead peer is gone
+		is.Equal(s.hub.Stats().PingTimeouts, int64(1)) // counted
+	})
+
+	t.Run("drop clients that fall behind", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		s, url, wait := setup(t, is, WithSendBuffer(16), WithSlowPolicy(DropSlow), WithWriteTimeout(time.Millisecond*100))
+
+		slow := dial(t, is, url())
+		fast, err := chatclient.Dial(context.Background(), url())
+		is.NoErr(err) // upgrade
+		t.Cleanup(func() { fast.Close() })
+		wait(2)
+
+		// fast reads everything it is sent, slow reads nothing
+		text := strings.Repeat("a", internal.MaxChatTextLength)
+		for i := 0; i < 10000 && s.hub.Clients() == 2; i++ {
+			is.NoErr(fast.Send("fizz", "", text)) // flood the room
+			receive(t, fast, internal.ChatAck)    // keep up
+		}
+		wait(1) // slow is gone
+
+		st := s.hub.Stats()
+		is.Equal(st.Dropped, int64(1)) // counted
+		is.True(st.Discarded > 0)      // along with its frames
+
+		// sent a close frame if it fit behind the frames already written
+		var ce wsutil.ClosedError
+		if err := readClosed(slow); errors.As(err, &ce) {
+			is.Equal(ce.Code, ws.StatusPolicyViolation) // 1008
+		}
+	})
+
+	t.Run("expose the counters to admins", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+
+		admin := &internal.User{ID: suid.NewUUID()}
+		ctx := context.Background()
+		ur := memory.NewUserRepo(ctx)
+		u := addUser(t, ur, "fizz")
+
+		s := NewService(ctx, chi.NewMux(), ur, memory.NewChatRepo(), public, WithAdmins(admin.ID)).(Service)
+		s.logf = t.Logf
+
+		srv := httptest.NewServer(s)
+		t.Cleanup(func() { srv.Close() })
+
+		get := func(token string) *http.Response {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/debug/chat", nil)
+			if token != "" {
+				req.Header.Set(`Authorization`, `Bearer `+token)
+			}
+			res, err := srv.Client().Do(req)
+			is.NoErr(err) // request
+			return res
+		}
+
+		res := get("")
+		res.Body.Close()
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // no token
+
+		res = get(token(t, u, time.Minute))
+		res.Body.Close()
+		is.Equal(res.StatusCode, http.StatusForbidden) // not an admin
+
+		res = get(token(t, admin, time.Minute))
+		is.Equal(res.StatusCode, http.StatusOK) // stats
+		defer res.Body.Close()
+
+		var st map[string]any
+		is.NoErr(json.NewDecoder(res.Body).Decode(&st)) // decode stats
+		for _, k := range []string{"clients", "queueDepth", "maxQueueDepth", "coalesced", "dropped", "pingTimeouts"} {
+			_, ok := st[k]
+			is.True(ok) // counter is exposed
+		}
+	})
+}
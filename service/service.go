@@ -6,26 +6,125 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	www "github.com/hyphengolang/prelude/http"
+	"github.com/hyphengolang/prelude/types/suid"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"secure.adoublef.com/internal/auth"
+	"secure.adoublef.com/internal/event"
+	"secure.adoublef.com/service/chat"
 	"secure.adoublef.com/service/user"
+	"secure.adoublef.com/service/webhook"
 	"secure.adoublef.com/store"
 )
 
 func (s Service) routes() {
 	s.m.Use(middleware.Logger)
+	s.m.Use(pin)
+
+	s.m.With(auth.RequireAdmin(s.public, s.admins)).Get("/debug/pool", s.handlePoolStats())
+}
+
+// handlePoolStats reports the connection pools of the store to admins
+func (s Service) handlePoolStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		www.Respond(w, r, s.st.Stats(), http.StatusOK)
+	}
+}
+
+// pin lets the reads of a request follow its writes to the primary
+func pin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(store.Pin(r.Context())))
+	})
 }
 
 func (s Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.m.ServeHTTP(w, r)
 }
 
+// Shutdown waits for the connections of chat to close, they are
+// closed once the context given to `New` is done. The server should
+// be shut down first so that no more connections are upgraded.
+func (s Service) Shutdown(ctx context.Context) error {
+	return s.chat.Shutdown(ctx)
+}
+
 type Service struct {
-	m chi.Router
+	m    chi.Router
+	st   *store.Store
+	chat chat.Service
+
+	// ids of the users allowed to read the debug endpoints
+	admins map[suid.UUID]bool
+	public jwk.Key
+}
+
+type config struct {
+	admins  []suid.UUID
+	user    []user.Option
+	chat    []chat.Option
+	webhook []webhook.Option
+	bus     *event.Bus
+}
+
+type Option func(c *config)
+
+// WithUserOptions configures the user service
+func WithUserOptions(opts ...user.Option) Option {
+	return func(c *config) { c.user = append(c.user, opts...) }
 }
 
-func New(ctx context.Context, st *store.Store) http.Handler {
-	s := &Service{m: chi.NewMux()}
+// WithChatOptions configures the chat service
+func WithChatOptions(opts ...chat.Option) Option {
+	return func(c *config) { c.chat = append(c.chat, opts...) }
+}
+
+// WithWebhookOptions configures the webhook service
+func WithWebhookOptions(opts ...webhook.Option) Option {
+	return func(c *config) { c.webhook = append(c.webhook, opts...) }
+}
+
+// WithAdmins allows the users to query the audit log, moderate every
+// room of chat, manage webhooks and read the debug endpoints
+func WithAdmins(ids ...suid.UUID) Option {
+	return func(c *config) {
+		c.admins = append(c.admins, ids...)
+		c.user = append(c.user, user.WithAdmins(ids...))
+		c.chat = append(c.chat, chat.WithAdmins(ids...))
+		c.webhook = append(c.webhook, webhook.WithAdmins(ids...))
+	}
+}
+
+// WithBus delivers the account events published to the bus to webhooks
+func WithBus(b *event.Bus) Option {
+	return func(c *config) { c.bus = b }
+}
+
+// New returns the services, which run until ctx is done
+func New(ctx context.Context, st *store.Store, opts ...Option) *Service {
+	var c config
+	for _, o := range opts {
+		o(&c)
+	}
+
+	// tokens issued by the user service are verified by the others
+	private, public := auth.RS256()
+
+	s := &Service{m: chi.NewMux(), st: st, admins: make(map[suid.UUID]bool), public: public}
+	for _, id := range c.admins {
+		s.admins[id] = true
+	}
 	s.routes()
 
-	user.NewService(ctx, s.m, st.UserRepo())
+	uopts := append([]user.Option{user.WithAudit(st.AuditRepo()), user.WithKeys(private, public)}, c.user...)
+	user.NewService(ctx, s.m, st.UserRepo(), uopts...)
+
+	copts := append([]chat.Option{chat.WithAudit(st.AuditRepo())}, c.chat...)
+	s.chat = chat.NewService(ctx, s.m, st.UserRepo(), st.ChatRepo(), public, copts...).(chat.Service)
+
+	wh := webhook.NewService(ctx, s.m, st.WebhookRepo(), public, c.webhook...)
+	if c.bus != nil {
+		c.bus.Subscribe(wh.Handle)
+	}
 	return s
 }
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal/auth"
+	"secure.adoublef.com/store"
+)
+
+func TestPoolStats(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	ctx := context.Background()
+
+	st, err := store.New(ctx, store.Config{Driver: store.SQLite, DSN: filepath.Join(t.TempDir(), "test.db")})
+	is.NoErr(err) // new store
+	t.Cleanup(func() { st.Close(ctx) })
+
+	private, public := auth.RS256()
+	admin, user := suid.NewUUID(), suid.NewUUID()
+
+	s := &Service{m: chi.NewMux(), st: st, admins: map[suid.UUID]bool{admin: true}, public: public}
+	s.routes()
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	get := func(id suid.UUID) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/debug/pool", nil)
+		if id != (suid.UUID{}) {
+			tk, err := auth.Sign(private, &auth.SignOption{
+				Type:       auth.TypeAccess,
+				Expiration: time.Minute,
+				Claims:     map[string]any{"id": id.ShortUUID()},
+			})
+			is.NoErr(err) // sign access token
+			req.Header.Set("Authorization", "Bearer "+string(tk))
+		}
+
+		res, err := srv.Client().Do(req)
+		is.NoErr(err) // get pool stats
+		res.Body.Close()
+		return res
+	}
+
+	is.Equal(get(suid.UUID{}).StatusCode, http.StatusUnauthorized) // no access token
+	is.Equal(get(user).StatusCode, http.StatusForbidden)           // not an admin
+	is.Equal(get(admin).StatusCode, http.StatusOK)                 // admin
+}
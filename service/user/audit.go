@@ -0,0 +1,256 @@
+package user
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hyphengolang/prelude/types/email"
+	"github.com/hyphengolang/prelude/types/suid"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"secure.adoublef.com/internal"
+	"secure.adoublef.com/internal/auth"
+)
+
+/*
+Query the audit log, newest first. Admins only
+
+	[ ] GET /api/v1/admin/audit
+
+Verify the hash chain of the audit log. Admins only
+
+	[ ] GET /api/v1/admin/audit/verify
+*/
+func (s Service) adminRoutes(public jwk.Key) {
+	s.m.Group(func(r chi.Router) {
+		r.Use(auth.RequireAdmin(public, s.admins))
+
+		r.Get("/api/v1/admin/audit", s.handleGetAuditList())
+		r.Get("/api/v1/admin/audit/verify", s.handleVerifyAudit())
+	})
+}
+
+// audit appends an event for the request. The request may have been
+// cancelled so the service context is used, failures are only logged
+// as they should not change the outcome of the request.
+func (s Service) audit(r *http.Request, action, outcome string, actor, target suid.UUID) {
+	s.appendAudit(r, action, outcome, shortID(actor), shortID(target))
+}
+
+// auditEmail appends an event whose target is an email that belongs to no
+// account, it is recorded by the form returned from `emailTarget`
+func (s Service) auditEmail(r *http.Request, action, outcome string, target email.Email) {
+	s.appendAudit(r, action, outcome, "", emailTarget(target))
+}
+
+// emailTarget returns the SHA-256 of an email, so attempts against an email
+// can be found without storing it. Emails are compared without case.
+func emailTarget(e email.Email) string {
+	h := sha256.Sum256([]byte(strings.ToLower(e.String())))
+	return "email:" + hex.EncodeToString(h[:])
+}
+
+func (s Service) appendAudit(r *http.Request, action, outcome, actor, target string) {
+	if s.a == nil {
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	e := internal.AuditEvent{
+		ID:        suid.NewUUID(),
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+		Outcome:   outcome,
+	}
+
+	ctx, cancel := context.WithTimeout(s.Context(), auditTimeout)
+	defer cancel()
+
+	if err := s.a.Append(ctx, &e); err != nil {
+		s.logf("appending audit event %q: %v", action, err)
+	}
+}
+
+// outcome returns the outcome of an action that failed with err
+func outcome(err error) string {
+	if err != nil {
+		return internal.OutcomeFailure
+	}
+	return internal.OutcomeSuccess
+}
+
+// shortID returns the short form of an id, or empty if it is not set
+func shortID(id suid.UUID) string {
+	if id == (suid.UUID{}) {
+		return ""
+	}
+	return id.ShortUUID().String()
+}
+
+func (s Service) handleGetAuditList() http.HandlerFunc {
+	type links struct {
+		Next string `json:"next,omitempty"`
+	}
+
+	type payload struct {
+		Length int                   `json:"length"`
+		Data   []internal.AuditEvent `json:"data"`
+		Links  links                 `json:"links"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.a == nil {
+			s.respondText(w, r, http.StatusNotFound)
+			return
+		}
+
+		q, err := s.parseAuditQuery(r)
+		if err != nil {
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		// read one more than the limit to know if there is another page
+		limit := q.Limit
+		q.Limit++
+
+		es, err := s.a.SelectMany(r.Context(), q)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		more := len(es) > limit
+		if more {
+			es = es[:limit]
+		}
+
+		p := payload{
+			Length: len(es),
+			Data:   es,
+		}
+
+		if more {
+			v := r.URL.Query()
+			v.Set("before", strconv.FormatInt(es[len(es)-1].Seq, 10))
+
+			u := url.URL{Path: r.URL.Path, RawQuery: v.Encode()}
+			p.Links.Next = u.String()
+		}
+
+		s.respond(w, r, p, http.StatusOK)
+	}
+}
+
+func (s Service) handleVerifyAudit() http.HandlerFunc {
+	type payload struct {
+		Valid  bool   `json:"valid"`
+		Events int    `json:"events"`
+		Error  string `json:"error,omitempty"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.a == nil {
+			s.respondText(w, r, http.StatusNotFound)
+			return
+		}
+
+		var (
+			p    payload
+			prev []byte
+			q    = internal.AuditQuery{Limit: auditVerifyBatch}
+		)
+
+		// the log is read oldest first a page at a time,
+		// carrying the hash of the last event over
+		for {
+			es, err := s.a.SelectMany(r.Context(), q)
+			if err != nil {
+				s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+				return
+			}
+
+			if prev, err = internal.VerifyAuditChain(prev, es); err != nil {
+				p.Error = err.Error()
+				s.respond(w, r, p, http.StatusOK)
+				return
+			}
+
+			p.Events += len(es)
+			if len(es) < q.Limit {
+				break
+			}
+			q.After = es[len(es)-1].Seq
+		}
+
+		p.Valid = true
+		s.respond(w, r, p, http.StatusOK)
+	}
+}
+
+/*
+parseAuditQuery reads the following query parameters
+
+	limit         page size, defaults to 20 with a maximum of 100
+	before        sequence number to read the page before
+	actor         id of the user that made the request
+	action        action, such as "auth.sign_in"
+	target        id of the record acted upon
+	outcome       either "success" or "failure"
+	created_from  inclusive lower bound (RFC 3339)
+	created_to    exclusive upper bound (RFC 3339)
+*/
+func (s Service) parseAuditQuery(r *http.Request) (q internal.AuditQuery, err error) {
+	v := r.URL.Query()
+
+	q.Desc, q.Limit = true, defaultPageSize
+	if l := v.Get("limit"); l != "" {
+		if q.Limit, err = strconv.Atoi(l); err != nil || q.Limit < 1 || q.Limit > maxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+
+	if b := v.Get("before"); b != "" {
+		if q.Before, err = strconv.ParseInt(b, 10, 64); err != nil || q.Before < 1 {
+			return q, errors.New(`before must be a positive integer`)
+		}
+	}
+
+	q.Actor, q.Action, q.Target = v.Get("actor"), v.Get("action"), v.Get("target")
+
+	switch q.Outcome = v.Get("outcome"); q.Outcome {
+	case "", internal.OutcomeSuccess, internal.OutcomeFailure:
+	default:
+		return q, errors.New(`outcome must be either "success" or "failure"`)
+	}
+
+	if t := v.Get("created_from"); t != "" {
+		if q.CreatedFrom, err = time.Parse(time.RFC3339, t); err != nil {
+			return q, err
+		}
+	}
+
+	if t := v.Get("created_to"); t != "" {
+		if q.CreatedTo, err = time.Parse(time.RFC3339, t); err != nil {
+			return q, err
+		}
+	}
+
+	return q, nil
+}
@@ -1,9 +1,17 @@
 package user
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -30,10 +38,22 @@ Get current user info
 
 	[ ] GET /api/v1/account/me
 
-Delete my account
+Update my account using a JSON Merge Patch (RFC 7386)
+
+	[ ] PATCH /api/v1/account/me
+
+Delete my account, the account can be restored until the grace period ends
 
 	[ ] DELETE /api/v1/account/me
 
+Restore my deleted account with the "restoreToken" returned when it was
+deleted, passed in the "Authorization" header, and its password. The username
+and email of a deleted account are released for others to use straight away,
+the account cannot be restored once either is claimed and the request fails
+with 409 Conflict
+
+	[ ] POST /api/v1/account/me/restore
+
 Get a user's info by uuid
 
 	[ ] GET /api/v1/account/{uuid}
@@ -44,14 +64,17 @@ Sign in with credentials
 
 Sign out with credentials
 
-	[ ] POST /api/v1/token
+	[ ] DELETE /api/v1/token
 
 Refresh token
 
 	[ ] GET /api/v1/token
 */
 func (s Service) routes() {
-	private, public := auth.RS256()
+	private, public := s.private, s.public
+	if private == nil {
+		private, public = auth.RS256()
+	}
 
 	s.m.Route("/api/v1/account", func(r chi.Router) {
 		r.Post("/", s.handleCreateAccount())
@@ -60,28 +83,160 @@ func (s Service) routes() {
 		r.Get("/", s.handleGetAccountList())
 		r.Get("/{uuid}", s.handleGetAccount())
 		r.Get("/me", s.handleGetMyAccount(public))
-		r.Delete("/me", s.handleSignOut())
+		r.Patch("/me", s.handleUpdateMyAccount(public))
+		r.Delete("/me", s.handleDeleteMyAccount(private, public))
+		r.Post("/me/restore", s.handleRestoreMyAccount(public))
 	})
 
 	s.m.Route("/api/v1/auth", func(r chi.Router) {
 		r.Post("/", s.handleSignIn(private))
 
 		// authorization required
-		r.Delete("/", http.NotFound)
+		r.Delete("/", s.handleSignOut(public))
 		r.Get("/", s.handleRefreshToken(private, public))
 	})
+
+	s.adminRoutes(public)
 }
 
-func (s Service) handleSignOut() http.HandlerFunc {
+func (s Service) handleSignOut(public jwk.Key) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c := &http.Cookie{
-			Path:     "/",
-			Name:     cookieName,
-			HttpOnly: true,
-			MaxAge:   -1,
+		// the session may have expired, in which case the actor is unknown
+		var uid suid.UUID
+		if tk, err := auth.ParseCookie(r, public, cookieName, auth.TypeRefresh); err == nil {
+			uid, _ = auth.ClaimID(tk)
+		}
+
+		s.clearCookie(w)
+		s.audit(r, internal.ActionSignOut, internal.OutcomeSuccess, uid, uid)
+		s.respondText(w, r, http.StatusOK)
+	}
+}
+
+func (s Service) handleDeleteMyAccount(private, public jwk.Key) http.HandlerFunc {
+	type payload struct {
+		RestoreBefore time.Time `json:"restoreBefore"`
+		RestoreToken  string    `json:"restoreToken"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// auth middleware
+		tk, err := auth.ParseRequest(r, public, auth.TypeAccess)
+		if err != nil {
+			s.respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		uid, err := auth.ClaimID(tk)
+		if err != nil {
+			s.respondText(w, r, http.StatusInternalServerError)
+			return
+		}
+		// auth middleware
+
+		err = s.r.Delete(r.Context(), uid)
+		s.audit(r, internal.ActionDeleteAccount, outcome(err), uid, uid)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		me, err := s.r.Select(readPrimary(includeDeleted(r.Context())), uid)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusNotFound))
+			return
+		}
+
+		if me.DeletedAt == nil {
+			s.respondText(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		// the account is restored by its id, as its email
+		// may be claimed by another account once released
+		p := payload{
+			RestoreBefore: me.DeletedAt.Add(s.gracePeriod),
+		}
+
+		rts, err := auth.Sign(private, &auth.SignOption{
+			Type:       auth.TypeRestore,
+			Issuer:     "api.adoublef.com",
+			Subject:    suid.NewUUID().String(),
+			Expiration: time.Until(p.RestoreBefore),
+			Claims:     map[string]any{"id": uid.ShortUUID()},
+		})
+		if err != nil {
+			s.respond(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		p.RestoreToken = string(rts)
+
+		// tokens are only honoured for accounts that have not been deleted,
+		// removing the refresh token ends the session on this client
+		s.clearCookie(w)
+
+		s.respond(w, r, p, http.StatusAccepted)
+	}
+}
+
+func (s Service) handleRestoreMyAccount(public jwk.Key) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tk, err := auth.ParseRequest(r, public, auth.TypeRestore)
+		if err != nil {
+			s.respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		uid, err := auth.ClaimID(tk)
+		if err != nil {
+			s.respondText(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		var d User
+		if err := s.decode(w, r, &d); err != nil {
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		u, err := s.r.Select(readPrimary(includeDeleted(r.Context())), uid)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusNotFound))
+			return
+		}
+
+		if err := u.Password.Compare(d.Password.String()); err != nil {
+			s.audit(r, internal.ActionRestoreAccount, internal.OutcomeFailure, suid.UUID{}, u.ID)
+			s.respond(w, r, err, http.StatusForbidden)
+			return
+		}
+
+		if u.DeletedAt == nil {
+			s.respondText(w, r, http.StatusConflict)
+			return
+		}
+
+		// the token is only honoured for the deletion it was issued for,
+		// tokens are only precise to the second
+		if tk.IssuedAt().Before(u.DeletedAt.Truncate(time.Second)) {
+			s.respondText(w, r, http.StatusUnauthorized)
+			return
+		}
+
+		if time.Since(*u.DeletedAt) > s.gracePeriod {
+			s.respondText(w, r, http.StatusGone)
+			return
+		}
+
+		// fails with `internal.ErrAlreadyExists` if a live account
+		// has claimed the username or email since it was deleted
+		err = s.r.Restore(r.Context(), u.ID)
+		s.audit(r, internal.ActionRestoreAccount, outcome(err), u.ID, u.ID)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
 		}
 
-		s.setCookie(w, c)
 		s.respondText(w, r, http.StatusOK)
 	}
 }
@@ -93,21 +248,32 @@ func (s Service) handleRefreshToken(private, public jwk.Key) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		// auth middleware
-		jtk, err := auth.ParseCookie(r, public, cookieName)
+		jtk, err := auth.ParseCookie(r, public, cookieName, auth.TypeRefresh)
 		if err != nil {
+			s.audit(r, internal.ActionRefreshToken, internal.OutcomeFailure, suid.UUID{}, suid.UUID{})
 			s.respond(w, r, err, http.StatusUnauthorized)
 			return
 		}
 
-		e, ok := jtk.PrivateClaims()["email"].(string)
-		if !ok {
+		uid, err := auth.ClaimID(jtk)
+		if err != nil {
 			s.respondText(w, r, http.StatusInternalServerError)
 			return
 		}
 		// auth middleware
-		u, err := s.r.Select(r.Context(), email.Email(e))
+		u, err := s.r.Select(r.Context(), uid)
 		if err != nil {
-			s.respond(w, r, err, http.StatusForbidden)
+			s.audit(r, internal.ActionRefreshToken, internal.OutcomeFailure, uid, uid)
+			s.respond(w, r, err, s.status(err, http.StatusForbidden))
+			return
+		}
+
+		// sessions are revoked when an account is deleted, tokens are only
+		// precise to the second so those issued within it are honoured
+		if u.RevokedAt != nil && jtk.IssuedAt().Before(u.RevokedAt.Truncate(time.Second)) {
+			s.audit(r, internal.ActionRefreshToken, internal.OutcomeFailure, uid, uid)
+			s.clearCookie(w)
+			s.respond(w, r, errors.New("session has been revoked"), http.StatusUnauthorized)
 			return
 		}
 
@@ -117,6 +283,8 @@ func (s Service) handleRefreshToken(private, public jwk.Key) http.HandlerFunc {
 			return
 		}
 
+		s.audit(r, internal.ActionRefreshToken, internal.OutcomeSuccess, u.ID, u.ID)
+
 		tk := token{
 			AccessToken: string(ats),
 		}
@@ -140,11 +308,13 @@ func (s Service) handleSignIn(private jwk.Key) http.HandlerFunc {
 
 		u, err := s.r.Select(r.Context(), d.Email)
 		if err != nil {
-			s.respond(w, r, err, http.StatusNotFound)
+			s.auditEmail(r, internal.ActionSignIn, internal.OutcomeFailure, d.Email)
+			s.respond(w, r, err, s.status(err, http.StatusNotFound))
 			return
 		}
 
 		if err := u.Password.Compare(d.Password.String()); err != nil {
+			s.audit(r, internal.ActionSignIn, internal.OutcomeFailure, suid.UUID{}, u.ID)
 			s.respond(w, r, err, http.StatusForbidden)
 			return
 		}
@@ -155,6 +325,8 @@ func (s Service) handleSignIn(private jwk.Key) http.HandlerFunc {
 			return
 		}
 
+		s.audit(r, internal.ActionSignIn, internal.OutcomeSuccess, u.ID, u.ID)
+
 		rc := &http.Cookie{
 			Path:     "/",
 			Name:     cookieName,
@@ -186,7 +358,7 @@ func (s Service) handleGetAccount() http.HandlerFunc {
 
 		u, err := s.r.Select(r.Context(), uid)
 		if err != nil {
-			s.respond(w, r, err, http.StatusNotFound)
+			s.respond(w, r, err, s.status(err, http.StatusNotFound))
 			return
 		}
 
@@ -197,51 +369,256 @@ func (s Service) handleGetAccount() http.HandlerFunc {
 func (s Service) handleGetMyAccount(public jwk.Key) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// auth middleware
-		tk, err := auth.ParseRequest(r, public)
+		tk, err := auth.ParseRequest(r, public, auth.TypeAccess)
 		if err != nil {
 			s.respond(w, r, err, http.StatusUnauthorized)
 			return
 		}
 
-		e, ok := tk.PrivateClaims()["email"].(string)
-		if !ok {
+		uid, err := auth.ClaimID(tk)
+		if err != nil {
 			s.respondText(w, r, http.StatusInternalServerError)
 			return
 		}
 		// auth middleware
 
-		me, err := s.r.Select(r.Context(), email.Email(e))
+		me, err := s.r.Select(r.Context(), uid)
 		if err != nil {
-			s.respond(w, r, err, http.StatusNotFound)
+			s.respond(w, r, err, s.status(err, http.StatusNotFound))
 			return
 		}
 
+		w.Header().Set("ETag", etag(me.Version))
+		s.respond(w, r, me, http.StatusOK)
+	}
+}
+
+func (s Service) handleUpdateMyAccount(public jwk.Key) http.HandlerFunc {
+	// fields that can be modified by the account owner
+	type profile struct {
+		Username string      `json:"username"`
+		Email    email.Email `json:"email"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// auth middleware
+		tk, err := auth.ParseRequest(r, public, auth.TypeAccess)
+		if err != nil {
+			s.respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		uid, err := auth.ClaimID(tk)
+		if err != nil {
+			s.respondText(w, r, http.StatusInternalServerError)
+			return
+		}
+		// auth middleware
+
+		if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != mergePatchJSON {
+			s.respondText(w, r, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if r.Header.Get("If-Match") == "" {
+			s.respondText(w, r, http.StatusPreconditionRequired)
+			return
+		}
+
+		version, err := parseETag(r.Header.Get("If-Match"))
+		if err != nil {
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		me, err := s.r.Select(readPrimary(r.Context()), uid)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusNotFound))
+			return
+		}
+
+		if me.Version != version {
+			s.respondText(w, r, http.StatusPreconditionFailed)
+			return
+		}
+
+		var patch map[string]any
+		if err := s.decode(w, r, &patch); err != nil {
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		// values are decoded by custom unmarshalers which
+		// expect a JSON string
+		for k, v := range patch {
+			if _, ok := v.(string); v != nil && !ok {
+				s.respond(w, r, fmt.Errorf("%q must be a string", k), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var p profile
+		if err := mergePatch(profile{Username: me.Username, Email: me.Email}, patch, &p); err != nil {
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		if p.Username == "" || !p.Email.IsValid() {
+			s.respondText(w, r, http.StatusBadRequest)
+			return
+		}
+
+		me.Username, me.Email = p.Username, p.Email
+		err = s.r.Update(r.Context(), me)
+		s.audit(r, internal.ActionUpdateAccount, outcome(err), uid, uid)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		w.Header().Set("ETag", etag(me.Version))
 		s.respond(w, r, me, http.StatusOK)
 	}
 }
 
 func (s Service) handleGetAccountList() http.HandlerFunc {
+	type links struct {
+		Next string `json:"next,omitempty"`
+		Prev string `json:"prev,omitempty"`
+	}
+
 	type payload struct {
 		Length int             `json:"length"`
+		Total  int             `json:"total"`
 		Data   []internal.User `json:"data"`
+		Links  links           `json:"links"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		us, err := s.r.SelectMany(r.Context())
+		q, err := s.parseUserQuery(r)
 		if err != nil {
-			s.respond(w, r, err, http.StatusInternalServerError)
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		// read one more than the limit to know if there is another page
+		limit := q.Limit
+		q.Limit++
+
+		us, err := s.r.SelectMany(r.Context(), q)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		more := len(us) > limit
+		if more && q.Before != nil {
+			us = us[1:]
+		} else if more {
+			us = us[:limit]
+		}
+
+		total, err := s.r.Count(r.Context(), q)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
 			return
 		}
 
 		p := payload{
 			Length: len(us),
+			Total:  total,
 			Data:   us,
 		}
 
+		if len(us) > 0 {
+			if more || q.Before != nil {
+				p.Links.Next = pageURL(r, "after", internal.CursorOf(&us[len(us)-1]))
+			}
+
+			if (more && q.Before != nil) || q.After != nil {
+				p.Links.Prev = pageURL(r, "before", internal.CursorOf(&us[0]))
+			}
+		}
+
 		s.respond(w, r, p, http.StatusOK)
 	}
 }
 
+/*
+parseUserQuery reads the following query parameters
+
+	limit         page size, defaults to 20 with a maximum of 100
+	after         cursor to read the page after
+	before        cursor to read the page before
+	username      username prefix
+	email         email prefix
+	created_from  inclusive lower bound (RFC 3339)
+	created_to    exclusive upper bound (RFC 3339)
+	sort          either "created_at" or "-created_at"
+*/
+func (s Service) parseUserQuery(r *http.Request) (q internal.UserQuery, err error) {
+	v := r.URL.Query()
+
+	q.Limit = defaultPageSize
+	if l := v.Get("limit"); l != "" {
+		if q.Limit, err = strconv.Atoi(l); err != nil || q.Limit < 1 || q.Limit > maxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+
+	if c := v.Get("after"); c != "" {
+		if q.After, err = internal.ParseCursor(c); err != nil {
+			return q, err
+		}
+	}
+
+	if c := v.Get("before"); c != "" {
+		if q.Before, err = internal.ParseCursor(c); err != nil {
+			return q, err
+		}
+	}
+
+	if q.After != nil && q.Before != nil {
+		return q, errors.New(`only one of "after" or "before" can be set`)
+	}
+
+	q.UsernamePrefix, q.EmailPrefix = v.Get("username"), v.Get("email")
+
+	if t := v.Get("created_from"); t != "" {
+		if q.CreatedFrom, err = time.Parse(time.RFC3339, t); err != nil {
+			return q, err
+		}
+	}
+
+	if t := v.Get("created_to"); t != "" {
+		if q.CreatedTo, err = time.Parse(time.RFC3339, t); err != nil {
+			return q, err
+		}
+	}
+
+	switch v.Get("sort") {
+	case "", "created_at":
+	case "-created_at":
+		q.Desc = true
+	default:
+		return q, errors.New(`sort must be either "created_at" or "-created_at"`)
+	}
+
+	return q, nil
+}
+
+// pageURL returns the request URL with the cursor
+// of the next or previous page
+func pageURL(r *http.Request, key string, c *internal.Cursor) string {
+	v := r.URL.Query()
+	v.Del("after")
+	v.Del("before")
+	v.Set(key, c.String())
+
+	u := url.URL{Path: r.URL.Path, RawQuery: v.Encode()}
+	return u.String()
+}
+
 func (s Service) handleCreateAccount() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var u internal.User
@@ -250,8 +627,10 @@ func (s Service) handleCreateAccount() http.HandlerFunc {
 			return
 		}
 
-		if err := s.r.Insert(r.Context(), &u); err != nil {
-			s.respond(w, r, err, http.StatusInternalServerError)
+		err := s.r.Insert(r.Context(), &u)
+		s.audit(r, internal.ActionCreateAccount, outcome(err), suid.UUID{}, u.ID)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
 			return
 		}
 
@@ -268,19 +647,19 @@ func (s Service) signedTokens(private jwk.Key, u *internal.User) (its, ats, rts
 	}
 
 	// its
-	o.Expiration = time.Hour * 10
+	o.Type, o.Expiration = auth.TypeID, time.Hour*10
 	if its, err = auth.Sign(private, &o); err != nil {
 		return
 	}
 
 	// ats
-	o.Expiration = time.Minute * 5
+	o.Type, o.Expiration = auth.TypeAccess, time.Minute*5
 	if ats, err = auth.Sign(private, &o); err != nil {
 		return
 	}
 
 	// rts
-	o.Expiration = time.Hour * 24 * 7
+	o.Type, o.Expiration = auth.TypeRefresh, time.Hour*24*7
 	if rts, err = auth.Sign(private, &o); err != nil {
 		return
 	}
@@ -288,6 +667,67 @@ func (s Service) signedTokens(private jwk.Key, u *internal.User) (its, ats, rts
 	return
 }
 
+// includeDeleted allows soft deleted accounts to be read,
+// used when the account owner needs to manage a deleted account
+func includeDeleted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internal.RuleIncludeDeleted, true)
+}
+
+// readPrimary reads from the primary when the store has replicas, used
+// to read back a write or the account that an update is made to
+func readPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internal.RuleReadPrimary, true)
+}
+
+func (s Service) clearCookie(w http.ResponseWriter) {
+	c := &http.Cookie{
+		Path:     "/",
+		Name:     cookieName,
+		HttpOnly: true,
+		MaxAge:   -1,
+	}
+
+	s.setCookie(w, c)
+}
+
+// purge will periodically hard delete accounts whose grace period
+// has ended. It returns once the service context is done.
+func (s Service) purge() {
+	t := time.NewTicker(s.purgeInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.Context().Done():
+			return
+		case <-t.C:
+			n, err := s.r.Purge(s.Context(), s.gracePeriod)
+			if err != nil {
+				s.logf("purging deleted accounts: %v", err)
+				continue
+			}
+
+			if n > 0 {
+				s.logf("purged %d deleted accounts", n)
+			}
+		}
+	}
+}
+
+// status returns the status code of a domain error,
+// otherwise the fallback is returned
+func (s Service) status(err error, fallback int) int {
+	switch {
+	case errors.Is(err, internal.ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, internal.ErrAlreadyExists):
+		return http.StatusConflict
+	case errors.Is(err, internal.ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	}
+	return fallback
+}
+
 func (s Service) respondText(w http.ResponseWriter, r *http.Request, status int) {
 	s.respond(w, r, http.StatusText(status), status)
 }
@@ -328,6 +768,16 @@ type Service struct {
 	ctx context.Context
 
 	r internal.UserRepo
+	// records security-relevant events when set
+	a internal.AuditRepo
+	// ids of the users allowed to query the audit log
+	admins map[suid.UUID]bool
+
+	gracePeriod   time.Duration
+	purgeInterval time.Duration
+
+	// tokens are signed with private and verified with public
+	private, public jwk.Key
 
 	m         chi.Router
 	respond   func(w http.ResponseWriter, r *http.Request, data any, status int)
@@ -351,22 +801,134 @@ func (s Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.m.ServeHTTP(w, r)
 }
 
-func NewService(ctx context.Context, m chi.Router, r internal.UserRepo) http.Handler {
+type Option func(s *Service)
+
+// WithGracePeriod sets how long a deleted account can be restored
+// before it is permanently removed.
+func WithGracePeriod(d time.Duration) Option {
+	return func(s *Service) { s.gracePeriod = d }
+}
+
+// WithPurgeInterval sets how often accounts with an ended grace
+// period are permanently removed.
+func WithPurgeInterval(d time.Duration) Option {
+	return func(s *Service) { s.purgeInterval = d }
+}
+
+// WithKeys sets the keys that tokens are signed and verified with,
+// otherwise a new pair is generated when the service is created.
+func WithKeys(private, public jwk.Key) Option {
+	return func(s *Service) { s.private, s.public = private, public }
+}
+
+// WithAudit records sign-ins, token refreshes and changes
+// to accounts in the audit log.
+func WithAudit(a internal.AuditRepo) Option {
+	return func(s *Service) { s.a = a }
+}
+
+// WithAdmins allows the users to query the audit log.
+func WithAdmins(ids ...suid.UUID) Option {
+	return func(s *Service) {
+		for _, id := range ids {
+			s.admins[id] = true
+		}
+	}
+}
+
+// NewService returns the user service, which purges accounts whose
+// grace period has ended until ctx is done.
+func NewService(ctx context.Context, m chi.Router, r internal.UserRepo, opts ...Option) http.Handler {
 	s := &Service{
-		ctx:       ctx,
-		r:         r,
-		m:         m,
-		respond:   www.Respond,
-		decode:    www.Decode,
-		created:   www.Created,
-		setCookie: http.SetCookie,
-		log:       log.Println,
-		logf:      log.Printf,
+		ctx:           ctx,
+		r:             r,
+		admins:        make(map[suid.UUID]bool),
+		gracePeriod:   defaultGracePeriod,
+		purgeInterval: defaultPurgeInterval,
+		m:             m,
+		respond:       www.Respond,
+		decode:        www.Decode,
+		created:       www.Created,
+		setCookie:     http.SetCookie,
+		log:           log.Println,
+		logf:          log.Printf,
 	}
+
+	for _, o := range opts {
+		o(s)
+	}
+
 	s.routes()
+	go s.purge()
 	return s
 }
 
 const (
 	cookieName = "__adf"
+
+	mergePatchJSON = "application/merge-patch+json"
+
+	defaultPageSize = 20
+	maxPageSize     = 100
+
+	defaultGracePeriod   = time.Hour * 24 * 30
+	defaultPurgeInterval = time.Hour
+
+	auditTimeout     = time.Second * 5
+	auditVerifyBatch = 500
 )
+
+func etag(version int) string { return strconv.Quote(strconv.Itoa(version)) }
+
+func parseETag(s string) (int, error) {
+	s, err := strconv.Unquote(strings.TrimPrefix(s, "W/"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid entity tag: %w", err)
+	}
+
+	return strconv.Atoi(s)
+}
+
+// mergePatch applies a JSON Merge Patch (RFC 7386) to doc and
+// decodes the result into v, unknown fields are rejected.
+func mergePatch(doc any, patch map[string]any, v any) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	var target map[string]any
+	if err := json.Unmarshal(b, &target); err != nil {
+		return err
+	}
+
+	if b, err = json.Marshal(mergeValue(target, patch)); err != nil {
+		return err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
+
+func mergeValue(target any, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergeValue(t[k], v)
+		}
+	}
+
+	return t
+}
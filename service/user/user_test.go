@@ -9,29 +9,30 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/hyphengolang/prelude/types/password"
+	"github.com/hyphengolang/prelude/types/suid"
 
-	"secure.adoublef.com/store/user"
+	"secure.adoublef.com/internal"
+	"secure.adoublef.com/store/memory"
 )
 
 const (
 	applicationJson = "application/json"
 )
 
-var h http.Handler
-
-func init() {
-	h = NewService(context.Background(), chi.NewMux(), user.RepoTest)
-}
-
 func TestService(t *testing.T) {
 	t.Parallel()
-	is, ctx := is.New(t), context.TODO()
-	_, _ = is, ctx
+	is := is.New(t)
+
+	// stops the purger of the service
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
 
-	srv := httptest.NewServer(h)
+	srv := httptest.NewServer(NewService(ctx, chi.NewMux(), memory.NewUserRepo(ctx)))
 
 	t.Cleanup(func() { srv.Close() })
 
@@ -81,6 +82,41 @@ func TestService(t *testing.T) {
 		is.Equal(bd.Length, 2) // get the two registered accounts
 	})
 
+	t.Run("paginate the list of accounts", func(t *testing.T) {
+		type body struct {
+			Length int `json:"length"`
+			Total  int `json:"total"`
+			Links  struct {
+				Next string `json:"next"`
+				Prev string `json:"prev"`
+			} `json:"links"`
+		}
+
+		res, _ := srv.Client().Get(srv.URL + "/api/v1/account/?limit=1")
+		is.Equal(res.StatusCode, http.StatusOK) // list first page
+
+		var bd body
+		_ = json.NewDecoder(res.Body).Decode(&bd)
+		res.Body.Close()
+		is.Equal(bd.Length, 1)       // one account per page
+		is.Equal(bd.Total, 2)        // two registered accounts
+		is.True(bd.Links.Next != "") // there is a next page
+		is.Equal(bd.Links.Prev, "")  // there is no previous page
+
+		res, _ = srv.Client().Get(srv.URL + bd.Links.Next)
+		is.Equal(res.StatusCode, http.StatusOK) // list next page
+
+		bd = body{}
+		_ = json.NewDecoder(res.Body).Decode(&bd)
+		res.Body.Close()
+		is.Equal(bd.Length, 1)       // last account
+		is.Equal(bd.Links.Next, "")  // there is no next page
+		is.True(bd.Links.Prev != "") // there is a previous page
+
+		res, _ = srv.Client().Get(srv.URL + "/api/v1/account/?after=invalid")
+		is.Equal(res.StatusCode, http.StatusBadRequest) // invalid cursor
+	})
+
 	t.Run("get a user by a key", func(t *testing.T) {
 		sid := lastSplitValue(fizzUrl.String(), "/")
 		res, _ := srv.Client().Get(srv.URL + "/api/v1/account/" + sid)
@@ -141,6 +177,42 @@ func TestService(t *testing.T) {
 		is.Equal(res.StatusCode, http.StatusOK) // authorized endpoint
 	})
 
+	t.Run(`update account for "i_am_fizz"`, func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/account/me", nil)
+		req.Header.Set(`Authorization`, fmt.Sprintf(`Bearer %s`, fizzTk.AccessToken))
+		res, _ := srv.Client().Do(req)
+		is.Equal(res.StatusCode, http.StatusOK) // get current account
+		etag := res.Header.Get("ETag")
+		is.True(etag != "") // entity tag is set
+
+		patch := func(payload, ifMatch string) *http.Response {
+			req, _ := http.NewRequest(http.MethodPatch, srv.URL+"/api/v1/account/me", strings.NewReader(payload))
+			req.Header.Set(`Authorization`, fmt.Sprintf(`Bearer %s`, fizzTk.AccessToken))
+			req.Header.Set(`Content-Type`, mergePatchJSON)
+			if ifMatch != "" {
+				req.Header.Set(`If-Match`, ifMatch)
+			}
+			res, _ := srv.Client().Do(req)
+			return res
+		}
+
+		res = patch(`{"username":"i_am_fizzy"}`, "")
+		is.Equal(res.StatusCode, http.StatusPreconditionRequired) // missing "If-Match"
+
+		res = patch(`{"username":null}`, etag)
+		is.Equal(res.StatusCode, http.StatusBadRequest) // username is required
+
+		res = patch(`{"role":"admin"}`, etag)
+		is.Equal(res.StatusCode, http.StatusBadRequest) // unknown field
+
+		res = patch(`{"username":"i_am_fizzy"}`, etag)
+		is.Equal(res.StatusCode, http.StatusOK) // update username
+		is.True(res.Header.Get("ETag") != etag) // version has changed
+
+		res = patch(`{"username":"i_am_fuzzy"}`, etag)
+		is.Equal(res.StatusCode, http.StatusPreconditionFailed) // stale version
+	})
+
 	t.Run(`refresh token for "i_am_fizz"`, func(t *testing.T) {
 		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/auth/", nil)
 		req.AddCookie(fizzC)
@@ -148,8 +220,248 @@ func TestService(t *testing.T) {
 		res, _ := srv.Client().Do(req)
 		is.Equal(res.StatusCode, http.StatusOK) // refresh token
 	})
+
+	t.Run(`delete and restore account for "i_am_fizz"`, func(t *testing.T) {
+		// tokens are only precise to the second, so the session of
+		// "i_am_fizz" is from before the second it is deleted in
+		time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+		req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/api/v1/account/me", nil)
+		req.Header.Set(`Authorization`, fmt.Sprintf(`Bearer %s`, fizzTk.AccessToken))
+		res, _ := srv.Client().Do(req)
+		is.Equal(res.StatusCode, http.StatusAccepted) // delete account
+
+		var deleted struct {
+			RestoreToken string `json:"restoreToken"`
+		}
+		err := json.NewDecoder(res.Body).Decode(&deleted)
+		res.Body.Close()
+		is.NoErr(err) // parsing json with restore token
+
+		restore := func(token, payload string) int {
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/account/me/restore", strings.NewReader(payload))
+			req.Header.Set(`Content-Type`, applicationJson)
+			req.Header.Set(`Authorization`, fmt.Sprintf(`Bearer %s`, token))
+			res, _ := srv.Client().Do(req)
+			res.Body.Close()
+			return res.StatusCode
+		}
+
+		req, _ = http.NewRequest(http.MethodGet, srv.URL+"/api/v1/account/me", nil)
+		req.Header.Set(`Authorization`, fmt.Sprintf(`Bearer %s`, fizzTk.AccessToken))
+		res, _ = srv.Client().Do(req)
+		is.Equal(res.StatusCode, http.StatusNotFound) // account is deleted
+
+		req, _ = http.NewRequest(http.MethodGet, srv.URL+"/api/v1/auth/", nil)
+		req.AddCookie(fizzC)
+		res, _ = srv.Client().Do(req)
+		is.Equal(res.StatusCode, http.StatusForbidden) // session is revoked
+
+		payload := `
+		{
+			"email":"fizz@mail.com",
+			"password":"p4$$w4rD"
+		}`
+
+		res, _ = srv.Client().Post(srv.URL+"/api/v1/auth/", applicationJson, strings.NewReader(payload))
+		is.Equal(res.StatusCode, http.StatusNotFound) // cannot sign-in to a deleted account
+
+		res, _ = srv.Client().Get(srv.URL + "/api/v1/account/")
+		var bd struct {
+			Length int `json:"length"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&bd)
+		res.Body.Close()
+		is.Equal(bd.Length, 1) // deleted account is not listed
+
+		is.Equal(restore(fizzTk.AccessToken, payload), http.StatusUnauthorized) // not a restore token
+
+		is.Equal(restore(deleted.RestoreToken, `{"password":"fizz_$PW_10"}`), http.StatusForbidden) // invalid password
+
+		is.Equal(restore(deleted.RestoreToken, payload), http.StatusOK) // restore account
+
+		is.Equal(restore(deleted.RestoreToken, payload), http.StatusConflict) // account is not deleted
+
+		req, _ = http.NewRequest(http.MethodGet, srv.URL+"/api/v1/auth/", nil)
+		req.AddCookie(fizzC)
+		res, _ = srv.Client().Do(req)
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // session stays revoked once restored
+
+		res, _ = srv.Client().Post(srv.URL+"/api/v1/auth/", applicationJson, strings.NewReader(payload))
+		is.Equal(res.StatusCode, http.StatusOK) // sign-in again
+
+		req, _ = http.NewRequest(http.MethodGet, srv.URL+"/api/v1/auth/", nil)
+		for _, c := range res.Cookies() {
+			req.AddCookie(c)
+		}
+		res, _ = srv.Client().Do(req)
+		is.Equal(res.StatusCode, http.StatusOK) // new session is honoured
+	})
+
+	t.Run(`restore fails once the email of "i_am_fizz" is claimed`, func(t *testing.T) {
+		payload := `
+		{
+			"email":"fizz@mail.com",
+			"password":"p4$$w4rD"
+		}`
+
+		res, _ := srv.Client().Post(srv.URL+"/api/v1/auth/", applicationJson, strings.NewReader(payload))
+		is.Equal(res.StatusCode, http.StatusOK) // sign-in
+
+		var tk struct {
+			AccessToken string `json:"accessToken"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&tk)
+		res.Body.Close()
+
+		req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/api/v1/account/me", nil)
+		req.Header.Set(`Authorization`, fmt.Sprintf(`Bearer %s`, tk.AccessToken))
+		res, _ = srv.Client().Do(req)
+		is.Equal(res.StatusCode, http.StatusAccepted) // delete account
+
+		var deleted struct {
+			RestoreToken string `json:"restoreToken"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&deleted)
+		res.Body.Close()
+
+		claim := `
+		{
+			"username":"i_am_fizz_too",
+			"email":"fizz@mail.com",
+			"password":"p4$$w4rD"
+		}`
+
+		res, _ = srv.Client().Post(srv.URL+"/api/v1/account/", applicationJson, strings.NewReader(claim))
+		is.Equal(res.StatusCode, http.StatusCreated) // email was released
+
+		req, _ = http.NewRequest(http.MethodPost, srv.URL+"/api/v1/account/me/restore", strings.NewReader(payload))
+		req.Header.Set(`Content-Type`, applicationJson)
+		req.Header.Set(`Authorization`, fmt.Sprintf(`Bearer %s`, deleted.RestoreToken))
+		res, _ = srv.Client().Do(req)
+		is.Equal(res.StatusCode, http.StatusConflict) // email has been claimed
+	})
 }
 
 func lastSplitValue(s, substr string) string {
 	return s[strings.LastIndex(s, substr)+1:]
 }
+
+func TestAudit(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	// stops the purger of the service
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	ur, ar := memory.NewUserRepo(ctx), memory.NewAuditRepo(ctx, true)
+
+	admin := internal.User{
+		ID:       suid.NewUUID(),
+		Username: "i_am_admin",
+		Email:    "admin@mail.com",
+		Password: password.Password("p4$$w4rD").MustHash(),
+	}
+	is.NoErr(ur.Insert(ctx, &admin)) // insert admin
+
+	srv := httptest.NewServer(NewService(ctx, chi.NewMux(), ur, WithAudit(ar), WithAdmins(admin.ID)))
+	t.Cleanup(func() { srv.Close() })
+
+	signIn := func(payload string) (int, string) {
+		res, _ := srv.Client().Post(srv.URL+"/api/v1/auth/", applicationJson, strings.NewReader(payload))
+
+		var tk struct {
+			AccessToken string `json:"accessToken"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&tk)
+		res.Body.Close()
+		return res.StatusCode, tk.AccessToken
+	}
+
+	get := func(path, token string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		req.Header.Set(`Authorization`, fmt.Sprintf(`Bearer %s`, token))
+		res, _ := srv.Client().Do(req)
+		return res
+	}
+
+	payload := `
+	{
+		"username":"i_am_fizz",
+		"email":"fizz@mail.com",
+		"password":"p4$$w4rD"
+	}`
+
+	res, _ := srv.Client().Post(srv.URL+"/api/v1/account/", applicationJson, strings.NewReader(payload))
+	is.Equal(res.StatusCode, http.StatusCreated) // register "i_am_fizz"
+
+	status, _ := signIn(`{"email":"fizz@mail.com","password":"fizz_$PW_10"}`)
+	is.Equal(status, http.StatusForbidden) // invalid password
+
+	status, fizzTk := signIn(payload)
+	is.Equal(status, http.StatusOK) // "i_am_fizz" signs in
+
+	status, adminTk := signIn(`{"email":"admin@mail.com","password":"p4$$w4rD"}`)
+	is.Equal(status, http.StatusOK) // admin signs in
+
+	res = get("/api/v1/admin/audit", "")
+	is.Equal(res.StatusCode, http.StatusUnauthorized) // not signed in
+
+	res = get("/api/v1/admin/audit", fizzTk)
+	is.Equal(res.StatusCode, http.StatusForbidden) // not an admin
+
+	type body struct {
+		Length int                   `json:"length"`
+		Data   []internal.AuditEvent `json:"data"`
+		Links  struct {
+			Next string `json:"next"`
+		} `json:"links"`
+	}
+
+	res = get("/api/v1/admin/audit?action=auth.sign_in&limit=2", adminTk)
+	is.Equal(res.StatusCode, http.StatusOK) // query sign-ins
+
+	var bd body
+	_ = json.NewDecoder(res.Body).Decode(&bd)
+	res.Body.Close()
+	is.Equal(bd.Length, 2)                                    // limited to two
+	is.Equal(bd.Data[0].Actor, admin.ID.ShortUUID().String()) // newest first
+	is.True(bd.Links.Next != "")                              // there is a next page
+
+	res = get(bd.Links.Next, adminTk)
+	is.Equal(res.StatusCode, http.StatusOK) // next page
+
+	bd = body{}
+	_ = json.NewDecoder(res.Body).Decode(&bd)
+	res.Body.Close()
+	is.Equal(bd.Length, 1)                                // failed sign-in
+	is.Equal(bd.Data[0].Outcome, internal.OutcomeFailure) // has failed
+	is.Equal(bd.Data[0].Actor, "")                        // actor is unknown
+	is.Equal(bd.Links.Next, "")                           // there is no next page
+
+	res = get("/api/v1/admin/audit/verify", adminTk)
+	is.Equal(res.StatusCode, http.StatusOK) // verify the chain
+
+	var v struct {
+		Valid  bool `json:"valid"`
+		Events int  `json:"events"`
+	}
+	_ = json.NewDecoder(res.Body).Decode(&v)
+	res.Body.Close()
+	is.True(v.Valid)      // chain is intact
+	is.Equal(v.Events, 4) // created, failed and two sign-ins
+
+	status, _ = signIn(`{"email":"fuzz@mail.com","password":"p4$$w4rD"}`)
+	is.Equal(status, http.StatusNotFound) // unknown email
+
+	res = get("/api/v1/admin/audit?target="+emailTarget("FUZZ@mail.com"), adminTk)
+	is.Equal(res.StatusCode, http.StatusOK) // query by email
+
+	bd = body{}
+	_ = json.NewDecoder(res.Body).Decode(&bd)
+	res.Body.Close()
+	is.Equal(bd.Length, 1)                                // failed sign-in
+	is.Equal(bd.Data[0].Action, internal.ActionSignIn)    // sign-in
+	is.True(!strings.Contains(bd.Data[0].Target, "fuzz")) // email is not stored
+}
@@ -0,0 +1,772 @@
+// Package webhook delivers the events of accounts to the webhooks
+// registered by admins.
+//
+// Each event is posted as JSON to every webhook that wants its type.
+// Requests are signed so that receivers can tell they were sent by
+// this service, see `Sign`. Failed deliveries are retried with an
+// exponential backoff until they run out of attempts, they are then
+// dead and kept in the delivery log until retried by an admin.
+//
+// Deliveries are made at least once, receivers should discard those with
+// a "Webhook-Id" they have already seen. Webhooks cannot point at loopback,
+// private or link-local addresses, which are checked again as they are
+// dialed, and redirects are not followed.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	www "github.com/hyphengolang/prelude/http"
+	"github.com/hyphengolang/prelude/types/suid"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"secure.adoublef.com/internal"
+	"secure.adoublef.com/internal/auth"
+)
+
+/*
+Register a webhook, the secret is only included in this response. Admins only
+
+	[ ] POST /api/v1/admin/webhooks
+
+Get list of webhooks. Admins only
+
+	[ ] GET /api/v1/admin/webhooks
+
+Delete a webhook along with its deliveries. Admins only
+
+	[ ] DELETE /api/v1/admin/webhooks/{uuid}
+
+Get the delivery log of a webhook, newest first. Admins only
+
+	[ ] GET /api/v1/admin/webhooks/{uuid}/deliveries
+
+Retry a delivery with a fresh set of attempts. Admins only
+
+	[ ] POST /api/v1/admin/webhooks/{uuid}/deliveries/{delivery}/retry
+*/
+func (s Service) routes() {
+	s.m.Route("/api/v1/admin/webhooks", func(r chi.Router) {
+		r.Use(auth.RequireAdmin(s.public, s.admins))
+
+		r.Post("/", s.handleCreateWebhook())
+		r.Get("/", s.handleGetWebhookList())
+		r.Delete("/{uuid}", s.handleDeleteWebhook())
+		r.Get("/{uuid}/deliveries", s.handleGetDeliveryList())
+		r.Post("/{uuid}/deliveries/{delivery}/retry", s.handleRetryDelivery())
+	})
+}
+
+// Webhook is the JSON representation of a webhook
+type Webhook struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Only set when the webhook is created
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func newWebhook(w *internal.Webhook) Webhook {
+	events := w.Events
+	if events == nil {
+		events = []string{}
+	}
+
+	return Webhook{
+		ID:        w.ID.ShortUUID().String(),
+		URL:       w.URL,
+		Events:    events,
+		CreatedAt: w.CreatedAt,
+	}
+}
+
+// Delivery is the JSON representation of a delivery
+type Delivery struct {
+	ID        string `json:"id"`
+	Seq       int64  `json:"seq"`
+	WebhookID string `json:"webhookId"`
+	// Sent as the "Webhook-Id" header
+	EventID   string          `json:"eventId"`
+	EventType string          `json:"eventType"`
+	Payload   json.RawMessage `json:"payload"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	// Only set while the delivery is pending
+	NextAttemptAt  *time.Time `json:"nextAttemptAt,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+	ResponseStatus int        `json:"responseStatus,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	UpdatedAt      time.Time  `json:"updatedAt"`
+}
+
+func newDelivery(d *internal.Delivery) Delivery {
+	v := Delivery{
+		ID:             d.ID.ShortUUID().String(),
+		Seq:            d.Seq,
+		WebhookID:      d.WebhookID.ShortUUID().String(),
+		EventID:        d.EventID.String(),
+		EventType:      d.EventType,
+		Payload:        d.Payload,
+		Status:         d.Status,
+		Attempts:       d.Attempts,
+		LastError:      d.LastError,
+		ResponseStatus: d.ResponseStatus,
+		CreatedAt:      d.CreatedAt,
+		UpdatedAt:      d.UpdatedAt,
+	}
+
+	if d.Status == internal.DeliveryPending {
+		v.NextAttemptAt = &d.NextAttemptAt
+	}
+	return v
+}
+
+// eventTypes are the types of event that a webhook can want
+var eventTypes = map[string]bool{
+	internal.EventAccountCreated:  true,
+	internal.EventAccountUpdated:  true,
+	internal.EventAccountDeleted:  true,
+	internal.EventAccountRestored: true,
+	internal.EventAccountPurged:   true,
+}
+
+func (s Service) handleCreateWebhook() http.HandlerFunc {
+	type request struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var d request
+		if err := s.decode(w, r, &d); err != nil {
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		u, err := url.Parse(d.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			s.respond(w, r, errors.New(`url must be an absolute http or https url`), http.StatusBadRequest)
+			return
+		}
+
+		if !s.private && !publicHost(u.Hostname()) {
+			s.respond(w, r, errBlockedAddress, http.StatusBadRequest)
+			return
+		}
+
+		for _, typ := range d.Events {
+			if !eventTypes[typ] {
+				s.respond(w, r, fmt.Errorf("unknown event type %q", typ), http.StatusBadRequest)
+				return
+			}
+		}
+
+		secret, err := newSecret()
+		if err != nil {
+			s.respondText(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		wh := internal.Webhook{
+			ID:     suid.NewUUID(),
+			URL:    d.URL,
+			Events: d.Events,
+			Secret: secret,
+		}
+
+		if err := s.r.InsertWebhook(r.Context(), &wh); err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		p := newWebhook(&wh)
+		p.Secret = wh.Secret
+
+		w.Header().Set("Location", path.Join(r.URL.Path, p.ID))
+		s.respond(w, r, p, http.StatusCreated)
+	}
+}
+
+func (s Service) handleGetWebhookList() http.HandlerFunc {
+	type payload struct {
+		Length int       `json:"length"`
+		Data   []Webhook `json:"data"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ws, err := s.r.SelectWebhooks(r.Context())
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		p := payload{Length: len(ws), Data: make([]Webhook, len(ws))}
+		for i := range ws {
+			p.Data[i] = newWebhook(&ws[i])
+		}
+
+		s.respond(w, r, p, http.StatusOK)
+	}
+}
+
+func (s Service) handleDeleteWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := suid.ParseString(chi.URLParam(r, "uuid"))
+		if err != nil {
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		if err := s.r.DeleteWebhook(r.Context(), id); err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		s.respondText(w, r, http.StatusOK)
+	}
+}
+
+func (s Service) handleGetDeliveryList() http.HandlerFunc {
+	type links struct {
+		Next string `json:"next,omitempty"`
+	}
+
+	type payload struct {
+		Length int        `json:"length"`
+		Data   []Delivery `json:"data"`
+		Links  links      `json:"links"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := suid.ParseString(chi.URLParam(r, "uuid"))
+		if err != nil {
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		if _, err := s.r.SelectWebhook(r.Context(), id); err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		q, err := parseDeliveryQuery(r)
+		if err != nil {
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+		q.WebhookID = id
+
+		// read one more than the limit to know if there is another page
+		limit := q.Limit
+		q.Limit++
+
+		ds, err := s.r.SelectDeliveries(r.Context(), q)
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		var p payload
+		if len(ds) > limit {
+			ds = ds[:limit]
+
+			v := r.URL.Query()
+			v.Set("before", strconv.FormatInt(ds[len(ds)-1].Seq, 10))
+
+			u := url.URL{Path: r.URL.Path, RawQuery: v.Encode()}
+			p.Links.Next = u.String()
+		}
+
+		p.Length, p.Data = len(ds), make([]Delivery, len(ds))
+		for i := range ds {
+			p.Data[i] = newDelivery(&ds[i])
+		}
+
+		s.respond(w, r, p, http.StatusOK)
+	}
+}
+
+func (s Service) handleRetryDelivery() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := suid.ParseString(chi.URLParam(r, "uuid"))
+		if err != nil {
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		did, err := suid.ParseString(chi.URLParam(r, "delivery"))
+		if err != nil {
+			s.respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		d, err := s.r.SelectDelivery(r.Context(), did)
+		if err == nil && d.WebhookID != id {
+			err = internal.ErrNotFound
+		}
+
+		if err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		if d.Status == internal.DeliveryPending {
+			s.respond(w, r, errors.New(`delivery is already pending`), http.StatusConflict)
+			return
+		}
+
+		d.Status, d.Attempts, d.NextAttemptAt = internal.DeliveryPending, 0, time.Now().UTC()
+		if err := s.r.UpdateDelivery(r.Context(), d); err != nil {
+			s.respond(w, r, err, s.status(err, http.StatusInternalServerError))
+			return
+		}
+
+		s.respond(w, r, newDelivery(d), http.StatusAccepted)
+	}
+}
+
+func parseDeliveryQuery(r *http.Request) (internal.DeliveryQuery, error) {
+	q, v := internal.DeliveryQuery{Limit: defaultPageSize}, r.URL.Query()
+
+	var err error
+	if l := v.Get("limit"); l != "" {
+		if q.Limit, err = strconv.Atoi(l); err != nil || q.Limit < 1 || q.Limit > maxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+
+	if b := v.Get("before"); b != "" {
+		if q.Before, err = strconv.ParseInt(b, 10, 64); err != nil || q.Before < 1 {
+			return q, errors.New(`before must be a positive integer`)
+		}
+	}
+
+	switch q.Status = v.Get("status"); q.Status {
+	case "", internal.DeliveryPending, internal.DeliveryDelivered, internal.DeliveryDead:
+	default:
+		return q, fmt.Errorf("unknown status %q", q.Status)
+	}
+	return q, nil
+}
+
+// newSecret returns a random key for signing the payloads of a webhook
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Headers of a delivery
+const (
+	// ID of the event, the same for every attempt so that
+	// receivers can discard duplicates
+	HeaderID = "Webhook-Id"
+	// Unix time in seconds of the attempt
+	HeaderTimestamp = "Webhook-Timestamp"
+	// "t=<timestamp>,v1=<signature>", see `Sign`
+	HeaderSignature = "Webhook-Signature"
+)
+
+// Sign returns the hex encoded HMAC-SHA256 of the timestamp and body,
+// joined by a ".", using the secret of the webhook as the key.
+// Receivers should reject signatures with an old timestamp to
+// prevent a delivery from being replayed.
+func Sign(secret string, t time.Time, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(strconv.FormatInt(t.Unix(), 10)))
+	m.Write([]byte("."))
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// ErrInvalidSignature is returned by `Verify`
+var ErrInvalidSignature = errors.New(`invalid webhook signature`)
+
+// Verify checks the value of the "Webhook-Signature" header against the
+// body, failing if the timestamp is more than tolerance from now
+func Verify(secret, header string, body []byte, tolerance time.Duration) error {
+	var (
+		ts  int64
+		sig string
+		err error
+	)
+
+	for _, kv := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "t":
+			if ts, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return ErrInvalidSignature
+			}
+		case "v1":
+			sig = v
+		}
+	}
+
+	t := time.Unix(ts, 0)
+	if ts == 0 || sig == "" || time.Since(t) > tolerance || time.Until(t) > tolerance {
+		return ErrInvalidSignature
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(Sign(secret, t, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Handle creates a delivery of the event to every webhook that wants it,
+// it is subscribed to a `event.Bus`. Failing causes the event to be
+// published again, deliveries that were created are not duplicated.
+func (s Service) Handle(ctx context.Context, e internal.Event) error {
+	ws, err := s.r.SelectWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range ws {
+		if !w.Wants(e.Type) {
+			continue
+		}
+
+		d := internal.Delivery{
+			ID:        suid.NewUUID(),
+			WebhookID: w.ID,
+			EventID:   e.ID,
+			EventType: e.Type,
+			Payload:   b,
+		}
+
+		if err := s.r.InsertDelivery(ctx, &d); err != nil && !errors.Is(err, internal.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver attempts due deliveries until the service context is done
+func (s Service) deliver() {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+
+	for {
+		n, err := s.Deliver(s.Context())
+		if err != nil {
+			s.logf("delivering webhooks: %v", err)
+		}
+
+		if err == nil && n == deliveryBatch {
+			continue
+		}
+
+		select {
+		case <-s.Context().Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Deliver attempts a single batch of due deliveries, returning how many
+// were attempted. A failed attempt is retried after a backoff that
+// doubles with each attempt, the delivery is dead once out of attempts.
+func (s Service) Deliver(ctx context.Context) (int, error) {
+	ds, err := s.r.ClaimDeliveries(ctx, deliveryBatch, deliveryLease)
+	if err != nil {
+		return 0, err
+	}
+
+	// a deleted webhook takes its deliveries with it
+	ws := make(map[suid.UUID]*internal.Webhook)
+	for i := range ds {
+		d := &ds[i]
+
+		w, ok := ws[d.WebhookID]
+		if !ok {
+			if w, err = s.r.SelectWebhook(ctx, d.WebhookID); errors.Is(err, internal.ErrNotFound) {
+				continue
+			} else if err != nil {
+				return i, err
+			}
+			ws[d.WebhookID] = w
+		}
+
+		d.ResponseStatus, err = s.post(ctx, w, d)
+		d.Attempts++
+
+		switch {
+		case err == nil:
+			d.Status, d.LastError = internal.DeliveryDelivered, ""
+		case d.Attempts >= s.maxAttempts:
+			d.Status, d.LastError = internal.DeliveryDead, err.Error()
+		default:
+			d.NextAttemptAt, d.LastError = time.Now().UTC().Add(s.backoff(d.Attempts)), err.Error()
+		}
+
+		if err := s.r.UpdateDelivery(ctx, d); err != nil && !errors.Is(err, internal.ErrNotFound) {
+			return i, err
+		}
+	}
+	return len(ds), nil
+}
+
+// backoff returns how long to wait after the nth failed attempt
+func (s Service) backoff(n int) time.Duration {
+	d := s.minBackoff
+	for i := 1; i < n && d < s.maxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > s.maxBackoff {
+		return s.maxBackoff
+	}
+	return d
+}
+
+// post sends the payload of a delivery to the webhook, returning the
+// status of the response if one was received
+func (s Service) post(ctx context.Context, w *internal.Webhook, d *internal.Delivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(HeaderID, d.EventID.String())
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderSignature, "t="+ts+",v1="+Sign(w.Secret, now, d.Payload))
+
+	res, err := s.c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook responded with %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+var errBlockedAddress = errors.New(`webhooks cannot be sent to loopback, private or link-local addresses`)
+
+// cgnat is the shared address space of carrier-grade NAT, RFC 6598
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicIP reports whether ip can be reached from the internet, which
+// rules out the hosts of the service and cloud metadata endpoints
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || cgnat.Contains(ip))
+}
+
+// publicHost reports whether the host of a webhook url is allowed when it
+// is registered. Names are checked again once resolved, by `newClient`.
+func publicHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return publicIP(ip)
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return host != "localhost" && !strings.HasSuffix(host, ".localhost") && !strings.HasSuffix(host, ".internal")
+}
+
+// newClient returns the client that deliveries are posted with. Addresses
+// are checked as they are dialed, so a name cannot resolve to a private
+// address after it was registered, and redirects are not followed.
+func newClient(private bool) *http.Client {
+	d := &net.Dialer{Timeout: deliveryTimeout}
+	if !private {
+		d.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("%w: %s", errBlockedAddress, host)
+			}
+			return nil
+		}
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would dial the webhook on behalf of the service
+	t.Proxy = nil
+	t.DialContext = d.DialContext
+
+	return &http.Client{
+		Transport: t,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// status returns the status code of a domain error,
+// otherwise the fallback is returned
+func (s Service) status(err error, fallback int) int {
+	switch {
+	case errors.Is(err, internal.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, internal.ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, internal.ErrAlreadyExists):
+		return http.StatusConflict
+	}
+	return fallback
+}
+
+func (s Service) respondText(w http.ResponseWriter, r *http.Request, status int) {
+	s.respond(w, r, http.StatusText(status), status)
+}
+
+func (s Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.m.ServeHTTP(w, r)
+}
+
+type Service struct {
+	ctx context.Context
+
+	r internal.WebhookRepo
+	c *http.Client
+	// allows webhooks to loopback, private and link-local addresses
+	private bool
+	// verifies the tokens issued by the user service
+	public jwk.Key
+	// ids of the users allowed to manage webhooks
+	admins map[suid.UUID]bool
+
+	interval    time.Duration
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	m chi.Router
+
+	respond func(w http.ResponseWriter, r *http.Request, data any, status int)
+	decode  func(rw http.ResponseWriter, r *http.Request, data any) (err error)
+
+	logf func(format string, v ...any)
+}
+
+func (s Service) Context() context.Context {
+	if s.ctx != nil {
+		return s.ctx
+	}
+	return context.Background()
+}
+
+type Option func(s *Service)
+
+// WithClient sets the client that deliveries are posted with,
+// which is then trusted to refuse addresses it should not reach
+func WithClient(c *http.Client) Option {
+	return func(s *Service) { s.c = c }
+}
+
+// WithPrivateHosts allows webhooks to loopback, private and
+// link-local addresses, such as those used in development
+func WithPrivateHosts() Option {
+	return func(s *Service) { s.private = true }
+}
+
+// WithAdmins allows the users to manage webhooks
+func WithAdmins(ids ...suid.UUID) Option {
+	return func(s *Service) {
+		for _, id := range ids {
+			s.admins[id] = true
+		}
+	}
+}
+
+// WithInterval sets how often due deliveries are attempted
+func WithInterval(d time.Duration) Option {
+	return func(s *Service) { s.interval = d }
+}
+
+// WithRetries sets how many times a delivery is attempted before it
+// is dead, and how long to wait after the first failed attempt
+func WithRetries(maxAttempts int, backoff time.Duration) Option {
+	return func(s *Service) { s.maxAttempts, s.minBackoff = maxAttempts, backoff }
+}
+
+func NewService(ctx context.Context, m chi.Router, r internal.WebhookRepo, public jwk.Key, opts ...Option) *Service {
+	s := &Service{
+		ctx:         ctx,
+		r:           r,
+		public:      public,
+		admins:      make(map[suid.UUID]bool),
+		interval:    defaultInterval,
+		maxAttempts: defaultMaxAttempts,
+		minBackoff:  defaultMinBackoff,
+		maxBackoff:  defaultMaxBackoff,
+		m:           m,
+		respond:     www.Respond,
+		decode:      www.Decode,
+		logf:        log.Printf,
+	}
+
+	for _, o := range opts {
+		o(s)
+	}
+
+	if s.c == nil {
+		s.c = newClient(s.private)
+	}
+
+	s.routes()
+	go s.deliver()
+	return s
+}
+
+const (
+	userAgent = "adoublef-webhook/1.0"
+
+	defaultPageSize = 20
+	maxPageSize     = 100
+
+	defaultInterval    = time.Second * 5
+	defaultMaxAttempts = 8
+	// the last attempt is made about two hours after the first
+	defaultMinBackoff = time.Minute
+	defaultMaxBackoff = time.Hour * 6
+
+	deliveryBatch   = 50
+	deliveryTimeout = time.Second * 10
+	// long enough for a batch to be attempted before it can be claimed again
+	deliveryLease = deliveryTimeout*deliveryBatch + time.Minute
+)
@@ -0,0 +1,345 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+	"secure.adoublef.com/internal/auth"
+	"secure.adoublef.com/store/memory"
+)
+
+const (
+	applicationJson = "application/json"
+)
+
+func TestService(t *testing.T) {
+	t.Parallel()
+	is, ctx := is.New(t), context.Background()
+
+	ctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+
+	// the receiver of deliveries, failing while unavailable
+	var (
+		mu          sync.Mutex
+		unavailable bool
+		secret      string
+		received    []internal.Event
+	)
+	rcv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		body, _ := io.ReadAll(r.Body)
+		if err := Verify(secret, r.Header.Get(HeaderSignature), body, time.Minute); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if unavailable {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var e internal.Event
+		_ = json.Unmarshal(body, &e)
+		if r.Header.Get(HeaderID) == e.ID.String() {
+			received = append(received, e)
+		}
+	}))
+	t.Cleanup(rcv.Close)
+
+	got := func() []internal.Event {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]internal.Event(nil), received...)
+	}
+
+	private, public := auth.RS256()
+	admin, fizz := suid.NewUUID(), suid.NewUUID()
+
+	s := NewService(ctx, chi.NewMux(), memory.NewWebhookRepo(), public,
+		WithAdmins(admin),
+		WithClient(rcv.Client()),
+		// the receiver listens on loopback
+		WithPrivateHosts(),
+		WithRetries(2, time.Millisecond),
+		// deliveries are attempted by the test
+		WithInterval(time.Hour),
+	)
+	s.logf = t.Logf
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	token := func(id suid.UUID) string {
+		tk, err := auth.Sign(private, &auth.SignOption{
+			Type:       auth.TypeAccess,
+			Expiration: time.Minute,
+			Claims:     map[string]any{"id": id.ShortUUID()},
+		})
+		is.NoErr(err) // sign token
+		return string(tk)
+	}
+
+	do := func(method, path, token, payload string, v any) int {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(payload))
+		req.Header.Set(`Content-Type`, applicationJson)
+		if token != "" {
+			req.Header.Set(`Authorization`, fmt.Sprintf(`Bearer %s`, token))
+		}
+
+		res, err := srv.Client().Do(req)
+		is.NoErr(err) // send request
+		defer res.Body.Close()
+
+		if v != nil {
+			is.NoErr(json.NewDecoder(res.Body).Decode(v)) // decode response
+		}
+		return res.StatusCode
+	}
+
+	adminTk := token(admin)
+
+	var wh Webhook
+	t.Run("register a webhook", func(t *testing.T) {
+		payload := fmt.Sprintf(`{"url":%q,"events":["account.created","account.deleted"]}`, rcv.URL)
+
+		is.Equal(do(http.MethodPost, "/api/v1/admin/webhooks/", "", payload, nil), http.StatusUnauthorized)       // not signed in
+		is.Equal(do(http.MethodPost, "/api/v1/admin/webhooks/", token(fizz), payload, nil), http.StatusForbidden) // not an admin
+
+		bad := `{"url":"ftp://fizz.com","events":[]}`
+		is.Equal(do(http.MethodPost, "/api/v1/admin/webhooks/", adminTk, bad, nil), http.StatusBadRequest) // unsupported scheme
+
+		bad = fmt.Sprintf(`{"url":%q,"events":["account.verified"]}`, rcv.URL)
+		is.Equal(do(http.MethodPost, "/api/v1/admin/webhooks/", adminTk, bad, nil), http.StatusBadRequest) // unknown event
+
+		is.Equal(do(http.MethodPost, "/api/v1/admin/webhooks/", adminTk, payload, &wh), http.StatusCreated) // webhook created
+		is.True(strings.HasPrefix(wh.Secret, "whsec_"))                                                     // secret is returned
+
+		mu.Lock()
+		secret = wh.Secret
+		mu.Unlock()
+
+		var list struct {
+			Length int       `json:"length"`
+			Data   []Webhook `json:"data"`
+		}
+		is.Equal(do(http.MethodGet, "/api/v1/admin/webhooks/", adminTk, "", &list), http.StatusOK) // list webhooks
+		is.Equal(list.Length, 1)                                                                   // one webhook
+		is.Equal(list.Data[0].Secret, "")                                                          // secret is hidden
+	})
+
+	type log struct {
+		Length int        `json:"length"`
+		Data   []Delivery `json:"data"`
+		Links  struct {
+			Next string `json:"next"`
+		} `json:"links"`
+	}
+
+	t.Run("deliver signed events", func(t *testing.T) {
+		created, err := internal.NewEvent(internal.EventAccountCreated, fizz, internal.AccountData{Username: "i_am_fizz", Version: 1})
+		is.NoErr(err) // new event
+
+		updated, err := internal.NewEvent(internal.EventAccountUpdated, fizz, internal.AccountData{Username: "i_am_fizz", Version: 2})
+		is.NoErr(err) // new event
+
+		is.NoErr(s.Handle(ctx, created)) // handle "account.created"
+		is.NoErr(s.Handle(ctx, created)) // handled again
+		is.NoErr(s.Handle(ctx, updated)) // not wanted
+
+		n, err := s.Deliver(ctx)
+		is.NoErr(err)  // deliver
+		is.Equal(n, 1) // created once
+
+		es := got()
+		is.Equal(len(es), 1)                               // received
+		is.Equal(es[0].ID, created.ID)                     // "account.created"
+		is.Equal(string(es[0].Data), string(created.Data)) // with its data
+
+		var l log
+		is.Equal(do(http.MethodGet, "/api/v1/admin/webhooks/"+wh.ID+"/deliveries", adminTk, "", &l), http.StatusOK) // get log
+		is.Equal(l.Length, 1)                                                                                       // one delivery
+		is.Equal(l.Data[0].Status, internal.DeliveryDelivered)                                                      // delivered
+		is.Equal(l.Data[0].Attempts, 1)                                                                             // first attempt
+		is.Equal(l.Data[0].ResponseStatus, http.StatusOK)                                                           // status is logged
+	})
+
+	var dead Delivery
+	t.Run("retry failed deliveries until dead", func(t *testing.T) {
+		mu.Lock()
+		unavailable = true
+		mu.Unlock()
+
+		deleted, err := internal.NewEvent(internal.EventAccountDeleted, fizz, internal.AccountData{Username: "i_am_fizz", Version: 2})
+		is.NoErr(err)                    // new event
+		is.NoErr(s.Handle(ctx, deleted)) // handle "account.deleted"
+
+		n, err := s.Deliver(ctx)
+		is.NoErr(err)  // first attempt
+		is.Equal(n, 1) // failed
+
+		var l log
+		is.Equal(do(http.MethodGet, "/api/v1/admin/webhooks/"+wh.ID+"/deliveries?status=pending", adminTk, "", &l), http.StatusOK) // pending deliveries
+		is.Equal(l.Length, 1)                                                                                                      // to be retried
+		is.Equal(l.Data[0].ResponseStatus, http.StatusServiceUnavailable)                                                          // status is logged
+		is.True(l.Data[0].NextAttemptAt != nil)                                                                                    // next attempt is set
+
+		time.Sleep(time.Millisecond * 10)
+
+		n, err = s.Deliver(ctx)
+		is.NoErr(err)  // second attempt
+		is.Equal(n, 1) // failed
+
+		is.Equal(do(http.MethodGet, "/api/v1/admin/webhooks/"+wh.ID+"/deliveries?status=dead", adminTk, "", &l), http.StatusOK) // dead deliveries
+		is.Equal(l.Length, 1)                                                                                                   // out of attempts
+		is.Equal(l.Data[0].Attempts, 2)                                                                                         // both attempts
+		is.True(l.Data[0].LastError != "")                                                                                      // error is logged
+		dead = l.Data[0]
+
+		time.Sleep(time.Millisecond * 10)
+
+		n, err = s.Deliver(ctx)
+		is.NoErr(err)  // deliver
+		is.Equal(n, 0) // dead deliveries are not attempted
+	})
+
+	t.Run("retry a dead delivery", func(t *testing.T) {
+		mu.Lock()
+		unavailable = false
+		mu.Unlock()
+
+		path := "/api/v1/admin/webhooks/" + wh.ID + "/deliveries/" + dead.ID + "/retry"
+		is.Equal(do(http.MethodPost, path, token(fizz), "", nil), http.StatusForbidden) // not an admin
+
+		var d Delivery
+		is.Equal(do(http.MethodPost, path, adminTk, "", &d), http.StatusAccepted) // retry
+		is.Equal(d.Status, internal.DeliveryPending)                              // pending again
+		is.Equal(d.Attempts, 0)                                                   // with fresh attempts
+
+		is.Equal(do(http.MethodPost, path, adminTk, "", nil), http.StatusConflict) // already pending
+
+		n, err := s.Deliver(ctx)
+		is.NoErr(err)           // deliver
+		is.Equal(n, 1)          // retried
+		is.Equal(len(got()), 2) // received
+
+		var l log
+		is.Equal(do(http.MethodGet, "/api/v1/admin/webhooks/"+wh.ID+"/deliveries?limit=1", adminTk, "", &l), http.StatusOK) // first page
+		is.Equal(l.Data[0].ID, dead.ID)                                                                                     // newest first
+		is.Equal(l.Data[0].Status, internal.DeliveryDelivered)                                                              // delivered
+		is.True(l.Links.Next != "")                                                                                         // another page
+	})
+
+	t.Run("delete the webhook", func(t *testing.T) {
+		is.Equal(do(http.MethodDelete, "/api/v1/admin/webhooks/"+wh.ID, adminTk, "", nil), http.StatusOK)                  // delete
+		is.Equal(do(http.MethodDelete, "/api/v1/admin/webhooks/"+wh.ID, adminTk, "", nil), http.StatusNotFound)            // already deleted
+		is.Equal(do(http.MethodGet, "/api/v1/admin/webhooks/"+wh.ID+"/deliveries", adminTk, "", nil), http.StatusNotFound) // log is gone
+	})
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	body, now := []byte(`{"type":"account.created"}`), time.Now()
+	header := fmt.Sprintf("t=%d,v1=%s", now.Unix(), Sign("fizz_secret", now, body))
+
+	is.NoErr(Verify("fizz_secret", header, body, time.Minute))                                                      // valid
+	is.Equal(Verify("buzz_secret", header, body, time.Minute), ErrInvalidSignature)                                 // wrong secret
+	is.Equal(Verify("fizz_secret", header, []byte(`{"type":"account.deleted"}`), time.Minute), ErrInvalidSignature) // tampered body
+	is.Equal(Verify("fizz_secret", "v1="+Sign("fizz_secret", now, body), body, time.Minute), ErrInvalidSignature)   // missing timestamp
+
+	old := now.Add(-time.Hour)
+	header = fmt.Sprintf("t=%d,v1=%s", old.Unix(), Sign("fizz_secret", old, body))
+	is.Equal(Verify("fizz_secret", header, body, time.Minute), ErrInvalidSignature) // replayed
+}
+
+func TestPrivateHosts(t *testing.T) {
+	t.Parallel()
+	is, ctx := is.New(t), context.Background()
+
+	ctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+
+	private, public := auth.RS256()
+	admin := suid.NewUUID()
+
+	s := NewService(ctx, chi.NewMux(), memory.NewWebhookRepo(), public, WithAdmins(admin), WithInterval(time.Hour))
+	s.logf = t.Logf
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	tk, err := auth.Sign(private, &auth.SignOption{
+		Type:       auth.TypeAccess,
+		Expiration: time.Minute,
+		Claims:     map[string]any{"id": admin.ShortUUID()},
+	})
+	is.NoErr(err) // sign token
+
+	create := func(u string) int {
+		payload := fmt.Sprintf(`{"url":%q,"events":[]}`, u)
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/admin/webhooks/", strings.NewReader(payload))
+		req.Header.Set(`Content-Type`, applicationJson)
+		req.Header.Set(`Authorization`, fmt.Sprintf(`Bearer %s`, tk))
+
+		res, err := srv.Client().Do(req)
+		is.NoErr(err) // send request
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	t.Run("refuse private hosts when registered", func(t *testing.T) {
+		for _, u := range []string{
+			"http://127.0.0.1:8080/",
+			"http://localhost/",
+			"http://[::1]/",
+			"http://10.0.0.1/",
+			"http://169.254.169.254/latest/meta-data/",
+			"http://metadata.google.internal/",
+		} {
+			is.Equal(create(u), http.StatusBadRequest) // private host
+		}
+
+		is.Equal(create("https://hooks.example.com/"), http.StatusCreated) // public host
+	})
+
+	t.Run("refuse private addresses when dialed", func(t *testing.T) {
+		rcv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		t.Cleanup(rcv.Close)
+
+		_, err := newClient(false).Get(rcv.URL)
+		is.True(errors.Is(err, errBlockedAddress)) // loopback
+
+		res, err := newClient(true).Get(rcv.URL)
+		is.NoErr(err) // allowed in development
+		res.Body.Close()
+	})
+
+	t.Run("do not follow redirects", func(t *testing.T) {
+		rcv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+		}))
+		t.Cleanup(rcv.Close)
+
+		res, err := newClient(true).Get(rcv.URL)
+		is.NoErr(err) // request
+		res.Body.Close()
+		is.Equal(res.StatusCode, http.StatusFound) // redirect is the response
+	})
+}
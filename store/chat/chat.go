@@ -0,0 +1,350 @@
+// Package chat is the Postgres `internal.ChatRepo`.
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	psql "github.com/hyphengolang/prelude/sql/postgres"
+	"github.com/hyphengolang/prelude/types/suid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"secure.adoublef.com/internal"
+)
+
+const (
+	// the row of the room is locked until the transaction ends, so the
+	// messages of a room are numbered in the order they are committed
+	qryInsertMessage = `with room as (
+		insert into "chat_room" (name, seq) values (@room, 1)
+		on conflict (name) do update set seq = "chat_room".seq + 1
+		returning seq
+	)
+	insert into "chat_message" (id, room, seq, sender, text, client_id)
+	select @id, @room, room.seq, @sender, @text, nullif(@client_id, '') from room
+	returning seq, created_at`
+
+	qrySelectMessages = `select id, room, seq, sender, text, created_at, coalesce(client_id, ''), edited_at, deleted_at from "chat_message"`
+	qrySelectMessage  = qrySelectMessages + ` where id = @id`
+
+	qrySelectMessageByClientID = qrySelectMessages + ` where room = @room and sender = @sender and client_id = @client_id`
+
+	// a user cannot read past the newest message of the room
+	qryMarkRead = `insert into "chat_member" (room, user_id, read_seq)
+	select name, @user, least(@seq, seq) from "chat_room" where name = @room
+	on conflict (room, user_id) do update set read_seq = greatest("chat_member".read_seq, excluded.read_seq)
+	returning read_seq`
+
+	// the newest message of a room has the seq of the room
+	qrySelectConversations = `select m.room, m.user_id, m.read_seq, c.id, c.room, c.seq, c.sender, c.text, c.created_at, coalesce(c.client_id, ''), c.edited_at, c.deleted_at
+	from "chat_member" m
+	join "chat_room" r on r.name = m.room
+	join "chat_message" c on c.room = r.name and c.seq = r.seq
+	where m.user_id = @user
+	order by c.created_at desc, m.room`
+
+	// the row of the message is locked until it is updated, the text
+	// replaced was written when the message was last edited
+	qryInsertEdit = `insert into "chat_message_edit" (message_id, text, created_at)
+	select id, text, coalesce(edited_at, created_at) from "chat_message" where id = @id and deleted_at is null
+	for update`
+	qryUpdateMessage = `update "chat_message" set text = @text, edited_at = now() where id = @id and deleted_at is null
+	returning id, room, seq, sender, text, created_at, coalesce(client_id, ''), edited_at, deleted_at`
+	qryDeleteMessage = `update "chat_message" set text = '', deleted_at = now() where id = @id and deleted_at is null
+	returning id, room, seq, sender, text, created_at, coalesce(client_id, ''), edited_at, deleted_at`
+	qrySelectEdits = `select message_id, text, created_at from "chat_message_edit" where message_id = @id order by id`
+
+	qrySetRole = `insert into "chat_role" (room, user_id, role) values (@room, @user, @role)
+	on conflict (room, user_id) do update set role = excluded.role`
+	qryUnsetRole   = `delete from "chat_role" where room = @room and user_id = @user`
+	qrySelectRoles = `select room, user_id, role from "chat_role" where room = @room order by role = 'owner' desc, user_id`
+
+	qryInsertSanction = `insert into "chat_sanction" (room, user_id, kind, by_user, reason, expires_at) values (@room, @user, @kind, @by, @reason, @expires_at)
+	on conflict (room, user_id, kind) do update set by_user = excluded.by_user, reason = excluded.reason, expires_at = excluded.expires_at, created_at = now()
+	returning created_at`
+	qryDeleteSanction  = `delete from "chat_sanction" where room = @room and user_id = @user and kind = @kind`
+	qrySelectSanctions = `select room, user_id, kind, by_user, reason, expires_at, created_at from "chat_sanction"
+	where room = @room and (expires_at is null or expires_at > now())
+	order by created_at`
+)
+
+// Repo stores chat messages, it shares the connections of
+// the user repository so it is never closed
+type Repo struct {
+	q Conn
+}
+
+var _ internal.ChatRepo = (*Repo)(nil)
+
+func NewRepo(q Conn) *Repo { return &Repo{q} }
+
+func (r *Repo) InsertMessage(ctx context.Context, m *internal.Message) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	args := pgx.NamedArgs{"id": m.ID, "room": m.Room, "sender": m.Sender, "text": m.Text, "client_id": m.ClientID}
+
+	var seq int64
+	var createdAt time.Time
+	err := mapError(psql.QueryRowContext(ctx, r.q, qryInsertMessage, func(r pgx.Row) error { return r.Scan(&seq, &createdAt) }, args))
+	if errors.Is(err, internal.ErrAlreadyExists) && m.ClientID != "" {
+		// the message was sent again, the statement did not take a seq
+		if psql.QueryRowContext(ctx, r.q, qrySelectMessageByClientID, func(r pgx.Row) error { return scanMessage(r, m) }, args) != nil {
+			return err
+		}
+		return internal.ErrAlreadyExists
+	}
+	if err != nil {
+		return err
+	}
+
+	m.Seq, m.CreatedAt = seq, createdAt.UTC()
+	return nil
+}
+
+func (r *Repo) SelectMessages(ctx context.Context, q internal.MessageQuery) ([]internal.Message, error) {
+	where := []string{"room = @room", "seq > @after"}
+	args := pgx.NamedArgs{"room": q.Room, "after": q.After}
+
+	if q.Before != 0 {
+		where = append(where, "seq < @before")
+		args["before"] = q.Before
+	}
+
+	qry := qrySelectMessages + " where " + strings.Join(where, " and ")
+	if q.Ascending {
+		qry += " order by seq"
+	} else {
+		qry += " order by seq desc"
+	}
+
+	if q.Limit > 0 {
+		qry += " limit @limit"
+		args["limit"] = q.Limit
+	}
+
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	ms, err := psql.QueryContext(ctx, r.q, qry, func(r pgx.Rows, m *internal.Message) error { return scanMessage(r, m) }, args)
+	return ms, mapError(err)
+}
+
+func (r *Repo) MarkRead(ctx context.Context, room string, uid suid.UUID, seq int64) (int64, error) {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	var read int64
+	err := psql.QueryRowContext(ctx, r.q, qryMarkRead, func(r pgx.Row) error { return r.Scan(&read) }, pgx.NamedArgs{"room": room, "user": uid, "seq": seq})
+	return read, mapError(err)
+}
+
+func (r *Repo) SelectConversations(ctx context.Context, uid suid.UUID) ([]internal.Conversation, error) {
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	cs, err := psql.QueryContext(ctx, r.q, qrySelectConversations, func(r pgx.Rows, c *internal.Conversation) error {
+		return scanMessage(r, &c.Last, &c.Room, &c.User, &c.ReadSeq)
+	}, pgx.NamedArgs{"user": uid})
+	return cs, mapError(err)
+}
+
+// scanMessage scans the columns of a message, after those of prefix
+func scanMessage(r pgx.Row, m *internal.Message, prefix ...any) error {
+	dest := append(prefix, &m.ID, &m.Room, &m.Seq, &m.Sender, &m.Text, &m.CreatedAt, &m.ClientID, &m.EditedAt, &m.DeletedAt)
+	if err := r.Scan(dest...); err != nil {
+		return err
+	}
+
+	m.CreatedAt, m.EditedAt, m.DeletedAt = m.CreatedAt.UTC(), utc(m.EditedAt), utc(m.DeletedAt)
+	return nil
+}
+
+func utc(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	v := t.UTC()
+	return &v
+}
+
+func (r *Repo) SelectMessage(ctx context.Context, id suid.UUID) (internal.Message, error) {
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	var m internal.Message
+	err := psql.QueryRowContext(ctx, r.q, qrySelectMessage, func(r pgx.Row) error { return scanMessage(r, &m) }, pgx.NamedArgs{"id": id})
+	return m, mapError(err)
+}
+
+func (r *Repo) UpdateMessage(ctx context.Context, m *internal.Message) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	args := pgx.NamedArgs{"id": m.ID, "text": m.Text}
+
+	return mapError(withTx(ctx, r.q, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, qryInsertEdit, args)
+		if err != nil {
+			return err
+		}
+
+		if tag.RowsAffected() == 0 {
+			return internal.ErrNotFound
+		}
+		return psql.QueryRowContext(ctx, tx, qryUpdateMessage, func(r pgx.Row) error { return scanMessage(r, m) }, args)
+	}))
+}
+
+func (r *Repo) DeleteMessage(ctx context.Context, m *internal.Message) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	args := pgx.NamedArgs{"id": m.ID}
+
+	// the text removed is kept with the edits for moderators
+	return mapError(withTx(ctx, r.q, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, qryInsertEdit, args)
+		if err != nil {
+			return err
+		}
+
+		if tag.RowsAffected() == 0 {
+			return internal.ErrNotFound
+		}
+		return psql.QueryRowContext(ctx, tx, qryDeleteMessage, func(r pgx.Row) error { return scanMessage(r, m) }, args)
+	}))
+}
+
+func (r *Repo) SelectEdits(ctx context.Context, id suid.UUID) ([]internal.MessageEdit, error) {
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	es, err := psql.QueryContext(ctx, r.q, qrySelectEdits, func(r pgx.Rows, e *internal.MessageEdit) error {
+		if err := r.Scan(&e.MessageID, &e.Text, &e.CreatedAt); err != nil {
+			return err
+		}
+		e.CreatedAt = e.CreatedAt.UTC()
+		return nil
+	}, pgx.NamedArgs{"id": id})
+	return es, mapError(err)
+}
+
+func (r *Repo) SetRole(ctx context.Context, rr internal.RoomRole) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	qry := qrySetRole
+	if rr.Role == internal.RoleMember {
+		qry = qryUnsetRole
+	}
+	return mapError(psql.ExecContext(ctx, r.q, qry, pgx.NamedArgs{"room": rr.Room, "user": rr.User, "role": rr.Role}))
+}
+
+func (r *Repo) SelectRoles(ctx context.Context, room string) ([]internal.RoomRole, error) {
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	rs, err := psql.QueryContext(ctx, r.q, qrySelectRoles, func(r pgx.Rows, rr *internal.RoomRole) error {
+		return r.Scan(&rr.Room, &rr.User, &rr.Role)
+	}, pgx.NamedArgs{"room": room})
+	return rs, mapError(err)
+}
+
+func (r *Repo) InsertSanction(ctx context.Context, sn *internal.Sanction) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	args := pgx.NamedArgs{"room": sn.Room, "user": sn.User, "kind": sn.Kind, "by": sn.By, "reason": sn.Reason, "expires_at": sn.ExpiresAt}
+
+	var createdAt time.Time
+	if err := psql.QueryRowContext(ctx, r.q, qryInsertSanction, func(r pgx.Row) error { return r.Scan(&createdAt) }, args); err != nil {
+		return mapError(err)
+	}
+
+	sn.CreatedAt = createdAt.UTC()
+	return nil
+}
+
+func (r *Repo) DeleteSanction(ctx context.Context, room string, uid suid.UUID, kind string) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	tag, err := r.q.Exec(ctx, qryDeleteSanction, pgx.NamedArgs{"room": room, "user": uid, "kind": kind})
+	if err != nil {
+		return mapError(err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return internal.ErrNotFound
+	}
+	return nil
+}
+
+func (r *Repo) SelectSanctions(ctx context.Context, room string) ([]internal.Sanction, error) {
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	ss, err := psql.QueryContext(ctx, r.q, qrySelectSanctions, func(r pgx.Rows, sn *internal.Sanction) error {
+		if err := r.Scan(&sn.Room, &sn.User, &sn.Kind, &sn.By, &sn.Reason, &sn.ExpiresAt, &sn.CreatedAt); err != nil {
+			return err
+		}
+		sn.ExpiresAt, sn.CreatedAt = utc(sn.ExpiresAt), sn.CreatedAt.UTC()
+		return nil
+	}, pgx.NamedArgs{"room": room})
+	return ss, mapError(err)
+}
+
+func withTx(ctx context.Context, q Conn, f func(tx pgx.Tx) error) error {
+	tx, err := q.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	// returns the connection to the pool if the transaction is not committed
+	defer tx.Rollback(ctx)
+
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Conn is either a pool or a transaction
+type Conn interface {
+	psql.Q
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+const codeUniqueViolation = "23505"
+
+// mapError converts database errors into their domain equivalent
+func mapError(err error) error {
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return internal.ErrNotFound
+	case errors.As(err, &pgErr) && pgErr.Code == codeUniqueViolation:
+		return fmt.Errorf("%w: %s", internal.ErrAlreadyExists, pgErr.ConstraintName)
+	case errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err):
+		return fmt.Errorf("%w: %v", internal.ErrTimeout, err)
+	}
+	return err
+}
+
+// Default timeouts of each operation, these are only
+// applied if the caller has not set a deadline
+const (
+	readTimeout  = time.Second * 5
+	writeTimeout = time.Second * 10
+)
+
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
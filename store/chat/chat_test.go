@@ -0,0 +1,76 @@
+package chat
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	psql "github.com/hyphengolang/prelude/sql/postgres"
+	"github.com/hyphengolang/prelude/types/suid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"secure.adoublef.com/store/migrate"
+	"secure.adoublef.com/store/storetest"
+)
+
+var connString = os.ExpandEnv("host=${POSTGRES_HOSTNAME} port=${DB_PORT} user=${POSTGRES_USER} password=${POSTGRES_PASSWORD} dbname=${POSTGRES_DB} sslmode=${SSL_MODE}")
+
+func TestRepo(t *testing.T) {
+	t.Parallel()
+
+	p, err := newTestPool(t, connString)
+	if err != nil {
+		t.Skipf("postgres is unavailable: %v", err)
+	}
+	t.Cleanup(p.Close)
+
+	storetest.ChatRepo(t, NewRepo(p))
+}
+
+// newTestPool applies the migrations within a new schema that every
+// connection of the pool will use, this stops tests that run in
+// parallel from sharing the same tables
+func newTestPool(t *testing.T, connString string) (*pgxpool.Pool, error) {
+	ctx := context.Background()
+
+	cfg, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := "test_" + strings.ReplaceAll(suid.NewUUID().String(), "-", "")
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema + ", public"
+
+	p, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := psql.ExecContext(ctx, p, `create schema `+schema); err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	t.Cleanup(func() {
+		c, err := pgxpool.New(ctx, connString)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		_ = psql.ExecContext(ctx, c, `drop schema `+schema+` cascade`)
+	})
+
+	c, err := p.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Release()
+
+	m, err := migrate.New(c, migrate.Postgres)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, m.Up(ctx)
+}
@@ -0,0 +1,264 @@
+// Package crypt implements envelope encryption of personal data.
+//
+// Each value is encrypted with its own data key, which is in turn
+// encrypted (wrapped) by a key-encryption key from a `Keyring`.
+// Rotating the key-encryption key only requires the data keys to be
+// wrapped again, the values themselves are left as they are.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	keySize = 32 // AES-256
+	version = 1
+)
+
+var (
+	ErrInvalidKey     = errors.New(`keys must be 32 bytes encoded as base64`)
+	ErrNoActiveKey    = errors.New(`active key is not in the keyring`)
+	ErrUnknownKey     = errors.New(`key is not in the keyring`)
+	ErrInvalidMessage = errors.New(`invalid encrypted message`)
+)
+
+// Keyring holds the key-encryption keys by ID, new values are always
+// wrapped by the active key. The index key is used for blind indexes
+// and cannot be rotated without recomputing every index.
+type Keyring struct {
+	active string
+	keks   map[string]cipher.AEAD
+	index  []byte
+}
+
+// File is the JSON encoding of a keyring, keys are base64 encoded
+//
+//	{"active": "2022-10", "keys": {"2022-10": "..."}, "index": "..."}
+type File struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+	Index  string            `json:"index"`
+}
+
+// Load reads a keyring from a JSON file
+func Load(name string) (*Keyring, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var f File
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+
+	keks := make(map[string][]byte, len(f.Keys))
+	for id, s := range f.Keys {
+		if keks[id], err = decodeKey(s); err != nil {
+			return nil, fmt.Errorf("%w: %s", err, id)
+		}
+	}
+
+	index, err := decodeKey(f.Index)
+	if err != nil {
+		return nil, fmt.Errorf("%w: index", err)
+	}
+
+	return New(f.Active, keks, index)
+}
+
+func decodeKey(s string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != keySize {
+		return nil, ErrInvalidKey
+	}
+	return b, nil
+}
+
+func New(active string, keks map[string][]byte, index []byte) (*Keyring, error) {
+	if len(index) != keySize {
+		return nil, ErrInvalidKey
+	}
+
+	k := &Keyring{
+		active: active,
+		keks:   make(map[string]cipher.AEAD, len(keks)),
+		index:  index,
+	}
+
+	for id, key := range keks {
+		if len(id) == 0 || len(id) > 255 {
+			return nil, fmt.Errorf("%w: key id must be 1 to 255 bytes", ErrInvalidKey)
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keks[id] = aead
+	}
+
+	if _, ok := k.keks[active]; !ok {
+		return nil, ErrNoActiveKey
+	}
+	return k, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, ErrInvalidKey
+	}
+
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// Active returns the ID of the key that new values are wrapped with
+func (k *Keyring) Active() string { return k.active }
+
+// Seal encrypts plaintext with a new data key wrapped by the active key.
+//
+// The message is laid out as: version, length of the key ID, key ID,
+// wrapped data key then the encrypted plaintext. Both of the last two
+// are prefixed by their nonce.
+func (k *Keyring) Seal(plaintext []byte) ([]byte, error) {
+	dek := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key ID is authenticated so that it cannot be swapped
+	wrapped, err := seal(k.keks[k.active], dek, []byte(k.active))
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := seal(aead, plaintext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return encode(k.active, wrapped, body), nil
+}
+
+// Open decrypts a message sealed by any key of the keyring
+func (k *Keyring) Open(msg []byte) ([]byte, error) {
+	id, wrapped, body, err := decode(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	dek, err := k.unwrap(id, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, body, nil)
+}
+
+// Rewrap wraps the data key of a message with the active key, leaving
+// the encrypted plaintext untouched. Messages already wrapped by the
+// active key are returned as they are.
+func (k *Keyring) Rewrap(msg []byte) ([]byte, error) {
+	id, wrapped, body, err := decode(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if id == k.active {
+		return msg, nil
+	}
+
+	dek, err := k.unwrap(id, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	if wrapped, err = seal(k.keks[k.active], dek, []byte(k.active)); err != nil {
+		return nil, err
+	}
+	return encode(k.active, wrapped, body), nil
+}
+
+// BlindIndex returns a keyed hash of b, equal values have equal
+// indexes so they can be looked up without being decrypted
+func (k *Keyring) BlindIndex(b []byte) []byte {
+	h := hmac.New(sha256.New, k.index)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func (k *Keyring) unwrap(id string, wrapped []byte) ([]byte, error) {
+	kek, ok := k.keks[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	return open(kek, wrapped, []byte(id))
+}
+
+// wrapped data keys are a fixed size: nonce, key and tag
+const wrappedSize = 12 + keySize + 16
+
+func encode(id string, wrapped, body []byte) []byte {
+	msg := make([]byte, 0, 2+len(id)+len(wrapped)+len(body))
+	msg = append(msg, version, byte(len(id)))
+	msg = append(msg, id...)
+	msg = append(msg, wrapped...)
+	return append(msg, body...)
+}
+
+func decode(msg []byte) (id string, wrapped, body []byte, err error) {
+	if len(msg) < 2 || msg[0] != version {
+		return "", nil, nil, ErrInvalidMessage
+	}
+
+	n := int(msg[1])
+	if len(msg) < 2+n+wrappedSize {
+		return "", nil, nil, ErrInvalidMessage
+	}
+
+	msg = msg[2:]
+	return string(msg[:n]), msg[n : n+wrappedSize], msg[n+wrappedSize:], nil
+}
+
+func seal(aead cipher.AEAD, plaintext, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, data), nil
+}
+
+func open(aead cipher.AEAD, msg, data []byte) ([]byte, error) {
+	if len(msg) < aead.NonceSize() {
+		return nil, ErrInvalidMessage
+	}
+
+	b, err := aead.Open(nil, msg[:aead.NonceSize()], msg[aead.NonceSize():], data)
+	if err != nil {
+		return nil, ErrInvalidMessage
+	}
+	return b, nil
+}
@@ -0,0 +1,104 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func newKey() []byte {
+	b := make([]byte, keySize)
+	rand.Read(b)
+	return b
+}
+
+func TestKeyring(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	k1, k2, index := newKey(), newKey(), newKey()
+
+	old, err := New("k1", map[string][]byte{"k1": k1}, index)
+	is.NoErr(err) // keyring with one key
+
+	msg, err := old.Seal([]byte("fizz@mail.com"))
+	is.NoErr(err) // seal with "k1"
+
+	t.Run(`open a sealed message`, func(t *testing.T) {
+		b, err := old.Open(msg)
+		is.NoErr(err)                            // open with "k1"
+		is.Equal(string(b), "fizz@mail.com")     // plaintext is the same
+		is.True(!bytes.Contains(msg, []byte(b))) // plaintext is not visible
+
+		tampered := append([]byte{}, msg...)
+		tampered[len(tampered)-1] ^= 1
+		_, err = old.Open(tampered)
+		is.True(errors.Is(err, ErrInvalidMessage)) // tampered message
+
+		_, err = old.Open(msg[:10])
+		is.True(errors.Is(err, ErrInvalidMessage)) // truncated message
+	})
+
+	t.Run(`rotate the key-encryption key`, func(t *testing.T) {
+		k, err := New("k2", map[string][]byte{"k1": k1, "k2": k2}, index)
+		is.NoErr(err) // keyring with "k2" active
+
+		b, err := k.Open(msg)
+		is.NoErr(err)                        // old messages can be read
+		is.Equal(string(b), "fizz@mail.com") // plaintext is the same
+
+		rewrapped, err := k.Rewrap(msg)
+		is.NoErr(err)                                              // wrap with "k2"
+		is.True(bytes.HasSuffix(rewrapped, msg[2+2+wrappedSize:])) // encrypted plaintext is untouched
+
+		b, err = k.Open(rewrapped)
+		is.NoErr(err)                        // open with "k2"
+		is.Equal(string(b), "fizz@mail.com") // plaintext is the same
+
+		_, err = old.Open(rewrapped)
+		is.True(errors.Is(err, ErrUnknownKey)) // "k2" is not known
+
+		again, err := k.Rewrap(rewrapped)
+		is.NoErr(err)                          // already wrapped with "k2"
+		is.True(bytes.Equal(again, rewrapped)) // message is unchanged
+
+		_, err = New("k3", map[string][]byte{"k1": k1}, index)
+		is.True(errors.Is(err, ErrNoActiveKey)) // active key is missing
+	})
+
+	t.Run(`blind index`, func(t *testing.T) {
+		k, err := New("k2", map[string][]byte{"k2": k2}, index)
+		is.NoErr(err) // same index key, different keys
+
+		is.True(bytes.Equal(old.BlindIndex([]byte("fizz")), k.BlindIndex([]byte("fizz"))))  // equal values
+		is.True(!bytes.Equal(old.BlindIndex([]byte("fizz")), k.BlindIndex([]byte("buzz")))) // different values
+	})
+
+	t.Run(`load from a file`, func(t *testing.T) {
+		enc := base64.StdEncoding.EncodeToString
+		b, _ := json.Marshal(File{Active: "k1", Keys: map[string]string{"k1": enc(k1)}, Index: enc(index)})
+
+		name := filepath.Join(t.TempDir(), "keys.json")
+		is.NoErr(os.WriteFile(name, b, 0o600)) // write keyring
+
+		k, err := Load(name)
+		is.NoErr(err) // load keyring
+
+		b, err = k.Open(msg)
+		is.NoErr(err)                        // open with loaded "k1"
+		is.Equal(string(b), "fizz@mail.com") // plaintext is the same
+
+		b, _ = json.Marshal(File{Active: "k1", Keys: map[string]string{"k1": "short"}, Index: enc(index)})
+		is.NoErr(os.WriteFile(name, b, 0o600)) // write invalid keyring
+
+		_, err = Load(name)
+		is.True(errors.Is(err, ErrInvalidKey)) // key is not 32 bytes
+	})
+}
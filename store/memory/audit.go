@@ -0,0 +1,93 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"secure.adoublef.com/internal"
+)
+
+// AuditRepo is an in-memory `internal.AuditRepo`
+type AuditRepo struct {
+	ctx   context.Context
+	chain bool
+
+	mu sync.RWMutex
+	es []internal.AuditEvent
+}
+
+var _ internal.AuditRepo = (*AuditRepo)(nil)
+
+// NewAuditRepo returns a repository that links events
+// by their hash when chain is set
+func NewAuditRepo(ctx context.Context, chain bool) *AuditRepo {
+	return &AuditRepo{ctx: ctx, chain: chain}
+}
+
+func (r *AuditRepo) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+func (r *AuditRepo) Close(ctx context.Context) error { return nil }
+
+func (r *AuditRepo) Append(ctx context.Context, e *internal.AuditEvent) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e.Seq = int64(len(r.es)) + 1
+	e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	e.PrevHash, e.Hash = nil, nil
+
+	if r.chain {
+		if n := len(r.es); n > 0 {
+			e.PrevHash = r.es[n-1].Hash
+		}
+		e.Hash = e.ChainHash(e.PrevHash)
+	}
+
+	r.es = append(r.es, *e)
+	return nil
+}
+
+func (r *AuditRepo) SelectMany(ctx context.Context, q internal.AuditQuery) ([]internal.AuditEvent, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var es []internal.AuditEvent
+	for _, e := range r.es {
+		switch {
+		case q.Actor != "" && e.Actor != q.Actor:
+		case q.Action != "" && e.Action != q.Action:
+		case q.Target != "" && e.Target != q.Target:
+		case q.Outcome != "" && e.Outcome != q.Outcome:
+		case !q.CreatedFrom.IsZero() && e.CreatedAt.Before(q.CreatedFrom):
+		case !q.CreatedTo.IsZero() && !e.CreatedAt.Before(q.CreatedTo):
+		case q.After != 0 && e.Seq <= q.After:
+		case q.Before != 0 && e.Seq >= q.Before:
+		default:
+			es = append(es, e)
+		}
+	}
+
+	if q.Desc {
+		sort.Slice(es, func(i, j int) bool { return es[i].Seq > es[j].Seq })
+	}
+
+	if q.Limit > 0 && len(es) > q.Limit {
+		es = es[:q.Limit]
+	}
+	return es, nil
+}
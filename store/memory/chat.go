@@ -0,0 +1,364 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+// ChatRepo is an in-memory `internal.ChatRepo`
+type ChatRepo struct {
+	mu sync.RWMutex
+	// messages of each room, in the order of their `Seq`
+	rooms map[string][]internal.Message
+	// the seq each user has read up to in each room
+	reads map[suid.UUID]map[string]int64
+	// earlier versions of each message that has been edited
+	edits map[suid.UUID][]internal.MessageEdit
+	// the users of each room that are not members
+	roles map[string]map[suid.UUID]string
+	// the sanctions of each room
+	sanctions map[string]map[sanctionKey]internal.Sanction
+}
+
+type sanctionKey struct {
+	uid  suid.UUID
+	kind string
+}
+
+var _ internal.ChatRepo = (*ChatRepo)(nil)
+
+func NewChatRepo() *ChatRepo {
+	return &ChatRepo{
+		rooms:     make(map[string][]internal.Message),
+		reads:     make(map[suid.UUID]map[string]int64),
+		edits:     make(map[suid.UUID][]internal.MessageEdit),
+		roles:     make(map[string]map[suid.UUID]string),
+		sanctions: make(map[string]map[sanctionKey]internal.Sanction),
+	}
+}
+
+func (r *ChatRepo) InsertMessage(ctx context.Context, m *internal.Message) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for room, ms := range r.rooms {
+		for _, v := range ms {
+			if v.ID == m.ID {
+				return internal.ErrAlreadyExists
+			}
+
+			if m.ClientID != "" && room == m.Room && v.Sender == m.Sender && v.ClientID == m.ClientID {
+				*m = v
+				return internal.ErrAlreadyExists
+			}
+		}
+	}
+
+	ms := r.rooms[m.Room]
+	m.Seq = int64(len(ms)) + 1
+	m.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+
+	r.rooms[m.Room] = append(ms, *m)
+	return nil
+}
+
+func (r *ChatRepo) SelectMessages(ctx context.Context, q internal.MessageQuery) ([]internal.Message, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// a message is at the index before its seq
+	all := r.rooms[q.Room]
+	lo, hi := q.After, int64(len(all))
+	if lo < 0 {
+		lo = 0
+	}
+	if q.Before != 0 && q.Before-1 < hi {
+		hi = q.Before - 1
+	}
+
+	if lo >= hi {
+		return nil, nil
+	}
+
+	var ms []internal.Message
+	for i := lo; i < hi; i++ {
+		j := i
+		if !q.Ascending {
+			j = hi - 1 - (i - lo)
+		}
+		ms = append(ms, all[j])
+
+		if q.Limit > 0 && len(ms) == q.Limit {
+			break
+		}
+	}
+	return ms, nil
+}
+
+func (r *ChatRepo) MarkRead(ctx context.Context, room string, uid suid.UUID, seq int64) (int64, error) {
+	if err := ctxErr(ctx); err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := int64(len(r.rooms[room]))
+	if n == 0 {
+		return 0, internal.ErrNotFound
+	}
+	if seq > n {
+		seq = n
+	}
+
+	rs, ok := r.reads[uid]
+	if !ok {
+		rs = make(map[string]int64)
+		r.reads[uid] = rs
+	}
+
+	if v, ok := rs[room]; !ok || seq > v {
+		rs[room] = seq
+	}
+	return rs[room], nil
+}
+
+func (r *ChatRepo) SelectConversations(ctx context.Context, uid suid.UUID) ([]internal.Conversation, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var cs []internal.Conversation
+	for room, seq := range r.reads[uid] {
+		ms := r.rooms[room]
+		if len(ms) == 0 {
+			continue
+		}
+		cs = append(cs, internal.Conversation{Room: room, User: uid, ReadSeq: seq, Last: ms[len(ms)-1]})
+	}
+
+	sort.Slice(cs, func(i, j int) bool {
+		if !cs[i].Last.CreatedAt.Equal(cs[j].Last.CreatedAt) {
+			return cs[i].Last.CreatedAt.After(cs[j].Last.CreatedAt)
+		}
+		return cs[i].Room < cs[j].Room
+	})
+	return cs, nil
+}
+
+func (r *ChatRepo) SelectMessage(ctx context.Context, id suid.UUID) (internal.Message, error) {
+	if err := ctxErr(ctx); err != nil {
+		return internal.Message{}, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m := r.find(id)
+	if m == nil {
+		return internal.Message{}, internal.ErrNotFound
+	}
+	return *m, nil
+}
+
+// find returns the stored message with the id, or nil
+func (r *ChatRepo) find(id suid.UUID) *internal.Message {
+	for _, ms := range r.rooms {
+		for i := range ms {
+			if ms[i].ID == id {
+				return &ms[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (r *ChatRepo) UpdateMessage(ctx context.Context, m *internal.Message) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v := r.find(m.ID)
+	if v == nil || v.DeletedAt != nil {
+		return internal.ErrNotFound
+	}
+
+	// the version replaced was written when the message was last edited
+	written := v.CreatedAt
+	if v.EditedAt != nil {
+		written = *v.EditedAt
+	}
+	r.edits[v.ID] = append(r.edits[v.ID], internal.MessageEdit{MessageID: v.ID, Text: v.Text, CreatedAt: written})
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	v.Text, v.EditedAt = m.Text, &now
+
+	*m = *v
+	return nil
+}
+
+func (r *ChatRepo) DeleteMessage(ctx context.Context, m *internal.Message) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v := r.find(m.ID)
+	if v == nil || v.DeletedAt != nil {
+		return internal.ErrNotFound
+	}
+
+	// the text removed is kept with the edits for moderators
+	written := v.CreatedAt
+	if v.EditedAt != nil {
+		written = *v.EditedAt
+	}
+	r.edits[v.ID] = append(r.edits[v.ID], internal.MessageEdit{MessageID: v.ID, Text: v.Text, CreatedAt: written})
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	v.Text, v.DeletedAt = "", &now
+
+	*m = *v
+	return nil
+}
+
+func (r *ChatRepo) SelectEdits(ctx context.Context, id suid.UUID) ([]internal.MessageEdit, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]internal.MessageEdit(nil), r.edits[id]...), nil
+}
+
+func (r *ChatRepo) SetRole(ctx context.Context, rr internal.RoomRole) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	roles, ok := r.roles[rr.Room]
+	if !ok {
+		roles = make(map[suid.UUID]string)
+		r.roles[rr.Room] = roles
+	}
+
+	if rr.Role == internal.RoleOwner {
+		for uid, role := range roles {
+			if role == internal.RoleOwner && uid != rr.User {
+				return internal.ErrAlreadyExists
+			}
+		}
+	}
+
+	if rr.Role == internal.RoleMember {
+		delete(roles, rr.User)
+	} else {
+		roles[rr.User] = rr.Role
+	}
+	return nil
+}
+
+func (r *ChatRepo) SelectRoles(ctx context.Context, room string) ([]internal.RoomRole, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var rs []internal.RoomRole
+	for uid, role := range r.roles[room] {
+		rs = append(rs, internal.RoomRole{Room: room, User: uid, Role: role})
+	}
+
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].Role != rs[j].Role {
+			return rs[i].Role == internal.RoleOwner
+		}
+		return rs[i].User.String() < rs[j].User.String()
+	})
+	return rs, nil
+}
+
+func (r *ChatRepo) InsertSanction(ctx context.Context, sn *internal.Sanction) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ss, ok := r.sanctions[sn.Room]
+	if !ok {
+		ss = make(map[sanctionKey]internal.Sanction)
+		r.sanctions[sn.Room] = ss
+	}
+
+	sn.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	ss[sanctionKey{sn.User, sn.Kind}] = *sn
+	return nil
+}
+
+func (r *ChatRepo) DeleteSanction(ctx context.Context, room string, uid suid.UUID, kind string) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := sanctionKey{uid, kind}
+	if _, ok := r.sanctions[room][k]; !ok {
+		return internal.ErrNotFound
+	}
+
+	delete(r.sanctions[room], k)
+	return nil
+}
+
+func (r *ChatRepo) SelectSanctions(ctx context.Context, room string) ([]internal.Sanction, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+
+	var ss []internal.Sanction
+	for _, sn := range r.sanctions[room] {
+		if sn.Active(now) {
+			ss = append(ss, sn)
+		}
+	}
+
+	sort.Slice(ss, func(i, j int) bool { return ss[i].CreatedAt.Before(ss[j].CreatedAt) })
+	return ss, nil
+}
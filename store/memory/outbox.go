@@ -0,0 +1,72 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+type outboxEvent struct {
+	internal.Event
+	lockedUntil time.Time
+	dispatched  bool
+}
+
+var _ internal.Outbox = (*UserRepo)(nil)
+
+// event appends an event to the outbox, the caller must hold the lock
+func (r *UserRepo) event(typ string, id suid.UUID, data any) error {
+	e, err := internal.NewEvent(typ, id, data)
+	if err != nil {
+		return err
+	}
+
+	r.es = append(r.es, &outboxEvent{Event: e})
+	return nil
+}
+
+func (r *UserRepo) Claim(ctx context.Context, n int, lease time.Duration) ([]internal.Event, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+
+	var es []internal.Event
+	for _, e := range r.es {
+		if len(es) == n {
+			break
+		}
+
+		if e.dispatched || e.lockedUntil.After(now) {
+			continue
+		}
+
+		e.lockedUntil = now.Add(lease)
+		es = append(es, e.Event)
+	}
+	return es, nil
+}
+
+func (r *UserRepo) Ack(ctx context.Context, ids ...suid.UUID) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range r.es {
+		for _, id := range ids {
+			if e.ID == id {
+				e.dispatched, e.lockedUntil = true, time.Time{}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyphengolang/prelude/types/email"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+// UserRepo is an in-memory `internal.UserRepo` that follows the
+// semantics of the Postgres store: usernames and emails are unique
+// among accounts that have not been deleted and emails are
+// compared without case.
+type UserRepo struct {
+	ctx context.Context
+
+	mu sync.RWMutex
+	us []*internal.User
+	// written with the change to the users, see outbox.go
+	es []*outboxEvent
+}
+
+var _ internal.UserRepo = (*UserRepo)(nil)
+
+func NewUserRepo(ctx context.Context) *UserRepo {
+	return &UserRepo{ctx: ctx}
+}
+
+func (r *UserRepo) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+func (r *UserRepo) Close(ctx context.Context) error { return nil }
+
+func (r *UserRepo) Select(ctx context.Context, key any) (*internal.User, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+
+	var match func(u *internal.User) bool
+	switch key := key.(type) {
+	case suid.UUID:
+		match = func(u *internal.User) bool { return u.ID == key }
+	case email.Email:
+		match = func(u *internal.User) bool { return equalEmail(u.Email, key) }
+	case string:
+		match = func(u *internal.User) bool { return u.Username == key }
+	default:
+		return nil, internal.ErrInvalidType
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	include := includeDeleted(ctx)
+	for _, u := range r.us {
+		if (include || u.DeletedAt == nil) && match(u) {
+			return clone(u), nil
+		}
+	}
+	return nil, internal.ErrNotFound
+}
+
+func (r *UserRepo) SelectMany(ctx context.Context, q internal.UserQuery) ([]internal.User, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// when paging backwards the users are read in the opposite
+	// order to find those closest to the cursor
+	desc := q.Desc != (q.Before != nil)
+
+	c := q.After
+	if c == nil {
+		c = q.Before
+	}
+
+	// users must come after the cursor in the order they are read
+	after := 1
+	if desc {
+		after = -1
+	}
+
+	var us []internal.User
+	for _, u := range r.filter(ctx, q) {
+		if c != nil && compare(u, c) != after {
+			continue
+		}
+		us = append(us, *clone(u))
+	}
+
+	sort.Slice(us, func(i, j int) bool {
+		return (compare(&us[i], internal.CursorOf(&us[j])) < 0) != desc
+	})
+
+	if q.Limit > 0 && len(us) > q.Limit {
+		us = us[:q.Limit]
+	}
+
+	if q.Before != nil {
+		for i, j := 0, len(us)-1; i < j; i, j = i+1, j-1 {
+			us[i], us[j] = us[j], us[i]
+		}
+	}
+	return us, nil
+}
+
+func (r *UserRepo) Count(ctx context.Context, q internal.UserQuery) (int, error) {
+	if err := ctxErr(ctx); err != nil {
+		return 0, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.filter(ctx, q)), nil
+}
+
+// filter returns the users matching the filters of a query
+func (r *UserRepo) filter(ctx context.Context, q internal.UserQuery) []*internal.User {
+	include := includeDeleted(ctx)
+
+	var us []*internal.User
+	for _, u := range r.us {
+		switch {
+		case !include && u.DeletedAt != nil:
+		case !strings.HasPrefix(u.Username, q.UsernamePrefix):
+		case !strings.HasPrefix(strings.ToLower(u.Email.String()), strings.ToLower(q.EmailPrefix)):
+		case !q.CreatedFrom.IsZero() && u.CreatedAt.Before(q.CreatedFrom):
+		case !q.CreatedTo.IsZero() && !u.CreatedAt.Before(q.CreatedTo):
+		default:
+			us = append(us, u)
+		}
+	}
+	return us
+}
+
+func (r *UserRepo) Insert(ctx context.Context, u *internal.User) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+
+	if err := validate(u); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, v := range r.us {
+		if v.ID == u.ID {
+			return fmt.Errorf("%w: %s", internal.ErrAlreadyExists, "account_pkey")
+		}
+	}
+
+	if err := r.unique(u); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	v := clone(u)
+	v.CreatedAt, v.UpdatedAt, v.Version, v.DeletedAt = now, now, 1, nil
+
+	r.us = append(r.us, v)
+	return r.event(internal.EventAccountCreated, v.ID, internal.AccountData{Username: v.Username, Version: v.Version})
+}
+
+func (r *UserRepo) Update(ctx context.Context, u *internal.User) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+
+	if err := validate(u); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v := r.find(u.ID)
+	if v == nil || v.DeletedAt != nil {
+		return internal.ErrNotFound
+	}
+
+	if v.Version != u.Version {
+		return internal.ErrVersionMismatch
+	}
+
+	if err := r.unique(u); err != nil {
+		return err
+	}
+
+	v.Username, v.Email, v.Password = u.Username, u.Email, u.Password
+	v.UpdatedAt, v.Version = time.Now().UTC(), v.Version+1
+
+	u.UpdatedAt, u.Version = v.UpdatedAt, v.Version
+	return r.event(internal.EventAccountUpdated, v.ID, internal.AccountData{Username: v.Username, Version: v.Version})
+}
+
+func (r *UserRepo) Delete(ctx context.Context, key any) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+
+	var match func(u *internal.User) bool
+	switch key := key.(type) {
+	case suid.UUID:
+		match = func(u *internal.User) bool { return u.ID == key }
+	case email.Email:
+		match = func(u *internal.User) bool { return equalEmail(u.Email, key) }
+	default:
+		return internal.ErrInvalidType
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if t, _ := ctx.Value(internal.RuleSoftDeletion).(internal.DeleteTyp); t == internal.HardDelete {
+		us := r.us[:0]
+		for _, u := range r.us {
+			if !match(u) {
+				us = append(us, u)
+			} else if err := r.event(internal.EventAccountPurged, u.ID, nil); err != nil {
+				return err
+			}
+		}
+		r.us = us
+		return nil
+	}
+
+	now := time.Now().UTC()
+	for _, u := range r.us {
+		if u.DeletedAt == nil && match(u) {
+			u.DeletedAt = &now
+			if err := r.event(internal.EventAccountDeleted, u.ID, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *UserRepo) Restore(ctx context.Context, id suid.UUID) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u := r.find(id)
+	if u == nil || u.DeletedAt == nil {
+		return internal.ErrNotFound
+	}
+
+	if err := r.unique(u); err != nil {
+		return err
+	}
+
+	// sessions from before the account was deleted are revoked
+	u.RevokedAt, u.DeletedAt, u.UpdatedAt, u.Version = u.DeletedAt, nil, time.Now().UTC(), u.Version+1
+	return r.event(internal.EventAccountRestored, u.ID, nil)
+}
+
+func (r *UserRepo) Purge(ctx context.Context, age time.Duration) (int64, error) {
+	if err := ctxErr(ctx); err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int64
+	us := r.us[:0]
+	for _, u := range r.us {
+		if u.DeletedAt != nil && time.Since(*u.DeletedAt) > age {
+			if err := r.event(internal.EventAccountPurged, u.ID, nil); err != nil {
+				return n, err
+			}
+			n++
+			continue
+		}
+		us = append(us, u)
+	}
+	r.us = us
+	return n, nil
+}
+
+func (r *UserRepo) find(id suid.UUID) *internal.User {
+	for _, u := range r.us {
+		if u.ID == id {
+			return u
+		}
+	}
+	return nil
+}
+
+// unique checks the username and email of u have not been
+// claimed by another account that has not been deleted
+func (r *UserRepo) unique(u *internal.User) error {
+	for _, v := range r.us {
+		if v.ID == u.ID || v.DeletedAt != nil {
+			continue
+		}
+
+		if v.Username == u.Username {
+			return fmt.Errorf("%w: %s", internal.ErrAlreadyExists, "account_username_key")
+		}
+
+		if equalEmail(v.Email, u.Email) {
+			return fmt.Errorf("%w: %s", internal.ErrAlreadyExists, "account_email_key")
+		}
+	}
+	return nil
+}
+
+var (
+	errEmptyUsername = errors.New(`username cannot be empty`)
+	errEmptyPassword = errors.New(`password cannot be empty`)
+)
+
+// validate mirrors the check constraints of the "account" table
+func validate(u *internal.User) error {
+	switch {
+	case u.Username == "":
+		return errEmptyUsername
+	case len(u.Password) == 0:
+		return errEmptyPassword
+	}
+	return u.Email.Validate()
+}
+
+// compare orders a user against a cursor by (`CreatedAt`, `ID`)
+func compare(u *internal.User, c *internal.Cursor) int {
+	switch {
+	case u.CreatedAt.Before(c.CreatedAt):
+		return -1
+	case u.CreatedAt.After(c.CreatedAt):
+		return 1
+	}
+	return bytes.Compare(u.ID.UUID[:], c.ID.UUID[:])
+}
+
+func equalEmail(a, b email.Email) bool { return strings.EqualFold(a.String(), b.String()) }
+
+func includeDeleted(ctx context.Context) bool {
+	ok, _ := ctx.Value(internal.RuleIncludeDeleted).(bool)
+	return ok
+}
+
+func ctxErr(ctx context.Context) error {
+	switch err := ctx.Err(); err {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return fmt.Errorf("%w: %v", internal.ErrTimeout, err)
+	default:
+		return err
+	}
+}
+
+func clone(u *internal.User) *internal.User {
+	v := *u
+	if u.DeletedAt != nil {
+		t := *u.DeletedAt
+		v.DeletedAt = &t
+	}
+	if u.RevokedAt != nil {
+		t := *u.RevokedAt
+		v.RevokedAt = &t
+	}
+	return &v
+}
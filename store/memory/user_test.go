@@ -0,0 +1,39 @@
+package memory
+
+import (
+	"context"
+	"testing"
+
+	"secure.adoublef.com/store/storetest"
+)
+
+func TestUserRepo(t *testing.T) {
+	t.Parallel()
+
+	storetest.UserRepo(t, NewUserRepo(context.Background()))
+}
+
+func TestAuditRepo(t *testing.T) {
+	t.Parallel()
+
+	storetest.AuditRepo(t, NewAuditRepo(context.Background(), true))
+}
+
+func TestOutbox(t *testing.T) {
+	t.Parallel()
+
+	r := NewUserRepo(context.Background())
+	storetest.Outbox(t, r, r)
+}
+
+func TestWebhookRepo(t *testing.T) {
+	t.Parallel()
+
+	storetest.WebhookRepo(t, NewWebhookRepo())
+}
+
+func TestChatRepo(t *testing.T) {
+	t.Parallel()
+
+	storetest.ChatRepo(t, NewChatRepo())
+}
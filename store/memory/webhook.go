@@ -0,0 +1,231 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+// WebhookRepo is an in-memory `internal.WebhookRepo`
+type WebhookRepo struct {
+	mu sync.RWMutex
+	ws []internal.Webhook
+	ds []*internal.Delivery
+}
+
+var _ internal.WebhookRepo = (*WebhookRepo)(nil)
+
+func NewWebhookRepo() *WebhookRepo { return &WebhookRepo{} }
+
+func (r *WebhookRepo) InsertWebhook(ctx context.Context, w *internal.Webhook) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, v := range r.ws {
+		if v.ID == w.ID {
+			return internal.ErrAlreadyExists
+		}
+	}
+
+	w.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+
+	v := *w
+	v.Events = append([]string(nil), w.Events...)
+	r.ws = append(r.ws, v)
+	return nil
+}
+
+func (r *WebhookRepo) SelectWebhook(ctx context.Context, id suid.UUID) (*internal.Webhook, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, w := range r.ws {
+		if w.ID == id {
+			w.Events = append([]string(nil), w.Events...)
+			return &w, nil
+		}
+	}
+	return nil, internal.ErrNotFound
+}
+
+func (r *WebhookRepo) SelectWebhooks(ctx context.Context) ([]internal.Webhook, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ws := make([]internal.Webhook, len(r.ws))
+	for i, w := range r.ws {
+		w.Events = append([]string(nil), w.Events...)
+		ws[i] = w
+	}
+	return ws, nil
+}
+
+func (r *WebhookRepo) DeleteWebhook(ctx context.Context, id suid.UUID) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ws := r.ws[:0]
+	for _, w := range r.ws {
+		if w.ID != id {
+			ws = append(ws, w)
+		}
+	}
+
+	if len(ws) == len(r.ws) {
+		return internal.ErrNotFound
+	}
+	r.ws = ws
+
+	ds := r.ds[:0]
+	for _, d := range r.ds {
+		if d.WebhookID != id {
+			ds = append(ds, d)
+		}
+	}
+	r.ds = ds
+	return nil
+}
+
+func (r *WebhookRepo) InsertDelivery(ctx context.Context, d *internal.Delivery) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var found bool
+	for _, w := range r.ws {
+		found = found || w.ID == d.WebhookID
+	}
+
+	if !found {
+		return internal.ErrNotFound
+	}
+
+	var seq int64
+	for _, v := range r.ds {
+		if v.WebhookID == d.WebhookID && v.EventID == d.EventID {
+			return nil
+		}
+		if v.Seq > seq {
+			seq = v.Seq
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	d.Seq, d.Status, d.Attempts = seq+1, internal.DeliveryPending, 0
+	d.NextAttemptAt, d.CreatedAt, d.UpdatedAt = now, now, now
+
+	v := *d
+	r.ds = append(r.ds, &v)
+	return nil
+}
+
+func (r *WebhookRepo) ClaimDeliveries(ctx context.Context, n int, lease time.Duration) ([]internal.Delivery, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+
+	var ds []internal.Delivery
+	for _, d := range r.ds {
+		if len(ds) == n {
+			break
+		}
+
+		if d.Status != internal.DeliveryPending || d.NextAttemptAt.After(now) {
+			continue
+		}
+
+		d.NextAttemptAt = now.Add(lease).Truncate(time.Microsecond)
+		ds = append(ds, *d)
+	}
+	return ds, nil
+}
+
+func (r *WebhookRepo) UpdateDelivery(ctx context.Context, d *internal.Delivery) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, v := range r.ds {
+		if v.ID == d.ID {
+			d.UpdatedAt = time.Now().UTC().Truncate(time.Microsecond)
+
+			v.Status, v.Attempts, v.NextAttemptAt = d.Status, d.Attempts, d.NextAttemptAt
+			v.LastError, v.ResponseStatus, v.UpdatedAt = d.LastError, d.ResponseStatus, d.UpdatedAt
+			return nil
+		}
+	}
+	return internal.ErrNotFound
+}
+
+func (r *WebhookRepo) SelectDelivery(ctx context.Context, id suid.UUID) (*internal.Delivery, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, d := range r.ds {
+		if d.ID == id {
+			v := *d
+			return &v, nil
+		}
+	}
+	return nil, internal.ErrNotFound
+}
+
+func (r *WebhookRepo) SelectDeliveries(ctx context.Context, q internal.DeliveryQuery) ([]internal.Delivery, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var ds []internal.Delivery
+	for i := len(r.ds) - 1; i >= 0; i-- {
+		d := r.ds[i]
+		switch {
+		case d.WebhookID != q.WebhookID:
+		case q.Status != "" && d.Status != q.Status:
+		case q.Before != 0 && d.Seq >= q.Before:
+		default:
+			ds = append(ds, *d)
+		}
+
+		if q.Limit > 0 && len(ds) == q.Limit {
+			break
+		}
+	}
+	return ds, nil
+}
@@ -0,0 +1,419 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	psql "github.com/hyphengolang/prelude/sql/postgres"
+	"github.com/jackc/pgx/v5"
+)
+
+// Postgres holds the migrations for the Postgres store
+//
+//go:embed postgres/*.sql
+var Postgres embed.FS
+
+// SQLite holds the migrations for the SQLite store
+//
+//go:embed sqlite/*.sql
+var SQLite embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+func (s Status) String() string {
+	if s.AppliedAt == nil {
+		return fmt.Sprintf("%04d %-40s pending", s.Version, s.Name)
+	}
+	return fmt.Sprintf("%04d %-40s applied %s", s.Version, s.Name, s.AppliedAt.Format(time.RFC3339))
+}
+
+var (
+	ErrInvalidName = errors.New(`migration file name must be of the form "0001_name.up.sql" or "0001_name.down.sql"`)
+	ErrDuplicate   = errors.New(`duplicate migration`)
+	ErrMissingUp   = errors.New(`migration has no up file`)
+	ErrMissingDown = errors.New(`migration has no down file`)
+)
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load reads every "*.sql" file found in the root directory of fsys
+// or the only directory within it, as is the case with an `embed.FS`.
+// Migrations are returned ordered by version.
+func Load(fsys fs.FS) ([]Migration, error) {
+	dir := "."
+	if ds, err := fs.ReadDir(fsys, dir); err == nil && len(ds) == 1 && ds[0].IsDir() {
+		dir = ds[0].Name()
+	}
+
+	names, err := fs.Glob(fsys, path.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, name := range names {
+		m := fileName.FindStringSubmatch(path.Base(name))
+		if m == nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidName, name)
+		}
+
+		version, _ := strconv.Atoi(m[1])
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		mg, ok := byVersion[version]
+		if !ok {
+			mg = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mg
+		} else if mg.Name != m[2] {
+			return nil, fmt.Errorf("%w: version %d", ErrDuplicate, version)
+		}
+
+		switch m[3] {
+		case "up":
+			mg.Up = string(b)
+		case "down":
+			mg.Down = string(b)
+		}
+	}
+
+	ms := make([]Migration, 0, len(byVersion))
+	for _, mg := range byVersion {
+		if mg.Up == "" {
+			return nil, fmt.Errorf("%w: %04d_%s", ErrMissingUp, mg.Version, mg.Name)
+		}
+		ms = append(ms, *mg)
+	}
+
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return ms, nil
+}
+
+// Conn is a single database session, the advisory lock is held
+// by the session so it must not be a pool
+type Conn interface {
+	psql.Q
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// session is the database specific half of a migrator
+type session interface {
+	// lock is held whilst migrating, the returned func releases it
+	lock(ctx context.Context) (unlock func() error, err error)
+	// applied returns when each migration was applied, the migrations table
+	// is created if needed when create is set and treated as empty otherwise
+	applied(ctx context.Context, create bool) (map[int]time.Time, error)
+	// apply runs sql and records it in the migrations table within a transaction
+	apply(ctx context.Context, qry string, mg Migration, up bool) error
+}
+
+type Migrator struct {
+	s  session
+	ms []Migration
+
+	// When set, pending migrations are logged but not applied
+	// and the migrations table is not created
+	DryRun bool
+
+	logf func(format string, v ...any)
+}
+
+// New returns a migrator for a Postgres connection
+func New(c Conn, fsys fs.FS) (*Migrator, error) {
+	return newMigrator(pgSession{c}, fsys)
+}
+
+// NewSQL returns a migrator for a SQLite connection
+func NewSQL(c *sql.Conn, fsys fs.FS) (*Migrator, error) {
+	return newMigrator(sqlSession{c}, fsys)
+}
+
+func newMigrator(s session, fsys fs.FS) (*Migrator, error) {
+	ms, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Migrator{
+		s:    s,
+		ms:   ms,
+		logf: log.Printf,
+	}
+	return m, nil
+}
+
+// Status reports every known migration and when it was applied
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var ss []Status
+	return ss, m.locked(ctx, false, func(applied map[int]time.Time) error {
+		for _, mg := range m.ms {
+			s := Status{Migration: mg}
+			if t, ok := applied[mg.Version]; ok {
+				s.AppliedAt = &t
+			}
+			ss = append(ss, s)
+		}
+		return nil
+	})
+}
+
+// Up applies every pending migration in order, each within its own transaction
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.locked(ctx, !m.DryRun, func(applied map[int]time.Time) error {
+		for _, mg := range m.ms {
+			if _, ok := applied[mg.Version]; ok {
+				continue
+			}
+
+			if err := m.apply(ctx, mg, true); err != nil {
+				return fmt.Errorf("migrating up %04d_%s: %w", mg.Version, mg.Name, err)
+			}
+			m.logf("migrated up %04d_%s", mg.Version, mg.Name)
+		}
+		return nil
+	})
+}
+
+// Down reverts the last n applied migrations
+func (m *Migrator) Down(ctx context.Context, n int) error {
+	return m.locked(ctx, !m.DryRun, func(applied map[int]time.Time) error {
+		for i := len(m.ms) - 1; i >= 0 && n > 0; i-- {
+			mg := m.ms[i]
+			if _, ok := applied[mg.Version]; !ok {
+				continue
+			}
+
+			if mg.Down == "" {
+				return fmt.Errorf("%w: %04d_%s", ErrMissingDown, mg.Version, mg.Name)
+			}
+
+			if err := m.apply(ctx, mg, false); err != nil {
+				return fmt.Errorf("migrating down %04d_%s: %w", mg.Version, mg.Name, err)
+			}
+			m.logf("migrated down %04d_%s", mg.Version, mg.Name)
+			n--
+		}
+		return nil
+	})
+}
+
+func (m *Migrator) apply(ctx context.Context, mg Migration, up bool) error {
+	qry := mg.Down
+	if up {
+		qry = mg.Up
+	}
+
+	if m.DryRun {
+		m.logf("-- %04d_%s (dry-run)\n%s", mg.Version, mg.Name, qry)
+		return nil
+	}
+
+	return m.s.apply(ctx, qry, mg, up)
+}
+
+// locked holds the lock while f is run with the applied migrations,
+// the migrations table is only created when create is set
+func (m *Migrator) locked(ctx context.Context, create bool, f func(applied map[int]time.Time) error) (err error) {
+	unlock, err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if uerr := unlock(); err == nil {
+			err = uerr
+		}
+	}()
+
+	applied, err := m.s.applied(ctx, create)
+	if err != nil {
+		return err
+	}
+
+	return f(applied)
+}
+
+const (
+	qryCreateTable = `create table if not exists "schema_migrations" (
+	version integer primary key,
+	name text not null,
+	applied_at timestamptz not null default now()
+)`
+
+	qryTableExists   = `select to_regclass('schema_migrations') is not null`
+	qrySelectApplied = `select version, applied_at from "schema_migrations"`
+	qryInsertApplied = `insert into "schema_migrations" (version, name) values ($1, $2)`
+	qryDeleteApplied = `delete from "schema_migrations" where version = $1`
+
+	// key shared by every instance so only one can migrate at a time
+	qryLock   = `select pg_advisory_lock(hashtext('schema_migrations'))`
+	qryUnlock = `select pg_advisory_unlock(hashtext('schema_migrations'))`
+)
+
+type pgSession struct{ c Conn }
+
+func (s pgSession) lock(ctx context.Context) (func() error, error) {
+	if err := psql.ExecContext(ctx, s.c, qryLock); err != nil {
+		return nil, err
+	}
+
+	// the session may be unusable if ctx is done
+	return func() error { return psql.ExecContext(context.Background(), s.c, qryUnlock) }, nil
+}
+
+func (s pgSession) applied(ctx context.Context, create bool) (map[int]time.Time, error) {
+	if create {
+		if err := psql.ExecContext(ctx, s.c, qryCreateTable); err != nil {
+			return nil, err
+		}
+	} else {
+		var ok bool
+		err := psql.QueryRowContext(ctx, s.c, qryTableExists, func(r pgx.Row) error { return r.Scan(&ok) })
+		if err != nil || !ok {
+			return map[int]time.Time{}, err
+		}
+	}
+
+	type row struct {
+		version   int
+		appliedAt time.Time
+	}
+
+	rs, err := psql.QueryContext(ctx, s.c, qrySelectApplied, func(r pgx.Rows, v *row) error { return r.Scan(&v.version, &v.appliedAt) })
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]time.Time, len(rs))
+	for _, r := range rs {
+		applied[r.version] = r.appliedAt
+	}
+	return applied, nil
+}
+
+func (s pgSession) apply(ctx context.Context, qry string, mg Migration, up bool) error {
+	tx, err := s.c.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := psql.ExecContext(ctx, tx, qry); err != nil {
+		return err
+	}
+
+	if up {
+		err = psql.ExecContext(ctx, tx, qryInsertApplied, mg.Version, mg.Name)
+	} else {
+		err = psql.ExecContext(ctx, tx, qryDeleteApplied, mg.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+const (
+	// SQLite has no timestamp type, times are stored as RFC 3339 text
+	qrySQLCreateTable = `create table if not exists "schema_migrations" (
+	version integer primary key,
+	name text not null,
+	applied_at text not null default (strftime('%Y-%m-%dT%H:%M:%SZ', 'now'))
+)`
+
+	qrySQLTableExists   = `select count(*) > 0 from sqlite_master where type = 'table' and name = 'schema_migrations'`
+	qrySQLSelectApplied = `select version, applied_at from "schema_migrations"`
+	qrySQLInsertApplied = `insert into "schema_migrations" (version, name) values (?, ?)`
+	qrySQLDeleteApplied = `delete from "schema_migrations" where version = ?`
+)
+
+// sqlSession has no lock as SQLite allows a single writer, a second
+// instance applying the same migration fails to record it and rolls back
+type sqlSession struct{ c *sql.Conn }
+
+func (s sqlSession) lock(ctx context.Context) (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+func (s sqlSession) applied(ctx context.Context, create bool) (map[int]time.Time, error) {
+	if create {
+		if _, err := s.c.ExecContext(ctx, qrySQLCreateTable); err != nil {
+			return nil, err
+		}
+	} else {
+		var ok bool
+		if err := s.c.QueryRowContext(ctx, qrySQLTableExists).Scan(&ok); err != nil || !ok {
+			return map[int]time.Time{}, err
+		}
+	}
+
+	rs, err := s.c.QueryContext(ctx, qrySQLSelectApplied)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	applied := map[int]time.Time{}
+	for rs.Next() {
+		var (
+			version   int
+			appliedAt string
+		)
+		if err := rs.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+
+		t, err := time.Parse(time.RFC3339, appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = t
+	}
+	return applied, rs.Err()
+}
+
+func (s sqlSession) apply(ctx context.Context, qry string, mg Migration, up bool) error {
+	tx, err := s.c.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, qry); err != nil {
+		return err
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, qrySQLInsertApplied, mg.Version, mg.Name)
+	} else {
+		_, err = tx.ExecContext(ctx, qrySQLDeleteApplied, mg.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
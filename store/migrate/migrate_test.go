@@ -0,0 +1,108 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	"github.com/hyphengolang/prelude/testing/is"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	t.Run(`load embedded migrations`, func(t *testing.T) {
+		for _, fsys := range []embed.FS{Postgres, SQLite} {
+			ms, err := Load(fsys)
+			is.NoErr(err)              // load embedded migrations
+			is.True(len(ms) > 0)       // at least one migration
+			is.Equal(ms[0].Version, 1) // ordered by version
+
+			for i, m := range ms {
+				is.Equal(m.Version, i+1) // versions have no gaps
+				is.True(m.Down != "")    // every migration can be reverted
+			}
+		}
+	})
+
+	t.Run(`load migrations in order`, func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"0010_second.up.sql":  {Data: []byte(`select 10`)},
+			"0002_first.up.sql":   {Data: []byte(`select 2`)},
+			"0002_first.down.sql": {Data: []byte(`select -2`)},
+		}
+
+		ms, err := Load(fsys)
+		is.NoErr(err)        // load migrations
+		is.Equal(len(ms), 2) // two migrations
+		is.Equal(ms[0].Name, "first")
+		is.Equal(ms[0].Down, `select -2`)
+		is.Equal(ms[1].Version, 10)
+		is.Equal(ms[1].Down, "") // down is optional
+	})
+
+	t.Run(`invalid migrations`, func(t *testing.T) {
+		_, err := Load(fstest.MapFS{"first.up.sql": {}})
+		is.True(errors.Is(err, ErrInvalidName)) // missing version
+
+		_, err = Load(fstest.MapFS{"0001_first.down.sql": {}})
+		is.True(errors.Is(err, ErrMissingUp)) // missing up
+
+		_, err = Load(fstest.MapFS{
+			"0001_first.up.sql":  {Data: []byte(`select 1`)},
+			"0001_second.up.sql": {Data: []byte(`select 1`)},
+		})
+		is.True(errors.Is(err, ErrDuplicate)) // same version
+	})
+}
+
+func TestDryRun(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	ctx := context.Background()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	is.NoErr(err) // open database
+	t.Cleanup(func() { db.Close() })
+
+	c, err := db.Conn(ctx)
+	is.NoErr(err) // connect
+	t.Cleanup(func() { c.Close() })
+
+	fsys := fstest.MapFS{
+		"0001_create_fizz.up.sql":   {Data: []byte(`create table "fizz" (id integer primary key)`)},
+		"0001_create_fizz.down.sql": {Data: []byte(`drop table "fizz"`)},
+	}
+
+	m, err := NewSQL(c, fsys)
+	is.NoErr(err) // new migrator
+	m.DryRun = true
+	m.logf = t.Logf
+
+	err = m.Up(ctx)
+	is.NoErr(err) // dry run
+
+	var n int
+	err = c.QueryRowContext(ctx, `select count(*) from sqlite_master where type = 'table'`).Scan(&n)
+	is.NoErr(err)  // count tables
+	is.Equal(n, 0) // nothing was created
+
+	ss, err := m.Status(ctx)
+	is.NoErr(err)                   // status
+	is.Equal(len(ss), len(m.ms))    // every migration is reported
+	is.True(ss[0].AppliedAt == nil) // and pending
+
+	m.DryRun = false
+	err = m.Up(ctx)
+	is.NoErr(err) // migrate up
+
+	ss, err = m.Status(ctx)
+	is.NoErr(err)                   // status
+	is.True(ss[0].AppliedAt != nil) // applied
+}
@@ -0,0 +1,25 @@
+create extension if not exists "uuid-ossp";
+create extension if not exists "citext";
+
+create table if not exists "account" (
+	id uuid primary key default uuid_generate_v4(),
+	username text not null check (username <> ''),
+	email citext not null check (email ~ '^[a-zA-Z0-9.!#$%&''*+/=?^_{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$'),
+	password citext not null check (password <> ''),
+	created_at timestamptz not null default now(),
+	updated_at timestamptz not null default now(),
+	version integer not null default 1 check (version > 0),
+	deleted boolean not null default false,
+	deleted_at timestamptz,
+	-- when an account that has been restored was deleted, refresh
+	-- tokens issued before then are not honoured
+	revoked_at timestamptz
+);
+
+-- identifiers are released once an account is deleted, restoring an account
+-- will fail if its username or email has since been claimed
+create unique index if not exists "account_username_key" on "account" (username) where not deleted;
+create unique index if not exists "account_email_key" on "account" (email) where not deleted;
+
+-- keyset pagination
+create index if not exists "account_created_at_id_idx" on "account" (created_at, id);
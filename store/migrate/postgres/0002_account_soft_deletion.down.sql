@@ -0,0 +1 @@
+drop rule if exists "_soft_deletion" on "account";
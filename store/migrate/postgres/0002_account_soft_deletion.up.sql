@@ -0,0 +1,7 @@
+-- More info regarding soft deleting https://evilmartians.com/chronicles/soft-deletion-with-postgresql-but-with-logic-on-the-database
+--
+-- deletes are soft unless "rules.soft_deletion" has been set to 'off'
+create or replace rule "_soft_deletion" 
+	as on delete to "account" 
+	where current_setting('rules.soft_deletion', true) is distinct from 'off'
+	do instead update "account" set deleted = true, deleted_at = now() where id = old.id and not deleted;
@@ -0,0 +1,10 @@
+-- fails if any email is still encrypted, as the keyring is not available here
+drop index if exists "account_email_kek_idx";
+drop index if exists "account_email_idx_key";
+
+alter table "account"
+	drop constraint if exists "account_email_present_check",
+	drop column if exists email_kek,
+	drop column if exists email_idx,
+	drop column if exists email_enc,
+	alter column email set not null;
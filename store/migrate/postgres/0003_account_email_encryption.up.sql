@@ -0,0 +1,16 @@
+-- emails are either plaintext or, when the store has a keyring, encrypted
+-- with a blind index for lookups. Plaintext emails are encrypted in the
+-- background once a keyring is configured.
+alter table "account"
+	alter column email drop not null,
+	add column email_enc bytea,
+	add column email_idx bytea,
+	add column email_kek text,
+	add constraint "account_email_present_check" check (
+		email is not null or (email_enc is not null and email_idx is not null and email_kek is not null)
+	);
+
+create unique index if not exists "account_email_idx_key" on "account" (email_idx) where not deleted;
+
+-- rows waiting to be encrypted or have their key rotated
+create index if not exists "account_email_kek_idx" on "account" (email_kek);
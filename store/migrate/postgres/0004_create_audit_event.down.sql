@@ -0,0 +1,2 @@
+drop table if exists "audit_event";
+drop function if exists "audit_event_append_only"();
@@ -0,0 +1,28 @@
+create table if not exists "audit_event" (
+	seq bigserial primary key,
+	id uuid not null unique,
+	actor text not null default '',
+	action text not null check (action <> ''),
+	target text not null default '',
+	ip text not null default '',
+	user_agent text not null default '',
+	outcome text not null check (outcome in ('success', 'failure')),
+	created_at timestamptz not null,
+	prev_hash bytea,
+	hash bytea
+);
+
+create index if not exists "audit_event_actor_idx" on "audit_event" (actor);
+create index if not exists "audit_event_action_idx" on "audit_event" (action);
+create index if not exists "audit_event_created_at_idx" on "audit_event" (created_at);
+
+-- events are append-only
+create or replace function "audit_event_append_only"() returns trigger as $$
+begin
+	raise exception 'audit_event is append-only';
+end;
+$$ language plpgsql;
+
+create trigger "_audit_event_append_only"
+	before update or delete or truncate on "audit_event"
+	for each statement execute function "audit_event_append_only"();
@@ -0,0 +1,16 @@
+-- domain events are written in the same transaction as the change
+-- to the account, then dispatched at least once
+create table if not exists "outbox" (
+	seq bigserial primary key,
+	id uuid not null unique,
+	type text not null check (type <> ''),
+	subject text not null,
+	data jsonb,
+	created_at timestamptz not null,
+	-- a claimed event is hidden from other dispatchers until the lease ends
+	locked_until timestamptz,
+	attempts integer not null default 0,
+	dispatched_at timestamptz
+);
+
+create index if not exists "outbox_pending_idx" on "outbox" (seq) where dispatched_at is null;
@@ -0,0 +1,33 @@
+-- subscriptions of external endpoints to the events of accounts
+create table if not exists "webhook" (
+	id uuid primary key,
+	url text not null check (url <> ''),
+	-- every type of event if empty
+	events text[] not null default '{}',
+	secret text not null check (secret <> ''),
+	created_at timestamptz not null default now()
+);
+
+-- each event is queued once per webhook and delivered at least once, as a
+-- delivery is posted again if its response is lost. Failed attempts are
+-- retried until the delivery is dead
+create table if not exists "webhook_delivery" (
+	seq bigserial primary key,
+	id uuid not null unique,
+	webhook_id uuid not null references "webhook" (id) on delete cascade,
+	event_id uuid not null,
+	event_type text not null check (event_type <> ''),
+	-- json rather than jsonb, so that the payload is signed as it was written
+	payload json not null,
+	status text not null default 'pending' check (status in ('pending', 'delivered', 'dead')),
+	attempts integer not null default 0,
+	next_attempt_at timestamptz not null default now(),
+	last_error text not null default '',
+	response_status integer not null default 0,
+	created_at timestamptz not null default now(),
+	updated_at timestamptz not null default now(),
+	unique (webhook_id, event_id)
+);
+
+create index if not exists "webhook_delivery_due_idx" on "webhook_delivery" (next_attempt_at) where status = 'pending';
+create index if not exists "webhook_delivery_log_idx" on "webhook_delivery" (webhook_id, seq);
@@ -0,0 +1,17 @@
+-- holds the last sequence number given to a message of each room, the
+-- row is locked while a message is inserted so rooms have no gaps
+create table if not exists "chat_room" (
+	name text primary key check (name <> ''),
+	seq bigint not null default 0
+);
+
+create table if not exists "chat_message" (
+	id uuid primary key,
+	room text not null references "chat_room" (name) on delete cascade,
+	seq bigint not null check (seq > 0),
+	-- the account may since have been deleted
+	sender uuid not null,
+	text text not null check (text <> ''),
+	created_at timestamptz not null default now(),
+	unique (room, seq)
+);
@@ -0,0 +1,6 @@
+-- the id the sender gave a message, so a message sent again after a
+-- lost ack is not stored twice
+alter table "chat_message"
+	add column if not exists client_id text check (client_id <> '' and length(client_id) <= 64);
+
+create unique index if not exists "chat_message_client_id_key" on "chat_message" (room, sender, client_id);
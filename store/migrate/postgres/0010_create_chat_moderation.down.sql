@@ -0,0 +1,12 @@
+drop table if exists "chat_sanction";
+drop table if exists "chat_role";
+drop table if exists "chat_message_edit";
+
+-- deleted messages cannot be kept without their text
+delete from "chat_message" where deleted_at is not null;
+
+alter table "chat_message"
+	drop constraint if exists "chat_message_text_check",
+	drop column if exists deleted_at,
+	drop column if exists edited_at,
+	add constraint "chat_message_text_check" check (text <> '');
@@ -0,0 +1,40 @@
+-- deleted messages are kept without their text, so the seqs of a room
+-- have no gaps
+alter table "chat_message"
+	drop constraint if exists "chat_message_text_check",
+	add column if not exists edited_at timestamptz,
+	add column if not exists deleted_at timestamptz,
+	add constraint "chat_message_text_check" check (text <> '' or deleted_at is not null);
+
+-- the versions of each message that have since been edited
+create table if not exists "chat_message_edit" (
+	id bigserial primary key,
+	message_id uuid not null references "chat_message" (id) on delete cascade,
+	text text not null check (text <> ''),
+	created_at timestamptz not null
+);
+
+create index if not exists "chat_message_edit_message_id_idx" on "chat_message_edit" (message_id);
+
+-- users without a role are members of the room
+create table if not exists "chat_role" (
+	room text not null check (room <> ''),
+	user_id uuid not null,
+	role text not null check (role in ('owner', 'moderator')),
+	primary key (room, user_id)
+);
+
+-- a room has one owner at most
+create unique index if not exists "chat_role_owner_key" on "chat_role" (room) where role = 'owner';
+
+-- mutes and bans, until they expire or are lifted
+create table if not exists "chat_sanction" (
+	room text not null check (room <> ''),
+	user_id uuid not null,
+	kind text not null check (kind in ('mute', 'ban')),
+	by_user uuid not null,
+	reason text not null default '',
+	expires_at timestamptz,
+	created_at timestamptz not null default now(),
+	primary key (room, user_id, kind)
+);
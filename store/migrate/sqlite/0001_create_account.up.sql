@@ -0,0 +1,26 @@
+-- times are stored as nanoseconds since the unix epoch, "now" is only
+-- precise to the millisecond
+create table if not exists "account" (
+	id text primary key check (length(id) = 36),
+	username text not null check (username <> ''),
+	-- case-insensitive, as the "citext" type is in Postgres, and checked against
+	-- the pattern of Postgres by the "regexp" function of the driver
+	email text not null collate nocase check (email regexp '^[a-zA-Z0-9.!#$%&''*+/=?^_{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$'),
+	password blob not null check (length(password) > 0),
+	created_at integer not null default (cast((julianday('now') - 2440587.5) * 86400000 as integer) * 1000000),
+	updated_at integer not null default (cast((julianday('now') - 2440587.5) * 86400000 as integer) * 1000000),
+	version integer not null default 1 check (version > 0),
+	deleted integer not null default 0 check (deleted in (0, 1)),
+	deleted_at integer,
+	-- when an account that has been restored was deleted, refresh
+	-- tokens issued before then are not honoured
+	revoked_at integer
+);
+
+-- identifiers are released once an account is deleted, restoring an account
+-- will fail if its username or email has since been claimed
+create unique index if not exists "account_username_key" on "account" (username) where not deleted;
+create unique index if not exists "account_email_key" on "account" (email) where not deleted;
+
+-- keyset pagination
+create index if not exists "account_created_at_id_idx" on "account" (created_at, id);
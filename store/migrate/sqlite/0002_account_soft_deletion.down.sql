@@ -0,0 +1,2 @@
+drop trigger if exists "_soft_deletion";
+drop table if exists "rules";
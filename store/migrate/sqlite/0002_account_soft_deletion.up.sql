@@ -0,0 +1,16 @@
+-- SQLite has no session settings, so rules are rows of this table that are
+-- written and removed within the transaction they apply to
+create table if not exists "rules" (
+	name text primary key,
+	value text not null
+);
+
+-- deletes are soft unless the "soft_deletion" rule has been set to 'off',
+-- ignoring the row once updated emulates the "do instead" rule of Postgres
+create trigger if not exists "_soft_deletion"
+	before delete on "account"
+	when coalesce((select value from "rules" where name = 'soft_deletion'), 'on') <> 'off'
+begin
+	update "account" set deleted = 1, deleted_at = cast((julianday('now') - 2440587.5) * 86400000 as integer) * 1000000 where id = old.id and not deleted;
+	select raise(ignore);
+end;
@@ -0,0 +1,31 @@
+create table if not exists "audit_event" (
+	seq integer primary key autoincrement,
+	id text not null unique check (length(id) = 36),
+	actor text not null default '',
+	action text not null check (action <> ''),
+	target text not null default '',
+	ip text not null default '',
+	user_agent text not null default '',
+	outcome text not null check (outcome in ('success', 'failure')),
+	-- nanoseconds since the unix epoch
+	created_at integer not null,
+	prev_hash blob,
+	hash blob
+);
+
+create index if not exists "audit_event_actor_idx" on "audit_event" (actor);
+create index if not exists "audit_event_action_idx" on "audit_event" (action);
+create index if not exists "audit_event_created_at_idx" on "audit_event" (created_at);
+
+-- events are append-only
+create trigger if not exists "_audit_event_no_update"
+	before update on "audit_event"
+begin
+	select raise(abort, 'audit_event is append-only');
+end;
+
+create trigger if not exists "_audit_event_no_delete"
+	before delete on "audit_event"
+begin
+	select raise(abort, 'audit_event is append-only');
+end;
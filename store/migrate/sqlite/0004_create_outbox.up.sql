@@ -0,0 +1,17 @@
+-- domain events are written in the same transaction as the change
+-- to the account, then dispatched at least once
+create table if not exists "outbox" (
+	seq integer primary key autoincrement,
+	id text not null unique check (length(id) = 36),
+	type text not null check (type <> ''),
+	subject text not null,
+	data text,
+	-- nanoseconds since the unix epoch
+	created_at integer not null,
+	-- a claimed event is hidden from other dispatchers until the lease ends
+	locked_until integer,
+	attempts integer not null default 0,
+	dispatched_at integer
+);
+
+create index if not exists "outbox_pending_idx" on "outbox" (seq) where dispatched_at is null;
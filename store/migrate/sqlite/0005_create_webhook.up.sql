@@ -0,0 +1,34 @@
+-- subscriptions of external endpoints to the events of accounts
+create table if not exists "webhook" (
+	id text primary key check (length(id) = 36),
+	url text not null check (url <> ''),
+	-- JSON array of event types, every type if empty
+	events text not null default '[]',
+	secret text not null check (secret <> ''),
+	-- nanoseconds since the unix epoch
+	created_at integer not null
+);
+
+-- each event is queued once per webhook and delivered at least once, as a
+-- delivery is posted again if its response is lost. Failed attempts are
+-- retried until the delivery is dead
+create table if not exists "webhook_delivery" (
+	seq integer primary key autoincrement,
+	id text not null unique check (length(id) = 36),
+	webhook_id text not null references "webhook" (id) on delete cascade,
+	event_id text not null check (length(event_id) = 36),
+	event_type text not null check (event_type <> ''),
+	payload text not null,
+	status text not null default 'pending' check (status in ('pending', 'delivered', 'dead')),
+	attempts integer not null default 0,
+	-- nanoseconds since the unix epoch
+	next_attempt_at integer not null,
+	last_error text not null default '',
+	response_status integer not null default 0,
+	created_at integer not null,
+	updated_at integer not null,
+	unique (webhook_id, event_id)
+);
+
+create index if not exists "webhook_delivery_due_idx" on "webhook_delivery" (next_attempt_at) where status = 'pending';
+create index if not exists "webhook_delivery_log_idx" on "webhook_delivery" (webhook_id, seq);
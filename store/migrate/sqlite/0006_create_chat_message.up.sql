@@ -0,0 +1,17 @@
+-- holds the last sequence number given to a message of each room
+create table if not exists "chat_room" (
+	name text primary key check (name <> ''),
+	seq integer not null default 0
+);
+
+create table if not exists "chat_message" (
+	id text primary key check (length(id) = 36),
+	room text not null references "chat_room" (name) on delete cascade,
+	seq integer not null check (seq > 0),
+	-- the account may since have been deleted
+	sender text not null check (length(sender) = 36),
+	text text not null check (text <> ''),
+	-- nanoseconds since the unix epoch
+	created_at integer not null,
+	unique (room, seq)
+);
@@ -0,0 +1,10 @@
+-- the rooms each user has read messages of, and how far
+create table if not exists "chat_member" (
+	room text not null references "chat_room" (name) on delete cascade,
+	-- the account may since have been deleted
+	user_id text not null check (length(user_id) = 36),
+	read_seq integer not null default 0 check (read_seq >= 0),
+	primary key (room, user_id)
+);
+
+create index if not exists "chat_member_user_id_idx" on "chat_member" (user_id);
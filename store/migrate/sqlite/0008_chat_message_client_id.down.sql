@@ -0,0 +1,3 @@
+drop index if exists "chat_message_client_id_key";
+
+alter table "chat_message" drop column client_id;
@@ -0,0 +1,25 @@
+drop table if exists "chat_sanction";
+drop table if exists "chat_role";
+drop table if exists "chat_message_edit";
+
+-- deleted messages cannot be kept without their text
+create table "chat_message_old" (
+	id text primary key check (length(id) = 36),
+	room text not null references "chat_room" (name) on delete cascade,
+	seq integer not null check (seq > 0),
+	-- the account may since have been deleted
+	sender text not null check (length(sender) = 36),
+	text text not null check (text <> ''),
+	-- nanoseconds since the unix epoch
+	created_at integer not null,
+	client_id text check (client_id <> '' and length(client_id) <= 64),
+	unique (room, seq)
+);
+
+insert into "chat_message_old" (id, room, seq, sender, text, created_at, client_id)
+select id, room, seq, sender, text, created_at, client_id from "chat_message" where deleted_at is null;
+
+drop table "chat_message";
+alter table "chat_message_old" rename to "chat_message";
+
+create unique index if not exists "chat_message_client_id_key" on "chat_message" (room, sender, client_id);
@@ -0,0 +1,59 @@
+-- deleted messages are kept without their text, so the seqs of a room
+-- have no gaps. SQLite cannot change a check so the table is rebuilt
+create table "chat_message_new" (
+	id text primary key check (length(id) = 36),
+	room text not null references "chat_room" (name) on delete cascade,
+	seq integer not null check (seq > 0),
+	-- the account may since have been deleted
+	sender text not null check (length(sender) = 36),
+	text text not null check (text <> '' or deleted_at is not null),
+	-- nanoseconds since the unix epoch
+	created_at integer not null,
+	client_id text check (client_id <> '' and length(client_id) <= 64),
+	edited_at integer,
+	deleted_at integer,
+	unique (room, seq)
+);
+
+insert into "chat_message_new" (id, room, seq, sender, text, created_at, client_id)
+select id, room, seq, sender, text, created_at, client_id from "chat_message";
+
+drop table "chat_message";
+alter table "chat_message_new" rename to "chat_message";
+
+create unique index if not exists "chat_message_client_id_key" on "chat_message" (room, sender, client_id);
+
+-- the versions of each message that have since been edited
+create table if not exists "chat_message_edit" (
+	id integer primary key,
+	message_id text not null references "chat_message" (id) on delete cascade,
+	text text not null check (text <> ''),
+	-- nanoseconds since the unix epoch
+	created_at integer not null
+);
+
+create index if not exists "chat_message_edit_message_id_idx" on "chat_message_edit" (message_id);
+
+-- users without a role are members of the room
+create table if not exists "chat_role" (
+	room text not null check (room <> ''),
+	user_id text not null check (length(user_id) = 36),
+	role text not null check (role in ('owner', 'moderator')),
+	primary key (room, user_id)
+);
+
+-- a room has one owner at most
+create unique index if not exists "chat_role_owner_key" on "chat_role" (room) where role = 'owner';
+
+-- mutes and bans, until they expire or are lifted
+create table if not exists "chat_sanction" (
+	room text not null check (room <> ''),
+	user_id text not null check (length(user_id) = 36),
+	kind text not null check (kind in ('mute', 'ban')),
+	by_user text not null check (length(by_user) = 36),
+	reason text not null default '',
+	-- nanoseconds since the unix epoch
+	expires_at integer,
+	created_at integer not null,
+	primary key (room, user_id, kind)
+);
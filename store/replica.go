@@ -0,0 +1,183 @@
+package store
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+// How often replicas are pinged when `PoolConfig.HealthCheckPeriod`
+// is not set and how long each ping may take
+const (
+	defaultReplicaCheckPeriod = time.Second * 5
+	replicaPingTimeout        = time.Second * 2
+)
+
+const pinKey = internal.ContextKey("store-pin")
+
+// Pin returns a context that will read from the primary once a write
+// has been made with it, so long as the store was configured with
+// `ReadYourWrites`. A context is usually pinned for a single request.
+// Reads with `internal.RuleReadPrimary` go to the primary either way.
+func Pin(ctx context.Context) context.Context {
+	return context.WithValue(ctx, pinKey, new(atomic.Bool))
+}
+
+func pinned(ctx context.Context) bool {
+	p, _ := ctx.Value(pinKey).(*atomic.Bool)
+	return p != nil && p.Load()
+}
+
+func pin(ctx context.Context) {
+	if p, _ := ctx.Value(pinKey).(*atomic.Bool); p != nil {
+		p.Store(true)
+	}
+}
+
+// replica is a read-only repository and how to check it can be read from
+type replica struct {
+	internal.RUserRepo
+	ping func(ctx context.Context) error
+}
+
+// replicaSet balances reads between the replicas that passed their
+// last health check, replicas are unhealthy until they are first checked
+type replicaSet struct {
+	rs      []replica
+	healthy []atomic.Bool
+	next    atomic.Uint32
+
+	cancel context.CancelFunc
+}
+
+func newReplicaSet(rs []replica, period time.Duration) *replicaSet {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &replicaSet{
+		rs:      rs,
+		healthy: make([]atomic.Bool, len(rs)),
+		cancel:  cancel,
+	}
+
+	go s.check(ctx, period)
+	return s
+}
+
+func (s *replicaSet) check(ctx context.Context, period time.Duration) {
+	t := time.NewTicker(period)
+	defer t.Stop()
+
+	for {
+		for i, r := range s.rs {
+			pctx, cancel := context.WithTimeout(ctx, replicaPingTimeout)
+			s.healthy[i].Store(r.ping(pctx) == nil)
+			cancel()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// pick returns the next healthy replica in turn
+func (s *replicaSet) pick() (internal.RUserRepo, bool) {
+	// unhealthy replicas use up their turn so the rest stay balanced
+	n := uint32(len(s.rs))
+	for i := uint32(0); i < n; i++ {
+		if j := s.next.Add(1) % n; s.healthy[j].Load() {
+			return s.rs[j].RUserRepo, true
+		}
+	}
+	return nil, false
+}
+
+func (s *replicaSet) close(ctx context.Context) error {
+	s.cancel()
+
+	var err error
+	for _, r := range s.rs {
+		if cerr := r.Close(ctx); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// routedUserRepo writes to the primary and reads from the replicas,
+// falling back to the primary when none are healthy
+type routedUserRepo struct {
+	primary  internal.UserRepo
+	replicas *replicaSet
+
+	readYourWrites bool
+}
+
+var _ internal.UserRepo = (*routedUserRepo)(nil)
+
+func (r *routedUserRepo) reader(ctx context.Context) internal.RUserRepo {
+	if primary, _ := ctx.Value(internal.RuleReadPrimary).(bool); primary {
+		return r.primary
+	}
+
+	if r.readYourWrites && pinned(ctx) {
+		return r.primary
+	}
+
+	if rr, ok := r.replicas.pick(); ok {
+		return rr
+	}
+	return r.primary
+}
+
+func (r *routedUserRepo) writer(ctx context.Context) internal.WUserRepo {
+	pin(ctx)
+	return r.primary
+}
+
+func (r *routedUserRepo) Context() context.Context { return r.primary.Context() }
+
+func (r *routedUserRepo) Close(ctx context.Context) error {
+	err := r.replicas.close(ctx)
+	if perr := r.primary.Close(ctx); err == nil {
+		err = perr
+	}
+	return err
+}
+
+func (r *routedUserRepo) SelectMany(ctx context.Context, q internal.UserQuery) ([]internal.User, error) {
+	return r.reader(ctx).SelectMany(ctx, q)
+}
+
+func (r *routedUserRepo) Count(ctx context.Context, q internal.UserQuery) (int, error) {
+	return r.reader(ctx).Count(ctx, q)
+}
+
+func (r *routedUserRepo) Select(ctx context.Context, key any) (*internal.User, error) {
+	return r.reader(ctx).Select(ctx, key)
+}
+
+func (r *routedUserRepo) Insert(ctx context.Context, u *internal.User) error {
+	return r.writer(ctx).Insert(ctx, u)
+}
+
+func (r *routedUserRepo) Update(ctx context.Context, u *internal.User) error {
+	return r.writer(ctx).Update(ctx, u)
+}
+
+func (r *routedUserRepo) Delete(ctx context.Context, key any) error {
+	return r.writer(ctx).Delete(ctx, key)
+}
+
+func (r *routedUserRepo) Restore(ctx context.Context, id suid.UUID) error {
+	return r.writer(ctx).Restore(ctx, id)
+}
+
+func (r *routedUserRepo) Purge(ctx context.Context, age time.Duration) (int64, error) {
+	return r.writer(ctx).Purge(ctx, age)
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/hyphengolang/prelude/types/password"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+	"secure.adoublef.com/store/memory"
+)
+
+func TestRoutedUserRepo(t *testing.T) {
+	t.Parallel()
+	is, ctx := is.New(t), context.Background()
+
+	errDown := errors.New("replica is down")
+	up := func(ctx context.Context) error { return nil }
+	down := func(ctx context.Context) error { return errDown }
+
+	primary := memory.NewUserRepo(ctx)
+	r1, r2, r3 := memory.NewUserRepo(ctx), memory.NewUserRepo(ctx), memory.NewUserRepo(ctx)
+
+	rs := newReplicaSet([]replica{{r1, up}, {r2, down}, {r3, up}}, time.Hour)
+	r := &routedUserRepo{primary: primary, replicas: rs, readYourWrites: true}
+	t.Cleanup(func() { r.Close(ctx) })
+
+	// wait for the first health check
+	for !rs.healthy[0].Load() || !rs.healthy[2].Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Run(`reads are balanced between healthy replicas`, func(t *testing.T) {
+		seen := map[internal.RUserRepo]int{}
+		for i := 0; i < 4; i++ {
+			seen[r.reader(ctx)]++
+		}
+
+		is.Equal(seen[r1], 2) // first replica read twice
+		is.Equal(seen[r2], 0) // unhealthy replica skipped
+		is.Equal(seen[r3], 2) // third replica read twice
+	})
+
+	u := internal.User{
+		ID:       suid.NewUUID(),
+		Username: "i_am_fizz",
+		Email:    "fizz@mail.com",
+		Password: password.Password("p4$$w4rD").MustHash(),
+	}
+
+	t.Run(`writes go to the primary`, func(t *testing.T) {
+		err := r.Insert(ctx, &u)
+		is.NoErr(err) // insert "fizz"
+
+		_, err = primary.Select(ctx, u.ID)
+		is.NoErr(err) // primary has "fizz"
+
+		_, err = r.Select(ctx, u.ID)
+		is.True(errors.Is(err, internal.ErrNotFound)) // replicas have yet to catch up
+	})
+
+	t.Run(`read your writes once pinned`, func(t *testing.T) {
+		ctx := Pin(ctx)
+
+		_, err := r.Select(ctx, u.ID)
+		is.True(errors.Is(err, internal.ErrNotFound)) // no write yet
+
+		err = r.Delete(ctx, u.ID)
+		is.NoErr(err) // soft delete "fizz"
+
+		_, err = r.Select(context.WithValue(ctx, internal.RuleIncludeDeleted, true), u.ID)
+		is.NoErr(err) // read from the primary
+	})
+
+	t.Run(`read back writes without read your writes`, func(t *testing.T) {
+		r := &routedUserRepo{primary: primary, replicas: rs}
+		ctx := Pin(ctx)
+
+		err := r.Restore(ctx, u.ID)
+		is.NoErr(err) // restore "fizz"
+
+		_, err = r.Select(ctx, u.ID)
+		is.True(errors.Is(err, internal.ErrNotFound)) // replicas have yet to catch up
+
+		_, err = r.Select(context.WithValue(ctx, internal.RuleReadPrimary, true), u.ID)
+		is.NoErr(err) // read from the primary
+	})
+
+	t.Run(`fall back to the primary`, func(t *testing.T) {
+		rs.healthy[0].Store(false)
+		rs.healthy[2].Store(false)
+
+		is.Equal(r.reader(ctx), primary) // no healthy replicas
+	})
+}
@@ -0,0 +1,162 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"secure.adoublef.com/internal"
+)
+
+const (
+	qrySelectAudit = `select seq, id, actor, action, target, ip, user_agent, outcome, created_at, prev_hash, hash from "audit_event"`
+
+	qryLastAuditHash = `select hash from "audit_event" order by seq desc limit 1`
+
+	qryInsertAudit = `insert into "audit_event" (id, actor, action, target, ip, user_agent, outcome, created_at, prev_hash, hash)
+	values (@id, @actor, @action, @target, @ip, @user_agent, @outcome, @created_at, @prev_hash, @hash)
+	returning seq`
+)
+
+// AuditRepo is the SQLite `internal.AuditRepo`
+type AuditRepo struct {
+	ctx   context.Context
+	chain bool
+
+	db Conn
+}
+
+var _ internal.AuditRepo = (*AuditRepo)(nil)
+
+// NewAuditRepo returns a repository that links events
+// by their hash when chain is set
+func NewAuditRepo(ctx context.Context, db Conn, chain bool) *AuditRepo {
+	return &AuditRepo{ctx, chain, db}
+}
+
+func (r *AuditRepo) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+func (r *AuditRepo) Close(ctx context.Context) error { return nil }
+
+func (r *AuditRepo) Append(ctx context.Context, e *internal.AuditEvent) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	// transactions take the write lock when they begin,
+	// so no other event can be appended between the two queries
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return mapError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	e.PrevHash, e.Hash = nil, nil
+
+	if r.chain {
+		err := tx.QueryRowContext(ctx, qryLastAuditHash).Scan(&e.PrevHash)
+		if err != nil && err != sql.ErrNoRows {
+			return mapError(err)
+		}
+		e.Hash = e.ChainHash(e.PrevHash)
+	}
+
+	args := []any{
+		sql.Named("id", e.ID),
+		sql.Named("actor", e.Actor),
+		sql.Named("action", e.Action),
+		sql.Named("target", e.Target),
+		sql.Named("ip", e.IP),
+		sql.Named("user_agent", e.UserAgent),
+		sql.Named("outcome", e.Outcome),
+		sql.Named("created_at", e.CreatedAt.UnixNano()),
+		sql.Named("prev_hash", e.PrevHash),
+		sql.Named("hash", e.Hash),
+	}
+
+	if err := tx.QueryRowContext(ctx, qryInsertAudit, args...).Scan(&e.Seq); err != nil {
+		return mapError(err)
+	}
+
+	return mapError(tx.Commit(ctx))
+}
+
+func (r *AuditRepo) SelectMany(ctx context.Context, q internal.AuditQuery) ([]internal.AuditEvent, error) {
+	var (
+		where []string
+		args  []any
+	)
+
+	for _, f := range []struct{ col, v string }{
+		{"actor", q.Actor},
+		{"action", q.Action},
+		{"target", q.Target},
+		{"outcome", q.Outcome},
+	} {
+		if f.v != "" {
+			where = append(where, f.col+" = @"+f.col)
+			args = append(args, sql.Named(f.col, f.v))
+		}
+	}
+
+	if !q.CreatedFrom.IsZero() {
+		where = append(where, "created_at >= @created_from")
+		args = append(args, sql.Named("created_from", q.CreatedFrom.UnixNano()))
+	}
+
+	if !q.CreatedTo.IsZero() {
+		where = append(where, "created_at < @created_to")
+		args = append(args, sql.Named("created_to", q.CreatedTo.UnixNano()))
+	}
+
+	if q.After != 0 {
+		where = append(where, "seq > @after")
+		args = append(args, sql.Named("after", q.After))
+	}
+
+	if q.Before != 0 {
+		where = append(where, "seq < @before")
+		args = append(args, sql.Named("before", q.Before))
+	}
+
+	order := " order by seq asc"
+	if q.Desc {
+		order = " order by seq desc"
+	}
+
+	qry := qrySelectAudit + whereClause(where) + order
+	if q.Limit > 0 {
+		qry += " limit @limit"
+		args = append(args, sql.Named("limit", q.Limit))
+	}
+
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	rs, err := r.db.QueryContext(ctx, qry, args...)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rs.Close()
+
+	var es []internal.AuditEvent
+	for rs.Next() {
+		var (
+			e         internal.AuditEvent
+			createdAt int64
+		)
+
+		if err := rs.Scan(&e.Seq, &e.ID, &e.Actor, &e.Action, &e.Target, &e.IP, &e.UserAgent, &e.Outcome, &createdAt, &e.PrevHash, &e.Hash); err != nil {
+			return nil, mapError(err)
+		}
+
+		e.CreatedAt = fromUnixNano(createdAt)
+		es = append(es, e)
+	}
+	return es, mapError(rs.Err())
+}
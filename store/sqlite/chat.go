@@ -0,0 +1,355 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+const (
+	qryNextSeq = `insert into "chat_room" (name, seq) values (?, 1)
+	on conflict (name) do update set seq = seq + 1
+	returning seq`
+	qryInsertMessage  = `insert into "chat_message" (id, room, seq, sender, text, created_at, client_id) values (?, ?, ?, ?, ?, ?, nullif(?, ''))`
+	qrySelectMessages = `select id, room, seq, sender, text, created_at, coalesce(client_id, ''), edited_at, deleted_at from "chat_message"`
+	qrySelectMessage  = qrySelectMessages + ` where id = ?`
+
+	qrySelectMessageByClientID = qrySelectMessages + ` where room = ? and sender = ? and client_id = ?`
+
+	// a user cannot read past the newest message of the room
+	qryMarkRead = `insert into "chat_member" (room, user_id, read_seq)
+	select name, ?, min(?, seq) from "chat_room" where name = ?
+	on conflict (room, user_id) do update set read_seq = max(read_seq, excluded.read_seq)
+	returning read_seq`
+
+	// the newest message of a room has the seq of the room
+	qrySelectConversations = `select m.room, m.user_id, m.read_seq, c.id, c.room, c.seq, c.sender, c.text, c.created_at, coalesce(c.client_id, ''), c.edited_at, c.deleted_at
+	from "chat_member" m
+	join "chat_room" r on r.name = m.room
+	join "chat_message" c on c.room = r.name and c.seq = r.seq
+	where m.user_id = ?
+	order by c.created_at desc, m.room`
+
+	// the text replaced was written when the message was last edited
+	qryInsertEdit = `insert into "chat_message_edit" (message_id, text, created_at)
+	select id, text, coalesce(edited_at, created_at) from "chat_message" where id = ? and deleted_at is null`
+	qryUpdateMessage = `update "chat_message" set text = ?, edited_at = ? where id = ? and deleted_at is null`
+	qryDeleteMessage = `update "chat_message" set text = '', deleted_at = ? where id = ? and deleted_at is null`
+	qrySelectEdits   = `select message_id, text, created_at from "chat_message_edit" where message_id = ? order by id`
+
+	qrySetRole = `insert into "chat_role" (room, user_id, role) values (?, ?, ?)
+	on conflict (room, user_id) do update set role = excluded.role`
+	qryUnsetRole   = `delete from "chat_role" where room = ? and user_id = ?`
+	qrySelectRoles = `select room, user_id, role from "chat_role" where room = ? order by role = 'owner' desc, user_id`
+
+	qryInsertSanction = `insert into "chat_sanction" (room, user_id, kind, by_user, reason, expires_at, created_at) values (?, ?, ?, ?, ?, ?, ?)
+	on conflict (room, user_id, kind) do update set by_user = excluded.by_user, reason = excluded.reason, expires_at = excluded.expires_at, created_at = excluded.created_at`
+	qryDeleteSanction  = `delete from "chat_sanction" where room = ? and user_id = ? and kind = ?`
+	qrySelectSanctions = `select room, user_id, kind, by_user, reason, expires_at, created_at from "chat_sanction"
+	where room = ? and (expires_at is null or expires_at > ?)
+	order by created_at`
+)
+
+// ChatRepo is the SQLite `internal.ChatRepo`, it shares the
+// connections of the user repository so it is never closed
+type ChatRepo struct {
+	db Conn
+}
+
+var _ internal.ChatRepo = (*ChatRepo)(nil)
+
+func NewChatRepo(db Conn) *ChatRepo { return &ChatRepo{db} }
+
+func (r *ChatRepo) InsertMessage(ctx context.Context, m *internal.Message) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	createdAt := time.Now().UTC().Truncate(time.Microsecond)
+
+	var seq int64
+	err := withTx(ctx, r.db, func(tx *Tx) error {
+		if err := tx.QueryRowContext(ctx, qryNextSeq, m.Room).Scan(&seq); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx, qryInsertMessage, m.ID, m.Room, seq, m.Sender, m.Text, createdAt.UnixNano(), m.ClientID)
+		return err
+	})
+	if err = mapError(err); errors.Is(err, internal.ErrAlreadyExists) && m.ClientID != "" {
+		// the message was sent again, the seq it took was rolled back
+		row := r.db.QueryRowContext(ctx, qrySelectMessageByClientID, m.Room, m.Sender, m.ClientID)
+		if scanMessage(row, m) != nil {
+			return err
+		}
+		return internal.ErrAlreadyExists
+	}
+	if err != nil {
+		return err
+	}
+
+	m.Seq, m.CreatedAt = seq, createdAt
+	return nil
+}
+
+func (r *ChatRepo) SelectMessages(ctx context.Context, q internal.MessageQuery) ([]internal.Message, error) {
+	where := []string{"room = @room", "seq > @after"}
+	args := []any{sql.Named("room", q.Room), sql.Named("after", q.After)}
+
+	if q.Before != 0 {
+		where = append(where, "seq < @before")
+		args = append(args, sql.Named("before", q.Before))
+	}
+
+	qry := qrySelectMessages + whereClause(where)
+	if q.Ascending {
+		qry += " order by seq"
+	} else {
+		qry += " order by seq desc"
+	}
+
+	if q.Limit > 0 {
+		qry += " limit @limit"
+		args = append(args, sql.Named("limit", q.Limit))
+	}
+
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	rs, err := r.db.QueryContext(ctx, qry, args...)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rs.Close()
+
+	var ms []internal.Message
+	for rs.Next() {
+		var m internal.Message
+		if err := scanMessage(rs, &m); err != nil {
+			return nil, mapError(err)
+		}
+		ms = append(ms, m)
+	}
+	return ms, mapError(rs.Err())
+}
+
+// scanMessage scans the columns of a message, after those of prefix
+func scanMessage(s interface{ Scan(dest ...any) error }, m *internal.Message, prefix ...any) error {
+	var (
+		createdAt           int64
+		editedAt, deletedAt sql.NullInt64
+	)
+
+	dest := append(prefix, &m.ID, &m.Room, &m.Seq, &m.Sender, &m.Text, &createdAt, &m.ClientID, &editedAt, &deletedAt)
+	if err := s.Scan(dest...); err != nil {
+		return err
+	}
+
+	m.CreatedAt, m.EditedAt, m.DeletedAt = fromUnixNano(createdAt), fromNullUnixNano(editedAt), fromNullUnixNano(deletedAt)
+	return nil
+}
+
+func (r *ChatRepo) MarkRead(ctx context.Context, room string, uid suid.UUID, seq int64) (int64, error) {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	var read int64
+	err := r.db.QueryRowContext(ctx, qryMarkRead, uid, seq, room).Scan(&read)
+	return read, mapError(err)
+}
+
+func (r *ChatRepo) SelectConversations(ctx context.Context, uid suid.UUID) ([]internal.Conversation, error) {
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	rs, err := r.db.QueryContext(ctx, qrySelectConversations, uid)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rs.Close()
+
+	var cs []internal.Conversation
+	for rs.Next() {
+		var c internal.Conversation
+		if err := scanMessage(rs, &c.Last, &c.Room, &c.User, &c.ReadSeq); err != nil {
+			return nil, mapError(err)
+		}
+		cs = append(cs, c)
+	}
+	return cs, mapError(rs.Err())
+}
+
+func (r *ChatRepo) SelectMessage(ctx context.Context, id suid.UUID) (internal.Message, error) {
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	var m internal.Message
+	err := scanMessage(r.db.QueryRowContext(ctx, qrySelectMessage, id), &m)
+	return m, mapError(err)
+}
+
+func (r *ChatRepo) UpdateMessage(ctx context.Context, m *internal.Message) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	editedAt := time.Now().UTC().Truncate(time.Microsecond)
+
+	err := withTx(ctx, r.db, func(tx *Tx) error {
+		if err := updated(tx.ExecContext(ctx, qryInsertEdit, m.ID)); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, qryUpdateMessage, m.Text, editedAt.UnixNano(), m.ID); err != nil {
+			return err
+		}
+		return scanMessage(tx.QueryRowContext(ctx, qrySelectMessage, m.ID), m)
+	})
+	return mapError(err)
+}
+
+func (r *ChatRepo) DeleteMessage(ctx context.Context, m *internal.Message) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	deletedAt := time.Now().UTC().Truncate(time.Microsecond)
+
+	// the text removed is kept with the edits for moderators
+	err := withTx(ctx, r.db, func(tx *Tx) error {
+		if err := updated(tx.ExecContext(ctx, qryInsertEdit, m.ID)); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, qryDeleteMessage, deletedAt.UnixNano(), m.ID); err != nil {
+			return err
+		}
+		return scanMessage(tx.QueryRowContext(ctx, qrySelectMessage, m.ID), m)
+	})
+	return mapError(err)
+}
+
+// updated returns `internal.ErrNotFound` if the statement changed no rows
+func updated(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return internal.ErrNotFound
+	}
+	return nil
+}
+
+func (r *ChatRepo) SelectEdits(ctx context.Context, id suid.UUID) ([]internal.MessageEdit, error) {
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	rs, err := r.db.QueryContext(ctx, qrySelectEdits, id)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rs.Close()
+
+	var es []internal.MessageEdit
+	for rs.Next() {
+		var e internal.MessageEdit
+		var createdAt int64
+		if err := rs.Scan(&e.MessageID, &e.Text, &createdAt); err != nil {
+			return nil, mapError(err)
+		}
+
+		e.CreatedAt = fromUnixNano(createdAt)
+		es = append(es, e)
+	}
+	return es, mapError(rs.Err())
+}
+
+func (r *ChatRepo) SetRole(ctx context.Context, rr internal.RoomRole) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	var err error
+	if rr.Role == internal.RoleMember {
+		_, err = r.db.ExecContext(ctx, qryUnsetRole, rr.Room, rr.User)
+	} else {
+		_, err = r.db.ExecContext(ctx, qrySetRole, rr.Room, rr.User, rr.Role)
+	}
+	return mapError(err)
+}
+
+func (r *ChatRepo) SelectRoles(ctx context.Context, room string) ([]internal.RoomRole, error) {
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	rs, err := r.db.QueryContext(ctx, qrySelectRoles, room)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rs.Close()
+
+	var roles []internal.RoomRole
+	for rs.Next() {
+		var rr internal.RoomRole
+		if err := rs.Scan(&rr.Room, &rr.User, &rr.Role); err != nil {
+			return nil, mapError(err)
+		}
+		roles = append(roles, rr)
+	}
+	return roles, mapError(rs.Err())
+}
+
+func (r *ChatRepo) InsertSanction(ctx context.Context, sn *internal.Sanction) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	createdAt := time.Now().UTC().Truncate(time.Microsecond)
+
+	var expiresAt sql.NullInt64
+	if sn.ExpiresAt != nil {
+		expiresAt = sql.NullInt64{Int64: sn.ExpiresAt.UnixNano(), Valid: true}
+	}
+
+	_, err := r.db.ExecContext(ctx, qryInsertSanction, sn.Room, sn.User, sn.Kind, sn.By, sn.Reason, expiresAt, createdAt.UnixNano())
+	if err != nil {
+		return mapError(err)
+	}
+
+	sn.CreatedAt = createdAt
+	return nil
+}
+
+func (r *ChatRepo) DeleteSanction(ctx context.Context, room string, uid suid.UUID, kind string) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	return mapError(updated(r.db.ExecContext(ctx, qryDeleteSanction, room, uid, kind)))
+}
+
+func (r *ChatRepo) SelectSanctions(ctx context.Context, room string) ([]internal.Sanction, error) {
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	rs, err := r.db.QueryContext(ctx, qrySelectSanctions, room, time.Now().UnixNano())
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rs.Close()
+
+	var ss []internal.Sanction
+	for rs.Next() {
+		var sn internal.Sanction
+		var expiresAt sql.NullInt64
+		var createdAt int64
+		if err := rs.Scan(&sn.Room, &sn.User, &sn.Kind, &sn.By, &sn.Reason, &expiresAt, &createdAt); err != nil {
+			return nil, mapError(err)
+		}
+
+		sn.ExpiresAt, sn.CreatedAt = fromNullUnixNano(expiresAt), fromUnixNano(createdAt)
+		ss = append(ss, sn)
+	}
+	return ss, mapError(rs.Err())
+}
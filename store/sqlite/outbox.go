@@ -0,0 +1,114 @@
+package sqlite
+
+import (
+	"context"
+	"time"
+
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+const (
+	qryInsertEvent = `insert into "outbox" (id, type, subject, data, created_at) values (?, ?, ?, ?, ?)`
+
+	qrySelectPending = `select seq, id, type, subject, data, created_at from "outbox"
+	where dispatched_at is null and (locked_until is null or locked_until < ?)
+	order by seq limit ?`
+
+	qryLockEvent = `update "outbox" set locked_until = ?, attempts = attempts + 1 where seq = ?`
+	qryAckEvent  = `update "outbox" set dispatched_at = ?, locked_until = null where id = ?`
+)
+
+// insertEvent writes an event of the account to the outbox, data is
+// encoded as JSON unless nil
+func insertEvent(ctx context.Context, c Conn, typ string, id suid.UUID, data any) error {
+	e, err := internal.NewEvent(typ, id, data)
+	if err != nil {
+		return err
+	}
+
+	var b any
+	if e.Data != nil {
+		b = string(e.Data)
+	}
+
+	_, err = c.ExecContext(ctx, qryInsertEvent, e.ID, e.Type, e.Subject, b, e.CreatedAt.UnixNano())
+	return err
+}
+
+// Outbox is the SQLite `internal.Outbox`, it shares the connections
+// of the user repository so it is never closed
+type Outbox struct {
+	db Conn
+}
+
+var _ internal.Outbox = (*Outbox)(nil)
+
+func NewOutbox(db Conn) *Outbox { return &Outbox{db} }
+
+func (o *Outbox) Claim(ctx context.Context, n int, lease time.Duration) ([]internal.Event, error) {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	var es []internal.Event
+	return es, mapError(withTx(ctx, o.db, func(tx *Tx) error {
+		now := time.Now()
+
+		rs, err := tx.QueryContext(ctx, qrySelectPending, now.UnixNano(), n)
+		if err != nil {
+			return err
+		}
+		defer rs.Close()
+
+		var seqs []int64
+		for rs.Next() {
+			var (
+				e         internal.Event
+				seq       int64
+				data      *string
+				createdAt int64
+			)
+
+			if err := rs.Scan(&seq, &e.ID, &e.Type, &e.Subject, &data, &createdAt); err != nil {
+				return err
+			}
+
+			if data != nil {
+				e.Data = []byte(*data)
+			}
+			e.CreatedAt = fromUnixNano(createdAt)
+
+			es, seqs = append(es, e), append(seqs, seq)
+		}
+
+		if err := rs.Err(); err != nil {
+			return err
+		}
+
+		for _, seq := range seqs {
+			if _, err := tx.ExecContext(ctx, qryLockEvent, now.Add(lease).UnixNano(), seq); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func (o *Outbox) Ack(ctx context.Context, ids ...suid.UUID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	return mapError(withTx(ctx, o.db, func(tx *Tx) error {
+		now := time.Now().UnixNano()
+		for _, id := range ids {
+			if _, err := tx.ExecContext(ctx, qryAckEvent, now, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
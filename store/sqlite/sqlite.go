@@ -0,0 +1,298 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"secure.adoublef.com/internal"
+	"secure.adoublef.com/store/migrate"
+)
+
+// Open returns a handle to the database of dsn, which is either a
+// file name or a "file:" URI. Writers wait for the database to be
+// unlocked and transactions take the write lock when they begin,
+// so a read cannot fail to be upgraded to a write.
+func Open(dsn string) (*DB, error) {
+	db, err := sql.Open(driverName, withParams(dsn))
+	if err != nil {
+		return nil, err
+	}
+
+	// every connection to an in-memory database has its own copy
+	if inMemory(dsn) {
+		db.SetMaxOpenConns(1)
+	}
+	return &DB{db}, nil
+}
+
+// driverName is the SQLite driver with the functions used by the migrations
+const driverName = "sqlite3_secure"
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(c *sqlite3.SQLiteConn) error {
+			return c.RegisterFunc("regexp", regexpMatch, true)
+		},
+	})
+}
+
+// patterns caches the compiled patterns of `regexpMatch`
+var patterns sync.Map
+
+// regexpMatch implements "s regexp pattern", which SQLite
+// calls as regexp(pattern, s), with the syntax of Go
+func regexpMatch(pattern, s string) (bool, error) {
+	re, ok := patterns.Load(pattern)
+	if !ok {
+		c, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, err
+		}
+		re, _ = patterns.LoadOrStore(pattern, c)
+	}
+	return re.(*regexp.Regexp).MatchString(s), nil
+}
+
+var params = [][2]string{
+	{"_busy_timeout", "5000"},
+	{"_txlock", "immediate"},
+	{"_foreign_keys", "on"},
+}
+
+func withParams(dsn string) string {
+	var ps []string
+	for _, p := range params {
+		if !strings.Contains(dsn, p[0]+"=") {
+			ps = append(ps, p[0]+"="+p[1])
+		}
+	}
+
+	if !inMemory(dsn) && !strings.Contains(dsn, "_journal_mode=") {
+		ps = append(ps, "_journal_mode=WAL")
+	}
+
+	if len(ps) == 0 {
+		return dsn
+	}
+
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return dsn + sep + strings.Join(ps, "&")
+}
+
+func inMemory(dsn string) bool {
+	return strings.Contains(dsn, ":memory:") || strings.Contains(dsn, "mode=memory")
+}
+
+// Migrate runs f with a migrator holding a single connection of db
+func Migrate(ctx context.Context, db *DB, f func(m *migrate.Migrator) error) error {
+	c, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	m, err := migrate.NewSQL(c, migrate.SQLite)
+	if err != nil {
+		return err
+	}
+
+	return f(m)
+}
+
+// times are stored as nanoseconds since the unix epoch
+const now = `cast((julianday('now') - 2440587.5) * 86400000 as integer) * 1000000`
+
+func fromUnixNano(n int64) time.Time { return time.Unix(0, n).UTC() }
+
+func fromNullUnixNano(n sql.NullInt64) *time.Time {
+	if !n.Valid {
+		return nil
+	}
+
+	t := fromUnixNano(n.Int64)
+	return &t
+}
+
+const (
+	// rules are rows that only live as long as the transaction that set them
+	qrySetRule   = `insert or replace into "rules" (name, value) values (?, ?)`
+	qryUnsetRule = `delete from "rules" where name = ?`
+
+	ruleSoftDeletion = "soft_deletion"
+)
+
+// withTx runs f within a transaction that is committed if f returns nil,
+// it is a savepoint when the repository is bound to a transaction
+func withTx(ctx context.Context, c Conn, f func(tx *Tx) error) error {
+	tx, err := c.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	// returns the connection to the pool if the transaction is not committed
+	defer tx.Rollback(ctx)
+
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// withRule runs f within a transaction that has the rule set to value
+func withRule(ctx context.Context, c Conn, rule, value string, f func(tx *Tx) error) error {
+	return withTx(ctx, c, func(tx *Tx) error {
+		if _, err := tx.ExecContext(ctx, qrySetRule, rule, value); err != nil {
+			return err
+		}
+
+		if err := f(tx); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx, qryUnsetRule, rule)
+		return err
+	})
+}
+
+// mapError converts database errors into their domain equivalent
+func mapError(err error) error {
+	var sqErr sqlite3.Error
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return internal.ErrNotFound
+	case errors.As(err, &sqErr) && (sqErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey):
+		return fmt.Errorf("%w: %s", internal.ErrAlreadyExists, constraintName(sqErr))
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("%w: %v", internal.ErrTimeout, err)
+	}
+	return err
+}
+
+// constraintName names a unique constraint as Postgres would,
+// SQLite only reports the columns, eg "account.email"
+func constraintName(err sqlite3.Error) string {
+	cols := err.Error()
+	if i := strings.LastIndex(cols, ": "); i >= 0 {
+		cols = cols[i+2:]
+	}
+
+	table, col, _ := strings.Cut(strings.Split(cols, ", ")[0], ".")
+	if err.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		return table + "_pkey"
+	}
+	return table + "_" + col + "_key"
+}
+
+// Default timeouts of each operation, these are only
+// applied if the caller has not set a deadline
+const (
+	readTimeout  = time.Second * 5
+	writeTimeout = time.Second * 10
+	purgeTimeout = time.Minute
+)
+
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// DB is a handle to the database that begins transactions
+// which can themselves be nested
+type DB struct{ *sql.DB }
+
+func (db *DB) Begin(ctx context.Context) (*Tx, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx: tx}, nil
+}
+
+// Tx is a transaction, when nested it is a savepoint of its parent.
+// Rolling back a transaction that has been committed has no effect,
+// so it is safe to defer.
+type Tx struct {
+	tx    *sql.Tx
+	depth int
+	done  bool
+}
+
+func (t *Tx) ExecContext(ctx context.Context, qry string, args ...any) (sql.Result, error) {
+	return t.tx.ExecContext(ctx, qry, args...)
+}
+
+func (t *Tx) QueryContext(ctx context.Context, qry string, args ...any) (*sql.Rows, error) {
+	return t.tx.QueryContext(ctx, qry, args...)
+}
+
+func (t *Tx) QueryRowContext(ctx context.Context, qry string, args ...any) *sql.Row {
+	return t.tx.QueryRowContext(ctx, qry, args...)
+}
+
+// Begin starts a nested transaction by creating a savepoint
+func (t *Tx) Begin(ctx context.Context) (*Tx, error) {
+	nt := &Tx{tx: t.tx, depth: t.depth + 1}
+	if _, err := t.tx.ExecContext(ctx, "savepoint "+nt.savepoint()); err != nil {
+		return nil, err
+	}
+	return nt, nil
+}
+
+func (t *Tx) Commit(ctx context.Context) error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+
+	if t.depth == 0 {
+		return t.tx.Commit()
+	}
+
+	_, err := t.tx.ExecContext(ctx, "release "+t.savepoint())
+	return err
+}
+
+func (t *Tx) Rollback(ctx context.Context) error {
+	if t.done {
+		return nil
+	}
+	t.done = true
+
+	if t.depth == 0 {
+		return t.tx.Rollback()
+	}
+
+	// the savepoint remains once rolled back to
+	_, err := t.tx.ExecContext(ctx, "rollback to "+t.savepoint()+"; release "+t.savepoint())
+	return err
+}
+
+func (t *Tx) savepoint() string { return "sp_" + strconv.Itoa(t.depth) }
+
+// Conn is either a `DB` or a `Tx`, repositories bound to
+// a transaction run their own transactions as savepoints
+type Conn interface {
+	ExecContext(ctx context.Context, qry string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, qry string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, qry string, args ...any) *sql.Row
+	Begin(ctx context.Context) (*Tx, error)
+}
+
+// Retryable reports whether err is caused by the database being
+// locked by another writer, the transaction can be tried again
+func Retryable(err error) bool {
+	var sqErr sqlite3.Error
+	return errors.As(err, &sqErr) && (sqErr.Code == sqlite3.ErrBusy || sqErr.Code == sqlite3.ErrLocked)
+}
@@ -0,0 +1,387 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/hyphengolang/prelude/types/email"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+const (
+	qrySelectMany = `select id, username, email, password, created_at, updated_at, version, deleted_at, revoked_at from "account"`
+	qryCount      = `select count(*) from "account"`
+
+	qrySelectByID       = `select id, username, email, password, created_at, updated_at, version, deleted_at, revoked_at from "account" where id = ?`
+	qrySelectByEmail    = `select id, username, email, password, created_at, updated_at, version, deleted_at, revoked_at from "account" where email = ?`
+	qrySelectByUsername = `select id, username, email, password, created_at, updated_at, version, deleted_at, revoked_at from "account" where username = ?`
+
+	// appended to reads unless `internal.RuleIncludeDeleted` is set
+	andNotDeleted = ` and not deleted`
+
+	qryInsert = `insert into "account" (id, username, email, password) values (@id, @username, @email, @password)`
+
+	qryUpdate = `update "account"
+	set username = @username, email = @email, password = @password, updated_at = ` + now + `, version = version + 1
+	where id = @id and version = @version and not deleted
+	returning updated_at, version`
+
+	qryExistsByID = `select exists (select 1 from "account" where id = ? and not deleted)`
+
+	qryDeleteByID    = `delete from "account" where id = ?`
+	qryDeleteByEmail = `delete from "account" where email = ?`
+
+	// the rows a delete will affect, as the trigger ignores those it updates
+	qrySelectIDByID    = `select id from "account" where id = ?`
+	qrySelectIDByEmail = `select id from "account" where email = ?`
+
+	// sessions from before the account was deleted are revoked
+	qryRestore = `update "account" set deleted = 0, revoked_at = deleted_at, deleted_at = null, updated_at = ` + now + `, version = version + 1 where id = ? and deleted`
+
+	// "now" is only precise to the millisecond, so a row deleted within
+	// the same millisecond is as old as the age of zero
+	qryPurge = `delete from "account" where deleted and deleted_at <= ` + now + ` - ? returning id`
+)
+
+// UserRepo is the SQLite `internal.UserRepo`, its migrations emulate
+// the soft deletion rule and case-insensitive emails of Postgres
+type UserRepo struct {
+	ctx context.Context
+
+	db Conn
+}
+
+var _ internal.UserRepo = (*UserRepo)(nil)
+
+func NewUserRepo(ctx context.Context, db Conn) *UserRepo {
+	return &UserRepo{ctx, db}
+}
+
+func (r *UserRepo) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// Close closes the database unless the repository is bound to a transaction
+func (r *UserRepo) Close(ctx context.Context) error {
+	if db, ok := r.db.(*DB); ok {
+		return db.Close()
+	}
+	return nil
+}
+
+func (r *UserRepo) Select(ctx context.Context, key any) (*internal.User, error) {
+	var qry string
+	switch key.(type) {
+	case suid.UUID:
+		qry = qrySelectByID
+	case email.Email:
+		qry = qrySelectByEmail
+	case string:
+		qry = qrySelectByUsername
+	default:
+		return nil, internal.ErrInvalidType
+	}
+
+	if !includeDeleted(ctx) {
+		qry += andNotDeleted
+	}
+
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	var u internal.User
+	return &u, mapError(scan(r.db.QueryRowContext(ctx, qry, key), &u))
+}
+
+func (r *UserRepo) SelectMany(ctx context.Context, q internal.UserQuery) ([]internal.User, error) {
+	where, args := filter(ctx, q)
+
+	// when paging backwards the rows are read in the opposite
+	// order to find those closest to the cursor
+	desc := q.Desc != (q.Before != nil)
+
+	if c := q.After; c != nil || q.Before != nil {
+		if c == nil {
+			c = q.Before
+		}
+
+		cmp := ">"
+		if desc {
+			cmp = "<"
+		}
+
+		where = append(where, "(created_at, id) "+cmp+" (@cursor_created_at, @cursor_id)")
+		args = append(args, sql.Named("cursor_created_at", c.CreatedAt.UnixNano()), sql.Named("cursor_id", c.ID))
+	}
+
+	order := " order by created_at asc, id asc"
+	if desc {
+		order = " order by created_at desc, id desc"
+	}
+
+	qry := qrySelectMany + whereClause(where) + order
+	if q.Limit > 0 {
+		qry += " limit @limit"
+		args = append(args, sql.Named("limit", q.Limit))
+	}
+
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	rs, err := r.db.QueryContext(ctx, qry, args...)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rs.Close()
+
+	var us []internal.User
+	for rs.Next() {
+		var u internal.User
+		if err := scan(rs, &u); err != nil {
+			return nil, mapError(err)
+		}
+		us = append(us, u)
+	}
+
+	if err := rs.Err(); err != nil {
+		return nil, mapError(err)
+	}
+
+	if q.Before != nil {
+		for i, j := 0, len(us)-1; i < j; i, j = i+1, j-1 {
+			us[i], us[j] = us[j], us[i]
+		}
+	}
+	return us, nil
+}
+
+func (r *UserRepo) Count(ctx context.Context, q internal.UserQuery) (int, error) {
+	where, args := filter(ctx, q)
+
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	var n int
+	return n, mapError(r.db.QueryRowContext(ctx, qryCount+whereClause(where), args...).Scan(&n))
+}
+
+// filter returns the conditions and arguments for the filters of a query.
+// SQLite's "like" ignores case, so prefixes are compared with "substr".
+func filter(ctx context.Context, q internal.UserQuery) (where []string, args []any) {
+	if !includeDeleted(ctx) {
+		where = append(where, "not deleted")
+	}
+
+	if q.UsernamePrefix != "" {
+		where = append(where, "substr(username, 1, length(@username_prefix)) = @username_prefix")
+		args = append(args, sql.Named("username_prefix", q.UsernamePrefix))
+	}
+
+	if q.EmailPrefix != "" {
+		where = append(where, "substr(email, 1, length(@email_prefix)) = @email_prefix collate nocase")
+		args = append(args, sql.Named("email_prefix", q.EmailPrefix))
+	}
+
+	if !q.CreatedFrom.IsZero() {
+		where = append(where, "created_at >= @created_from")
+		args = append(args, sql.Named("created_from", q.CreatedFrom.UnixNano()))
+	}
+
+	if !q.CreatedTo.IsZero() {
+		where = append(where, "created_at < @created_to")
+		args = append(args, sql.Named("created_to", q.CreatedTo.UnixNano()))
+	}
+
+	return where, args
+}
+
+func whereClause(where []string) string {
+	if len(where) == 0 {
+		return ""
+	}
+	return " where " + strings.Join(where, " and ")
+}
+
+func includeDeleted(ctx context.Context) bool {
+	ok, _ := ctx.Value(internal.RuleIncludeDeleted).(bool)
+	return ok
+}
+
+func scan(r interface{ Scan(dest ...any) error }, u *internal.User) error {
+	var (
+		createdAt, updatedAt int64
+		deletedAt, revokedAt sql.NullInt64
+	)
+
+	if err := r.Scan(&u.ID, &u.Username, &u.Email, &u.Password, &createdAt, &updatedAt, &u.Version, &deletedAt, &revokedAt); err != nil {
+		return err
+	}
+
+	u.CreatedAt, u.UpdatedAt = fromUnixNano(createdAt), fromUnixNano(updatedAt)
+	u.DeletedAt, u.RevokedAt = fromNullUnixNano(deletedAt), fromNullUnixNano(revokedAt)
+	return nil
+}
+
+func (r *UserRepo) Insert(ctx context.Context, u *internal.User) error {
+	args := []any{
+		sql.Named("id", u.ID),
+		sql.Named("username", u.Username),
+		sql.Named("email", u.Email),
+		sql.Named("password", u.Password),
+	}
+
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	return mapError(withTx(ctx, r.db, func(tx *Tx) error {
+		if _, err := tx.ExecContext(ctx, qryInsert, args...); err != nil {
+			return err
+		}
+		return insertEvent(ctx, tx, internal.EventAccountCreated, u.ID, internal.AccountData{Username: u.Username, Version: 1})
+	}))
+}
+
+func (r *UserRepo) Update(ctx context.Context, u *internal.User) error {
+	args := []any{
+		sql.Named("id", u.ID),
+		sql.Named("username", u.Username),
+		sql.Named("email", u.Email),
+		sql.Named("password", u.Password),
+		sql.Named("version", u.Version),
+	}
+
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	return mapError(withTx(ctx, r.db, func(tx *Tx) error {
+		var updatedAt int64
+		err := tx.QueryRowContext(ctx, qryUpdate, args...).Scan(&updatedAt, &u.Version)
+		if err == nil {
+			u.UpdatedAt = fromUnixNano(updatedAt)
+			return insertEvent(ctx, tx, internal.EventAccountUpdated, u.ID, internal.AccountData{Username: u.Username, Version: u.Version})
+		}
+
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		// no rows were updated, so either the record does not exist
+		// or the version has moved on since it was read
+		var exists bool
+		if err := tx.QueryRowContext(ctx, qryExistsByID, u.ID).Scan(&exists); err != nil {
+			return err
+		}
+
+		if exists {
+			return internal.ErrVersionMismatch
+		}
+		return internal.ErrNotFound
+	}))
+}
+
+func (r *UserRepo) Delete(ctx context.Context, key any) error {
+	var qry, sel string
+	switch key.(type) {
+	case suid.UUID:
+		qry, sel = qryDeleteByID, qrySelectIDByID
+	case email.Email:
+		qry, sel = qryDeleteByEmail, qrySelectIDByEmail
+	default:
+		return internal.ErrInvalidType
+	}
+
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	// a soft delete leaves deleted rows as they are
+	rule, typ := "on", internal.EventAccountDeleted
+	if t, _ := ctx.Value(internal.RuleSoftDeletion).(internal.DeleteTyp); t == internal.HardDelete {
+		rule, typ = "off", internal.EventAccountPurged
+	} else {
+		sel += andNotDeleted
+	}
+
+	return mapError(withRule(ctx, r.db, ruleSoftDeletion, rule, func(tx *Tx) error {
+		ids, err := queryIDs(ctx, tx, sel, key)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, qry, key); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if err := insertEvent(ctx, tx, typ, id, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func (r *UserRepo) Restore(ctx context.Context, id suid.UUID) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	return mapError(withTx(ctx, r.db, func(tx *Tx) error {
+		res, err := tx.ExecContext(ctx, qryRestore, id)
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return internal.ErrNotFound
+		}
+		return insertEvent(ctx, tx, internal.EventAccountRestored, id, nil)
+	}))
+}
+
+func (r *UserRepo) Purge(ctx context.Context, age time.Duration) (int64, error) {
+	ctx, cancel := withTimeout(ctx, purgeTimeout)
+	defer cancel()
+
+	var n int64
+	return n, mapError(withRule(ctx, r.db, ruleSoftDeletion, "off", func(tx *Tx) error {
+		ids, err := queryIDs(ctx, tx, qryPurge, age.Nanoseconds())
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if err := insertEvent(ctx, tx, internal.EventAccountPurged, id, nil); err != nil {
+				return err
+			}
+		}
+
+		n = int64(len(ids))
+		return nil
+	}))
+}
+
+func queryIDs(ctx context.Context, c Conn, qry string, args ...any) ([]suid.UUID, error) {
+	rs, err := c.QueryContext(ctx, qry, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	var ids []suid.UUID
+	for rs.Next() {
+		var id suid.UUID
+		if err := rs.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rs.Err()
+}
@@ -0,0 +1,91 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"secure.adoublef.com/store/migrate"
+	"secure.adoublef.com/store/storetest"
+)
+
+func TestUserRepo(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(ctx, db, func(m *migrate.Migrator) error { return m.Up(ctx) }); err != nil {
+		t.Fatal(err)
+	}
+
+	storetest.UserRepo(t, NewUserRepo(ctx, db))
+}
+
+func TestAuditRepo(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := Migrate(ctx, db, func(m *migrate.Migrator) error { return m.Up(ctx) }); err != nil {
+		t.Fatal(err)
+	}
+
+	storetest.AuditRepo(t, NewAuditRepo(ctx, db, true))
+}
+
+func TestOutbox(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(ctx, db, func(m *migrate.Migrator) error { return m.Up(ctx) }); err != nil {
+		t.Fatal(err)
+	}
+
+	storetest.Outbox(t, NewUserRepo(ctx, db), NewOutbox(db))
+}
+
+func TestWebhookRepo(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(ctx, db, func(m *migrate.Migrator) error { return m.Up(ctx) }); err != nil {
+		t.Fatal(err)
+	}
+
+	storetest.WebhookRepo(t, NewWebhookRepo(db))
+}
+
+func TestChatRepo(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(ctx, db, func(m *migrate.Migrator) error { return m.Up(ctx) }); err != nil {
+		t.Fatal(err)
+	}
+
+	storetest.ChatRepo(t, NewChatRepo(db))
+}
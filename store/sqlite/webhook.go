@@ -0,0 +1,273 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+const (
+	qryInsertWebhook    = `insert into "webhook" (id, url, events, secret, created_at) values (?, ?, ?, ?, ?)`
+	qrySelectWebhook    = `select id, url, events, secret, created_at from "webhook" where id = ?`
+	qrySelectWebhooks   = `select id, url, events, secret, created_at from "webhook" order by created_at, id`
+	qryDeleteWebhook    = `delete from "webhook" where id = ?`
+	qrySelectDeliveries = `select seq, id, webhook_id, event_id, event_type, payload, status, attempts, next_attempt_at, last_error, response_status, created_at, updated_at from "webhook_delivery"`
+	qrySelectDelivery   = qrySelectDeliveries + ` where id = ?`
+
+	qryInsertDelivery = `insert into "webhook_delivery" (id, webhook_id, event_id, event_type, payload, next_attempt_at, created_at, updated_at)
+	values (?, ?, ?, ?, ?, ?, ?, ?)
+	on conflict (webhook_id, event_id) do nothing
+	returning seq`
+
+	qrySelectDue = qrySelectDeliveries + ` where status = 'pending' and next_attempt_at <= ? order by seq limit ?`
+
+	qryLeaseDelivery  = `update "webhook_delivery" set next_attempt_at = ? where seq = ?`
+	qryUpdateDelivery = `update "webhook_delivery"
+	set status = ?, attempts = ?, next_attempt_at = ?, last_error = ?, response_status = ?, updated_at = ?
+	where id = ?`
+)
+
+// WebhookRepo is the SQLite `internal.WebhookRepo`, it shares the
+// connections of the user repository so it is never closed
+type WebhookRepo struct {
+	db Conn
+}
+
+var _ internal.WebhookRepo = (*WebhookRepo)(nil)
+
+func NewWebhookRepo(db Conn) *WebhookRepo { return &WebhookRepo{db} }
+
+func (r *WebhookRepo) InsertWebhook(ctx context.Context, w *internal.Webhook) error {
+	events, err := json.Marshal(append([]string{}, w.Events...))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	createdAt := time.Now().UTC().Truncate(time.Microsecond)
+	if _, err := r.db.ExecContext(ctx, qryInsertWebhook, w.ID, w.URL, string(events), w.Secret, createdAt.UnixNano()); err != nil {
+		return mapError(err)
+	}
+
+	w.CreatedAt = createdAt
+	return nil
+}
+
+func (r *WebhookRepo) SelectWebhook(ctx context.Context, id suid.UUID) (*internal.Webhook, error) {
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	var w internal.Webhook
+	if err := scanWebhook(r.db.QueryRowContext(ctx, qrySelectWebhook, id), &w); err != nil {
+		return nil, mapError(err)
+	}
+	return &w, nil
+}
+
+func (r *WebhookRepo) SelectWebhooks(ctx context.Context) ([]internal.Webhook, error) {
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	rs, err := r.db.QueryContext(ctx, qrySelectWebhooks)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rs.Close()
+
+	var ws []internal.Webhook
+	for rs.Next() {
+		var w internal.Webhook
+		if err := scanWebhook(rs, &w); err != nil {
+			return nil, mapError(err)
+		}
+		ws = append(ws, w)
+	}
+	return ws, mapError(rs.Err())
+}
+
+func (r *WebhookRepo) DeleteWebhook(ctx context.Context, id suid.UUID) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	res, err := r.db.ExecContext(ctx, qryDeleteWebhook, id)
+	if err != nil {
+		return mapError(err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return internal.ErrNotFound
+	}
+	return nil
+}
+
+func (r *WebhookRepo) InsertDelivery(ctx context.Context, d *internal.Delivery) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	args := []any{d.ID, d.WebhookID, d.EventID, d.EventType, string(d.Payload), now.UnixNano(), now.UnixNano(), now.UnixNano()}
+
+	var seq int64
+	switch err := r.db.QueryRowContext(ctx, qryInsertDelivery, args...).Scan(&seq); {
+	case errors.Is(err, sql.ErrNoRows):
+		// the event has already been delivered to the webhook
+		return nil
+	case err != nil:
+		return mapError(err)
+	}
+
+	d.Seq, d.Status, d.Attempts = seq, internal.DeliveryPending, 0
+	d.NextAttemptAt, d.CreatedAt, d.UpdatedAt = now, now, now
+	return nil
+}
+
+func (r *WebhookRepo) ClaimDeliveries(ctx context.Context, n int, lease time.Duration) ([]internal.Delivery, error) {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	var ds []internal.Delivery
+	return ds, mapError(withTx(ctx, r.db, func(tx *Tx) error {
+		now := time.Now().UTC()
+
+		rs, err := tx.QueryContext(ctx, qrySelectDue, now.UnixNano(), n)
+		if err != nil {
+			return err
+		}
+		defer rs.Close()
+
+		for rs.Next() {
+			var d internal.Delivery
+			if err := scanDelivery(rs, &d); err != nil {
+				return err
+			}
+			ds = append(ds, d)
+		}
+
+		if err := rs.Err(); err != nil {
+			return err
+		}
+
+		until := now.Add(lease).Truncate(time.Microsecond)
+		for i := range ds {
+			if _, err := tx.ExecContext(ctx, qryLeaseDelivery, until.UnixNano(), ds[i].Seq); err != nil {
+				return err
+			}
+			ds[i].NextAttemptAt = until
+		}
+		return nil
+	}))
+}
+
+func (r *WebhookRepo) UpdateDelivery(ctx context.Context, d *internal.Delivery) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	updatedAt := time.Now().UTC().Truncate(time.Microsecond)
+	args := []any{d.Status, d.Attempts, d.NextAttemptAt.UnixNano(), d.LastError, d.ResponseStatus, updatedAt.UnixNano(), d.ID}
+
+	res, err := r.db.ExecContext(ctx, qryUpdateDelivery, args...)
+	if err != nil {
+		return mapError(err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return internal.ErrNotFound
+	}
+
+	d.UpdatedAt = updatedAt
+	return nil
+}
+
+func (r *WebhookRepo) SelectDelivery(ctx context.Context, id suid.UUID) (*internal.Delivery, error) {
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	var d internal.Delivery
+	if err := scanDelivery(r.db.QueryRowContext(ctx, qrySelectDelivery, id), &d); err != nil {
+		return nil, mapError(err)
+	}
+	return &d, nil
+}
+
+func (r *WebhookRepo) SelectDeliveries(ctx context.Context, q internal.DeliveryQuery) ([]internal.Delivery, error) {
+	where := []string{"webhook_id = @webhook_id"}
+	args := []any{sql.Named("webhook_id", q.WebhookID)}
+
+	if q.Status != "" {
+		where = append(where, "status = @status")
+		args = append(args, sql.Named("status", q.Status))
+	}
+
+	if q.Before != 0 {
+		where = append(where, "seq < @before")
+		args = append(args, sql.Named("before", q.Before))
+	}
+
+	qry := qrySelectDeliveries + whereClause(where) + " order by seq desc"
+	if q.Limit > 0 {
+		qry += " limit @limit"
+		args = append(args, sql.Named("limit", q.Limit))
+	}
+
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	rs, err := r.db.QueryContext(ctx, qry, args...)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rs.Close()
+
+	var ds []internal.Delivery
+	for rs.Next() {
+		var d internal.Delivery
+		if err := scanDelivery(rs, &d); err != nil {
+			return nil, mapError(err)
+		}
+		ds = append(ds, d)
+	}
+	return ds, mapError(rs.Err())
+}
+
+func scanWebhook(s interface{ Scan(dest ...any) error }, w *internal.Webhook) error {
+	var (
+		events    string
+		createdAt int64
+	)
+
+	if err := s.Scan(&w.ID, &w.URL, &events, &w.Secret, &createdAt); err != nil {
+		return err
+	}
+
+	w.CreatedAt = fromUnixNano(createdAt)
+	return json.Unmarshal([]byte(events), &w.Events)
+}
+
+func scanDelivery(s interface{ Scan(dest ...any) error }, d *internal.Delivery) error {
+	var (
+		payload                             string
+		nextAttemptAt, createdAt, updatedAt int64
+	)
+
+	err := s.Scan(&d.Seq, &d.ID, &d.WebhookID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts,
+		&nextAttemptAt, &d.LastError, &d.ResponseStatus, &createdAt, &updatedAt)
+	if err != nil {
+		return err
+	}
+
+	d.Payload = []byte(payload)
+	d.NextAttemptAt = fromUnixNano(nextAttemptAt)
+	d.CreatedAt, d.UpdatedAt = fromUnixNano(createdAt), fromUnixNano(updatedAt)
+	return nil
+}
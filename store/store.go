@@ -1,36 +1,376 @@
+// Package store opens the repositories on Postgres or SQLite.
+//
+// With read replicas, reads are balanced between the healthy replicas and
+// writes go to the primary. When read your writes is set, the rest of a
+// request reads from the primary once it has written. Either way an account
+// is read back from the primary after it is deleted, and read from the
+// primary before it is updated or restored.
+//
+// With a keyring, see `crypt.File`, the emails of accounts are encrypted in
+// the background and wrapped again once another key is made active. An
+// encrypted email can only be matched whole. Every instance should be given
+// the keyring before emails are encrypted, as one without it cannot see them
+// when checking emails are unique. Plaintext emails that another account
+// holds encrypted are logged and left as they are.
+//
+// The audit log is append-only. With the audit chain set, each event is
+// linked to the one before it by its hash, so that edits can be detected.
 package store
 
 import (
 	"context"
-	"os"
+	"errors"
+	"fmt"
+	"log"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"secure.adoublef.com/internal"
+	"secure.adoublef.com/store/chat"
+	"secure.adoublef.com/store/crypt"
+	"secure.adoublef.com/store/migrate"
+	"secure.adoublef.com/store/sqlite"
 	"secure.adoublef.com/store/user"
 )
 
+// Backends that a store can be opened with
+const (
+	Postgres = "postgres"
+	SQLite   = "sqlite"
+)
+
+// Config selects the backend of a store
+type Config struct {
+	// One of `Postgres` or `SQLite`, defaults to `Postgres`
+	Driver string
+	// A Postgres connection string or the file name of a SQLite database
+	DSN string
+	// Only used by Postgres, also applied to the replica pools
+	Pool PoolConfig
+	// Connection strings of Postgres read replicas. Reads are balanced
+	// between the healthy replicas, falling back to the primary.
+	Replicas []string
+	// When set, reads made with a context from `Pin` go to the
+	// primary once a write has been made with the same context.
+	// Reads with `internal.RuleReadPrimary` go to the primary either way.
+	ReadYourWrites bool
+	// A JSON keyring, see `crypt.File`. When set, emails are encrypted
+	// and those stored in plaintext or wrapped by an old key are
+	// encrypted again in the background. Only used by Postgres.
+	KeyFile string
+	// When set, each audit event holds the hash of the event before it
+	// so that the log can be verified, appends are then serialized
+	AuditChain bool
+}
+
+var (
+	ErrUnknownDriver = errors.New(`unknown store driver`)
+	ErrNoReplicas    = errors.New(`read replicas are only supported by postgres`)
+	ErrNoEncryption  = errors.New(`email encryption is only supported by postgres`)
+	ErrNoNotify      = errors.New(`notify sinks are only supported by postgres`)
+)
+
+// How often stale emails are encrypted again and how many are written
+// by each transaction
+const (
+	reencryptInterval = time.Minute
+	reencryptBatch    = 100
+)
+
 type Store struct {
+	// only one of these is set, depending on the driver
+	p  *pgxpool.Pool
+	db *sqlite.DB
+
+	// set when the store is bound to a transaction by `WithTx`
+	pgTx pgx.Tx
+	sqTx *sqlite.Tx
+
+	// applied to every Postgres repository
+	opts []user.Option
+	// stops the background work of the store
+	stop context.CancelFunc
+
+	// whether audit events are chained by their hash
+	chain bool
+
 	u internal.UserRepo
+	a internal.AuditRepo
+	o internal.Outbox
+	w internal.WebhookRepo
+	c internal.ChatRepo
 }
 
 func (s Store) UserRepo() internal.UserRepo { return s.u }
 
-func New(ctx context.Context, c *pgx.Conn) *Store {
-	return &Store{
-		u: user.NewRepo(ctx, c),
+func (s Store) AuditRepo() internal.AuditRepo { return s.a }
+
+// Outbox holds the events written by changes to accounts
+func (s Store) Outbox() internal.Outbox { return s.o }
+
+// WebhookRepo holds the webhooks that events are delivered to
+func (s Store) WebhookRepo() internal.WebhookRepo { return s.w }
+
+// ChatRepo holds the messages sent to chat rooms
+func (s Store) ChatRepo() internal.ChatRepo { return s.c }
+
+// NotifySink returns a sink that publishes events to the Postgres channel
+func (s Store) NotifySink(channel string) (*user.NotifySink, error) {
+	if s.p == nil {
+		return nil, ErrNoNotify
+	}
+	return user.NewNotifySink(s.p, channel), nil
+}
+
+func (s Store) Ping(ctx context.Context) error {
+	if s.db != nil {
+		return s.db.PingContext(ctx)
+	}
+	return s.p.Ping(ctx)
+}
+
+// Close releases every connection held by the store, it has
+// no effect on a store bound to a transaction
+func (s Store) Close(ctx context.Context) error {
+	if s.stop != nil {
+		s.stop()
+	}
+	return s.u.Close(ctx)
+}
+
+func New(ctx context.Context, c Config) (*Store, error) {
+	switch c.Driver {
+	case Postgres, "":
+		return newPostgres(ctx, c)
+	case SQLite:
+		if len(c.Replicas) > 0 {
+			return nil, ErrNoReplicas
+		}
+
+		if c.KeyFile != "" {
+			return nil, ErrNoEncryption
+		}
+
+		db, err := sqlite.Open(c.DSN)
+		if err != nil {
+			return nil, err
+		}
+
+		s := &Store{
+			db:    db,
+			chain: c.AuditChain,
+			u:     sqlite.NewUserRepo(ctx, db),
+			a:     sqlite.NewAuditRepo(ctx, db, c.AuditChain),
+			o:     sqlite.NewOutbox(db),
+			w:     sqlite.NewWebhookRepo(db),
+			c:     sqlite.NewChatRepo(db),
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownDriver, c.Driver)
+	}
+}
+
+func newPostgres(ctx context.Context, c Config) (*Store, error) {
+	var k *crypt.Keyring
+	if c.KeyFile != "" {
+		var err error
+		if k, err = crypt.Load(c.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	p, err := NewPool(ctx, c.DSN, c.Pool)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		p:     p,
+		chain: c.AuditChain,
+		a:     user.NewAuditRepo(ctx, p, c.AuditChain),
+		o:     user.NewOutbox(p),
+		w:     user.NewWebhookRepo(p),
+		c:     chat.NewRepo(p),
+	}
+	if k != nil {
+		s.opts = append(s.opts, user.WithKeyring(k))
+	}
+
+	primary := user.NewRepo(ctx, p, s.opts...)
+	s.u = primary
+
+	if len(c.Replicas) > 0 {
+		rs := make([]replica, 0, len(c.Replicas))
+		for _, dsn := range c.Replicas {
+			rp, err := NewPool(ctx, dsn, c.Pool)
+			if err != nil {
+				for _, r := range rs {
+					r.Close(ctx)
+				}
+				p.Close()
+				return nil, err
+			}
+
+			rs = append(rs, replica{user.NewRepo(ctx, rp, s.opts...), rp.Ping})
+		}
+
+		period := c.Pool.HealthCheckPeriod
+		if period <= 0 {
+			period = defaultReplicaCheckPeriod
+		}
+
+		s.u = &routedUserRepo{
+			primary:        primary,
+			replicas:       newReplicaSet(rs, period),
+			readYourWrites: c.ReadYourWrites,
+		}
+	}
+
+	if k != nil {
+		var bg context.Context
+		bg, s.stop = context.WithCancel(context.Background())
+		go reencrypt(bg, primary)
+	}
+	return s, nil
+}
+
+// reencrypt periodically encrypts the emails that are plaintext or
+// wrapped by an old key, in batches until none are left
+func reencrypt(ctx context.Context, r *user.Repo) {
+	t := time.NewTicker(reencryptInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		for {
+			n, err := r.Reencrypt(ctx, reencryptBatch)
+
+			// conflicting emails are left in each batch, so
+			// carry on until nothing else is written
+			if errors.Is(err, user.ErrEmailConflict) && n > 0 {
+				continue
+			}
+
+			if err != nil {
+				log.Printf("re-encrypting emails: %v", err)
+			}
+
+			if err != nil || n < reencryptBatch {
+				break
+			}
+		}
 	}
 }
 
-var StoreTest = func() *Store {
-	ctx := context.Background()
+// PoolConfig overrides the settings parsed from the connection string,
+// zero values are ignored
+type PoolConfig struct {
+	MinConns int32
+	MaxConns int32
+	// How long a connection can be open before it is closed
+	MaxConnLifetime time.Duration
+	// How long an idle connection is kept before it is closed
+	MaxConnIdleTime time.Duration
+	// How often idle connections are checked
+	HealthCheckPeriod time.Duration
+	// Number of prepared statements cached by each connection
+	StatementCacheCapacity int
+}
 
-	connString := os.ExpandEnv("host=${POSTGRES_HOSTNAME} port=${DB_PORT} user=${POSTGRES_USER} password=${POSTGRES_PASSWORD} dbname=${POSTGRES_DB} sslmode=${SSL_MODE}")
-	c, err := pgx.Connect(ctx, connString)
+func NewPool(ctx context.Context, connString string, c PoolConfig) (*pgxpool.Pool, error) {
+	cfg, err := pgxpool.ParseConfig(connString)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	user.Migration(c)
+	if c.MinConns > 0 {
+		cfg.MinConns = c.MinConns
+	}
+	if c.MaxConns > 0 {
+		cfg.MaxConns = c.MaxConns
+	}
+	if c.MaxConnLifetime > 0 {
+		cfg.MaxConnLifetime = c.MaxConnLifetime
+	}
+	if c.MaxConnIdleTime > 0 {
+		cfg.MaxConnIdleTime = c.MaxConnIdleTime
+	}
+	if c.HealthCheckPeriod > 0 {
+		cfg.HealthCheckPeriod = c.HealthCheckPeriod
+	}
+	if c.StatementCacheCapacity > 0 {
+		cfg.ConnConfig.StatementCacheCapacity = c.StatementCacheCapacity
+	}
+
+	return pgxpool.NewWithConfig(ctx, cfg)
+}
+
+// Migrate runs f with a migrator holding a single connection of the store
+func (s Store) Migrate(ctx context.Context, f func(m *migrate.Migrator) error) error {
+	if s.db != nil {
+		return sqlite.Migrate(ctx, s.db, f)
+	}
 
-	return New(ctx, c)
-}()
+	c, err := s.p.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Release()
+
+	m, err := migrate.New(c, migrate.Postgres)
+	if err != nil {
+		return err
+	}
+
+	return f(m)
+}
+
+type PoolStats struct {
+	AcquireCount         int64         `json:"acquireCount"`
+	AcquireDuration      time.Duration `json:"acquireDuration"`
+	AcquiredConns        int32         `json:"acquiredConns"`
+	CanceledAcquireCount int64         `json:"canceledAcquireCount"`
+	ConstructingConns    int32         `json:"constructingConns"`
+	EmptyAcquireCount    int64         `json:"emptyAcquireCount"`
+	IdleConns            int32         `json:"idleConns"`
+	MaxConns             int32         `json:"maxConns"`
+	TotalConns           int32         `json:"totalConns"`
+	NewConnsCount        int64         `json:"newConnsCount"`
+}
+
+// Stats reports on the connections of the store, SQLite has
+// no equivalent to some of the counts so these are left as zero
+func (s Store) Stats() PoolStats {
+	if s.db != nil {
+		st := s.db.Stats()
+		return PoolStats{
+			AcquireDuration:   st.WaitDuration,
+			AcquiredConns:     int32(st.InUse),
+			EmptyAcquireCount: st.WaitCount,
+			IdleConns:         int32(st.Idle),
+			MaxConns:          int32(st.MaxOpenConnections),
+			TotalConns:        int32(st.OpenConnections),
+		}
+	}
+
+	st := s.p.Stat()
+	return PoolStats{
+		AcquireCount:         st.AcquireCount(),
+		AcquireDuration:      st.AcquireDuration(),
+		AcquiredConns:        st.AcquiredConns(),
+		CanceledAcquireCount: st.CanceledAcquireCount(),
+		ConstructingConns:    st.ConstructingConns(),
+		EmptyAcquireCount:    st.EmptyAcquireCount(),
+		IdleConns:            st.IdleConns(),
+		MaxConns:             st.MaxConns(),
+		TotalConns:           st.TotalConns(),
+		NewConnsCount:        st.NewConnsCount(),
+	}
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/hyphengolang/prelude/types/email"
+	"github.com/hyphengolang/prelude/types/password"
+	"github.com/hyphengolang/prelude/types/suid"
+	"github.com/mattn/go-sqlite3"
+	"secure.adoublef.com/internal"
+	"secure.adoublef.com/store/migrate"
+)
+
+func TestWithTx(t *testing.T) {
+	t.Parallel()
+	is, ctx := is.New(t), context.Background()
+
+	s, err := New(ctx, Config{Driver: SQLite, DSN: filepath.Join(t.TempDir(), "test.db")})
+	is.NoErr(err) // open sqlite store
+	t.Cleanup(func() { s.Close(ctx) })
+
+	err = s.Migrate(ctx, func(m *migrate.Migrator) error { return m.Up(ctx) })
+	is.NoErr(err) // apply migrations
+
+	newUser := func(username string) *internal.User {
+		return &internal.User{
+			ID:       suid.NewUUID(),
+			Username: "i_am_" + username,
+			Email:    email.Email(username + "@mail.com"),
+			Password: password.Password("p4$$w4rD").MustHash(),
+		}
+	}
+
+	count := func() int {
+		n, err := s.UserRepo().Count(ctx, internal.UserQuery{})
+		is.NoErr(err) // count accounts
+		return n
+	}
+
+	errRollback := errors.New("rollback")
+
+	t.Run(`commit when f succeeds`, func(t *testing.T) {
+		err := s.WithTx(ctx, func(tx Store) error {
+			u := newUser("fizz")
+			return tx.UserRepo().Insert(ctx, u)
+		})
+		is.NoErr(err)        // transaction committed
+		is.Equal(count(), 1) // "fizz" was inserted
+	})
+
+	t.Run(`rollback when f fails`, func(t *testing.T) {
+		err := s.WithTx(ctx, func(tx Store) error {
+			u := newUser("buzz")
+			if err := tx.UserRepo().Insert(ctx, u); err != nil {
+				return err
+			}
+			return errRollback
+		})
+		is.True(errors.Is(err, errRollback)) // error is returned
+		is.Equal(count(), 1)                 // "buzz" was not inserted
+	})
+
+	t.Run(`rollback to a savepoint`, func(t *testing.T) {
+		err := s.WithTx(ctx, func(tx Store) error {
+			u := newUser("buzz")
+			if err := tx.UserRepo().Insert(ctx, u); err != nil {
+				return err
+			}
+
+			err := tx.WithTx(ctx, func(tx Store) error {
+				u := newUser("burp")
+				if err := tx.UserRepo().Insert(ctx, u); err != nil {
+					return err
+				}
+				return errRollback
+			})
+			is.True(errors.Is(err, errRollback)) // nested transaction failed
+
+			return tx.UserRepo().Delete(context.WithValue(ctx, internal.RuleSoftDeletion, internal.HardDelete), u.ID)
+		})
+		is.NoErr(err)        // transaction committed
+		is.Equal(count(), 1) // neither "buzz" nor "burp" remain
+	})
+
+	t.Run(`retry when the database is locked`, func(t *testing.T) {
+		var attempts int
+		err := s.WithTx(ctx, func(tx Store) error {
+			attempts++
+			return sqlite3.Error{Code: sqlite3.ErrBusy}
+		})
+		is.True(err != nil)               // every attempt failed
+		is.Equal(attempts, maxTxAttempts) // retried until exhausted
+
+		attempts = 0
+		err = s.WithTx(ctx, func(tx Store) error {
+			attempts++
+			return errRollback
+		})
+		is.True(errors.Is(err, errRollback)) // not retryable
+		is.Equal(attempts, 1)                // tried once
+	})
+
+	t.Run(`write events only when committed`, func(t *testing.T) {
+		es, err := s.Outbox().Claim(ctx, 10, time.Minute)
+		is.NoErr(err)        // claim events
+		is.Equal(len(es), 3) // events of rolled back changes were not written
+
+		is.Equal(es[0].Type, internal.EventAccountCreated) // "fizz" was created
+		is.Equal(es[1].Type, internal.EventAccountCreated) // "buzz" was created
+		is.Equal(es[2].Type, internal.EventAccountPurged)  // then deleted
+	})
+}
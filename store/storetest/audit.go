@@ -0,0 +1,82 @@
+package storetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+// AuditRepo tests that r behaves as expected of an `internal.AuditRepo`
+// that chains events. The repository must be empty.
+func AuditRepo(t *testing.T, r internal.AuditRepo) {
+	is, ctx := is.New(t), context.TODO()
+
+	t.Cleanup(func() { r.Close(ctx) })
+
+	fizz, buzz := suid.NewUUID().ShortUUID().String(), suid.NewUUID().ShortUUID().String()
+
+	t.Run(`append events`, func(t *testing.T) {
+		es := []internal.AuditEvent{
+			{Actor: "", Action: internal.ActionCreateAccount, Target: fizz, Outcome: internal.OutcomeSuccess},
+			{Actor: fizz, Action: internal.ActionSignIn, Target: fizz, Outcome: internal.OutcomeSuccess},
+			{Actor: "", Action: internal.ActionSignIn, Target: buzz, Outcome: internal.OutcomeFailure},
+			{Actor: fizz, Action: internal.ActionDeleteAccount, Target: fizz, Outcome: internal.OutcomeSuccess},
+		}
+
+		var prev int64
+		for i := range es {
+			e := &es[i]
+			e.ID, e.IP, e.UserAgent = suid.NewUUID(), "127.0.0.1", "go-test"
+
+			err := r.Append(ctx, e)
+			is.NoErr(err)                  // append event
+			is.True(e.Seq > prev)          // sequence is increasing
+			is.True(!e.CreatedAt.IsZero()) // time is set
+			is.True(e.Hash != nil)         // events are chained
+			prev = e.Seq
+		}
+	})
+
+	t.Run(`select events`, func(t *testing.T) {
+		es, err := r.SelectMany(ctx, internal.AuditQuery{})
+		is.NoErr(err)                  // select every event
+		is.Equal(len(es), 4)           // four events
+		is.True(es[0].Seq < es[1].Seq) // ascending by default
+
+		_, err = internal.VerifyAuditChain(nil, es)
+		is.NoErr(err) // chain is intact
+
+		es, err = r.SelectMany(ctx, internal.AuditQuery{Actor: fizz})
+		is.NoErr(err)        // filter by actor
+		is.Equal(len(es), 2) // "fizz" signed in and deleted
+
+		es, err = r.SelectMany(ctx, internal.AuditQuery{Action: internal.ActionSignIn, Outcome: internal.OutcomeFailure})
+		is.NoErr(err)                // filter by action and outcome
+		is.Equal(len(es), 1)         // one failed sign in
+		is.Equal(es[0].Target, buzz) // for "buzz"
+
+		es, err = r.SelectMany(ctx, internal.AuditQuery{Desc: true, Limit: 3})
+		is.NoErr(err)                                        // newest first
+		is.Equal(len(es), 3)                                 // limited to three
+		is.Equal(es[0].Action, internal.ActionDeleteAccount) // last event first
+
+		es, err = r.SelectMany(ctx, internal.AuditQuery{Desc: true, Before: es[2].Seq})
+		is.NoErr(err)                                        // next page
+		is.Equal(len(es), 1)                                 // one event left
+		is.Equal(es[0].Action, internal.ActionCreateAccount) // first event last
+
+		es, err = r.SelectMany(ctx, internal.AuditQuery{After: es[0].Seq, Limit: 1})
+		is.NoErr(err)                                 // page forwards
+		is.Equal(len(es), 1)                          // limited to one
+		is.Equal(es[0].Action, internal.ActionSignIn) // second event
+
+		prev := es[0].PrevHash
+		es[0].Outcome = internal.OutcomeFailure
+		_, err = internal.VerifyAuditChain(prev, es)
+		is.True(errors.Is(err, internal.ErrAuditChainBroken)) // tampering is detected
+	})
+}
@@ -0,0 +1,266 @@
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+// ChatRepo tests that r behaves as expected of an
+// `internal.ChatRepo`. The repository must be empty.
+func ChatRepo(t *testing.T, r internal.ChatRepo) {
+	is, ctx := is.New(t), context.TODO()
+
+	fizz := suid.NewUUID()
+
+	t.Run(`number the messages of each room`, func(t *testing.T) {
+		for i := 1; i <= 3; i++ {
+			m := internal.Message{ID: suid.NewUUID(), Room: "fizz", Sender: fizz, Text: fmt.Sprintf("fizz %d", i)}
+			is.NoErr(r.InsertMessage(ctx, &m)) // insert into "fizz"
+			is.Equal(m.Seq, int64(i))          // numbered in order
+			is.True(!m.CreatedAt.IsZero())     // time is set
+		}
+
+		m := internal.Message{ID: suid.NewUUID(), Room: "buzz", Sender: fizz, Text: "buzz 1"}
+		is.NoErr(r.InsertMessage(ctx, &m)) // insert into "buzz"
+		is.Equal(m.Seq, int64(1))          // numbered apart from "fizz"
+
+		m.Room = "fizz"
+		is.True(errors.Is(r.InsertMessage(ctx, &m), internal.ErrAlreadyExists)) // id is taken
+	})
+
+	t.Run(`number concurrent messages without gaps`, func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				m := internal.Message{ID: suid.NewUUID(), Room: "bar", Sender: fizz, Text: "bar"}
+				if err := r.InsertMessage(ctx, &m); err != nil {
+					t.Errorf("insert into \"bar\": %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		ms, err := r.SelectMessages(ctx, internal.MessageQuery{Room: "bar", Ascending: true})
+		is.NoErr(err)         // select "bar"
+		is.Equal(len(ms), 10) // every message
+		for i, m := range ms {
+			is.Equal(m.Seq, int64(i+1)) // no gaps
+		}
+	})
+
+	t.Run(`page through the messages of a room`, func(t *testing.T) {
+		ms, err := r.SelectMessages(ctx, internal.MessageQuery{Room: "fizz", Limit: 2})
+		is.NoErr(err)                  // first page
+		is.Equal(len(ms), 2)           // limited
+		is.Equal(ms[0].Seq, int64(3))  // newest first
+		is.Equal(ms[0].Text, "fizz 3") // text is stored
+		is.Equal(ms[0].Sender, fizz)   // sender is stored
+		is.Equal(ms[0].Room, "fizz")   // room is stored
+
+		ms, err = r.SelectMessages(ctx, internal.MessageQuery{Room: "fizz", Before: ms[1].Seq, Limit: 2})
+		is.NoErr(err)                 // next page
+		is.Equal(len(ms), 1)          // last page
+		is.Equal(ms[0].Seq, int64(1)) // oldest
+
+		ms, err = r.SelectMessages(ctx, internal.MessageQuery{Room: "fizz", After: 1, Ascending: true})
+		is.NoErr(err)                 // replay
+		is.Equal(len(ms), 2)          // after the first
+		is.Equal(ms[0].Seq, int64(2)) // oldest first
+		is.Equal(ms[1].Seq, int64(3)) // then the newest
+
+		ms, err = r.SelectMessages(ctx, internal.MessageQuery{Room: "fizz", After: 3, Ascending: true})
+		is.NoErr(err)        // replay
+		is.Equal(len(ms), 0) // nothing was missed
+
+		ms, err = r.SelectMessages(ctx, internal.MessageQuery{Room: "unknown"})
+		is.NoErr(err)        // select unknown room
+		is.Equal(len(ms), 0) // no messages
+	})
+
+	t.Run(`store a message sent again once`, func(t *testing.T) {
+		buzz := suid.NewUUID()
+
+		m := internal.Message{ID: suid.NewUUID(), Room: "resend", Sender: fizz, Text: "once", ClientID: "c1"}
+		is.NoErr(r.InsertMessage(ctx, &m)) // insert with a client id
+
+		again := internal.Message{ID: suid.NewUUID(), Room: "resend", Sender: fizz, Text: "once", ClientID: "c1"}
+		is.True(errors.Is(r.InsertMessage(ctx, &again), internal.ErrAlreadyExists)) // sent again
+		is.Equal(again.ID, m.ID)                                                    // set to the first
+		is.Equal(again.Seq, m.Seq)
+
+		other := internal.Message{ID: suid.NewUUID(), Room: "resend", Sender: buzz, Text: "mine", ClientID: "c1"}
+		is.NoErr(r.InsertMessage(ctx, &other)) // same id from another sender
+		is.Equal(other.Seq, int64(2))          // no gap left by the resend
+
+		ms, err := r.SelectMessages(ctx, internal.MessageQuery{Room: "resend", Ascending: true})
+		is.NoErr(err)                  // select "resend"
+		is.Equal(len(ms), 2)           // stored once
+		is.Equal(ms[0].ClientID, "c1") // client id is kept
+	})
+
+	t.Run(`track what each user has read`, func(t *testing.T) {
+		buzz, bar := suid.NewUUID(), suid.NewUUID()
+
+		dm := internal.DirectRoom(fizz, buzz)
+		for i := 1; i <= 3; i++ {
+			m := internal.Message{ID: suid.NewUUID(), Room: dm, Sender: buzz, Text: fmt.Sprintf("dm %d", i)}
+			is.NoErr(r.InsertMessage(ctx, &m)) // insert into the direct room
+		}
+
+		read := func(room string, uid suid.UUID, seq int64) int64 {
+			n, err := r.MarkRead(ctx, room, uid, seq)
+			is.NoErr(err) // mark read
+			return n
+		}
+
+		is.Equal(read(dm, fizz, 1), int64(1))     // read the first
+		is.Equal(read(dm, buzz, 3), int64(3))     // read every one
+		is.Equal(read("fizz", fizz, 9), int64(3)) // no further than the newest
+
+		// the direct room was written to last
+		cs, err := r.SelectConversations(ctx, fizz)
+		is.NoErr(err)                      // select conversations
+		is.Equal(len(cs), 2)               // "fizz" and the direct room
+		is.Equal(cs[0].Room, dm)           // most recently active first
+		is.Equal(cs[0].User, fizz)         // of fizz
+		is.Equal(cs[0].ReadSeq, int64(1))  // read up to
+		is.Equal(cs[0].Last.Seq, int64(3)) // newest message
+		is.Equal(cs[0].Last.Text, "dm 3")  // is stored
+		is.Equal(cs[0].Last.Sender, buzz)  // sent by buzz
+		is.Equal(cs[0].Unread(), int64(2)) // not read
+		is.Equal(cs[1].Room, "fizz")       // then "fizz"
+		is.Equal(cs[1].Unread(), int64(0)) // every message read
+
+		is.Equal(read(dm, fizz, 0), int64(1)) // does not go back
+		cs, err = r.SelectConversations(ctx, fizz)
+		is.NoErr(err)                     // select conversations
+		is.Equal(cs[0].ReadSeq, int64(1)) // unchanged
+
+		cs, err = r.SelectConversations(ctx, bar)
+		is.NoErr(err)        // select conversations
+		is.Equal(len(cs), 0) // bar has read nothing
+
+		_, err = r.MarkRead(ctx, "empty", bar, 1)
+		is.True(errors.Is(err, internal.ErrNotFound)) // room has no messages
+	})
+
+	t.Run(`edit and delete messages`, func(t *testing.T) {
+		m := internal.Message{ID: suid.NewUUID(), Room: "edits", Sender: fizz, Text: "v1", ClientID: "e1"}
+		is.NoErr(r.InsertMessage(ctx, &m)) // insert into "edits"
+
+		for _, text := range []string{"v2", "v3"} {
+			e := internal.Message{ID: m.ID, Text: text}
+			is.NoErr(r.UpdateMessage(ctx, &e)) // edit
+			is.Equal(e.Text, text)             // replaced
+			is.Equal(e.Seq, m.Seq)             // the same message
+			is.True(e.EditedAt != nil)         // edited
+		}
+
+		es, err := r.SelectEdits(ctx, m.ID)
+		is.NoErr(err)                          // select edits
+		is.Equal(len(es), 2)                   // every earlier version
+		is.Equal(es[0].Text, "v1")             // oldest first
+		is.Equal(es[0].CreatedAt, m.CreatedAt) // written when sent
+		is.Equal(es[1].Text, "v2")
+
+		got, err := r.SelectMessage(ctx, m.ID)
+		is.NoErr(err)                // select the message
+		is.Equal(got.Text, "v3")     // latest version
+		is.Equal(got.ClientID, "e1") // client id is kept
+
+		d := internal.Message{ID: m.ID}
+		is.NoErr(r.DeleteMessage(ctx, &d)) // delete
+		is.Equal(d.Text, "")               // text is removed
+		is.True(d.DeletedAt != nil)        // tombstone
+		is.Equal(d.Seq, m.Seq)
+
+		es, err = r.SelectEdits(ctx, m.ID)
+		is.NoErr(err)                            // select edits
+		is.Equal(len(es), 3)                     // kept
+		is.Equal(es[2].Text, "v3")               // with the text removed
+		is.Equal(es[2].CreatedAt, *got.EditedAt) // written when last edited
+
+		ms, err := r.SelectMessages(ctx, internal.MessageQuery{Room: "edits"})
+		is.NoErr(err)                   // select "edits"
+		is.Equal(len(ms), 1)            // tombstone is kept
+		is.True(ms[0].DeletedAt != nil) // as deleted
+
+		is.True(errors.Is(r.UpdateMessage(ctx, &internal.Message{ID: m.ID, Text: "v4"}), internal.ErrNotFound)) // deleted
+		is.True(errors.Is(r.DeleteMessage(ctx, &internal.Message{ID: m.ID}), internal.ErrNotFound))             // already deleted
+		is.True(errors.Is(r.DeleteMessage(ctx, &internal.Message{ID: suid.NewUUID()}), internal.ErrNotFound))   // no message
+
+		_, err = r.SelectMessage(ctx, suid.NewUUID())
+		is.True(errors.Is(err, internal.ErrNotFound)) // no message
+	})
+
+	t.Run(`give users roles in a room`, func(t *testing.T) {
+		buzz, bar := suid.NewUUID(), suid.NewUUID()
+
+		is.NoErr(r.SetRole(ctx, internal.RoomRole{Room: "roles", User: buzz, Role: internal.RoleModerator})) // buzz moderates
+		is.NoErr(r.SetRole(ctx, internal.RoomRole{Room: "roles", User: fizz, Role: internal.RoleOwner}))     // fizz owns
+
+		err := r.SetRole(ctx, internal.RoomRole{Room: "roles", User: bar, Role: internal.RoleOwner})
+		is.True(errors.Is(err, internal.ErrAlreadyExists)) // one owner
+
+		rs, err := r.SelectRoles(ctx, "roles")
+		is.NoErr(err)              // select roles
+		is.Equal(len(rs), 2)       // bar is a member
+		is.Equal(rs[0].User, fizz) // owner first
+		is.Equal(rs[0].Role, internal.RoleOwner)
+		is.Equal(rs[1].Role, internal.RoleModerator) // then buzz
+
+		is.NoErr(r.SetRole(ctx, internal.RoomRole{Room: "roles", User: buzz, Role: internal.RoleMember})) // buzz steps down
+		rs, err = r.SelectRoles(ctx, "roles")
+		is.NoErr(err)        // select roles
+		is.Equal(len(rs), 1) // only fizz
+	})
+
+	t.Run(`sanction users until they expire`, func(t *testing.T) {
+		buzz, bar := suid.NewUUID(), suid.NewUUID()
+		// Postgres keeps times to the microsecond
+		past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour).Truncate(time.Microsecond)
+
+		mute := internal.Sanction{Room: "sanctions", User: buzz, Kind: internal.SanctionMute, By: fizz, Reason: "spam", ExpiresAt: &future}
+		is.NoErr(r.InsertSanction(ctx, &mute)) // mute buzz
+		is.True(!mute.CreatedAt.IsZero())      // time is set
+
+		ban := internal.Sanction{Room: "sanctions", User: bar, Kind: internal.SanctionBan, By: fizz}
+		is.NoErr(r.InsertSanction(ctx, &ban)) // ban bar until lifted
+
+		expired := internal.Sanction{Room: "sanctions", User: buzz, Kind: internal.SanctionBan, By: fizz, ExpiresAt: &past}
+		is.NoErr(r.InsertSanction(ctx, &expired)) // banned in the past
+
+		ss, err := r.SelectSanctions(ctx, "sanctions")
+		is.NoErr(err)                               // select sanctions
+		is.Equal(len(ss), 2)                        // not the expired one
+		is.Equal(ss[0].Kind, internal.SanctionMute) // oldest first
+		is.Equal(ss[0].Reason, "spam")
+		is.True(ss[0].ExpiresAt.Equal(future))       // until
+		is.Equal(ss[1].ExpiresAt, (*time.Time)(nil)) // until lifted
+
+		mute.Reason = "more spam"
+		is.NoErr(r.InsertSanction(ctx, &mute)) // replaces the mute
+		ss, err = r.SelectSanctions(ctx, "sanctions")
+		is.NoErr(err)        // select sanctions
+		is.Equal(len(ss), 2) // still two
+
+		is.NoErr(r.DeleteSanction(ctx, "sanctions", bar, internal.SanctionBan))                                 // lift the ban
+		is.True(errors.Is(r.DeleteSanction(ctx, "sanctions", bar, internal.SanctionBan), internal.ErrNotFound)) // already lifted
+
+		ss, err = r.SelectSanctions(ctx, "sanctions")
+		is.NoErr(err)                       // select sanctions
+		is.Equal(len(ss), 1)                // the mute
+		is.Equal(ss[0].Reason, "more spam") // replaced
+	})
+}
@@ -0,0 +1,110 @@
+package storetest
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/hyphengolang/prelude/types/password"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+// Outbox tests that changes made through r write events to o, which
+// are claimed and acknowledged as expected of an `internal.Outbox`.
+// Both must be empty and r is closed once the test completes.
+func Outbox(t *testing.T, r internal.UserRepo, o internal.Outbox) {
+	is, ctx := is.New(t), context.TODO()
+
+	t.Cleanup(func() { r.Close(ctx) })
+
+	fizz := internal.User{
+		ID:       suid.NewUUID(),
+		Username: "i_am_fizz",
+		Email:    "fizz@mail.com",
+		Password: password.Password("p4$$w4rD").MustHash(),
+	}
+
+	t.Run(`write events with each change`, func(t *testing.T) {
+		is.NoErr(r.Insert(ctx, &fizz)) // insert "fizz"
+
+		u, err := r.Select(ctx, fizz.ID)
+		is.NoErr(err) // select "fizz"
+
+		u.Username = "i_am_fizzy"
+		is.NoErr(r.Update(ctx, u))                   // update "fizz"
+		is.NoErr(r.Delete(ctx, fizz.ID))             // soft delete "fizz"
+		is.NoErr(r.Delete(ctx, fizz.ID))             // already deleted
+		is.NoErr(r.Restore(ctx, fizz.ID))            // restore "fizz"
+		is.NoErr(r.Delete(hardDelete(ctx), fizz.ID)) // hard delete "fizz"
+
+		es, err := o.Claim(ctx, 10, time.Hour)
+		is.NoErr(err)        // claim events
+		is.Equal(len(es), 5) // one event for each change
+
+		types := []string{
+			internal.EventAccountCreated,
+			internal.EventAccountUpdated,
+			internal.EventAccountDeleted,
+			internal.EventAccountRestored,
+			internal.EventAccountPurged,
+		}
+
+		seen := make(map[suid.UUID]bool)
+		for i, e := range es {
+			is.Equal(e.Type, types[i])                        // oldest first
+			is.Equal(e.Subject, fizz.ID.ShortUUID().String()) // subject is "fizz"
+			is.True(!seen[e.ID])                              // ids are unique
+			seen[e.ID] = true
+		}
+
+		var d internal.AccountData
+		is.NoErr(json.Unmarshal(es[1].Data, &d)) // decode data
+		is.Equal(d.Username, "i_am_fizzy")       // updated username
+		is.Equal(d.Version, 2)                   // updated version
+		is.True(es[2].Data == nil)               // deletes have no data
+
+		claimed, err := o.Claim(ctx, 10, time.Hour)
+		is.NoErr(err)             // claim again
+		is.Equal(len(claimed), 0) // events are leased
+
+		ids := make([]suid.UUID, len(es))
+		for i := range es {
+			ids[i] = es[i].ID
+		}
+		is.NoErr(o.Ack(ctx, ids...)) // acknowledge events
+	})
+
+	t.Run(`redeliver events once the lease ends`, func(t *testing.T) {
+		buzz := internal.User{
+			ID:       suid.NewUUID(),
+			Username: "i_am_buzz",
+			Email:    "buzz@mail.com",
+			Password: password.Password("p4$$w4rD").MustHash(),
+		}
+		is.NoErr(r.Insert(ctx, &buzz)) // insert "buzz"
+
+		es, err := o.Claim(ctx, 10, time.Millisecond)
+		is.NoErr(err)        // claim events
+		is.Equal(len(es), 1) // "buzz" was created
+
+		time.Sleep(time.Millisecond * 20)
+
+		again, err := o.Claim(ctx, 10, time.Hour)
+		is.NoErr(err)                   // claim once the lease ended
+		is.Equal(len(again), 1)         // event is pending again
+		is.Equal(again[0].ID, es[0].ID) // same event
+
+		is.NoErr(o.Ack(ctx, again[0].ID)) // acknowledge event
+
+		es, err = o.Claim(ctx, 10, time.Millisecond)
+		is.NoErr(err)        // claim events
+		is.Equal(len(es), 0) // nothing is pending
+	})
+}
+
+func hardDelete(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internal.RuleSoftDeletion, internal.HardDelete)
+}
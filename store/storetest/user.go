@@ -0,0 +1,255 @@
+package storetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/hyphengolang/prelude/types/email"
+	"github.com/hyphengolang/prelude/types/password"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+// UserRepo tests that r behaves as expected of an `internal.UserRepo`.
+// The repository must be empty and is closed once the test completes.
+func UserRepo(t *testing.T, r internal.UserRepo) {
+	is, ctx := is.New(t), context.TODO()
+
+	t.Cleanup(func() { r.Close(ctx) })
+
+	t.Run(`select many from "account"`, func(t *testing.T) {
+		as, err := r.SelectMany(ctx, internal.UserQuery{})
+		is.NoErr(err)        // cannot query from database
+		is.Equal(len(as), 0) // no users in database
+	})
+
+	t.Run(`honour the deadline of a context`, func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, time.Nanosecond)
+		defer cancel()
+		<-ctx.Done()
+
+		_, err := r.SelectMany(ctx, internal.UserQuery{})
+		is.True(errors.Is(err, internal.ErrTimeout)) // deadline exceeded
+	})
+
+	fizzId := suid.NewUUID()
+	buzzEmail := email.Email("buzz@mail.com")
+	burpUsername := "i_am_burp"
+	t.Run(`insert one into "account"`, func(t *testing.T) {
+		fizz := internal.User{
+			ID:       fizzId,
+			Username: "i_am_fizz",
+			Email:    "fizz@mail.com",
+			Password: password.Password("p4$$w4rD").MustHash(),
+		}
+
+		err := r.Insert(ctx, &fizz)
+		is.NoErr(err) // inserting "fizz"
+
+		buzz := internal.User{
+			ID:       suid.NewUUID(),
+			Username: "i_am_buzz",
+			Email:    buzzEmail,
+			Password: password.Password("p4$$w4rD").MustHash(),
+		}
+
+		err = r.Insert(ctx, &buzz)
+		is.NoErr(err) // inserting "buzz"
+
+		burp := internal.User{
+			ID:       suid.NewUUID(),
+			Username: burpUsername,
+			Email:    "burp@mail.com",
+			Password: password.Password("p4$$w4rD").MustHash(),
+		}
+
+		err = r.Insert(ctx, &burp)
+		is.NoErr(err) // inserting "buzz"
+
+		us, err := r.SelectMany(ctx, internal.UserQuery{})
+		is.NoErr(err)        // cannot query from database
+		is.Equal(len(us), 3) // 2 users in database
+	})
+
+	t.Run(`invalid inserts`, func(t *testing.T) {
+		u := internal.User{
+			ID:       suid.NewUUID(),
+			Username: "i_am_fizz",
+			Email:    "fizz@mail.com",
+			Password: password.Password("p4$$w4rD").MustHash(),
+		}
+
+		err := r.Insert(context.Background(), &u)
+		is.True(err != nil) // "fizz" already exists
+
+		u = internal.User{
+			ID:       suid.NewUUID(),
+			Username: "i_am_bazz",
+			Email:    "bazzmail.com",
+			Password: password.Password("p4$$w4rD").MustHash(),
+		}
+
+		err = r.Insert(context.Background(), &u)
+		is.True(err != nil) // invalid email
+
+		u.Email = "bazz bazz@mail.com"
+		err = r.Insert(context.Background(), &u)
+		is.True(err != nil) // invalid email
+
+		u = internal.User{
+			ID:       suid.NewUUID(),
+			Username: "i_am_bazz",
+			Email:    "FIZZ@MAIL.COM",
+			Password: password.Password("p4$$w4rD").MustHash(),
+		}
+
+		err = r.Insert(context.Background(), &u)
+		is.True(errors.Is(err, internal.ErrAlreadyExists)) // emails are case-insensitive
+
+		us, err := r.SelectMany(ctx, internal.UserQuery{})
+		is.NoErr(err)        // cannot query from database
+		is.Equal(len(us), 3) // 3 users in database
+	})
+
+	t.Run(`paginate "account"`, func(t *testing.T) {
+		page, err := r.SelectMany(ctx, internal.UserQuery{Limit: 2})
+		is.NoErr(err)          // select first page
+		is.Equal(len(page), 2) // first page is full
+
+		next, err := r.SelectMany(ctx, internal.UserQuery{Limit: 2, After: internal.CursorOf(&page[1])})
+		is.NoErr(err)                            // select second page
+		is.Equal(len(next), 1)                   // one user left
+		is.Equal(next[0].Username, burpUsername) // "i_am_burp" was created last
+
+		prev, err := r.SelectMany(ctx, internal.UserQuery{Limit: 2, Before: internal.CursorOf(&next[0])})
+		is.NoErr(err)                                      // select previous page
+		is.Equal(len(prev), 2)                             // back to the first page
+		is.Equal(prev[0].ID.String(), page[0].ID.String()) // same order as the first page
+
+		desc, err := r.SelectMany(ctx, internal.UserQuery{Desc: true, Limit: 1})
+		is.NoErr(err)                            // select newest user
+		is.Equal(desc[0].Username, burpUsername) // "i_am_burp" was created last
+
+		q := internal.UserQuery{UsernamePrefix: "i_am_b"}
+		us, err := r.SelectMany(ctx, q)
+		is.NoErr(err)        // filter by username prefix
+		is.Equal(len(us), 2) // "i_am_buzz" & "i_am_burp"
+
+		n, err := r.Count(ctx, q)
+		is.NoErr(err)  // count by username prefix
+		is.Equal(n, 2) // "i_am_buzz" & "i_am_burp"
+
+		us, _ = r.SelectMany(ctx, internal.UserQuery{UsernamePrefix: "i_am_%"})
+		is.Equal(len(us), 0) // wildcards are escaped
+	})
+
+	t.Run(`update one in "account"`, func(t *testing.T) {
+		u, err := r.Select(ctx, burpUsername)
+		is.NoErr(err) // select "i_am_burp"
+
+		stale := *u
+
+		u.Username = "i_am_burpy"
+		err = r.Update(ctx, u)
+		is.NoErr(err)                        // update "i_am_burp"
+		is.Equal(u.Version, stale.Version+1) // version incremented
+
+		stale.Username = "i_am_burped"
+		err = r.Update(ctx, &stale)
+		is.True(errors.Is(err, internal.ErrVersionMismatch)) // stale version
+
+		u.Username = burpUsername
+		err = r.Update(ctx, u)
+		is.NoErr(err) // revert "i_am_burp"
+	})
+
+	t.Run(`delete one from "account"`, func(t *testing.T) {
+		err := r.Delete(ctx, fizzId)
+		is.NoErr(err) // perform soft delete on "i_am_fizz"
+
+		us, _ := r.SelectMany(ctx, internal.UserQuery{})
+		is.Equal(len(us), 2) // soft deleted users are hidden
+
+		us, _ = r.SelectMany(context.WithValue(ctx, internal.RuleIncludeDeleted, true), internal.UserQuery{})
+		is.Equal(len(us), 3) // 3 users in database after soft delete
+
+		_, err = r.Select(ctx, fizzId)
+		is.True(err != nil) // "i_am_fizz" is hidden
+
+		ctx = context.WithValue(ctx, internal.RuleSoftDeletion, internal.HardDelete)
+		err = r.Delete(ctx, buzzEmail)
+		is.NoErr(err) // perform hard delete on "i_am_buzz"
+
+		us, _ = r.SelectMany(context.WithValue(ctx, internal.RuleIncludeDeleted, true), internal.UserQuery{})
+		is.Equal(len(us), 2) // 2 users in database
+
+		err = r.Delete(ctx, nil)
+		is.True(err != nil) // invalid key
+	})
+
+	t.Run(`select one from "account"`, func(t *testing.T) {
+		u, err := r.Select(context.WithValue(ctx, internal.RuleIncludeDeleted, true), fizzId)
+		is.NoErr(err)                            // select "i_am_fizz"
+		is.Equal(u.ID.String(), fizzId.String()) // "id" values are the same
+
+		u, err = r.Select(ctx, burpUsername)
+		is.NoErr(err)                      // select "i_am_burp"
+		is.Equal(u.Username, burpUsername) // "username" values are the same
+
+		u, err = r.Select(ctx, email.Email("BURP@mail.com"))
+		is.NoErr(err)                      // select "i_am_burp" by email
+		is.Equal(u.Username, burpUsername) // emails are case-insensitive
+
+		_, err = r.Select(ctx, suid.NewUUID())
+		is.True(errors.Is(err, internal.ErrNotFound)) // no such user
+
+		_, err = r.Select(ctx, 42)
+		is.True(errors.Is(err, internal.ErrInvalidType)) // invalid key
+	})
+
+	t.Run(`restore and purge from "account"`, func(t *testing.T) {
+		fuzz := internal.User{
+			ID:       suid.NewUUID(),
+			Username: "i_am_fuzz",
+			Email:    "FIZZ@mail.com",
+			Password: password.Password("p4$$w4rD").MustHash(),
+		}
+
+		err := r.Insert(ctx, &fuzz)
+		is.NoErr(err) // email of "i_am_fizz" was released
+
+		err = r.Restore(ctx, fizzId)
+		is.True(errors.Is(err, internal.ErrAlreadyExists)) // email has been claimed
+
+		err = r.Delete(ctx, fuzz.ID)
+		is.NoErr(err) // perform hard delete on "i_am_fuzz"
+
+		err = r.Restore(ctx, fizzId)
+		is.NoErr(err) // restore "i_am_fizz"
+
+		u, err := r.Select(ctx, fizzId)
+		is.NoErr(err)               // select "i_am_fizz"
+		is.True(u.DeletedAt == nil) // no longer deleted
+		is.True(u.RevokedAt != nil) // sessions from before the delete are revoked
+
+		err = r.Restore(ctx, fizzId)
+		is.True(err != nil) // "i_am_fizz" is not deleted
+
+		err = r.Delete(context.Background(), fizzId)
+		is.NoErr(err) // perform soft delete on "i_am_fizz"
+
+		n, err := r.Purge(ctx, time.Hour)
+		is.NoErr(err)         // purge accounts deleted over an hour ago
+		is.Equal(n, int64(0)) // "i_am_fizz" was deleted recently
+
+		n, err = r.Purge(ctx, 0)
+		is.NoErr(err)         // purge all deleted accounts
+		is.Equal(n, int64(1)) // "i_am_fizz" was purged
+
+		us, _ := r.SelectMany(ctx, internal.UserQuery{})
+		is.Equal(len(us), 1) // 1 user in database
+	})
+}
@@ -0,0 +1,143 @@
+package storetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/hyphengolang/prelude/types/suid"
+	"secure.adoublef.com/internal"
+)
+
+// WebhookRepo tests that r behaves as expected of an
+// `internal.WebhookRepo`. The repository must be empty.
+func WebhookRepo(t *testing.T, r internal.WebhookRepo) {
+	is, ctx := is.New(t), context.TODO()
+
+	fizz := internal.Webhook{
+		ID:     suid.NewUUID(),
+		URL:    "https://fizz.com/hook",
+		Events: []string{internal.EventAccountCreated},
+		Secret: "fizz_secret",
+	}
+
+	t.Run(`insert and select webhooks`, func(t *testing.T) {
+		is.NoErr(r.InsertWebhook(ctx, &fizz)) // insert "fizz"
+		is.True(!fizz.CreatedAt.IsZero())     // time is set
+
+		buzz := internal.Webhook{ID: suid.NewUUID(), URL: "https://buzz.com/hook", Secret: "buzz_secret"}
+		is.NoErr(r.InsertWebhook(ctx, &buzz)) // insert "buzz"
+
+		w, err := r.SelectWebhook(ctx, fizz.ID)
+		is.NoErr(err)                                                           // select "fizz"
+		is.Equal(w.URL, fizz.URL)                                               // url is stored
+		is.Equal(w.Secret, fizz.Secret)                                         // secret is stored
+		is.Equal(len(w.Events), 1)                                              // events are stored
+		is.True(w.Wants(internal.EventAccountCreated))                          // wants created events
+		is.True(!w.Wants(internal.EventAccountDeleted))                         // but no others
+		is.True(buzz.Wants(internal.EventAccountDeleted))                       // "buzz" wants every event
+		is.True(w.CreatedAt.Equal(fizz.CreatedAt))                              // time is stored
+		_, err = r.SelectWebhook(ctx, suid.NewUUID())                           // select unknown webhook
+		is.True(errors.Is(err, internal.ErrNotFound))                           // not found
+		is.NoErr(r.DeleteWebhook(ctx, buzz.ID))                                 // delete "buzz"
+		is.True(errors.Is(r.DeleteWebhook(ctx, buzz.ID), internal.ErrNotFound)) // already deleted
+
+		ws, err := r.SelectWebhooks(ctx)
+		is.NoErr(err)               // select every webhook
+		is.Equal(len(ws), 1)        // only "fizz" is left
+		is.Equal(ws[0].ID, fizz.ID) // "fizz"
+	})
+
+	var first internal.Delivery
+	t.Run(`insert deliveries once per event`, func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			d := internal.Delivery{
+				ID:        suid.NewUUID(),
+				WebhookID: fizz.ID,
+				EventID:   suid.NewUUID(),
+				EventType: internal.EventAccountCreated,
+				Payload:   []byte(`{"type":"account.created"}`),
+			}
+			is.NoErr(r.InsertDelivery(ctx, &d))          // insert delivery
+			is.Equal(d.Status, internal.DeliveryPending) // pending
+			is.True(d.Seq > first.Seq)                   // sequence is increasing
+
+			if i == 0 {
+				first = d
+			}
+		}
+
+		dup := first
+		dup.ID = suid.NewUUID()
+		is.NoErr(r.InsertDelivery(ctx, &dup)) // duplicate event is ignored
+
+		_, err := r.SelectDelivery(ctx, dup.ID)
+		is.True(errors.Is(err, internal.ErrNotFound)) // duplicate was not inserted
+
+		d := internal.Delivery{ID: suid.NewUUID(), WebhookID: suid.NewUUID(), EventID: suid.NewUUID(), EventType: "x", Payload: []byte(`{}`)}
+		is.True(r.InsertDelivery(ctx, &d) != nil) // unknown webhook
+	})
+
+	t.Run(`claim and update deliveries`, func(t *testing.T) {
+		ds, err := r.ClaimDeliveries(ctx, 2, time.Hour)
+		is.NoErr(err)                                                 // claim deliveries
+		is.Equal(len(ds), 2)                                          // limited to two
+		is.Equal(ds[0].ID, first.ID)                                  // oldest first
+		is.Equal(string(ds[0].Payload), `{"type":"account.created"}`) // payload is stored
+
+		ds, err = r.ClaimDeliveries(ctx, 10, time.Hour)
+		is.NoErr(err)        // claim again
+		is.Equal(len(ds), 1) // the others are leased
+
+		d := ds[0]
+		d.Attempts, d.LastError, d.ResponseStatus = 1, "503 Service Unavailable", 503
+		d.NextAttemptAt = time.Now().UTC().Add(-time.Second).Truncate(time.Microsecond)
+		is.NoErr(r.UpdateDelivery(ctx, &d)) // failed attempt
+
+		ds, err = r.ClaimDeliveries(ctx, 10, time.Hour)
+		is.NoErr(err)                       // claim again
+		is.Equal(len(ds), 1)                // retry is due
+		is.Equal(ds[0].ID, d.ID)            // the failed delivery
+		is.Equal(ds[0].Attempts, 1)         // attempts are stored
+		is.Equal(ds[0].ResponseStatus, 503) // response status is stored
+
+		first.Status, first.Attempts = internal.DeliveryDelivered, 1
+		is.NoErr(r.UpdateDelivery(ctx, &first)) // delivered
+
+		d.Status, d.Attempts = internal.DeliveryDead, 2
+		is.NoErr(r.UpdateDelivery(ctx, &d)) // dead
+
+		stored, err := r.SelectDelivery(ctx, d.ID)
+		is.NoErr(err)                                         // select delivery
+		is.Equal(stored.Status, internal.DeliveryDead)        // status is stored
+		is.Equal(stored.LastError, "503 Service Unavailable") // error is stored
+	})
+
+	t.Run(`select the delivery log`, func(t *testing.T) {
+		ds, err := r.SelectDeliveries(ctx, internal.DeliveryQuery{WebhookID: fizz.ID})
+		is.NoErr(err)                  // select every delivery
+		is.Equal(len(ds), 3)           // three deliveries
+		is.True(ds[0].Seq > ds[1].Seq) // newest first
+
+		ds, err = r.SelectDeliveries(ctx, internal.DeliveryQuery{WebhookID: fizz.ID, Status: internal.DeliveryDelivered})
+		is.NoErr(err)                // filter by status
+		is.Equal(len(ds), 1)         // one was delivered
+		is.Equal(ds[0].ID, first.ID) // the first
+
+		ds, err = r.SelectDeliveries(ctx, internal.DeliveryQuery{WebhookID: fizz.ID, Limit: 1})
+		is.NoErr(err)        // first page
+		is.Equal(len(ds), 1) // limited to one
+
+		ds, err = r.SelectDeliveries(ctx, internal.DeliveryQuery{WebhookID: fizz.ID, Before: ds[0].Seq})
+		is.NoErr(err)        // next page
+		is.Equal(len(ds), 2) // the rest
+
+		is.NoErr(r.DeleteWebhook(ctx, fizz.ID)) // delete "fizz"
+
+		ds, err = r.SelectDeliveries(ctx, internal.DeliveryQuery{WebhookID: fizz.ID})
+		is.NoErr(err)        // select deliveries
+		is.Equal(len(ds), 0) // deleted with the webhook
+	})
+}
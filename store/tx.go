@@ -0,0 +1,113 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"secure.adoublef.com/store/chat"
+	"secure.adoublef.com/store/sqlite"
+	"secure.adoublef.com/store/user"
+)
+
+// How many times a transaction is tried when it conflicts with another
+// and how long to wait before the first retry, doubling each time
+const (
+	maxTxAttempts = 3
+	txRetryDelay  = time.Millisecond * 10
+)
+
+// WithTx runs f with a store whose repositories are bound to a single
+// transaction, which is committed if f returns nil and rolled back
+// otherwise. Postgres transactions are serializable.
+//
+// When the transaction fails to serialize, or SQLite is locked by
+// another writer, f is run again within a new transaction, so f must
+// not have side effects outside of the store.
+//
+// Calling WithTx on a store that is already bound to a transaction
+// creates a savepoint that is rolled back to if f returns an error,
+// the outer transaction is left to decide whether to retry.
+func (s Store) WithTx(ctx context.Context, f func(tx Store) error) error {
+	switch {
+	case s.pgTx != nil:
+		return s.withPgTx(ctx, s.pgTx.Begin, f)
+	case s.sqTx != nil:
+		return s.withSQLiteTx(ctx, s.sqTx.Begin, f)
+	case s.db != nil:
+		return retry(ctx, sqlite.Retryable, func() error { return s.withSQLiteTx(ctx, s.db.Begin, f) })
+	default:
+		begin := func(ctx context.Context) (pgx.Tx, error) {
+			return s.p.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
+		}
+		return retry(ctx, user.Retryable, func() error { return s.withPgTx(ctx, begin, f) })
+	}
+}
+
+func (s Store) withPgTx(ctx context.Context, begin func(ctx context.Context) (pgx.Tx, error), f func(tx Store) error) error {
+	tx, err := begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	st := Store{
+		p:     s.p,
+		pgTx:  tx,
+		opts:  s.opts,
+		chain: s.chain,
+		u:     user.NewRepo(ctx, tx, s.opts...),
+		a:     user.NewAuditRepo(ctx, tx, s.chain),
+		o:     user.NewOutbox(tx),
+		w:     user.NewWebhookRepo(tx),
+		c:     chat.NewRepo(tx),
+	}
+
+	if err := f(st); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s Store) withSQLiteTx(ctx context.Context, begin func(ctx context.Context) (*sqlite.Tx, error), f func(tx Store) error) error {
+	tx, err := begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	st := Store{
+		db:    s.db,
+		sqTx:  tx,
+		chain: s.chain,
+		u:     sqlite.NewUserRepo(ctx, tx),
+		a:     sqlite.NewAuditRepo(ctx, tx, s.chain),
+		o:     sqlite.NewOutbox(tx),
+		w:     sqlite.NewWebhookRepo(tx),
+		c:     sqlite.NewChatRepo(tx),
+	}
+
+	if err := f(st); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// retry runs f until it succeeds, fails with an error that cannot be
+// retried or has been attempted `maxTxAttempts` times
+func retry(ctx context.Context, retryable func(err error) bool, f func() error) error {
+	delay := txRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt == maxTxAttempts || !retryable(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
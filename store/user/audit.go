@@ -0,0 +1,155 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	psql "github.com/hyphengolang/prelude/sql/postgres"
+	"github.com/jackc/pgx/v5"
+	"secure.adoublef.com/internal"
+)
+
+const (
+	qrySelectAudit = `select seq, id, actor, action, target, ip, user_agent, outcome, created_at, prev_hash, hash from "audit_event"`
+
+	// held until the transaction ends, so events are chained one at a time
+	qryLockAudit     = `select pg_advisory_xact_lock(hashtext('audit_event'))`
+	qryLastAuditHash = `select hash from "audit_event" order by seq desc limit 1`
+
+	qryInsertAudit = `insert into "audit_event" (id, actor, action, target, ip, user_agent, outcome, created_at, prev_hash, hash)
+	values (@id, @actor, @action, @target, @ip, @user_agent, @outcome, @created_at, @prev_hash, @hash)
+	returning seq`
+)
+
+// AuditRepo is the Postgres `internal.AuditRepo`
+type AuditRepo struct {
+	ctx   context.Context
+	chain bool
+
+	q Conn
+}
+
+var _ internal.AuditRepo = (*AuditRepo)(nil)
+
+// NewAuditRepo returns a repository that links events
+// by their hash when chain is set
+func NewAuditRepo(ctx context.Context, q Conn, chain bool) *AuditRepo {
+	return &AuditRepo{ctx, chain, q}
+}
+
+func (r *AuditRepo) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+func (r *AuditRepo) Close(ctx context.Context) error { return nil }
+
+func (r *AuditRepo) Append(ctx context.Context, e *internal.AuditEvent) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	tx, err := r.q.Begin(ctx)
+	if err != nil {
+		return mapError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	e.PrevHash, e.Hash = nil, nil
+
+	if r.chain {
+		if err := psql.ExecContext(ctx, tx, qryLockAudit); err != nil {
+			return mapError(err)
+		}
+
+		err := psql.QueryRowContext(ctx, tx, qryLastAuditHash, func(r pgx.Row) error { return r.Scan(&e.PrevHash) })
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return mapError(err)
+		}
+		e.Hash = e.ChainHash(e.PrevHash)
+	}
+
+	args := pgx.NamedArgs{
+		"id":         e.ID,
+		"actor":      e.Actor,
+		"action":     e.Action,
+		"target":     e.Target,
+		"ip":         e.IP,
+		"user_agent": e.UserAgent,
+		"outcome":    e.Outcome,
+		"created_at": e.CreatedAt,
+		"prev_hash":  e.PrevHash,
+		"hash":       e.Hash,
+	}
+
+	if err := psql.QueryRowContext(ctx, tx, qryInsertAudit, func(r pgx.Row) error { return r.Scan(&e.Seq) }, args); err != nil {
+		return mapError(err)
+	}
+
+	return mapError(tx.Commit(ctx))
+}
+
+func (r *AuditRepo) SelectMany(ctx context.Context, q internal.AuditQuery) ([]internal.AuditEvent, error) {
+	var (
+		where []string
+		args  = pgx.NamedArgs{}
+	)
+
+	for _, f := range []struct{ col, v string }{
+		{"actor", q.Actor},
+		{"action", q.Action},
+		{"target", q.Target},
+		{"outcome", q.Outcome},
+	} {
+		if f.v != "" {
+			where = append(where, f.col+" = @"+f.col)
+			args[f.col] = f.v
+		}
+	}
+
+	if !q.CreatedFrom.IsZero() {
+		where = append(where, "created_at >= @created_from")
+		args["created_from"] = q.CreatedFrom
+	}
+
+	if !q.CreatedTo.IsZero() {
+		where = append(where, "created_at < @created_to")
+		args["created_to"] = q.CreatedTo
+	}
+
+	if q.After != 0 {
+		where = append(where, "seq > @after")
+		args["after"] = q.After
+	}
+
+	if q.Before != 0 {
+		where = append(where, "seq < @before")
+		args["before"] = q.Before
+	}
+
+	order := " order by seq asc"
+	if q.Desc {
+		order = " order by seq desc"
+	}
+
+	qry := qrySelectAudit + whereClause(where) + order
+	if q.Limit > 0 {
+		qry += " limit @limit"
+		args["limit"] = q.Limit
+	}
+
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	es, err := psql.QueryContext(ctx, r.q, qry, func(r pgx.Rows, e *internal.AuditEvent) error {
+		if err := r.Scan(&e.Seq, &e.ID, &e.Actor, &e.Action, &e.Target, &e.IP, &e.UserAgent, &e.Outcome, &e.CreatedAt, &e.PrevHash, &e.Hash); err != nil {
+			return err
+		}
+		e.CreatedAt = e.CreatedAt.UTC()
+		return nil
+	}, args)
+	return es, mapError(err)
+}
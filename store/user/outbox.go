@@ -0,0 +1,111 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	psql "github.com/hyphengolang/prelude/sql/postgres"
+	"github.com/hyphengolang/prelude/types/suid"
+	"github.com/jackc/pgx/v5"
+	"secure.adoublef.com/internal"
+)
+
+const (
+	qryInsertEvent = `insert into "outbox" (id, type, subject, data, created_at) values ($1, $2, $3, $4, $5)`
+
+	// rows locked by another dispatcher are skipped rather than waited on
+	qryClaimEvents = `with claimed as (
+		update "outbox" set locked_until = now() + make_interval(secs => $2), attempts = attempts + 1
+		where seq in (
+			select seq from "outbox"
+			where dispatched_at is null and (locked_until is null or locked_until < now())
+			order by seq limit $1 for update skip locked
+		)
+		returning seq, id, type, subject, data, created_at
+	)
+	select id, type, subject, data, created_at from claimed order by seq`
+
+	qryAckEvents = `update "outbox" set dispatched_at = now(), locked_until = null where id = any($1::uuid[])`
+
+	qryNotify = `select pg_notify($1, $2)`
+)
+
+// insertEvent writes an event of the account to the outbox, data is
+// encoded as JSON unless nil
+func insertEvent(ctx context.Context, q psql.Q, typ string, id suid.UUID, data any) error {
+	e, err := internal.NewEvent(typ, id, data)
+	if err != nil {
+		return err
+	}
+
+	// a nil slice would be written as the JSON "null"
+	var b any
+	if e.Data != nil {
+		b = []byte(e.Data)
+	}
+
+	return psql.ExecContext(ctx, q, qryInsertEvent, e.ID, e.Type, e.Subject, b, e.CreatedAt)
+}
+
+// Outbox is the Postgres `internal.Outbox`, it shares the connections
+// of the user repository so it is never closed
+type Outbox struct {
+	q Conn
+}
+
+var _ internal.Outbox = (*Outbox)(nil)
+
+func NewOutbox(q Conn) *Outbox { return &Outbox{q} }
+
+func (o *Outbox) Claim(ctx context.Context, n int, lease time.Duration) ([]internal.Event, error) {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	es, err := psql.QueryContext(ctx, o.q, qryClaimEvents, func(r pgx.Rows, e *internal.Event) error {
+		var data []byte
+		if err := r.Scan(&e.ID, &e.Type, &e.Subject, &data, &e.CreatedAt); err != nil {
+			return err
+		}
+		e.Data, e.CreatedAt = data, e.CreatedAt.UTC()
+		return nil
+	}, n, lease.Seconds())
+	return es, mapError(err)
+}
+
+func (o *Outbox) Ack(ctx context.Context, ids ...suid.UUID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	ss := make([]string, len(ids))
+	for i, id := range ids {
+		ss[i] = id.String()
+	}
+
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	return mapError(psql.ExecContext(ctx, o.q, qryAckEvents, ss))
+}
+
+// NotifySink publishes events with "pg_notify", the payload is the
+// event encoded as JSON. Payloads are limited to 8000 bytes by Postgres.
+type NotifySink struct {
+	q       psql.Q
+	channel string
+}
+
+func NewNotifySink(q psql.Q, channel string) *NotifySink { return &NotifySink{q, channel} }
+
+func (s *NotifySink) Publish(ctx context.Context, e internal.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	return mapError(psql.ExecContext(ctx, s.q, qryNotify, s.channel, string(b)))
+}
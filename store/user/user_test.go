@@ -2,133 +2,263 @@ package user
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
 	"os"
+	"strings"
 	"testing"
 
+	psql "github.com/hyphengolang/prelude/sql/postgres"
 	"github.com/hyphengolang/prelude/testing/is"
 	"github.com/hyphengolang/prelude/types/email"
 	"github.com/hyphengolang/prelude/types/password"
 	"github.com/hyphengolang/prelude/types/suid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"secure.adoublef.com/internal"
+	"secure.adoublef.com/store/crypt"
+	"secure.adoublef.com/store/migrate"
+	"secure.adoublef.com/store/storetest"
 )
 
-var r internal.UserRepo
+var connString = os.ExpandEnv("host=${POSTGRES_HOSTNAME} port=${DB_PORT} user=${POSTGRES_USER} password=${POSTGRES_PASSWORD} dbname=${POSTGRES_DB} sslmode=${SSL_MODE}")
 
-func init() {
-	connString := os.ExpandEnv("host=${POSTGRES_HOSTNAME} port=${DB_PORT} user=${POSTGRES_USER} password=${POSTGRES_PASSWORD} dbname=${POSTGRES_DB} sslmode=${SSL_MODE}")
-	c, err := pgx.Connect(context.Background(), connString)
+func TestRepo(t *testing.T) {
+	t.Parallel()
+
+	p, err := newTestPool(t, connString)
 	if err != nil {
-		panic(err)
+		t.Skipf("postgres is unavailable: %v", err)
 	}
 
-	Migration(c)
+	storetest.UserRepo(t, NewRepo(context.Background(), p))
+}
+
+func TestEncryptedRepo(t *testing.T) {
+	t.Parallel()
+
+	p, err := newTestPool(t, connString)
+	if err != nil {
+		t.Skipf("postgres is unavailable: %v", err)
+	}
 
-	r = NewRepo(context.Background(), c)
+	storetest.UserRepo(t, NewRepo(context.Background(), p, WithKeyring(newTestKeyring(t, "k1"))))
 }
 
-func TestRepo(t *testing.T) {
+func TestReencrypt(t *testing.T) {
 	t.Parallel()
-	is, ctx := is.New(t), context.TODO()
+	is, ctx := is.New(t), context.Background()
 
-	t.Cleanup(func() { r.Close(ctx) })
+	p, err := newTestPool(t, connString)
+	if err != nil {
+		t.Skipf("postgres is unavailable: %v", err)
+	}
+	t.Cleanup(p.Close)
 
-	t.Run(`select many from "account"`, func(t *testing.T) {
-		as, err := r.SelectMany(ctx)
-		is.NoErr(err)        // cannot query from database
-		is.Equal(len(as), 0) // no users in database
-	})
+	k1 := newTestKeyring(t, "k1")
+	plain, enc := NewRepo(ctx, p), NewRepo(ctx, p, WithKeyring(k1))
 
-	fizzId := suid.NewUUID()
-	buzzEmail := email.Email("buzz@mail.com")
-	burpUsername := "i_am_burp"
-	t.Run(`insert one into "account"`, func(t *testing.T) {
-		fizz := internal.User{
-			ID:       fizzId,
-			Username: "i_am_fizz",
-			Email:    "fizz@mail.com",
-			Password: password.Password("p4$$w4rD").MustHash(),
-		}
+	fizz := internal.User{
+		ID:       suid.NewUUID(),
+		Username: "i_am_fizz",
+		Email:    "fizz@mail.com",
+		Password: password.Password("p4$$w4rD").MustHash(),
+	}
+	is.NoErr(plain.Insert(ctx, &fizz)) // insert plaintext "fizz"
 
-		err := r.Insert(ctx, &fizz)
-		is.NoErr(err) // inserting "fizz"
+	n, err := enc.Reencrypt(ctx, 10)
+	is.NoErr(err)         // encrypt plaintext emails
+	is.Equal(n, int64(1)) // "fizz" was encrypted
 
-		buzz := internal.User{
-			ID:       suid.NewUUID(),
-			Username: "i_am_buzz",
-			Email:    buzzEmail,
-			Password: password.Password("p4$$w4rD").MustHash(),
-		}
+	var stored *string
+	err = psql.QueryRowContext(ctx, p, `select email from "account" where id = $1`, func(r pgx.Row) error { return r.Scan(&stored) }, fizz.ID)
+	is.NoErr(err)          // read raw row
+	is.True(stored == nil) // plaintext is gone
 
-		err = r.Insert(ctx, &buzz)
-		is.NoErr(err) // inserting "buzz"
+	u, err := enc.Select(ctx, email.Email("FIZZ@mail.com"))
+	is.NoErr(err)                                   // select by blind index
+	is.Equal(u.Email, email.Email("fizz@mail.com")) // decrypted email
 
-		burp := internal.User{
-			ID:       suid.NewUUID(),
-			Username: burpUsername,
-			Email:    "burp@mail.com",
-			Password: password.Password("p4$$w4rD").MustHash(),
-		}
+	_, err = plain.Select(ctx, fizz.ID)
+	is.True(errors.Is(err, ErrNoKeyring)) // cannot decrypt without a keyring
 
-		err = r.Insert(ctx, &burp)
-		is.NoErr(err) // inserting "buzz"
+	n, err = enc.Reencrypt(ctx, 10)
+	is.NoErr(err)         // nothing left to encrypt
+	is.Equal(n, int64(0)) // already wrapped by "k1"
 
-		us, err := r.SelectMany(ctx)
-		is.NoErr(err)        // cannot query from database
-		is.Equal(len(us), 3) // 2 users in database
-	})
+	// rotate to "k2", keeping "k1" to read the old emails
+	k2 := newTestKeyring(t, "k2", k1)
+	rotated := NewRepo(ctx, p, WithKeyring(k2))
 
-	t.Run(`invalid inserts`, func(t *testing.T) {
-		u := internal.User{
-			ID:       suid.NewUUID(),
-			Username: "i_am_fizz",
-			Email:    "fizz@mail.com",
-			Password: password.Password("p4$$w4rD").MustHash(),
-		}
+	n, err = rotated.Reencrypt(ctx, 10)
+	is.NoErr(err)         // wrap with "k2"
+	is.Equal(n, int64(1)) // "fizz" was rewrapped
 
-		err := r.Insert(context.Background(), &u)
-		is.True(err != nil) // "fizz" already exists
+	u, err = rotated.Select(ctx, fizz.ID)
+	is.NoErr(err)                                   // decrypt with "k2"
+	is.Equal(u.Email, email.Email("fizz@mail.com")) // email is the same
+}
+
+func TestMixedEmails(t *testing.T) {
+	t.Parallel()
+	is, ctx := is.New(t), context.Background()
 
-		u = internal.User{
+	p, err := newTestPool(t, connString)
+	if err != nil {
+		t.Skipf("postgres is unavailable: %v", err)
+	}
+	t.Cleanup(p.Close)
+
+	plain, enc := NewRepo(ctx, p), NewRepo(ctx, p, WithKeyring(newTestKeyring(t, "k1")))
+
+	newUser := func(username string, e email.Email) internal.User {
+		return internal.User{
 			ID:       suid.NewUUID(),
-			Username: "i_am_bazz",
-			Email:    "bazzmail.com",
+			Username: username,
+			Email:    e,
 			Password: password.Password("p4$$w4rD").MustHash(),
 		}
+	}
 
-		err = r.Insert(context.Background(), &u)
-		is.True(err != nil) // invalid email
+	fizz := newUser("i_am_fizz", "fizz@mail.com")
+	is.NoErr(plain.Insert(ctx, &fizz)) // insert plaintext "fizz"
 
-		us, err := r.SelectMany(ctx)
-		is.NoErr(err)        // cannot query from database
-		is.Equal(len(us), 3) // 3 users in database
-	})
+	fuzz := newUser("i_am_fuzz", "FIZZ@mail.com")
+	err = enc.Insert(ctx, &fuzz)
+	is.True(errors.Is(err, internal.ErrAlreadyExists)) // email is held in plaintext
 
-	t.Run(`delete one from "account"`, func(t *testing.T) {
-		err := r.Delete(ctx, fizzId)
-		is.NoErr(err) // perform soft delete on "i_am_fizz"
+	buzz := newUser("i_am_buzz", "buzz@mail.com")
+	is.NoErr(enc.Insert(ctx, &buzz)) // insert encrypted "buzz"
 
-		us, _ := r.SelectMany(ctx)
-		is.Equal(len(us), 3) // 3 users in database after soft delete
+	buzz.Email, buzz.Version = "fizz@mail.com", 1
+	err = enc.Update(ctx, &buzz)
+	is.True(errors.Is(err, internal.ErrAlreadyExists)) // email is held in plaintext
 
-		ctx = context.WithValue(ctx, RuleSoftDeletion, HardDelete)
-		err = r.Delete(ctx, buzzEmail)
-		is.NoErr(err) // perform hard delete on "i_am_buzz"
+	// an instance without the keyring cannot see encrypted emails
+	burp := newUser("i_am_burp", "buzz@mail.com")
+	is.NoErr(plain.Insert(ctx, &burp)) // insert plaintext "burp"
 
-		us, _ = r.SelectMany(ctx)
-		is.Equal(len(us), 2) // 2 users in database
+	n, err := enc.Reencrypt(ctx, 10)
+	is.True(errors.Is(err, ErrEmailConflict)) // "burp" holds the email of "buzz"
+	is.Equal(n, int64(1))                     // "fizz" was still encrypted
 
-		err = r.Delete(ctx, nil)
-		is.True(err != nil) // invalid key
-	})
+	u, err := enc.Select(ctx, email.Email("fizz@mail.com"))
+	is.NoErr(err)           // select by blind index
+	is.Equal(u.ID, fizz.ID) // "fizz"
+
+	n, err = enc.Reencrypt(ctx, 10)
+	is.True(errors.Is(err, ErrEmailConflict)) // "burp" is left in plaintext
+	is.Equal(n, int64(0))                     // nothing else to encrypt
+}
+
+func newTestKeyring(t *testing.T, active string, old ...*crypt.Keyring) *crypt.Keyring {
+	t.Helper()
 
-	t.Run(`select one from "account"`, func(t *testing.T) {
-		u, err := r.Select(ctx, fizzId)
-		is.NoErr(err)                            // select "i_am_fizz"
-		is.Equal(u.ID.String(), fizzId.String()) // "id" values are the same
+	keks := map[string][]byte{}
+	for _, id := range append([]string{active}, activeIDs(old)...) {
+		keks[id] = testKey(id)
+	}
 
-		u, err = r.Select(ctx, burpUsername)
-		is.NoErr(err)                      // select "i_am_burp"
-		is.Equal(u.Username, burpUsername) // "username" values are the same
+	k, err := crypt.New(active, keks, testKey("index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// testKey derives a key from its ID so keyrings can read what the others wrote
+func testKey(id string) []byte {
+	b := sha256.Sum256([]byte(id))
+	return b[:]
+}
+
+func activeIDs(ks []*crypt.Keyring) (ids []string) {
+	for _, k := range ks {
+		ids = append(ids, k.Active())
+	}
+	return ids
+}
+
+// newTestPool applies the migrations within a new schema that every
+// connection of the pool will use, this stops tests that run in
+// parallel from sharing the same tables
+func newTestPool(t *testing.T, connString string) (*pgxpool.Pool, error) {
+	ctx := context.Background()
+
+	cfg, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := "test_" + strings.ReplaceAll(suid.NewUUID().String(), "-", "")
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema + ", public"
+
+	p, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := psql.ExecContext(ctx, p, `create schema `+schema); err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	t.Cleanup(func() {
+		// the repository closes the pool once tested
+		c, err := pgxpool.New(ctx, connString)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		_ = psql.ExecContext(ctx, c, `drop schema `+schema+` cascade`)
 	})
+
+	c, err := p.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Release()
+
+	m, err := migrate.New(c, migrate.Postgres)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, m.Up(ctx)
+}
+
+func TestAuditRepo(t *testing.T) {
+	t.Parallel()
+
+	p, err := newTestPool(t, connString)
+	if err != nil {
+		t.Skipf("postgres is unavailable: %v", err)
+	}
+	t.Cleanup(p.Close)
+
+	storetest.AuditRepo(t, NewAuditRepo(context.Background(), p, true))
+}
+
+func TestOutbox(t *testing.T) {
+	t.Parallel()
+
+	p, err := newTestPool(t, connString)
+	if err != nil {
+		t.Skipf("postgres is unavailable: %v", err)
+	}
+
+	storetest.Outbox(t, NewRepo(context.Background(), p), NewOutbox(p))
+}
+
+func TestWebhookRepo(t *testing.T) {
+	t.Parallel()
+
+	p, err := newTestPool(t, connString)
+	if err != nil {
+		t.Skipf("postgres is unavailable: %v", err)
+	}
+	t.Cleanup(p.Close)
+
+	storetest.WebhookRepo(t, NewWebhookRepo(p))
 }
@@ -0,0 +1,196 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	psql "github.com/hyphengolang/prelude/sql/postgres"
+	"github.com/hyphengolang/prelude/types/suid"
+	"github.com/jackc/pgx/v5"
+	"secure.adoublef.com/internal"
+)
+
+const (
+	qryInsertWebhook  = `insert into "webhook" (id, url, events, secret) values ($1, $2, $3, $4) returning created_at`
+	qrySelectWebhook  = `select id, url, events, secret, created_at from "webhook" where id = $1`
+	qrySelectWebhooks = `select id, url, events, secret, created_at from "webhook" order by created_at, id`
+	qryDeleteWebhook  = `delete from "webhook" where id = $1 returning id`
+
+	qrySelectDeliveries = `select seq, id, webhook_id, event_id, event_type, payload, status, attempts, next_attempt_at, last_error, response_status, created_at, updated_at from "webhook_delivery"`
+	qrySelectDelivery   = qrySelectDeliveries + ` where id = $1`
+
+	qryInsertDelivery = `insert into "webhook_delivery" (id, webhook_id, event_id, event_type, payload)
+	values ($1, $2, $3, $4, $5)
+	on conflict (webhook_id, event_id) do nothing
+	returning seq, status, attempts, next_attempt_at, created_at, updated_at`
+
+	// rows locked by another deliverer are skipped rather than waited on
+	qryClaimDeliveries = `with claimed as (
+		update "webhook_delivery" set next_attempt_at = now() + make_interval(secs => $2)
+		where seq in (
+			select seq from "webhook_delivery"
+			where status = 'pending' and next_attempt_at <= now()
+			order by seq limit $1 for update skip locked
+		)
+		returning seq, id, webhook_id, event_id, event_type, payload, status, attempts, next_attempt_at, last_error, response_status, created_at, updated_at
+	)
+	select * from claimed order by seq`
+
+	qryUpdateDelivery = `update "webhook_delivery"
+	set status = $2, attempts = $3, next_attempt_at = $4, last_error = $5, response_status = $6, updated_at = now()
+	where id = $1
+	returning updated_at`
+)
+
+// WebhookRepo is the Postgres `internal.WebhookRepo`, it shares the
+// connections of the user repository so it is never closed
+type WebhookRepo struct {
+	q Conn
+}
+
+var _ internal.WebhookRepo = (*WebhookRepo)(nil)
+
+func NewWebhookRepo(q Conn) *WebhookRepo { return &WebhookRepo{q} }
+
+func (r *WebhookRepo) InsertWebhook(ctx context.Context, w *internal.Webhook) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	events := append([]string{}, w.Events...)
+	err := psql.QueryRowContext(ctx, r.q, qryInsertWebhook, func(r pgx.Row) error { return r.Scan(&w.CreatedAt) }, w.ID, w.URL, events, w.Secret)
+	w.CreatedAt = w.CreatedAt.UTC()
+	return mapError(err)
+}
+
+func (r *WebhookRepo) SelectWebhook(ctx context.Context, id suid.UUID) (*internal.Webhook, error) {
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	var w internal.Webhook
+	if err := psql.QueryRowContext(ctx, r.q, qrySelectWebhook, func(r pgx.Row) error { return scanWebhook(r, &w) }, id); err != nil {
+		return nil, mapError(err)
+	}
+	return &w, nil
+}
+
+func (r *WebhookRepo) SelectWebhooks(ctx context.Context) ([]internal.Webhook, error) {
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	ws, err := psql.QueryContext(ctx, r.q, qrySelectWebhooks, func(r pgx.Rows, w *internal.Webhook) error { return scanWebhook(r, w) })
+	return ws, mapError(err)
+}
+
+func (r *WebhookRepo) DeleteWebhook(ctx context.Context, id suid.UUID) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	return mapError(psql.QueryRowContext(ctx, r.q, qryDeleteWebhook, func(r pgx.Row) error { return r.Scan(&id) }, id))
+}
+
+func (r *WebhookRepo) InsertDelivery(ctx context.Context, d *internal.Delivery) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	v := *d
+	err := psql.QueryRowContext(ctx, r.q, qryInsertDelivery, func(r pgx.Row) error {
+		return r.Scan(&v.Seq, &v.Status, &v.Attempts, &v.NextAttemptAt, &v.CreatedAt, &v.UpdatedAt)
+	}, d.ID, d.WebhookID, d.EventID, d.EventType, []byte(d.Payload))
+
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		// the event has already been delivered to the webhook
+		return nil
+	case err != nil:
+		return mapError(err)
+	}
+
+	v.NextAttemptAt, v.CreatedAt, v.UpdatedAt = v.NextAttemptAt.UTC(), v.CreatedAt.UTC(), v.UpdatedAt.UTC()
+	*d = v
+	return nil
+}
+
+func (r *WebhookRepo) ClaimDeliveries(ctx context.Context, n int, lease time.Duration) ([]internal.Delivery, error) {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	ds, err := psql.QueryContext(ctx, r.q, qryClaimDeliveries, func(r pgx.Rows, d *internal.Delivery) error { return scanDelivery(r, d) }, n, lease.Seconds())
+	return ds, mapError(err)
+}
+
+func (r *WebhookRepo) UpdateDelivery(ctx context.Context, d *internal.Delivery) error {
+	ctx, cancel := withTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	var updatedAt time.Time
+	err := psql.QueryRowContext(ctx, r.q, qryUpdateDelivery, func(r pgx.Row) error { return r.Scan(&updatedAt) },
+		d.ID, d.Status, d.Attempts, d.NextAttemptAt, d.LastError, d.ResponseStatus)
+	if err != nil {
+		return mapError(err)
+	}
+
+	d.UpdatedAt = updatedAt.UTC()
+	return nil
+}
+
+func (r *WebhookRepo) SelectDelivery(ctx context.Context, id suid.UUID) (*internal.Delivery, error) {
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	var d internal.Delivery
+	if err := psql.QueryRowContext(ctx, r.q, qrySelectDelivery, func(r pgx.Row) error { return scanDelivery(r, &d) }, id); err != nil {
+		return nil, mapError(err)
+	}
+	return &d, nil
+}
+
+func (r *WebhookRepo) SelectDeliveries(ctx context.Context, q internal.DeliveryQuery) ([]internal.Delivery, error) {
+	where := []string{"webhook_id = @webhook_id"}
+	args := pgx.NamedArgs{"webhook_id": q.WebhookID}
+
+	if q.Status != "" {
+		where = append(where, "status = @status")
+		args["status"] = q.Status
+	}
+
+	if q.Before != 0 {
+		where = append(where, "seq < @before")
+		args["before"] = q.Before
+	}
+
+	qry := qrySelectDeliveries + whereClause(where) + " order by seq desc"
+	if q.Limit > 0 {
+		qry += " limit @limit"
+		args["limit"] = q.Limit
+	}
+
+	ctx, cancel := withTimeout(ctx, readTimeout)
+	defer cancel()
+
+	ds, err := psql.QueryContext(ctx, r.q, qry, func(r pgx.Rows, d *internal.Delivery) error { return scanDelivery(r, d) }, args)
+	return ds, mapError(err)
+}
+
+func scanWebhook(r pgx.Row, w *internal.Webhook) error {
+	if err := r.Scan(&w.ID, &w.URL, &w.Events, &w.Secret, &w.CreatedAt); err != nil {
+		return err
+	}
+	w.CreatedAt = w.CreatedAt.UTC()
+	return nil
+}
+
+func scanDelivery(r pgx.Row, d *internal.Delivery) error {
+	var payload []byte
+
+	err := r.Scan(&d.Seq, &d.ID, &d.WebhookID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts,
+		&d.NextAttemptAt, &d.LastError, &d.ResponseStatus, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	d.Payload = payload
+	d.NextAttemptAt = d.NextAttemptAt.UTC()
+	d.CreatedAt, d.UpdatedAt = d.CreatedAt.UTC(), d.UpdatedAt.UTC()
+	return nil
+}